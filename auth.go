@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// registry login credentials, from flags or a docker/containers auth file
+type credentials struct {
+	username string
+	password string
+}
+
+func (c credentials) empty() bool {
+	return c.username == "" && c.password == ""
+}
+
+// the files we look for registry credentials in, in order of precedence,
+// following containers-auth.json(5) and docker's config.json
+func authFilePaths() []string {
+	paths := []string{}
+	if authFile := os.Getenv("REGISTRY_AUTH_FILE"); authFile != "" {
+		paths = append(paths, authFile)
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		paths = append(paths, filepath.Join(runtimeDir, "containers", "auth.json"))
+	}
+	home, _ := os.UserHomeDir()
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" && home != "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	if configHome != "" {
+		paths = append(paths, filepath.Join(configHome, "containers", "auth.json"))
+	}
+	if dockerConfig := os.Getenv("DOCKER_CONFIG"); dockerConfig != "" {
+		paths = append(paths, filepath.Join(dockerConfig, "config.json"))
+	} else if home != "" {
+		paths = append(paths, filepath.Join(home, ".docker", "config.json"))
+	}
+	return paths
+}
+
+type authFile struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+}
+
+// find credentials for host (host[:port]) in the auth files. docker keys
+// entries by URL as well as by host, so compare hosts.
+func loadCredentials(host string) (credentials, error) {
+	for _, path := range authFilePaths() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				slog.Warn("can't read auth file", "file", path, "err", err)
+			}
+			continue
+		}
+		af := authFile{}
+		if err := json.Unmarshal(data, &af); err != nil {
+			slog.Warn("can't parse auth file", "file", path, "err", err)
+			continue
+		}
+		for key, entry := range af.Auths {
+			if authKeyHost(key) != host || entry.Auth == "" {
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return credentials{}, fmt.Errorf("bad auth for %s in %s: %w", key, path, err)
+			}
+			username, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return credentials{}, fmt.Errorf("bad auth for %s in %s: expected user:password", key, path)
+			}
+			slog.Debug("using registry credentials", "host", host, "file", path)
+			return credentials{username: username, password: password}, nil
+		}
+	}
+	return credentials{}, nil
+}
+
+// "https://index.docker.io/v1/" -> "index.docker.io", "quay.io" -> "quay.io"
+func authKeyHost(key string) string {
+	if strings.Contains(key, "://") {
+		if u, err := url.Parse(key); err == nil {
+			return u.Host
+		}
+	}
+	host, _, _ := strings.Cut(key, "/")
+	return host
+}
+
+// authTransport answers registry auth challenges. Basic challenges are
+// retried with the credentials, which are then sent up front to that host
+// only; Bearer challenges get a token from the realm, which is cached per
+// scope and sent up front on later requests.
+type authTransport struct {
+	base  http.RoundTripper
+	creds credentials
+
+	mu         sync.Mutex
+	tokens     map[string]string // host and scope -> bearer token
+	basicHosts map[string]bool   // the hosts that asked for basic auth
+}
+
+func newAuthTransport(base http.RoundTripper, creds credentials) *authTransport {
+	return &authTransport{
+		base:       base,
+		creds:      creds,
+		tokens:     map[string]string{},
+		basicHosts: map[string]bool{},
+	}
+}
+
+// the token scope the distribution spec uses for a request path
+func scopeForPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return ""
+	}
+	if rest == "_catalog" {
+		return "registry:catalog:*"
+	}
+	for _, sep := range []string{"/manifests/", "/tags/", "/blobs/", "/referrers/"} {
+		if repo, _, ok := strings.Cut(rest, sep); ok {
+			return fmt.Sprintf("repository:%s:pull", repo)
+		}
+	}
+	return ""
+}
+
+// tokens are for a scope at a host, since mirrors have their own
+func tokenKey(req *http.Request) string {
+	return req.URL.Host + " " + scopeForPath(req.URL.Path)
+}
+
+func (at *authTransport) authorize(req *http.Request) *http.Request {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	req = req.Clone(req.Context())
+	if token, ok := at.tokens[tokenKey(req)]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if at.basicHosts[req.URL.Host] && !at.creds.empty() {
+		req.SetBasicAuth(at.creds.username, at.creds.password)
+	}
+	return req
+}
+
+func (at *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := at.base.RoundTrip(at.authorize(req))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if at.creds.empty() {
+			return resp, nil
+		}
+		at.mu.Lock()
+		at.basicHosts[req.URL.Host] = true
+		at.mu.Unlock()
+	case "bearer":
+		token, err := at.fetchToken(req, params)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		at.mu.Lock()
+		at.tokens[tokenKey(req)] = token
+		at.mu.Unlock()
+	default:
+		return resp, nil
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return at.base.RoundTrip(at.authorize(req))
+}
+
+// get a token from the realm in a Bearer challenge, using the credentials
+// if we have any, or anonymously
+func (at *authTransport) fetchToken(req *http.Request, params map[string]string) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("bearer challenge from %s has no realm", req.URL.Host)
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("bad realm %q: %w", realm, err)
+	}
+	query := tokenURL.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	scope, ok := params["scope"]
+	if !ok {
+		scope = scopeForPath(req.URL.Path)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if !at.creds.empty() {
+		tokenReq.SetBasicAuth(at.creds.username, at.creds.password)
+	}
+	resp, err := at.base.RoundTrip(tokenReq)
+	if err != nil {
+		return "", fmt.Errorf("getting token from %s: %w", realm, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting token from %s: bad status code: %d", realm, resp.StatusCode)
+	}
+
+	tokenResp := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("decoding token from %s: %w", realm, err)
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token in response from %s", realm)
+}
+
+// parse a WWW-Authenticate header like
+// Bearer realm="https://auth.example.com/token",service="registry",scope="repository:foo:pull"
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return scheme, params
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestRegBearerAuth(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.authMode = "bearer"
+	fr.username, fr.password = "bird", "tweet"
+	fr.addImage("c3/bird", "1.0.56", digest.FromString("bird"))
+
+	reg := fr.newReg("", credentials{username: "bird", password: "tweet"})
+	ctx := context.Background()
+	if _, err := reg.GetRepoList(ctx); err != nil {
+		t.Fatalf("catalog with bearer auth: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := reg.GetLayerNameEntries(ctx, "c3/bird", "1.0.56"); err != nil {
+			t.Fatalf("manifest with bearer auth: %v", err)
+		}
+	}
+	// one token for the catalog and one for the repo, reused the second time
+	if fr.tokenHits != 2 {
+		t.Errorf("expected 2 token requests, got %d: %v", fr.tokenHits, fr.requestLog())
+	}
+
+	badReg := fr.newReg("", credentials{username: "bird", password: "wrong"})
+	if _, err := badReg.GetRepoList(ctx); err == nil {
+		t.Error("expected an error with the wrong password")
+	}
+}
+
+func TestRegAnonymousBearerAuth(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.authMode = "bearer"
+	fr.addImage("library/busybox", "latest", digest.FromString("busybox"))
+
+	if _, err := fr.newReg("", credentials{}).GetRepoInfo(context.Background(), "library/busybox"); err != nil {
+		t.Fatalf("anonymous token: %v", err)
+	}
+}
+
+func TestRegBasicAuth(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.authMode = "basic"
+	fr.username, fr.password = "bird", "tweet"
+	fr.addImage("c3/bird", "1.0.56", digest.FromString("bird"))
+
+	ctx := context.Background()
+	if _, err := fr.newReg("", credentials{username: "bird", password: "tweet"}).GetRepoList(ctx); err != nil {
+		t.Fatalf("catalog with basic auth: %v", err)
+	}
+	if _, err := fr.newReg("", credentials{}).GetRepoList(ctx); err == nil {
+		t.Error("expected an error without credentials")
+	}
+}
+
+func TestBasicAuthSentToChallengingHostOnly(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "bird" || pass != "tweet" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer registry.Close()
+	var sent []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+
+	client := &http.Client{Transport: newAuthTransport(http.DefaultTransport, credentials{username: "bird", password: "tweet"})}
+	for _, url := range []string{registry.URL + "/v2/", other.URL + "/blob"} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", url, resp.Status)
+		}
+	}
+	if !reflect.DeepEqual(sent, []string{""}) {
+		t.Errorf("credentials leaked to another host: %q", sent)
+	}
+}
+
+func TestRegBasicAuthNotSentOnRedirect(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.authMode = "basic"
+	fr.username, fr.password = "bird", "tweet"
+	blob := fr.addBlob("application/octet-stream", []byte("from the CDN"))
+
+	// a CDN the registry redirects the blob to, which mustn't see the
+	// registry's credentials
+	var mu sync.Mutex
+	cdnAuth := []string{}
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		cdnAuth = append(cdnAuth, req.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Write([]byte("from the CDN"))
+	}))
+	t.Cleanup(cdn.Close)
+	fr.redirects[blob.Digest] = cdn.URL + "/blobs/" + blob.Digest.Encoded()
+
+	data, err := fr.newReg("", credentials{username: "bird", password: "tweet"}).GetBlob(context.Background(), "c3/bird", blob.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "from the CDN" {
+		t.Errorf("blob = %q", data)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(cdnAuth, []string{""}) {
+		t.Errorf("the CDN was sent Authorization headers %q", cdnAuth)
+	}
+}
+
+func writeAuthFile(t *testing.T, path, key, userpass string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(userpass))
+	if err := os.WriteFile(path, []byte(`{"auths": {"`+key+`": {"auth": "`+auth+`"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("DOCKER_CONFIG", "")
+
+	creds, err := loadCredentials("registry.example.com")
+	if err != nil || !creds.empty() {
+		t.Fatalf("expected no credentials without auth files, got %+v, %v", creds, err)
+	}
+
+	writeAuthFile(t, filepath.Join(home, ".docker", "config.json"), "https://registry.example.com/v1/", "docker:pw")
+	creds, err = loadCredentials("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(creds, credentials{username: "docker", password: "pw"}) {
+		t.Errorf("expected credentials from docker config, got %+v", creds)
+	}
+
+	// containers auth.json takes precedence over docker's config
+	writeAuthFile(t, filepath.Join(home, ".config", "containers", "auth.json"), "registry.example.com", "podman:pw:with:colons")
+	creds, err = loadCredentials("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(creds, credentials{username: "podman", password: "pw:with:colons"}) {
+		t.Errorf("expected credentials from containers auth.json, got %+v", creds)
+	}
+
+	if creds, _ := loadCredentials("other.example.com"); !creds.empty() {
+		t.Errorf("expected no credentials for another host, got %+v", creds)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:c3/bird:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("scheme = %q", scheme)
+	}
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:c3/bird:pull,push",
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("params = %v, want %v", params, want)
+	}
+}
+
+func TestScopeForPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/v2/_catalog":                 "registry:catalog:*",
+		"/v2/c3/bird/tags/list":        "repository:c3/bird:pull",
+		"/v2/c3/bird/manifests/1.0.56": "repository:c3/bird:pull",
+		"/v2/":                         "",
+	} {
+		if got := scopeForPath(path); got != want {
+			t.Errorf("scopeForPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// just enough CBOR (RFC 8949) to read COSE signature envelopes. values are
+// decoded as int64, []byte, string, []interface{}, map[interface{}]interface{},
+// bool, nil or cborTag. indefinite lengths and floats aren't supported, since
+// signers use the deterministic encoding.
+
+type cborTag struct {
+	number  uint64
+	content interface{}
+}
+
+// cbor nested deeper than this is rejected rather than recursed into
+const maxCBORDepth = 32
+
+var errCBORTruncated = errors.New("cbor: truncated data")
+
+// decode one CBOR value from data, returning it and what's left
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORValue(data, 0)
+}
+
+// the major type, argument and rest of an item's head
+func decodeCBORHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errCBORTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return 0, 0, nil, errCBORTruncated
+		}
+		var arg uint64
+		for _, b := range data[:size] {
+			arg = arg<<8 | uint64(b)
+		}
+		return major, arg, data[size:], nil
+	default:
+		return 0, 0, nil, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+}
+
+func decodeCBORValue(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("cbor: nested too deeply")
+	}
+	major, arg, rest, err := decodeCBORHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("cbor: integer %d too big", arg)
+		}
+		return int64(arg), rest, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("cbor: integer -1-%d too small", arg)
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if uint64(len(rest)) < arg {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return rest[:arg], rest[arg:], nil
+		}
+		return string(rest[:arg]), rest[arg:], nil
+	case 4:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, rest, err = decodeCBORValue(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		m := map[interface{}]interface{}{}
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			if key, rest, err = decodeCBORValue(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key %T", key)
+			}
+			if value, rest, err = decodeCBORValue(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+	case 6:
+		content, rest, err := decodeCBORValue(rest, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cborTag{number: arg, content: content}, rest, nil
+	default:
+		switch arg {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+	}
+}
+
+// the head of a CBOR item of a major type with argument arg
+func encodeCBORHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+	}
+}
+
+// encode a value of the types decodeCBOR returns. map keys are sorted by
+// their encoding, as the deterministic encoding has them.
+func encodeCBOR(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return encodeCBORHead(1, uint64(-1-v)), nil
+		}
+		return encodeCBORHead(0, uint64(v)), nil
+	case int:
+		return encodeCBOR(int64(v))
+	case bool:
+		if v {
+			return []byte{0xf5}, nil
+		}
+		return []byte{0xf4}, nil
+	case nil:
+		return []byte{0xf6}, nil
+	case []byte:
+		return append(encodeCBORHead(2, uint64(len(v))), v...), nil
+	case string:
+		return append(encodeCBORHead(3, uint64(len(v))), v...), nil
+	case []interface{}:
+		out := encodeCBORHead(4, uint64(len(v)))
+		for _, item := range v {
+			encoded, err := encodeCBOR(item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, encoded...)
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		entries := [][]byte{}
+		for key, item := range v {
+			encodedKey, err := encodeCBOR(key)
+			if err != nil {
+				return nil, err
+			}
+			encodedItem, err := encodeCBOR(item)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, append(encodedKey, encodedItem...))
+		}
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i], entries[j]) < 0 })
+		out := encodeCBORHead(5, uint64(len(v)))
+		for _, entry := range entries {
+			out = append(out, entry...)
+		}
+		return out, nil
+	case cborTag:
+		content, err := encodeCBOR(v.content)
+		if err != nil {
+			return nil, err
+		}
+		return append(encodeCBORHead(6, v.number), content...), nil
+	default:
+		return nil, fmt.Errorf("cbor: can't encode %T", value)
+	}
+}
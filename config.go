@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+)
+
+// the home directory of the user running ociv, or of the user who ran sudo
+// if we're running as root through it, e.g. to look at an OCI layout in a
+// mounted squashfs filesystem. containers often have no $USER, or no entry
+// in /etc/passwd, so $HOME is used when the user can't be looked up.
+func getUserOrSudoUserHomedir() (string, error) {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		u, err := user.Lookup(sudoUser)
+		if err == nil {
+			return u.HomeDir, nil
+		}
+		slog.Warn("looking up the sudo user, using $HOME", "user", sudoUser, "err", err)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return home, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("finding the home directory: no $HOME, and %w", err)
+	}
+	if u.HomeDir == "" {
+		return "", fmt.Errorf("finding the home directory: no $HOME, and user %s has none", u.Username)
+	}
+	return u.HomeDir, nil
+}
+
+// $xdgVar/name, or ~/homeSubdir/name. under sudo the sudo user's home is
+// used, since $xdgVar would be root's.
+func getXDGDir(xdgVar, homeSubdir, name string) (string, error) {
+	if dir := os.Getenv(xdgVar); dir != "" && os.Getenv("SUDO_USER") == "" {
+		return filepath.Join(dir, name), nil
+	}
+	home, err := getUserOrSudoUserHomedir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, homeSubdir, name), nil
+}
+
+// $XDG_CACHE_HOME/ociv, or ~/.cache/ociv
+func getCacheDir() (string, error) {
+	return getXDGDir("XDG_CACHE_HOME", ".cache", "ociv")
+}
+
+// $XDG_CONFIG_HOME/ociv, or ~/.config/ociv
+func getConfigDir() (string, error) {
+	return getXDGDir("XDG_CONFIG_HOME", ".config", "ociv")
+}
+
+func makeCacheDir() error {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("making the cache directory: %w", err)
+	}
+	return nil
+}
+
+func defaultConfigFilename() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "config.toml"), nil
+}
+
+// settings that can't go in the config file
+var configExcludedFlags = map[string]string{
+	"config":   "it names the config file",
+	"password": "put credentials in an auth file instead",
+}
+
+// the config file to use: the --config flag, or the default one. the
+// default one doesn't have to exist.
+func configFilename(c *cli.Context) (string, bool, error) {
+	if fname := c.String("config"); fname != "" {
+		return fname, true, nil
+	}
+	fname, err := defaultConfigFilename()
+	return fname, false, err
+}
+
+// read the config file's settings, keyed by flag name. a missing default
+// file has none.
+func readConfig(c *cli.Context) (map[string]interface{}, string, error) {
+	fname, explicit, err := configFilename(c)
+	if err != nil {
+		slog.Warn("not reading a config file", "err", err)
+		return nil, "", nil
+	}
+	settings := map[string]interface{}{}
+	if _, err := toml.DecodeFile(fname, &settings); err != nil {
+		if errors.Is(err, fs.ErrNotExist) && !explicit {
+			return nil, fname, nil
+		}
+		return nil, fname, fmt.Errorf("reading config file %s: %w", fname, err)
+	}
+	return settings, fname, nil
+}
+
+// use the config file's settings as the defaults of the app's flags. flags
+// given on the command line, or by their environment variables, win.
+func applyConfig(c *cli.Context) error {
+	settings, fname, err := readConfig(c)
+	if err != nil {
+		return err
+	}
+	flags := appFlagNames(c)
+	for _, name := range sortedKeys(settings) {
+		if reason, ok := configExcludedFlags[name]; ok {
+			return fmt.Errorf("%s: %q can't be set in the config file, %s", fname, name, reason)
+		}
+		if !flags[name] {
+			return fmt.Errorf("%s: unknown setting %q", fname, name)
+		}
+		if c.IsSet(name) {
+			continue
+		}
+		values, err := configValues(settings[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", fname, name, err)
+		}
+		for _, value := range values {
+			if err := c.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s: %w", fname, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func appFlagNames(c *cli.Context) map[string]bool {
+	names := map[string]bool{}
+	for _, flag := range c.App.Flags {
+		names[flag.Names()[0]] = true
+	}
+	return names
+}
+
+// a config value as flag values. lists, like known-layers or exclude, set a
+// flag once for each item.
+func configValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string, int64, bool, float64:
+		return []string{fmt.Sprint(v)}, nil
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			itemValues, err := configValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v (%T)", value, value)
+	}
+}
+
+func sortedKeys(settings map[string]interface{}) []string {
+	keys := []string{}
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// print where ociv keeps things, and the config file's settings
+func doShowConfig(ctxt *cli.Context) error {
+	w := ctxt.App.Writer
+	settings, fname, err := readConfig(ctxt)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fname == "":
+		fmt.Fprintln(w, "config file: none, the home directory couldn't be found")
+	case settings == nil:
+		fmt.Fprintf(w, "config file: %s (not there)\n", fname)
+	default:
+		fmt.Fprintf(w, "config file: %s\n", fname)
+		for _, name := range sortedKeys(settings) {
+			values, _ := configValues(settings[name])
+			fmt.Fprintf(w, "  %s = %s\n", name, strings.Join(values, ","))
+		}
+	}
+
+	logFilename := func() (string, error) {
+		if fname := ctxt.String("log-file"); fname != "" {
+			return fname, nil
+		}
+		return defaultLogFilename()
+	}
+	for _, dir := range []struct {
+		name string
+		get  func() (string, error)
+	}{
+		{"cache dir", getCacheDir},
+		{"known layers file", getKnowLayersFilename},
+		{"log file", logFilename},
+	} {
+		path, err := dir.get()
+		if err != nil {
+			path = fmt.Sprintf("none (%v)", err)
+		}
+		fmt.Fprintf(w, "%s: %s\n", dir.name, path)
+	}
+	return nil
+}
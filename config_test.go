@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestGetCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SUDO_USER", "")
+	t.Setenv("HOME", dir)
+
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "xdg"))
+	if got, err := getCacheDir(); err != nil || got != filepath.Join(dir, "xdg", "ociv") {
+		t.Errorf("getCacheDir with XDG_CACHE_HOME = %q, %v", got, err)
+	}
+
+	t.Setenv("XDG_CACHE_HOME", "")
+	if got, err := getCacheDir(); err != nil || got != filepath.Join(dir, ".cache", "ociv") {
+		t.Errorf("getCacheDir = %q, %v", got, err)
+	}
+
+	// no $USER, like in many containers, is fine
+	t.Setenv("USER", "")
+	if got, err := getConfigDir(); err != nil || got != filepath.Join(dir, ".config", "ociv") {
+		t.Errorf("getConfigDir without $USER = %q, %v", got, err)
+	}
+
+	// under sudo, the sudo user's home, not root's XDG dirs
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("can't look up the current user:", err)
+	}
+	t.Setenv("SUDO_USER", u.Username)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "xdg"))
+	if got, err := getCacheDir(); err != nil || got != filepath.Join(u.HomeDir, ".cache", "ociv") {
+		t.Errorf("getCacheDir under sudo = %q, %v", got, err)
+	}
+	t.Setenv("XDG_STATE_HOME", filepath.Join(dir, "state"))
+	if got, err := getStateDir(); err != nil || got != filepath.Join(u.HomeDir, ".local", "state", "ociv") {
+		t.Errorf("getStateDir under sudo = %q, %v", got, err)
+	}
+
+	// a sudo user that can't be looked up falls back to $HOME
+	t.Setenv("SUDO_USER", "no-such-user-here")
+	if got, err := getCacheDir(); err != nil || got != filepath.Join(dir, ".cache", "ociv") {
+		t.Errorf("getCacheDir with an unknown sudo user = %q, %v", got, err)
+	}
+}
+
+// run the app with args, returning the context its action saw
+func runApp(t *testing.T, args ...string) (*cli.Context, string, error) {
+	t.Helper()
+	defer slog.SetDefault(slog.Default())
+	var seen *cli.Context
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+	app.Action = func(c *cli.Context) error {
+		seen = c
+		return nil
+	}
+	// the action stands in for the TUI, which can't log to stderr, so log
+	// to the default file in a temp state dir
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	defer closeLogging()
+	err := app.Run(append([]string{"ociv"}, args...))
+	return seen, out.String(), err
+}
+
+func TestApplyConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SUDO_USER", "")
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	// set, even to "", the environment variable would win
+	t.Setenv("OCIV_REGISTRY_USERNAME", "")
+	os.Unsetenv("OCIV_REGISTRY_USERNAME")
+	if err := os.MkdirAll(filepath.Join(dir, "ociv"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig := func(fname, contents string) string {
+		t.Helper()
+		if err := os.WriteFile(fname, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	writeConfig(filepath.Join(dir, "ociv", "config.toml"), `
+username = "config-user"
+prefixes = "c3/,team/"
+known-layers = ["/shared/team.json", "/shared/more"]
+concurrency = 8
+timeout = "45s"
+follow-symlinks = true
+`)
+
+	c, _, err := runApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.String("username") != "config-user" || c.String("prefixes") != "c3/,team/" {
+		t.Errorf("settings weren't applied: username %q, prefixes %q", c.String("username"), c.String("prefixes"))
+	}
+	if got := strings.Join(c.StringSlice("known-layers"), ","); got != "/shared/team.json,/shared/more" {
+		t.Errorf("known-layers = %q", got)
+	}
+	if c.Int("concurrency") != 8 || c.Duration("timeout").String() != "45s" || !c.Bool("follow-symlinks") {
+		t.Errorf("concurrency %d, timeout %v, follow-symlinks %v", c.Int("concurrency"), c.Duration("timeout"), c.Bool("follow-symlinks"))
+	}
+
+	// flags and environment variables win
+	t.Setenv("OCIV_REGISTRY_USERNAME", "env-user")
+	c, _, err = runApp(t, "--known-layers", "mine.json", "--concurrency", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.String("username") != "env-user" || c.Int("concurrency") != 2 {
+		t.Errorf("username %q, concurrency %d", c.String("username"), c.Int("concurrency"))
+	}
+	if got := strings.Join(c.StringSlice("known-layers"), ","); got != "mine.json" {
+		t.Errorf("known-layers from the flag = %q", got)
+	}
+
+	for _, tt := range []struct {
+		contents string
+		err      string
+	}{
+		{`regsitry = "x"`, `unknown setting "regsitry"`},
+		{`password = "x"`, `"password" can't be set`},
+		{`concurrency = "lots"`, "concurrency"},
+		{`timeout = 2023-01-01`, "unsupported value"},
+		{`not toml`, "reading config file"},
+	} {
+		fname := writeConfig(filepath.Join(dir, "bad.toml"), tt.contents)
+		if _, _, err := runApp(t, "--config", fname); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("config %q: got error %v, want %q", tt.contents, err, tt.err)
+		}
+	}
+
+	// only a config file that was asked for has to exist
+	if _, _, err := runApp(t, "--config", filepath.Join(dir, "missing.toml")); err == nil {
+		t.Errorf("expected an error for a missing --config file")
+	}
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "empty"))
+	if _, _, err := runApp(t); err != nil {
+		t.Errorf("a missing default config file: %v", err)
+	}
+}
+
+func TestShowConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SUDO_USER", "")
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	fname := filepath.Join(dir, "ociv.toml")
+	if err := os.WriteFile(fname, []byte("registry = \"my.registry.tld\"\nexclude = [\"tmp\", \"*.bak\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, out, err := runApp(t, "--config", fname, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"config file: " + fname,
+		"  exclude = tmp,*.bak",
+		"  registry = my.registry.tld",
+		"cache dir: " + filepath.Join(dir, "cache", "ociv"),
+		"known layers file: " + filepath.Join(dir, "cache", "ociv", "known-layers.json"),
+		"log file: " + filepath.Join(os.Getenv("XDG_STATE_HOME"), "ociv", "ociv.log"),
+		"",
+	}, "\n")
+	if out != want {
+		t.Errorf("config output:\n%s\nwant:\n%s", out, want)
+	}
+
+	_, out, err = runApp(t, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "config file: "+filepath.Join(dir, "config", "ociv", "config.toml")+" (not there)\n") {
+		t.Errorf("config output without a file:\n%s", out)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+)
+
+// cosign signatures and attestations. cosign stores them as an image
+// tagged sha256-<subject hash>.sig or .att, or as a referrer of the subject,
+// with a layer per signature: a simple signing payload with the signature in
+// an annotation, or a DSSE envelope of an in-toto statement.
+
+const (
+	ArtifactTypeCosignSignature   = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	ArtifactTypeCosignAttestation = "application/vnd.dev.cosign.artifact.att.v1+json"
+	MediaTypeCosignSimpleSigning  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	MediaTypeDSSEEnvelope         = "application/vnd.dsse.envelope.v1+json"
+
+	cosignSignatureAnnotation     = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation   = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation         = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation        = "dev.sigstore.cosign/bundle"
+	cosignPredicateTypeAnnotation = "dev.sigstore.cosign/predicateType"
+)
+
+// keys, and CAs of signing certificates, to verify cosign signatures with,
+// from --cosign-key. signatures are unverified if there are none.
+var CosignKeys = cosignKeys{}
+
+// the OIDs of the Fulcio extensions with the OIDC issuer that vouched for a
+// keyless signer: the original raw string, and its DER replacement
+var (
+	fulcioIssuerV1OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+type cosignKeys struct {
+	keys  []crypto.PublicKey
+	roots []*x509.Certificate
+
+	// who the CAs' certificates must be issued to, from --cosign-identity
+	// and --cosign-oidc-issuer, since a CA like Fulcio issues them to anyone
+	identity   string
+	oidcIssuer string
+}
+
+// read PEM public keys and certificates. a CA certificate verifies the
+// certificates signatures carry; another certificate is used as a key.
+func loadCosignKeys(files []string) (cosignKeys, error) {
+	loaded := cosignKeys{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return loaded, err
+		}
+		found := 0
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return loaded, fmt.Errorf("%s: %w", file, err)
+				}
+				loaded.keys = append(loaded.keys, key)
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return loaded, fmt.Errorf("%s: %w", file, err)
+				}
+				if cert.IsCA {
+					loaded.roots = append(loaded.roots, cert)
+				} else {
+					loaded.keys = append(loaded.keys, cert.PublicKey)
+				}
+			default:
+				continue
+			}
+			found++
+		}
+		if found == 0 {
+			return loaded, fmt.Errorf("%s: no PEM public keys or certificates", file)
+		}
+	}
+	return loaded, nil
+}
+
+func (ck cosignKeys) empty() bool {
+	return len(ck.keys) == 0 && len(ck.roots) == 0
+}
+
+// a cosign image's signatures and attestations, one per layer
+type cosignArtifact struct {
+	subject    digest.Digest // what they should sign, if we know
+	signatures []*cosignSignature
+	status     signatureStatus // the best of the signatures'
+}
+
+type cosignSignature struct {
+	kind string // signature or attestation
+
+	// simple signing payloads
+	identity string // the docker-reference signed
+	signed   digest.Digest
+	optional map[string]interface{}
+
+	// attestations
+	predicateType string
+	statement     *inTotoStatement
+
+	certificate *x509.Certificate
+	chain       []*x509.Certificate
+	bundle      *cosignBundle
+
+	status signatureStatus
+	reason string
+}
+
+// the transparency log entry in a signature's bundle. we show it, but
+// don't have the log's key to check it with.
+type cosignBundle struct {
+	Payload struct {
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	} `json:"Payload"`
+}
+
+// is a layer a cosign signature or attestation
+func isCosignLayer(layer ispec.Descriptor) bool {
+	if layer.MediaType == MediaTypeCosignSimpleSigning {
+		return true
+	}
+	_, signed := layer.Annotations[cosignSignatureAnnotation]
+	_, predicate := layer.Annotations[cosignPredicateTypeAnnotation]
+	return layer.MediaType == MediaTypeDSSEEnvelope && (signed || predicate)
+}
+
+// is this image cosign's: its type says so, or its layers are cosign's
+func isCosignImage(info imageInfo) bool {
+	switch info.manifest.ArtifactType {
+	case ArtifactTypeCosignSignature, ArtifactTypeCosignAttestation:
+		return true
+	}
+	if info.manifest.Config.MediaType == ArtifactTypeCosignSignature {
+		return true
+	}
+	for _, layer := range info.manifest.Layers {
+		if isCosignLayer(layer) {
+			return true
+		}
+	}
+	return false
+}
+
+// the digest a cosign image signs: its subject, or the one in its tag
+func cosignSubject(info imageInfo) digest.Digest {
+	if info.manifest.Subject != nil {
+		return info.manifest.Subject.Digest
+	}
+	tag := strings.TrimSuffix(strings.TrimSuffix(info.ref.tag, ".sig"), ".att")
+	if algo, hash, ok := strings.Cut(tag, "-"); ok && tag != info.ref.tag {
+		if d := digest.NewDigestFromEncoded(digest.Algorithm(algo), hash); d.Validate() == nil {
+			return d
+		}
+	}
+	return ""
+}
+
+// read and verify a cosign image's signatures and attestations
+func verifyCosignImage(fetch blobFetcher, info imageInfo) *cosignArtifact {
+	artifact := &cosignArtifact{subject: cosignSubject(info), status: signatureInvalid}
+	for _, layer := range info.manifest.Layers {
+		if !isCosignLayer(layer) {
+			continue
+		}
+		sig := verifyCosignLayer(fetch, layer, artifact.subject)
+		artifact.signatures = append(artifact.signatures, sig)
+		if statusRank(sig.status) > statusRank(artifact.status) {
+			artifact.status = sig.status
+		}
+	}
+	return artifact
+}
+
+// how good a status is, to pick the best of several signatures: like
+// cosign, one good one is enough
+func statusRank(status signatureStatus) int {
+	return map[signatureStatus]int{signatureInvalid: 0, signatureUntrusted: 1, signatureUnchecked: 2, signatureVerified: 3}[status]
+}
+
+func verifyCosignLayer(fetch blobFetcher, layer ispec.Descriptor, subject digest.Digest) *cosignSignature {
+	sig := &cosignSignature{kind: "signature"}
+	if layer.MediaType == MediaTypeDSSEEnvelope {
+		sig.kind = "attestation"
+	}
+	invalid := func(format string, args ...interface{}) *cosignSignature {
+		sig.status = signatureInvalid
+		sig.reason = fmt.Sprintf(format, args...)
+		return sig
+	}
+
+	if certPEM := layer.Annotations[cosignCertificateAnnotation]; certPEM != "" {
+		certs, err := parseCertificates([]byte(certPEM))
+		if err != nil {
+			return invalid("parsing its certificate: %v", err)
+		}
+		sig.certificate = certs[0]
+	}
+	if chainPEM := layer.Annotations[cosignChainAnnotation]; chainPEM != "" {
+		chain, err := parseCertificates([]byte(chainPEM))
+		if err != nil {
+			return invalid("parsing its certificate chain: %v", err)
+		}
+		sig.chain = chain
+	}
+	if bundleJSON := layer.Annotations[cosignBundleAnnotation]; bundleJSON != "" {
+		bundle := &cosignBundle{}
+		if err := json.Unmarshal([]byte(bundleJSON), bundle); err != nil {
+			return invalid("parsing its bundle: %v", err)
+		}
+		sig.bundle = bundle
+	}
+
+	data, err := readArtifactBlob(fetch, layer)
+	if err != nil {
+		return invalid("reading it: %v", err)
+	}
+
+	var signed []byte
+	var signatures [][]byte
+	if sig.kind == "signature" {
+		signed = data
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			return invalid("its signature annotation isn't base64")
+		}
+		signatures = [][]byte{signature}
+
+		var payload struct {
+			Critical struct {
+				Identity struct {
+					DockerReference string `json:"docker-reference"`
+				} `json:"identity"`
+				Image struct {
+					DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+				} `json:"image"`
+				Type string `json:"type"`
+			} `json:"critical"`
+			Optional map[string]interface{} `json:"optional"`
+		}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return invalid("parsing its payload: %v", err)
+		}
+		sig.identity = payload.Critical.Identity.DockerReference
+		sig.signed = payload.Critical.Image.DockerManifestDigest
+		sig.optional = payload.Optional
+		if subject != "" && sig.signed != subject {
+			return invalid("it signs %s, not %s", sig.signed, subject)
+		}
+	} else {
+		var envelope dsseEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return invalid("parsing its DSSE envelope: %v", err)
+		}
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			return invalid("its DSSE payload isn't base64: %v", err)
+		}
+		signed = dssePAE(envelope.PayloadType, payload)
+		for _, s := range envelope.Signatures {
+			signature, err := base64.StdEncoding.DecodeString(s.Sig)
+			if err != nil {
+				return invalid("its DSSE signature isn't base64: %v", err)
+			}
+			signatures = append(signatures, signature)
+		}
+
+		sig.statement = &inTotoStatement{}
+		if err := json.Unmarshal(payload, sig.statement); err != nil {
+			return invalid("parsing its in-toto statement: %v", err)
+		}
+		sig.predicateType = sig.statement.PredicateType
+		if subject != "" && !sig.statement.hasSubject(subject) {
+			return invalid("its statement isn't about %s", subject)
+		}
+	}
+
+	sig.checkKeys(signed, signatures)
+	return sig
+}
+
+// check the signatures over signed with the keys we were given, or with the
+// signature's certificate if one of our CAs issued it
+func (sig *cosignSignature) checkKeys(signed []byte, signatures [][]byte) {
+	// a signature that its own certificate doesn't verify is bad, whoever
+	// made it
+	if sig.certificate != nil && !verifiesWithAny(signed, signatures, sig.certificate.PublicKey) {
+		sig.status = signatureInvalid
+		sig.reason = "the signature doesn't verify with its certificate"
+		return
+	}
+
+	if CosignKeys.empty() {
+		sig.status = signatureUnchecked
+		sig.reason = "no --cosign-key to verify it with"
+		return
+	}
+	if verifiesWithAny(signed, signatures, CosignKeys.keys...) {
+		sig.status = signatureVerified
+		sig.reason = "signed by a key we were given"
+		return
+	}
+	if sig.certificate != nil && len(CosignKeys.roots) > 0 {
+		if err := sig.verifyChain(); err != nil {
+			sig.status = signatureUntrusted
+			sig.reason = fmt.Sprintf("its certificate isn't trusted: %v", err)
+			return
+		}
+		if err := CosignKeys.checkIdentity(sig.certificate); err != nil {
+			sig.status = signatureUntrusted
+			sig.reason = fmt.Sprintf("its certificate is from a CA we were given, but %v", err)
+			return
+		}
+		sig.status = signatureVerified
+		sig.reason = fmt.Sprintf("signed by %s, issued by a CA we were given", certificateIdentity(sig.certificate))
+		return
+	}
+	sig.status = signatureUntrusted
+	sig.reason = "not signed by any key we were given"
+}
+
+// check the signature's certificate chains to one of our CAs. it has to be
+// valid now: we can't check the transparency log's word for when the
+// signature was made, so a keyless signature's certificate, which only lasts
+// minutes, isn't trusted once it expires.
+func (sig *cosignSignature) verifyChain() error {
+	roots := x509.NewCertPool()
+	for _, root := range CosignKeys.roots {
+		roots.AddCert(root)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range sig.chain {
+		intermediates.AddCert(cert)
+	}
+	_, err := sig.certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	return err
+}
+
+// check a certificate from one of our CAs was issued to the identity we
+// were given, by way of the OIDC issuer we were given if it names one
+func (ck cosignKeys) checkIdentity(cert *x509.Certificate) error {
+	if ck.identity == "" {
+		return fmt.Errorf("there's no --cosign-identity to check who it was issued to")
+	}
+	if !slices.Contains(certificateIdentities(cert), ck.identity) {
+		return fmt.Errorf("it was issued to %s, not %s", certificateIdentity(cert), ck.identity)
+	}
+	issuer := fulcioIssuer(cert)
+	if ck.oidcIssuer == "" && issuer != "" {
+		return fmt.Errorf("there's no --cosign-oidc-issuer to check its issuer, %s, against", issuer)
+	}
+	if ck.oidcIssuer != "" && issuer != ck.oidcIssuer {
+		return fmt.Errorf("its OIDC issuer is %q, not %s", issuer, ck.oidcIssuer)
+	}
+	return nil
+}
+
+// who a signing certificate was issued to: its email or URI, as keyless
+// certificates have, or its subject
+func certificateIdentity(cert *x509.Certificate) string {
+	return certificateIdentities(cert)[0]
+}
+
+func certificateIdentities(cert *x509.Certificate) []string {
+	identities := append([]string{}, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return append(identities, cert.Subject.String())
+}
+
+// the OIDC issuer in a Fulcio certificate, or "" if it hasn't one
+func fulcioIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(fulcioIssuerV2OID):
+			var issuer string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &issuer, "utf8"); err == nil {
+				return issuer
+			}
+		case ext.Id.Equal(fulcioIssuerV1OID):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// does any signature verify with any key. cosign signs sha256 digests, with
+// ASN.1 ECDSA signatures and PKCS #1 v1.5 RSA ones.
+func verifiesWithAny(signed []byte, signatures [][]byte, keys ...crypto.PublicKey) bool {
+	hashed := sha256.Sum256(signed)
+	for _, key := range keys {
+		for _, signature := range signatures {
+			switch k := key.(type) {
+			case *ecdsa.PublicKey:
+				if ecdsa.VerifyASN1(k, hashed[:], signature) {
+					return true
+				}
+			case *rsa.PublicKey:
+				if rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed[:], signature) == nil {
+					return true
+				}
+			case ed25519.PublicKey:
+				if ed25519.Verify(k, signed, signature) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// the tree label of a cosign image
+func (ca *cosignArtifact) label(ref imageref) string {
+	kind := "signature"
+	if len(ca.signatures) > 0 && ca.signatures[0].kind == "attestation" {
+		kind = "attestation"
+	}
+	name := ref.hash
+	if ref.tag != "" {
+		name = ref.tag
+	}
+	return fmt.Sprintf("🔏 cosign %s %q %s", kind, name, ca.status.label())
+}
+
+// the signatures' details, for the info pane
+func (ca *cosignArtifact) infoString() string {
+	out := fmt.Sprintf("[yellow]# Cosign: %s\n", ca.status.colored())
+	if ca.subject != "" {
+		out += fmt.Sprintf("[green]subject: [blue]%s[white]\n", ca.subject)
+	}
+	if len(ca.signatures) == 0 {
+		return out + "no signatures or attestations in its layers\n\n"
+	}
+	for idx, sig := range ca.signatures {
+		out += fmt.Sprintf("\n[yellow]## %s %d: %s\n%s\n", sig.kind, idx+1, sig.status.colored(), tview.Escape(sig.reason))
+		if sig.identity != "" {
+			out += fmt.Sprintf("[green]identity: [white]%s\n", tview.Escape(sig.identity))
+		}
+		if sig.signed != "" {
+			out += fmt.Sprintf("[green]signs: [blue]%s[white]\n", sig.signed)
+		}
+		keys := []string{}
+		for key := range sig.optional {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			out += fmt.Sprintf("[green]%s: [white]%v\n", tview.Escape(key), tview.Escape(fmt.Sprint(sig.optional[key])))
+		}
+		if sig.statement != nil {
+			out += fmt.Sprintf("[green]predicate type: [white]%s\n", tview.Escape(sig.predicateType))
+			for _, subject := range sig.statement.Subject {
+				out += fmt.Sprintf("[green]subject: [white]%s %s\n", tview.Escape(subject.Name), formatInTotoDigest(subject.Digest))
+			}
+			out += predicateInfoString(sig.statement)
+		}
+		if sig.certificate != nil {
+			out += fmt.Sprintf("[green]certificate: [white]%s, issued by %s, valid %s to %s\n",
+				tview.Escape(certificateIdentity(sig.certificate)), tview.Escape(sig.certificate.Issuer.String()),
+				sig.certificate.NotBefore.UTC().Format(time.RFC3339), sig.certificate.NotAfter.UTC().Format(time.RFC3339))
+		}
+		if sig.bundle != nil {
+			out += fmt.Sprintf("[green]transparency log: [white]entry %d, at %s (not checked)\n",
+				sig.bundle.Payload.LogIndex, time.Unix(sig.bundle.Payload.IntegratedTime, 0).UTC().Format(time.RFC3339))
+		}
+	}
+	return out + "\n"
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func newTestCosignKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// write a key's public half, like cosign.pub
+func writeCosignPublicKey(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(fname, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func cosignSign(t *testing.T, key *ecdsa.PrivateKey, data []byte) string {
+	t.Helper()
+	hashed := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// a cosign signature layer of signed, as cosign sign makes it
+func (b *layoutBuilder) cosignSignatureLayer(key *ecdsa.PrivateKey, signed digest.Digest) ispec.Descriptor {
+	b.t.Helper()
+	payload, _ := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{"docker-reference": "registry.example.com/web"},
+			"image":    map[string]string{"docker-manifest-digest": signed.String()},
+			"type":     "cosign container image signature",
+		},
+		"optional": map[string]string{"release": "1.0"},
+	})
+	layer := b.writeBlob(MediaTypeCosignSimpleSigning, payload)
+	layer.Annotations = map[string]string{cosignSignatureAnnotation: cosignSign(b.t, key, payload)}
+	return layer
+}
+
+// a cosign attestation layer about subject
+func (b *layoutBuilder) cosignAttestationLayer(key *ecdsa.PrivateKey, subject digest.Digest) ispec.Descriptor {
+	b.t.Helper()
+	statement, _ := json.Marshal(inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v0.1",
+		PredicateType: "https://slsa.dev/provenance/v0.2",
+		Subject:       []inTotoSubject{{Name: "registry.example.com/web", Digest: map[string]string{"sha256": subject.Encoded()}}},
+		Predicate:     json.RawMessage(`{"builder": {"id": "https://ci.example.com"}}`),
+	})
+	payloadType := "application/vnd.in-toto+json"
+	envelope, _ := json.Marshal(map[string]interface{}{
+		"payloadType": payloadType,
+		"payload":     base64.StdEncoding.EncodeToString(statement),
+		"signatures":  []map[string]string{{"keyid": "", "sig": cosignSign(b.t, key, dssePAE(payloadType, statement))}},
+	})
+	layer := b.writeBlob(MediaTypeDSSEEnvelope, envelope)
+	layer.Annotations = map[string]string{
+		cosignSignatureAnnotation:     "",
+		cosignPredicateTypeAnnotation: "https://slsa.dev/provenance/v0.2",
+	}
+	return layer
+}
+
+// add a cosign image with layers, tagged like cosign does for subject
+func (b *layoutBuilder) addCosignImage(subject ispec.Descriptor, suffix string, layers ...ispec.Descriptor) ispec.Descriptor {
+	b.t.Helper()
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config:    b.writeJSONBlob(ispec.MediaTypeImageConfig, ispec.Image{}),
+		Layers:    layers,
+	}
+	desc := b.writeJSONBlob(ispec.MediaTypeImageManifest, manifest)
+	b.addToIndex(desc, "sha256-"+subject.Digest.Encoded()+suffix)
+	return desc
+}
+
+func loadCosignImage(t *testing.T, dir string, desc ispec.Descriptor) imageInfo {
+	t.Helper()
+	loadFixtureTree(t, &standardFixture{dir: dir})
+	info, ok := ImageInfoMap[digestHash(desc.Digest)]
+	if !ok || info.cosign == nil {
+		t.Fatalf("the cosign image wasn't recognized: %+v", info)
+	}
+	return info
+}
+
+func TestCosignSignature(t *testing.T) {
+	key := newTestCosignKey(t)
+	keyFile := writeCosignPublicKey(t, key)
+	otherKeyFile := writeCosignPublicKey(t, newTestCosignKey(t))
+
+	tests := []struct {
+		name   string
+		keys   []string
+		signs  func(web ispec.Descriptor) digest.Digest
+		status signatureStatus
+		reason string
+	}{
+		{"no key", nil, nil, signatureUnchecked, "no --cosign-key"},
+		{"key", []string{keyFile}, nil, signatureVerified, "signed by a key we were given"},
+		{"other key", []string{otherKeyFile}, nil, signatureUntrusted, "not signed by any key"},
+		{"either key", []string{otherKeyFile, keyFile}, nil, signatureVerified, ""},
+		{"another image", []string{keyFile}, func(ispec.Descriptor) digest.Digest { return digest.FromString("other") }, signatureInvalid, "it signs sha256:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetGlobals(t)
+			dir := t.TempDir()
+			b := newLayoutBuilder(t, dir)
+			web := b.addImage("web", "rootfs")
+			signs := web.Digest
+			if tt.signs != nil {
+				signs = tt.signs(web)
+			}
+			desc := b.addCosignImage(web, ".sig", b.cosignSignatureLayer(key, signs))
+			b.save()
+			var err error
+			if CosignKeys, err = loadCosignKeys(tt.keys); err != nil {
+				t.Fatal(err)
+			}
+
+			info := loadCosignImage(t, dir, desc)
+			if info.cosign.subject != web.Digest {
+				t.Errorf("subject = %s, want %s", info.cosign.subject, web.Digest)
+			}
+			sig := info.cosign.signatures[0]
+			if sig.status != tt.status || !strings.Contains(sig.reason, tt.reason) {
+				t.Errorf("status %s (%s), want %s (%s)", sig.status, sig.reason, tt.status, tt.reason)
+			}
+			if info.cosign.status != tt.status || !strings.HasSuffix(info.displayLabel, tt.status.label()) {
+				t.Errorf("image status %s, label %q", info.cosign.status, info.displayLabel)
+			}
+			if tt.status == signatureVerified {
+				got := getImageInfoString(info.ref, info, 0)
+				for _, want := range []string{"# Cosign: [green]verified", "identity: [white]registry.example.com/web", "release: [white]1.0"} {
+					if !strings.Contains(got, want) {
+						t.Errorf("info doesn't have %q:\n%s", want, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCosignAttestation(t *testing.T) {
+	resetGlobals(t)
+	key := newTestCosignKey(t)
+	dir := t.TempDir()
+	b := newLayoutBuilder(t, dir)
+	web := b.addImage("web", "rootfs")
+	good := b.cosignAttestationLayer(key, web.Digest)
+	other := b.cosignAttestationLayer(key, digest.FromString("other"))
+	desc := b.addCosignImage(web, ".att", other, good)
+	b.save()
+	var err error
+	if CosignKeys, err = loadCosignKeys([]string{writeCosignPublicKey(t, key)}); err != nil {
+		t.Fatal(err)
+	}
+
+	info := loadCosignImage(t, dir, desc)
+	sigs := info.cosign.signatures
+	if len(sigs) != 2 || sigs[0].status != signatureInvalid || sigs[1].status != signatureVerified {
+		t.Fatalf("attestations = %+v", sigs)
+	}
+	// one good attestation is enough
+	if info.cosign.status != signatureVerified || !strings.HasPrefix(info.displayLabel, "🔏 cosign attestation ") {
+		t.Errorf("status %s, label %q", info.cosign.status, info.displayLabel)
+	}
+	if sigs[1].predicateType != "https://slsa.dev/provenance/v0.2" {
+		t.Errorf("predicate type = %q", sigs[1].predicateType)
+	}
+	got := info.cosign.infoString()
+	for _, want := range []string{"subject: [white]registry.example.com/web sha256:" + web.Digest.Encoded(), "builder: [white]https://ci.example.com"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("info doesn't have %q:\n%s", want, got)
+		}
+	}
+}
+
+// a short-lived certificate for the signer's key, as Fulcio issues them to
+// an email address that an OIDC issuer vouched for
+func fulcioCertificate(t *testing.T, signer *testSigner, email, issuer string, issued time.Time) *x509.Certificate {
+	t.Helper()
+	issuerDER, err := asn1.MarshalWithParams(issuer, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(3),
+		NotBefore:       issued,
+		NotAfter:        issued.Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{email},
+		ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerV2OID, Value: issuerDER}},
+	}
+	return newTestCertificate(t, template, signer.caCert, signer.leafKey.Public(), signer.caKey)
+}
+
+func TestCosignKeyless(t *testing.T) {
+	signer := newTestSigner(t, "fulcio", false)
+	signingKey := signer.leafKey.(*ecdsa.PrivateKey)
+	caFile := filepath.Join(t.TempDir(), "fulcio.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signer.caCert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	keyless := fulcioCertificate(t, signer, "bird@example.com", "https://accounts.example.com", now.Add(-time.Minute))
+	expired := fulcioCertificate(t, signer, "bird@example.com", "https://accounts.example.com", now.Add(-time.Hour))
+	// the log's timestamp for the signature, which we can't check
+	bundle := `{"SignedEntryTimestamp": "", "Payload": {"integratedTime": ` +
+		big.NewInt(fixtureTime.Unix()).String() + `, "logIndex": 1234, "logID": "c0d23d6a"}}`
+
+	for _, tt := range []struct {
+		name     string
+		key      *ecdsa.PrivateKey
+		cert     *x509.Certificate
+		keys     []string
+		identity string
+		issuer   string
+		status   signatureStatus
+		reason   string
+	}{
+		{"keyless", signingKey, keyless, []string{caFile}, "bird@example.com", "https://accounts.example.com",
+			signatureVerified, "signed by bird@example.com, issued by a CA"},
+		{"keyless, no identity", signingKey, keyless, []string{caFile}, "", "",
+			signatureUntrusted, "there's no --cosign-identity"},
+		{"keyless, another identity", signingKey, keyless, []string{caFile}, "cat@example.com", "https://accounts.example.com",
+			signatureUntrusted, "it was issued to bird@example.com, not cat@example.com"},
+		{"keyless, no issuer", signingKey, keyless, []string{caFile}, "bird@example.com", "",
+			signatureUntrusted, "there's no --cosign-oidc-issuer"},
+		{"keyless, another issuer", signingKey, keyless, []string{caFile}, "bird@example.com", "https://evil.example.com",
+			signatureUntrusted, `its OIDC issuer is "https://accounts.example.com"`},
+		{"keyless, expired", signingKey, expired, []string{caFile}, "bird@example.com", "https://accounts.example.com",
+			signatureUntrusted, "expired"},
+		{"a private CA", signingKey, signer.leafCert, []string{caFile}, "CN=signer,O=Acme,C=US", "",
+			signatureVerified, "signed by CN=signer,O=Acme,C=US, issued by a CA"},
+		{"untrusted CA", signingKey, keyless, []string{writeCosignPublicKey(t, newTestCosignKey(t))}, "bird@example.com", "",
+			signatureUntrusted, "not signed by any key"},
+		{"not its certificate's signature", newTestCosignKey(t), keyless, []string{caFile}, "bird@example.com", "",
+			signatureInvalid, "doesn't verify with its certificate"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resetGlobals(t)
+			dir := t.TempDir()
+			b := newLayoutBuilder(t, dir)
+			web := b.addImage("web", "rootfs")
+			layer := b.cosignSignatureLayer(tt.key, web.Digest)
+			layer.Annotations[cosignCertificateAnnotation] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tt.cert.Raw}))
+			layer.Annotations[cosignBundleAnnotation] = bundle
+			// as a referrer, like cosign's OCI 1.1 mode
+			manifest := ispec.Manifest{
+				Versioned:    specs.Versioned{SchemaVersion: 2},
+				MediaType:    ispec.MediaTypeImageManifest,
+				ArtifactType: ArtifactTypeCosignSignature,
+				Config:       b.writeBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+				Layers:       []ispec.Descriptor{layer},
+				Subject:      &web,
+			}
+			desc := b.writeJSONBlob(ispec.MediaTypeImageManifest, manifest)
+			b.addToIndex(desc, "")
+			b.save()
+			var err error
+			if CosignKeys, err = loadCosignKeys(tt.keys); err != nil {
+				t.Fatal(err)
+			}
+			CosignKeys.identity, CosignKeys.oidcIssuer = tt.identity, tt.issuer
+
+			info := loadCosignImage(t, dir, desc)
+			sig := info.cosign.signatures[0]
+			if sig.status != tt.status || !strings.Contains(sig.reason, tt.reason) {
+				t.Errorf("status %s (%s), want %s (%s)", sig.status, sig.reason, tt.status, tt.reason)
+			}
+			if got := info.cosign.infoString(); !strings.Contains(got, "transparency log: [white]entry 1234, at "+fixtureTime.Format(time.RFC3339)) {
+				t.Errorf("info:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestLoadCosignKeys(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(notPEM, []byte("not a key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCosignKeys([]string{notPEM}); err == nil || !strings.Contains(err.Error(), "no PEM public keys") {
+		t.Errorf("expected an error for a file without keys, got %v", err)
+	}
+	if _, err := loadCosignKeys([]string{filepath.Join(dir, "missing.pub")}); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+
+	signer := newTestSigner(t, "ca", false)
+	both := filepath.Join(dir, "both.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signer.caCert.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signer.leafCert.Raw})...)
+	if err := os.WriteFile(both, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadCosignKeys([]string{both})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.roots) != 1 || len(keys.keys) != 1 {
+		t.Errorf("loaded %d roots and %d keys, want a CA and a key", len(keys.roots), len(keys.keys))
+	}
+	if _, ok := keys.keys[0].(*ecdsa.PublicKey); !ok {
+		t.Errorf("key is a %T", keys.keys[0])
+	}
+}
@@ -2,6 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
 
 	"github.com/k0kubun/go-ansi"
 	"github.com/schollz/progressbar/v3"
@@ -15,24 +22,44 @@ func doFetchTags(c *cli.Context) error {
 	}
 
 	prefixes := c.String("prefixes")
-	out := getKnowLayersFilename()
-	makeCacheDir() // Ensure the cache directory exists.
+	out, err := makeKnownLayersFile()
+	if err != nil {
+		return err
+	}
 
-	reg := NewReg(registry, prefixes)
-	ctx := context.Background()
-	l, e := reg.GetRepoList(ctx)
-	if e != nil {
-		return e
+	// credentials from flags take precedence over the auth files
+	creds := credentials{
+		username: c.String("username"),
+		password: c.String("password"),
+	}
+	if creds.empty() {
+		if creds, err = loadCredentials(registryHost(registry)); err != nil {
+			return err
+		}
 	}
 
-	entries := LayerNameHashEntries{}
-	repos := []*Repo{}
-	bar := progressbar.NewOptions(len(l.Repositories),
-		progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
+	// ctrl-c stops the fetch, saving what we have so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	opts, err := newFetchOptions(c)
+	if err != nil {
+		return err
+	}
+	reg, err := NewReg(registry, prefixes, creds, opts)
+	if err != nil {
+		return err
+	}
+	return refreshKnownLayers(ctx, reg, out, c.Bool("prune"), ansi.NewAnsiStdout())
+}
+
+func newProgressBar(w io.Writer, total int, description string) *progressbar.ProgressBar {
+	return progressbar.NewOptions(total,
+		progressbar.OptionSetWriter(w),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionSetWidth(15),
-		progressbar.OptionSetDescription("[cyan][1/2][reset] Fetching Repositories"),
+		progressbar.OptionSetDescription(description),
 		progressbar.OptionSetTheme(progressbar.Theme{
 			Saucer:        "[green]=[reset]",
 			SaucerHead:    "[green]>[reset]",
@@ -40,19 +67,64 @@ func doFetchTags(c *cli.Context) error {
 			BarStart:      "[",
 			BarEnd:        "]",
 		}))
+}
+
+// a repo or tag we couldn't fetch
+type fetchFailure struct {
+	name string
+	err  error
+}
+
+// fetch the registry's tags and merge them into the known layers file out.
+// tags whose manifest digest is unchanged since the last refresh aren't
+// fetched again. tags that are gone from the registry are removed if prune
+// is set. repos and tags that fail to fetch keep their old entries and are
+// reported at the end. if ctx is cancelled, what was fetched so far is
+// saved, without pruning. progress goes to w.
+func refreshKnownLayers(ctx context.Context, reg *Reg, out string, prune bool, w io.Writer) error {
+	existing, err := Load(out)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("reading %s: %w", out, err)
+		}
+		existing = LayerNameHashEntries{}
+	}
+
+	l, e := reg.GetRepoList(ctx)
+	if e != nil {
+		return e
+	}
+
+	refresh := registryRefresh{
+		registry:  registryHost(reg.URL),
+		inScope:   reg.InScope,
+		fetched:   LayerNameHashEntries{},
+		unchanged: map[string]bool{},
+		seen:      map[string]bool{},
+		failed:    map[string]bool{},
+	}
+	// failed repos are counted and reported apart from their tags, which
+	// weren't listed at all
+	repoFailures, tagFailures := []fetchFailure{}, []fetchFailure{}
+	fetchedTags, unchangedTags := 0, 0
+
+	repos := []*Repo{}
+	bar := newProgressBar(w, len(l.Repositories), "[cyan][1/2][reset] Fetching Repositories")
 
 	repoChan := make(chan RepoError, 16)
-	go reg.FetchRepoInfos(l, repoChan)
+	go reg.FetchRepoInfos(ctx, l, repoChan)
 
 	for repo := range repoChan {
-		r, e := repo.Repo, repo.Err
-		if e != nil {
-			return e
-		}
 		if e := bar.Add(1); e != nil {
 			return e
 		}
-		repos = append(repos, r)
+		if repo.Err != nil {
+			slog.Warn("can't fetch repo", "repo", repo.Name, "err", repo.Err)
+			refresh.failed[repo.Name] = true
+			repoFailures = append(repoFailures, fetchFailure{repo.Name, repo.Err})
+			continue
+		}
+		repos = append(repos, repo.Repo)
 	}
 
 	totalTags := 0
@@ -60,33 +132,62 @@ func doFetchTags(c *cli.Context) error {
 		totalTags += len(r.Tags)
 	}
 
-	bar = progressbar.NewOptions(totalTags,
-		progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
-		progressbar.OptionEnableColorCodes(true),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetWidth(15),
-		progressbar.OptionSetDescription("[cyan][2/2][reset] Fetching Image Tags"),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "[green]=[reset]",
-			SaucerHead:    "[green]>[reset]",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}))
+	bar = newProgressBar(w, totalTags, "[cyan][2/2][reset] Fetching Image Tags")
 
 	tagChan := make(chan LayerEntryError, 64)
-	go reg.FetchLayerEntries(repos, tagChan)
+	go reg.FetchLayerEntries(ctx, repos, existing.TagDigests(refresh.registry), tagChan)
 
 	for entryErr := range tagChan {
-		entry, err := entryErr.Entry, entryErr.Err
-		if err != nil {
-			return err
-		}
 		if e := bar.Add(1); e != nil {
 			return e
 		}
-		entries = append(entries, entry)
+		key := repoTagKey(entryErr.Repo, entryErr.Tag)
+		refresh.seen[key] = true
+		switch {
+		case entryErr.Err != nil:
+			slog.Warn("can't fetch tag", "tag", key, "err", entryErr.Err)
+			refresh.failed[key] = true
+			tagFailures = append(tagFailures, fetchFailure{key, entryErr.Err})
+		case entryErr.Unchanged:
+			refresh.unchanged[key] = true
+			unchangedTags++
+		default:
+			refresh.fetched = append(refresh.fetched, entryErr.Entries...)
+			fetchedTags++
+		}
 	}
 
-	return entries.Save(out)
+	interrupted := ctx.Err()
+	if interrupted != nil {
+		// we haven't seen every tag, so we can't tell which are gone
+		prune = false
+	}
+
+	merged, pruned := existing.Merge(refresh, prune)
+	fmt.Fprintf(w, "\n%d tags fetched, %d unchanged, %d failed; %d repos failed; %d entries pruned\n",
+		fetchedTags, unchangedTags, len(tagFailures), len(repoFailures), pruned)
+	for _, failures := range []struct {
+		kind string
+		list []fetchFailure
+	}{{"repo", repoFailures}, {"tag", tagFailures}} {
+		for _, failure := range failures.list {
+			if interrupted != nil && errors.Is(failure.err, context.Canceled) {
+				continue
+			}
+			fmt.Fprintf(w, "failed %s: %s: %v\n", failures.kind, failure.name, failure.err)
+		}
+	}
+
+	if len(merged) > 0 {
+		if err := merged.Save(out); err != nil {
+			return err
+		}
+	}
+	if interrupted != nil {
+		return fmt.Errorf("fetch interrupted, saved what was fetched so far: %w", interrupted)
+	}
+	if len(merged) == 0 {
+		return fmt.Errorf("no entries to save")
+	}
+	return nil
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// the names of the images in a known layers file, with their registry, sorted
+func knownLayerNames(t *testing.T, file string) []string {
+	t.Helper()
+	entries, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.LayerIndex != entry.LayerCount {
+			continue
+		}
+		names = append(names, entry.Registry+" "+entry.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRefreshKnownLayers(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.addImage("c3/bird", "1.0.56", digest.FromString("base"), digest.FromString("bird"))
+	fr.addImage("c3/bird", "1.0.57", digest.FromString("base"), digest.FromString("bird2"))
+	fr.addImage("c3/fish", "1.0", digest.FromString("fish"))
+	host := registryHost(fr.URL())
+
+	// an existing file with an old style entry and another registry's entry
+	out := filepath.Join(t.TempDir(), "known-layers.json")
+	existing := LayerNameHashEntries{
+		{Hash: digest.FromString("bird").Encoded(), Name: "c3/bird:1.0.56"},
+		{Hash: "abc", Name: "elsewhere/thing:1", Registry: "elsewhere.example.com", Repository: "elsewhere/thing", Tag: "1", ManifestDigest: "sha256:abc"},
+	}
+	if err := existing.Save(out); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := refreshKnownLayers(ctx, fr.newReg("c3/bird", credentials{}), out, false, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		host + " c3/bird:1.0.56",
+		host + " c3/bird:1.0.57",
+		"elsewhere.example.com elsewhere/thing:1",
+	}
+	if got := knownLayerNames(t, out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("after first refresh got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// a refresh only fetches tags that changed, and keeps removed tags
+	fr.addImage("c3/bird", "1.0.57", digest.FromString("base"), digest.FromString("bird3"))
+	fr.addImage("c3/bird", "1.0.58", digest.FromString("base"), digest.FromString("bird4"))
+	fr.removeTag("c3/bird", "1.0.56")
+	fr.clearRequestLog()
+	if err := refreshKnownLayers(ctx, fr.newReg("c3/bird", credentials{}), out, false, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fr.requestLog() {
+		if r == "GET /v2/c3/bird/manifests/1.0.56" {
+			t.Errorf("removed tag was fetched")
+		}
+	}
+	entries, err := Load(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := map[string]string{}
+	for _, entry := range entries {
+		hashes[entry.Name] = entry.Hash
+	}
+	if hashes["c3/bird:1.0.57"] != digest.FromString("bird3").Encoded() {
+		t.Errorf("changed tag not refreshed, got %s", hashes["c3/bird:1.0.57"])
+	}
+	if _, ok := hashes["c3/bird:1.0.56"]; !ok {
+		t.Errorf("removed tag was dropped without --prune")
+	}
+	if _, ok := hashes["c3/bird:1.0.58"]; !ok {
+		t.Errorf("new tag not added")
+	}
+
+	// unchanged tags are only checked with a HEAD request
+	fr.clearRequestLog()
+	if err := refreshKnownLayers(ctx, fr.newReg("c3/bird", credentials{}), out, true, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fr.requestLog() {
+		if strings.HasPrefix(r, "GET /v2/c3/bird/manifests/") {
+			t.Errorf("unchanged tag fetched: %s", r)
+		}
+	}
+	want = []string{
+		host + " c3/bird:1.0.57",
+		host + " c3/bird:1.0.58",
+		"elsewhere.example.com elsewhere/thing:1",
+	}
+	if got := knownLayerNames(t, out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("after pruning got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRefreshKnownLayersFailures(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.addImage("c3/bird", "1.0.56", digest.FromString("bird"))
+	fr.addImage("c3/bird", "1.0.57", digest.FromString("bird2"))
+	fr.addImage("c3/fish", "1.0", digest.FromString("fish"))
+	host := registryHost(fr.URL())
+
+	out := filepath.Join(t.TempDir(), "known-layers.json")
+	ctx := context.Background()
+	if err := refreshKnownLayers(ctx, fr.newReg("c3", credentials{}), out, false, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// transient errors are retried
+	fr.addImage("c3/bird", "1.0.58", digest.FromString("bird3"))
+	fr.failWith("/v2/c3/bird/manifests/1.0.58", http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	// persistent errors are reported, and the old entries kept even with prune
+	fr.addImage("c3/bird", "1.0.57", digest.FromString("bird4"))
+	fr.failWith("/v2/c3/bird/manifests/1.0.57", 500, 500, 500, 500, 500, 500, 500, 500)
+	fr.failWith("/v2/c3/fish/tags/list", 500, 500, 500, 500)
+
+	report := &strings.Builder{}
+	if err := refreshKnownLayers(ctx, fr.newReg("c3", credentials{}), out, true, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, failed := range []string{
+		"1 tags fetched, 1 unchanged, 1 failed; 1 repos failed;",
+		"failed repo: c3/fish:",
+		"failed tag: c3/bird:1.0.57:",
+	} {
+		if !strings.Contains(report.String(), failed) {
+			t.Errorf("report doesn't mention %q:\n%s", failed, report)
+		}
+	}
+
+	want := []string{
+		host + " c3/bird:1.0.56",
+		host + " c3/bird:1.0.57",
+		host + " c3/bird:1.0.58",
+		host + " c3/fish:1.0",
+	}
+	if got := knownLayerNames(t, out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFetchLayerEntriesCancelled(t *testing.T) {
+	fr := newFakeRegistry(t)
+	repo := &Repo{Name: "c3/bird"}
+	for _, tag := range []string{"1", "2", "3", "4"} {
+		fr.addImage("c3/bird", tag, digest.FromString(tag))
+		repo.Tags = append(repo.Tags, tag)
+	}
+
+	reg := fr.newReg("", credentials{})
+	reg.Concurrency = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	entries := make(chan LayerEntryError, 64)
+	go reg.FetchLayerEntries(ctx, []*Repo{repo}, nil, entries)
+	for entry := range entries {
+		if entry.Err == nil {
+			t.Errorf("expected %s:%s to fail after cancelling", entry.Repo, entry.Tag)
+		}
+	}
+	if requests := fr.requestLog(); len(requests) > 0 {
+		t.Errorf("expected no requests after cancelling, got %v", requests)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// the code under test logs a lot, keep test output readable
+	slog.SetDefault(newLogger(io.Discard, slog.LevelDebug))
+	os.Exit(m.Run())
+}
+
+// the global maps are filled in as layouts are loaded, so each test starts
+// from a clean slate
+func resetGlobals(t *testing.T) {
+	t.Helper()
+	ImageInfoMap = map[string]imageInfo{}
+	SubIndexInfoMap = map[string]subIndexInfo{}
+	LayerNameMap = map[string][]string{}
+	KnownLayerEntries = map[string][]*LayerNameMapEntry{}
+	KnownDiffIDEntries = map[string][]*LayerNameMapEntry{}
+	KnownConfigEntries = map[string][]*LayerNameMapEntry{}
+	LayerSummaryCache = map[string]string{}
+	PreviewCache = map[string][]*artifactPreview{}
+	SBOMPackageMap = map[string][]string{}
+	NotaryTrustDir = ""
+	CosignKeys = cosignKeys{}
+}
+
+// compare got to testdata/<name>.golden, or rewrite it with -update
+func checkGolden(t *testing.T, name string, got string) {
+	t.Helper()
+	goldenPath := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(goldenPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(goldenPath, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("reading golden file (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("output doesn't match %s (run with -update to accept it)\n--- got:\n%s\n--- want:\n%s", goldenPath, got, want)
+	}
+}
+
+// replace the temp dir in output with a stable placeholder
+func scrubPath(s, dir string) string {
+	return strings.ReplaceAll(s, dir, "TESTDIR")
+}
+
+var fixtureTime = time.Date(2023, time.March, 14, 15, 9, 26, 0, time.UTC)
+
+// layoutBuilder programmatically creates an OCI layout. all content is
+// deterministic, so digests and golden output are stable.
+type layoutBuilder struct {
+	t     *testing.T
+	path  string
+	index ispec.Index
+}
+
+func newLayoutBuilder(t *testing.T, path string) *layoutBuilder {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(path, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	layout, _ := json.Marshal(ispec.ImageLayout{Version: ispec.ImageLayoutVersion})
+	if err := os.WriteFile(filepath.Join(path, ispec.ImageLayoutFile), layout, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &layoutBuilder{
+		t:    t,
+		path: path,
+		index: ispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ispec.MediaTypeImageIndex,
+		},
+	}
+}
+
+func (b *layoutBuilder) writeBlob(mediaType string, data []byte) ispec.Descriptor {
+	b.t.Helper()
+	return b.writeBlobWithAlgorithm(digest.SHA256, mediaType, data)
+}
+
+func (b *layoutBuilder) writeBlobWithAlgorithm(algo digest.Algorithm, mediaType string, data []byte) ispec.Descriptor {
+	b.t.Helper()
+	dgst := algo.FromBytes(data)
+	if err := os.MkdirAll(filepath.Join(b.path, "blobs", algo.String()), 0755); err != nil {
+		b.t.Fatal(err)
+	}
+	if err := os.WriteFile(blobPath(b.path, dgst), data, 0644); err != nil {
+		b.t.Fatal(err)
+	}
+	return ispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+func (b *layoutBuilder) writeJSONBlob(mediaType string, v interface{}) ispec.Descriptor {
+	b.t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return b.writeBlob(mediaType, data)
+}
+
+// add a descriptor to index.json, tagged if tag isn't empty
+func (b *layoutBuilder) addToIndex(desc ispec.Descriptor, tag string) {
+	if tag != "" {
+		desc.Annotations = map[string]string{ispec.AnnotationRefName: tag}
+	}
+	b.index.Manifests = append(b.index.Manifests, desc)
+}
+
+// a gzipped tar layer containing a single file, and its diffID
+func (b *layoutBuilder) writeLayer(filename, contents string) (ispec.Descriptor, digest.Digest) {
+	b.t.Helper()
+	data, diffID := tarGzLayer(b.t, filename, contents)
+	return b.writeBlob(ispec.MediaTypeImageLayerGzip, data), diffID
+}
+
+// the blob of a gzipped tar layer containing a single file, and its diffID
+func tarGzLayer(t *testing.T, filename, contents string) ([]byte, digest.Digest) {
+	t.Helper()
+	tarBuf := new(bytes.Buffer)
+	tw := tar.NewWriter(tarBuf)
+	hdr := &tar.Header{Name: filename, Mode: 0644, Size: int64(len(contents)), ModTime: fixtureTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gzBuf := new(bytes.Buffer)
+	gw := gzip.NewWriter(gzBuf)
+	if _, err := gw.Write(tarBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return gzBuf.Bytes(), digest.FromBytes(tarBuf.Bytes())
+}
+
+// add an image with one layer per entry in layers, each holding a file of
+// that name. the same layer name always makes the same blob, so images can
+// share base layers.
+func (b *layoutBuilder) addImage(tag string, layers ...string) ispec.Descriptor {
+	return b.addImageForPlatform(tag, nil, layers...)
+}
+
+func (b *layoutBuilder) addImageForPlatform(tag string, platform *ispec.Platform, layers ...string) ispec.Descriptor {
+	b.t.Helper()
+	return b.addImageWithConfig(tag, platform, nil, layers...)
+}
+
+// add an image whose config is changed by edit, if it isn't nil, before
+// it's written, e.g. to make its history disagree with its layers
+func (b *layoutBuilder) addImageWithConfig(tag string, platform *ispec.Platform, edit func(config *ispec.Image), layers ...string) ispec.Descriptor {
+	b.t.Helper()
+	config := ispec.Image{
+		Created:  &fixtureTime,
+		Platform: ispec.Platform{OS: "linux", Architecture: "amd64"},
+		Config: ispec.ImageConfig{
+			Entrypoint: []string{"/bin/" + tag},
+		},
+		RootFS: ispec.RootFS{Type: "layers"},
+	}
+	if platform != nil {
+		config.Platform = *platform
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+	}
+	for _, layer := range layers {
+		desc, diffID := b.writeLayer(layer, "contents of "+layer)
+		manifest.Layers = append(manifest.Layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+		config.History = append(config.History, ispec.History{
+			Created:   &fixtureTime,
+			CreatedBy: "add " + layer,
+		})
+	}
+	if edit != nil {
+		edit(&config)
+	}
+	manifest.Config = b.writeJSONBlob(ispec.MediaTypeImageConfig, config)
+
+	desc := b.writeJSONBlob(ispec.MediaTypeImageManifest, manifest)
+	desc.Platform = platform
+	if platform == nil {
+		b.addToIndex(desc, tag)
+	}
+	return desc
+}
+
+// add an image whose manifest and config use sha512 digests
+func (b *layoutBuilder) addSha512Image(tag string, layers ...string) ispec.Descriptor {
+	b.t.Helper()
+	config := ispec.Image{RootFS: ispec.RootFS{Type: "layers"}}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+	}
+	for _, layer := range layers {
+		desc, diffID := b.writeLayer(layer, "contents of "+layer)
+		manifest.Layers = append(manifest.Layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	}
+	configBytes, _ := json.Marshal(config)
+	manifest.Config = b.writeBlobWithAlgorithm(digest.SHA512, ispec.MediaTypeImageConfig, configBytes)
+
+	manifestBytes, _ := json.Marshal(manifest)
+	desc := b.writeBlobWithAlgorithm(digest.SHA512, ispec.MediaTypeImageManifest, manifestBytes)
+	b.addToIndex(desc, tag)
+	return desc
+}
+
+// add a multi-arch index with an image per platform
+func (b *layoutBuilder) addMultiArchIndex(tag string, platforms []ispec.Platform, layers ...string) ispec.Descriptor {
+	b.t.Helper()
+	index := ispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+	}
+	for i := range platforms {
+		platformLayers := append([]string{}, layers...)
+		platformLayers = append(platformLayers, platforms[i].Architecture)
+		index.Manifests = append(index.Manifests, b.addImageForPlatform(tag, &platforms[i], platformLayers...))
+	}
+	desc := b.writeJSONBlob(ispec.MediaTypeImageIndex, index)
+	b.addToIndex(desc, tag)
+	return desc
+}
+
+// add an artifact with an empty config and a single file layer. subject may
+// be nil, otherwise the artifact is a referrer of subject.
+func (b *layoutBuilder) addArtifact(tag, artifactType, filename, contents string, subject *ispec.Descriptor) ispec.Descriptor {
+	b.t.Helper()
+	layer := b.writeBlob("application/octet-stream", []byte(contents))
+	layer.Annotations = map[string]string{OCIImageTitleAnnotation: filename}
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       b.writeBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       []ispec.Descriptor{layer},
+		Subject:      subject,
+		Annotations:  map[string]string{"org.opencontainers.image.created": fixtureTime.Format(time.RFC3339)},
+	}
+	desc := b.writeJSONBlob(ispec.MediaTypeImageManifest, manifest)
+	desc.ArtifactType = artifactType
+	b.addToIndex(desc, tag)
+	return desc
+}
+
+// add a notary v2 signature referrer for subject
+func (b *layoutBuilder) addNotarySignature(subject ispec.Descriptor) ispec.Descriptor {
+	b.t.Helper()
+	envelope := b.writeBlob("application/jose+json", []byte(`{"payload":"","signatures":[]}`))
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.cncf.notary.signature",
+		Config:       b.writeBlob("application/vnd.cncf.notary.signature", []byte("{}")),
+		Layers:       []ispec.Descriptor{envelope},
+		Subject:      &subject,
+		Annotations:  map[string]string{"io.cncf.notary.x509chain.thumbprint#S256": `["abc123"]`},
+	}
+	desc := b.writeJSONBlob(ispec.MediaTypeImageManifest, manifest)
+	b.addToIndex(desc, "")
+	return desc
+}
+
+// add an artifact with an empty config and no layers at all
+func (b *layoutBuilder) addEmptyArtifact(tag, artifactType string) ispec.Descriptor {
+	b.t.Helper()
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       b.writeBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       []ispec.Descriptor{},
+	}
+	desc := b.writeJSONBlob(ispec.MediaTypeImageManifest, manifest)
+	b.addToIndex(desc, tag)
+	return desc
+}
+
+// add an index entry whose manifest blob is missing
+func (b *layoutBuilder) addMissingBlob(tag string) ispec.Descriptor {
+	data := []byte(`{"this blob": "was never written"}`)
+	desc := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	b.addToIndex(desc, tag)
+	return desc
+}
+
+// add an index entry whose manifest blob doesn't match its digest
+func (b *layoutBuilder) addCorruptBlob(tag string) ispec.Descriptor {
+	b.t.Helper()
+	desc := b.writeBlob(ispec.MediaTypeImageManifest, []byte(`{"schemaVersion": 2}`))
+	if err := os.WriteFile(blobPath(b.path, desc.Digest), []byte(`{"schemaVersion": 3}`), 0644); err != nil {
+		b.t.Fatal(err)
+	}
+	b.addToIndex(desc, tag)
+	return desc
+}
+
+// write index.json
+func (b *layoutBuilder) save() {
+	b.t.Helper()
+	data, err := json.Marshal(b.index)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(b.path, "index.json"), data, 0644); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// the fixture most tests use: two layouts under dir sharing a base image,
+// with a multi-arch index, referrers, a signature and some broken entries.
+// returns the builders so tests can look up descriptors.
+type standardFixture struct {
+	dir       string
+	apps      *layoutBuilder
+	tools     *layoutBuilder
+	web       ispec.Descriptor
+	db        ispec.Descriptor
+	sbom      ispec.Descriptor
+	signature ispec.Descriptor
+	multiArch ispec.Descriptor
+}
+
+func newStandardFixture(t *testing.T) *standardFixture {
+	t.Helper()
+	resetGlobals(t)
+	// named, so goldens don't depend on how t.TempDir numbers its dirs
+	f := &standardFixture{dir: filepath.Join(t.TempDir(), "forest")}
+
+	f.apps = newLayoutBuilder(t, filepath.Join(f.dir, "team", "apps"))
+	f.apps.addImage("base", "rootfs")
+	f.web = f.apps.addImage("web", "rootfs", "nginx", "site")
+	f.db = f.apps.addImage("db", "rootfs", "postgres")
+	f.sbom = f.apps.addArtifact("", "application/spdx+json", "web.spdx.json", `{"spdxVersion": "SPDX-2.3"}`, &f.web)
+	f.signature = f.apps.addNotarySignature(f.web)
+	f.apps.addArtifact("readme", "text/markdown", "README.md", "# hello", nil)
+	f.apps.addMissingBlob("missing")
+	f.apps.addCorruptBlob("corrupt")
+	f.apps.save()
+
+	f.tools = newLayoutBuilder(t, filepath.Join(f.dir, "tools"))
+	f.tools.addImage("builder", "rootfs", "gcc")
+	f.multiArch = f.tools.addMultiArchIndex("busybox", []ispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}, "busybox")
+	f.tools.save()
+
+	return f
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+	"github.com/urfave/cli/v2"
+)
+
+// local layouts are recorded in the known layers file like a registry named
+// for the directory they were imported from
+const layoutSourcePrefix = "oci:"
+
+func doImportKnownLayers(ctxt *cli.Context) error {
+	dirs := ctxt.Args().Slice()
+	if len(dirs) == 0 {
+		return fmt.Errorf("known-layers import needs a directory of OCI layouts")
+	}
+	out := ctxt.String("out")
+	if out == "" {
+		var err error
+		if out, err = makeKnownLayersFile(); err != nil {
+			return err
+		}
+	}
+	return importKnownLayers(dirs, newWalkOptions(ctxt), out, ctxt.Bool("prune"), os.Stdout)
+}
+
+// record the layers of every tagged image in the layouts under dirs in the
+// known layers file out, like fetching them from a registry would. each
+// layout's images are named after its path under the dir, like
+// layers/oci:bird-1.0. entries from an earlier import of a dir are replaced;
+// ones for tags that are gone are removed if prune is set and the whole dir
+// could be read.
+func importKnownLayers(dirs []string, opts *walkOptions, out string, prune bool, w io.Writer) error {
+	existing, err := Load(out)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("reading %s: %w", out, err)
+		}
+		existing = LayerNameHashEntries{}
+	}
+
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return err
+		}
+
+		// the same walk as the tree, without showing it
+		ti := addOCILayoutNodes(tview.NewTreeNode(""), abs, opts, 0)
+		refresh := registryRefresh{
+			registry:  layoutSourcePrefix + abs,
+			inScope:   func(string) bool { return true },
+			fetched:   LayerNameHashEntries{},
+			unchanged: map[string]bool{},
+			seen:      map[string]bool{},
+			failed:    map[string]bool{},
+		}
+		images := 0
+		for _, info := range layoutTaggedImages(ti) {
+			entries := layoutLayerEntries(abs, info)
+			if len(entries) == 0 {
+				continue
+			}
+			refresh.seen[repoTagKey(entries[0].Repository, entries[0].Tag)] = true
+			refresh.fetched = append(refresh.fetched, entries...)
+			images++
+		}
+
+		for _, err := range ti.errs {
+			fmt.Fprintf(w, "failed: %v\n", err)
+		}
+		var pruned int
+		existing, pruned = existing.Merge(refresh, prune && len(ti.errs) == 0)
+		fmt.Fprintf(w, "%s: %d images imported from %d layouts, %d entries pruned\n", dir, images, ti.numLayouts, pruned)
+	}
+
+	if len(existing) == 0 {
+		return fmt.Errorf("no images found to import")
+	}
+	return existing.Save(out)
+}
+
+// the tagged images of the layouts in a walk, including the images of
+// tagged indexes, under the index's tag
+func layoutTaggedImages(ti treeInfo) []imageInfo {
+	images := []imageInfo{}
+	for _, info := range ti.imageInfos {
+		if info.ref.tag != "" {
+			images = append(images, info)
+		}
+	}
+	for _, subInfo := range ti.subIndexInfos {
+		if subInfo.ref.tag == "" || len(subInfo.manifestDescriptors) == 0 {
+			continue
+		}
+		for _, desc := range subInfo.manifestDescriptors {
+			info, ok := ImageInfoMap[digestHash(desc.Digest)]
+			if !ok {
+				slog.Warn("index image not loaded", "path", subInfo.ref.layoutpath, "digest", desc.Digest)
+				continue
+			}
+			info.ref = imageref{layoutpath: subInfo.ref.layoutpath, tag: subInfo.ref.tag, hash: info.ref.hash}
+			images = append(images, info)
+		}
+	}
+	return images
+}
+
+// known layer entries for every layer of a local image. artifacts, and
+// images that couldn't be read, have none.
+func layoutLayerEntries(dir string, info imageInfo) []*LayerNameMapEntry {
+	if info.err != nil {
+		slog.Warn("not importing unreadable image", "layout", info.ref.layoutpath, "tag", info.ref.tag, "err", info.err)
+		return nil
+	}
+	if info.configBlob == nil || (info.configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig &&
+		info.configBlob.Descriptor.MediaType != MediaTypeDockerConfig) {
+		return nil
+	}
+
+	repo, err := filepath.Rel(dir, info.ref.layoutpath)
+	if err != nil || repo == "." {
+		repo = filepath.Base(info.ref.layoutpath)
+	}
+	repo = filepath.ToSlash(repo)
+
+	entries := []*LayerNameMapEntry{}
+	imported := time.Now().UTC().Truncate(time.Second)
+	count := len(info.manifest.Layers)
+	for idx, layer := range info.manifest.Layers {
+		entries = append(entries, &LayerNameMapEntry{
+			Hash:         digestHash(layer.Digest),
+			Name:         layerEntryName(repo, info.ref.tag, idx+1, count),
+			Registry:     layoutSourcePrefix + dir,
+			Repository:   repo,
+			Tag:          info.ref.tag,
+			Platform:     platformString(&info.config.Platform),
+			LayerIndex:   idx + 1,
+			LayerCount:   count,
+			ImageDigest:  info.manifestDescriptor.Digest.String(),
+			ConfigDigest: info.manifest.Config.Digest.String(),
+			DiffID:       info.diffIDHash(idx),
+			Fetched:      &imported,
+		})
+	}
+	return entries
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestImportKnownLayers(t *testing.T) {
+	f := newStandardFixture(t)
+	out := filepath.Join(t.TempDir(), "known-layers.json")
+	// an entry fetched from a registry, which importing leaves alone
+	fetched := &LayerNameMapEntry{Hash: "abc", Name: "c3/bird:1.0", Registry: "my.registry.tld", Repository: "c3/bird", Tag: "1.0"}
+	if err := (LayerNameHashEntries{fetched}).Save(out); err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(bytes.Buffer)
+	if err := importKnownLayers([]string{f.dir}, &walkOptions{ancestors: map[string]bool{}}, out, true, w); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); !strings.Contains(got, ": 6 images imported from 2 layouts, 0 entries pruned") {
+		t.Errorf("output = %q", got)
+	}
+
+	entries, err := Load(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		if e.LayerIndex == e.LayerCount && !strings.Contains(strings.Join(names, ","), e.Name) {
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	want := "c3/bird:1.0,team/apps:base,team/apps:db,team/apps:web,tools:builder,tools:busybox"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("imported images = %q, want %q", got, want)
+	}
+
+	// the imported layers name local images, offline
+	web := ImageInfoMap[digestHash(f.web.Digest)]
+	resetGlobals(t)
+	setupWellKnownLayerNames([]string{out})
+	if got := baseImageDescription(web.layerDigests, web.diffIDHashes()); got != "exactly team/apps:web" {
+		t.Errorf("web's base = %q", got)
+	}
+	if got := baseImageDescription(append(web.layerDigests[:1:1], "other"), nil); got != "team/apps:base plus one layer" {
+		t.Errorf("base of an image on rootfs = %q", got)
+	}
+
+	// importing again replaces the entries, and prunes removed layouts
+	if err := os.RemoveAll(filepath.Join(f.dir, "tools")); err != nil {
+		t.Fatal(err)
+	}
+	resetGlobals(t)
+	w.Reset()
+	if err := importKnownLayers([]string{f.dir}, &walkOptions{ancestors: map[string]bool{}}, out, true, w); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); !strings.Contains(got, ": 3 images imported from 1 layouts, 6 entries pruned") {
+		t.Errorf("output = %q", got)
+	}
+	reimported, err := Load(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reimported) != len(entries)-6 {
+		t.Errorf("expected %d entries after pruning, got %d", len(entries)-6, len(reimported))
+	}
+	if reimported[0].Name != fetched.Name {
+		t.Errorf("the registry entry wasn't kept first: %+v", reimported[0])
+	}
+}
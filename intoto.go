@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+)
+
+// in-toto attestations: statements about a subject with a predicate, like
+// SLSA provenance or an SBOM, either bare or in a DSSE envelope. build tools
+// attach them to images as artifacts. cosign's are read in cosign.go, which
+// shares these types.
+
+const (
+	MediaTypeInTotoStatement = "application/vnd.in-toto+json"
+
+	PredicateSLSAProvenanceV02 = "https://slsa.dev/provenance/v0.2"
+	PredicateSLSAProvenanceV1  = "https://slsa.dev/provenance/v1"
+
+	inTotoPredicateTypeAnnotation = "in-toto.io/predicate-type"
+)
+
+// short names of the predicate types we know, for labels
+var predicateTypeNames = map[string]string{
+	"https://slsa.dev/provenance/v0.1":                "SLSA provenance v0.1",
+	PredicateSLSAProvenanceV02:                        "SLSA provenance v0.2",
+	PredicateSLSAProvenanceV1:                         "SLSA provenance v1",
+	"https://slsa.dev/verification_summary/v1":        "SLSA verification summary",
+	PredicateSPDX:                                     "SPDX SBOM",
+	PredicateCycloneDX:                                "CycloneDX SBOM",
+	"https://cosign.sigstore.dev/attestation/vuln/v1": "vulnerability scan",
+}
+
+// a predicate type's short name, or the type itself
+func predicateTypeName(predicateType string) string {
+	if predicateType == "" {
+		return "unknown predicate"
+	}
+	if name, ok := predicateTypeNames[predicateType]; ok {
+		return name
+	}
+	return predicateType
+}
+
+// predicates longer than this many lines are cut short in the info pane
+const maxPredicateLines = 60
+
+// an in-toto statement, the payload of attestations
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	PredicateType string          `json:"predicateType"`
+	Subject       []inTotoSubject `json:"subject"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// a DSSE envelope
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// the bytes a DSSE signature signs, its pre-authentication encoding
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// is d one of the statement's subjects
+func (s *inTotoStatement) hasSubject(d digest.Digest) bool {
+	for _, subject := range s.Subject {
+		if subject.Digest[d.Algorithm().String()] == d.Encoded() {
+			return true
+		}
+	}
+	return false
+}
+
+// an in-toto digest set, like sha256:abc, in a stable order
+func formatInTotoDigest(digests map[string]string) string {
+	parts := []string{}
+	for algo, hash := range digests {
+		parts = append(parts, algo+":"+hash)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// one attestation layer of an image
+type inTotoAttestation struct {
+	predicateType string // from the statement, or the layer's annotation if we couldn't read it
+	statement     *inTotoStatement
+	envelope      bool // whether it was in a DSSE envelope
+	signatures    int  // how many the envelope has. we don't verify them.
+	warning       string
+	err           error
+}
+
+// is a layer an in-toto statement or a DSSE envelope of one
+func isInTotoLayer(layer ispec.Descriptor) bool {
+	switch layer.MediaType {
+	case MediaTypeInTotoStatement, MediaTypeDSSEEnvelope:
+		return true
+	}
+	if strings.HasPrefix(layer.MediaType, "application/vnd.in-toto.") {
+		return true
+	}
+	_, ok := layer.Annotations[inTotoPredicateTypeAnnotation]
+	return ok
+}
+
+// is this image an attestation: its type says so, or it has in-toto layers
+func isInTotoImage(info imageInfo) bool {
+	switch info.manifest.ArtifactType {
+	case MediaTypeInTotoStatement, MediaTypeDSSEEnvelope:
+		return true
+	}
+	for _, layer := range info.manifest.Layers {
+		if isInTotoLayer(layer) {
+			return true
+		}
+	}
+	return false
+}
+
+// read an image's attestations, one per in-toto layer
+func readInTotoAttestations(fetch blobFetcher, info imageInfo) []*inTotoAttestation {
+	attestations := []*inTotoAttestation{}
+	for _, layer := range info.manifest.Layers {
+		if !isInTotoLayer(layer) {
+			continue
+		}
+		att := &inTotoAttestation{predicateType: layer.Annotations[inTotoPredicateTypeAnnotation]}
+		attestations = append(attestations, att)
+
+		data, err := readArtifactBlob(fetch, layer)
+		if err != nil {
+			att.err = err
+			continue
+		}
+		if err := att.parse(data); err != nil {
+			att.err = err
+			continue
+		}
+		if subject := info.manifest.Subject; subject != nil && !att.statement.hasSubject(subject.Digest) {
+			att.warning = fmt.Sprintf("the statement isn't about this artifact's subject, %s", subject.Digest)
+		}
+	}
+	return attestations
+}
+
+// parse a statement, opening its DSSE envelope if it has one
+func (att *inTotoAttestation) parse(data []byte) error {
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.PayloadType != "" {
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			return fmt.Errorf("its DSSE payload isn't base64: %w", err)
+		}
+		att.envelope = true
+		att.signatures = len(envelope.Signatures)
+		data = payload
+	}
+
+	statement := &inTotoStatement{}
+	if err := json.Unmarshal(data, statement); err != nil {
+		return fmt.Errorf("parsing its in-toto statement: %w", err)
+	}
+	if statement.Type == "" && statement.PredicateType == "" {
+		return fmt.Errorf("it isn't an in-toto statement")
+	}
+	att.statement = statement
+	att.predicateType = statement.PredicateType
+	return nil
+}
+
+// the tree label of an attestation image, naming what it attests to
+func inTotoLabel(ref imageref, attestations []*inTotoAttestation) string {
+	names := []string{}
+	seen := map[string]bool{}
+	failed := false
+	for _, att := range attestations {
+		failed = failed || att.err != nil || att.warning != ""
+		name := predicateTypeName(att.predicateType)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	label := fmt.Sprintf("📜 attestation %s (%s)", ref.hash, strings.Join(names, ", "))
+	if ref.tag != "" {
+		label = fmt.Sprintf("📜 attestation %q (%s)", ref.tag, strings.Join(names, ", "))
+	}
+	if failed {
+		label += " ⚠️"
+	}
+	return label
+}
+
+// the attestations' statements, for the info pane
+func inTotoInfoString(attestations []*inTotoAttestation) string {
+	out := fmt.Sprintf("[yellow]# in-toto Attestations: %d\n", len(attestations))
+	for idx, att := range attestations {
+		out += fmt.Sprintf("\n[yellow]## %d: %s[white]\n", idx+1, tview.Escape(predicateTypeName(att.predicateType)))
+		if att.err != nil {
+			out += fmt.Sprintf("[red]couldn't read it: %s[white]\n", tview.Escape(att.err.Error()))
+			continue
+		}
+		if att.warning != "" {
+			out += fmt.Sprintf("[orange]%s[white]\n", tview.Escape(att.warning))
+		}
+		if att.envelope {
+			out += fmt.Sprintf("[green]envelope: [white]DSSE, %d signatures (not verified)\n", att.signatures)
+		}
+		out += fmt.Sprintf("[green]predicate type: [white]%s\n", tview.Escape(att.predicateType))
+		for _, subject := range att.statement.Subject {
+			out += fmt.Sprintf("[green]subject: [white]%s %s\n", tview.Escape(subject.Name), formatInTotoDigest(subject.Digest))
+		}
+		out += predicateInfoString(att.statement)
+	}
+	return out + "\n"
+}
+
+// a statement's predicate: a structured view of SLSA provenance or an SBOM,
+// otherwise the JSON, indented
+func predicateInfoString(statement *inTotoStatement) string {
+	if len(statement.Predicate) == 0 {
+		return ""
+	}
+	if doc := statementSBOM(statement); doc != nil {
+		return doc.infoString()
+	}
+	provenance, err := parseSLSAProvenance(statement)
+	if err != nil {
+		return fmt.Sprintf("[red]couldn't read its provenance: %s[white]\n", tview.Escape(err.Error()))
+	}
+	if provenance != nil {
+		return provenance.infoString()
+	}
+	return "[green]predicate:[white]\n" + indentJSON(statement.Predicate, maxPredicateLines)
+}
+
+// JSON indented for display, cut to at most maxLines lines
+func indentJSON(data json.RawMessage, maxLines int) string {
+	buf := new(bytes.Buffer)
+	if err := json.Indent(buf, data, "  ", "  "); err != nil {
+		return tview.Escape(string(data)) + "\n"
+	}
+	return tview.Escape(cutLines("  "+buf.String(), maxLines)) + "\n"
+}
+
+// the first maxLines lines of text, saying how many more there were
+func cutLines(text string, maxLines int) string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) > maxLines {
+		lines = append(lines[:maxLines], fmt.Sprintf("... %d more lines", len(lines)-maxLines))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SLSA provenance, from either the v0.2 or v1 layout
+type slsaProvenance struct {
+	builder      string
+	buildType    string
+	invocationID string
+	started      *time.Time
+	finished     *time.Time
+	configSource string // where the build was defined, in v0.2
+	entryPoint   string
+	parameters   json.RawMessage // what the build was given
+	materials    []slsaMaterial  // what went into it
+}
+
+type slsaMaterial struct {
+	Name   string            `json:"name"`
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// parse a statement's predicate if it's SLSA provenance we can read, or
+// return nil
+func parseSLSAProvenance(statement *inTotoStatement) (*slsaProvenance, error) {
+	switch statement.PredicateType {
+	case PredicateSLSAProvenanceV02:
+		var predicate struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+			BuildType  string `json:"buildType"`
+			Invocation struct {
+				ConfigSource struct {
+					URI        string            `json:"uri"`
+					Digest     map[string]string `json:"digest"`
+					EntryPoint string            `json:"entryPoint"`
+				} `json:"configSource"`
+				Parameters json.RawMessage `json:"parameters"`
+			} `json:"invocation"`
+			Metadata struct {
+				BuildInvocationID string     `json:"buildInvocationId"`
+				BuildStartedOn    *time.Time `json:"buildStartedOn"`
+				BuildFinishedOn   *time.Time `json:"buildFinishedOn"`
+			} `json:"metadata"`
+			Materials []slsaMaterial `json:"materials"`
+		}
+		if err := json.Unmarshal(statement.Predicate, &predicate); err != nil {
+			return nil, err
+		}
+		source := predicate.Invocation.ConfigSource
+		configSource := source.URI
+		if len(source.Digest) > 0 {
+			configSource += " " + formatInTotoDigest(source.Digest)
+		}
+		return &slsaProvenance{
+			builder:      predicate.Builder.ID,
+			buildType:    predicate.BuildType,
+			invocationID: predicate.Metadata.BuildInvocationID,
+			started:      predicate.Metadata.BuildStartedOn,
+			finished:     predicate.Metadata.BuildFinishedOn,
+			configSource: configSource,
+			entryPoint:   source.EntryPoint,
+			parameters:   predicate.Invocation.Parameters,
+			materials:    predicate.Materials,
+		}, nil
+
+	case PredicateSLSAProvenanceV1:
+		var predicate struct {
+			BuildDefinition struct {
+				BuildType            string          `json:"buildType"`
+				ExternalParameters   json.RawMessage `json:"externalParameters"`
+				ResolvedDependencies []slsaMaterial  `json:"resolvedDependencies"`
+			} `json:"buildDefinition"`
+			RunDetails struct {
+				Builder struct {
+					ID      string            `json:"id"`
+					Version map[string]string `json:"version"`
+				} `json:"builder"`
+				Metadata struct {
+					InvocationID string     `json:"invocationId"`
+					StartedOn    *time.Time `json:"startedOn"`
+					FinishedOn   *time.Time `json:"finishedOn"`
+				} `json:"metadata"`
+			} `json:"runDetails"`
+		}
+		if err := json.Unmarshal(statement.Predicate, &predicate); err != nil {
+			return nil, err
+		}
+		builder := predicate.RunDetails.Builder
+		builderID := builder.ID
+		if len(builder.Version) > 0 {
+			builderID += " (" + formatInTotoDigest(builder.Version) + ")"
+		}
+		return &slsaProvenance{
+			builder:      builderID,
+			buildType:    predicate.BuildDefinition.BuildType,
+			invocationID: predicate.RunDetails.Metadata.InvocationID,
+			started:      predicate.RunDetails.Metadata.StartedOn,
+			finished:     predicate.RunDetails.Metadata.FinishedOn,
+			parameters:   predicate.BuildDefinition.ExternalParameters,
+			materials:    predicate.BuildDefinition.ResolvedDependencies,
+		}, nil
+	}
+	return nil, nil
+}
+
+func (p *slsaProvenance) infoString() string {
+	out := "\n[yellow]### Provenance[white]\n"
+	fields := [][2]string{
+		{"builder", p.builder},
+		{"build type", p.buildType},
+		{"invocation", p.invocationID},
+		{"config source", p.configSource},
+		{"entry point", p.entryPoint},
+	}
+	if p.started != nil {
+		fields = append(fields, [2]string{"started", p.started.UTC().Format(time.RFC3339)})
+	}
+	if p.finished != nil {
+		fields = append(fields, [2]string{"finished", p.finished.UTC().Format(time.RFC3339)})
+	}
+	for _, field := range fields {
+		if field[1] != "" {
+			out += fmt.Sprintf("[green]%s: [white]%s\n", field[0], tview.Escape(field[1]))
+		}
+	}
+	if len(p.parameters) > 0 && string(p.parameters) != "null" {
+		out += "[green]parameters:[white]\n" + indentJSON(p.parameters, maxPredicateLines)
+	}
+
+	if len(p.materials) > 0 {
+		out += fmt.Sprintf("\n[yellow]### %d materials[white]\n", len(p.materials))
+		buf := new(bytes.Buffer)
+		tw := tabwriter.NewWriter(buf, 1, 1, 2, ' ', 0)
+		fmt.Fprintln(tw, "[blue]uri[white]\tdigest\t")
+		for _, material := range p.materials {
+			uri := material.URI
+			if uri == "" {
+				uri = material.Name
+			}
+			fmt.Fprintf(tw, "[blue]%s[white]\t%s\t\n", tview.Escape(uri), formatInTotoDigest(material.Digest))
+		}
+		tw.Flush()
+		out += buf.String()
+	}
+	return out
+}
+
+// what to search attestations by: their predicate types and builders
+func inTotoSearchStrings(attestations []*inTotoAttestation) []string {
+	components := []string{}
+	for _, att := range attestations {
+		components = append(components, att.predicateType, predicateTypeName(att.predicateType))
+		if att.statement == nil {
+			continue
+		}
+		if provenance, err := parseSLSAProvenance(att.statement); err == nil && provenance != nil {
+			components = append(components, provenance.builder, provenance.buildType)
+		}
+	}
+	return components
+}
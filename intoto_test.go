@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+)
+
+const testProvenanceV02 = `{
+	"builder": {"id": "https://github.com/actions/runner"},
+	"buildType": "https://github.com/slsa-framework/slsa-github-generator/container@v1",
+	"invocation": {
+		"configSource": {"uri": "git+https://github.com/acme/web@refs/heads/main", "digest": {"sha1": "4b825dc6"}, "entryPoint": ".github/workflows/build.yml"},
+		"parameters": {"platform": "linux/amd64"}
+	},
+	"metadata": {"buildInvocationId": "run-42", "buildStartedOn": "2023-03-14T15:00:00Z", "buildFinishedOn": "2023-03-14T15:09:26Z"},
+	"materials": [
+		{"uri": "pkg:docker/alpine@3.17", "digest": {"sha256": "aaaa"}},
+		{"uri": "git+https://github.com/acme/web", "digest": {"sha1": "4b825dc6"}}
+	]
+}`
+
+const testProvenanceV1 = `{
+	"buildDefinition": {
+		"buildType": "https://mobyproject.org/buildkit@v1",
+		"externalParameters": {"request": {"frontend": "dockerfile.v0"}},
+		"resolvedDependencies": [{"uri": "pkg:docker/golang@1.21", "digest": {"sha256": "bbbb"}}]
+	},
+	"runDetails": {
+		"builder": {"id": "https://ci.example.com/buildkit", "version": {"buildkit": "v0.12.0"}},
+		"metadata": {"invocationId": "build-7", "startedOn": "2023-03-14T15:00:00Z"}
+	}
+}`
+
+// an in-toto statement about subject, bare or in a DSSE envelope
+func inTotoLayerData(t *testing.T, subject ispec.Descriptor, predicateType, predicate string, dsse bool) []byte {
+	t.Helper()
+	statement, err := json.Marshal(inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v0.1",
+		PredicateType: predicateType,
+		Subject:       []inTotoSubject{{Name: "registry.example.com/web", Digest: map[string]string{"sha256": subject.Digest.Encoded()}}},
+		Predicate:     json.RawMessage(predicate),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dsse {
+		return statement
+	}
+	envelope, _ := json.Marshal(map[string]interface{}{
+		"payloadType": MediaTypeInTotoStatement,
+		"payload":     base64.StdEncoding.EncodeToString(statement),
+		"signatures":  []map[string]string{{"keyid": "", "sig": "c2ln"}},
+	})
+	return envelope
+}
+
+// add an attestation referrer of subject with a layer of each of data
+func (b *layoutBuilder) addAttestation(subject ispec.Descriptor, mediaType string, data ...[]byte) ispec.Descriptor {
+	b.t.Helper()
+	layers := []ispec.Descriptor{}
+	for _, d := range data {
+		layers = append(layers, b.writeBlob(mediaType, d))
+	}
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: mediaType,
+		Config:       b.writeBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       layers,
+		Subject:      &subject,
+	}
+	desc := b.writeJSONBlob(ispec.MediaTypeImageManifest, manifest)
+	desc.ArtifactType = mediaType
+	b.addToIndex(desc, "")
+	return desc
+}
+
+func TestInTotoAttestation(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType string
+		data      func(t *testing.T, web ispec.Descriptor) [][]byte
+		label     string
+		info      []string
+	}{
+		{
+			name:      "SLSA v0.2",
+			mediaType: MediaTypeInTotoStatement,
+			data: func(t *testing.T, web ispec.Descriptor) [][]byte {
+				return [][]byte{inTotoLayerData(t, web, PredicateSLSAProvenanceV02, testProvenanceV02, false)}
+			},
+			label: "(SLSA provenance v0.2)",
+			info: []string{
+				"builder: [white]https://github.com/actions/runner",
+				"config source: [white]git+https://github.com/acme/web@refs/heads/main sha1:4b825dc6",
+				"entry point: [white].github/workflows/build.yml",
+				"invocation: [white]run-42",
+				"finished: [white]2023-03-14T15:09:26Z",
+				`"platform": "linux/amd64"`,
+				"### 2 materials",
+				"[blue]pkg:docker/alpine@3.17[white]           sha256:aaaa",
+			},
+		},
+		{
+			name:      "SLSA v1 and an SBOM in DSSE envelopes",
+			mediaType: MediaTypeDSSEEnvelope,
+			data: func(t *testing.T, web ispec.Descriptor) [][]byte {
+				return [][]byte{
+					inTotoLayerData(t, web, PredicateSLSAProvenanceV1, testProvenanceV1, true),
+					inTotoLayerData(t, web, "https://spdx.dev/Document", `{"spdxVersion": "SPDX-2.3"}`, true),
+				}
+			},
+			label: "(SLSA provenance v1, SPDX SBOM)",
+			info: []string{
+				"envelope: [white]DSSE, 1 signatures (not verified)",
+				"builder: [white]https://ci.example.com/buildkit (buildkit:v0.12.0)",
+				"build type: [white]https://mobyproject.org/buildkit@v1",
+				`"frontend": "dockerfile.v0"`,
+				"### 1 materials",
+				"## 2: SPDX SBOM",
+				"format: [white]SPDX-2.3",
+			},
+		},
+		{
+			name:      "about another image",
+			mediaType: MediaTypeInTotoStatement,
+			data: func(t *testing.T, web ispec.Descriptor) [][]byte {
+				other := ispec.Descriptor{Digest: digest.FromString("other")}
+				return [][]byte{inTotoLayerData(t, other, "https://example.com/custom/v1", `{"ok": true}`, false)}
+			},
+			label: "(https://example.com/custom/v1) ⚠️",
+			info:  []string{"the statement isn't about this artifact's subject", `"ok": true`},
+		},
+		{
+			name:      "not a statement",
+			mediaType: MediaTypeInTotoStatement,
+			data: func(t *testing.T, web ispec.Descriptor) [][]byte {
+				return [][]byte{[]byte(`{"hello": "world"}`)}
+			},
+			label: "(unknown predicate) ⚠️",
+			info:  []string{"couldn't read it: it isn't an in-toto statement"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetGlobals(t)
+			dir := t.TempDir()
+			b := newLayoutBuilder(t, dir)
+			web := b.addImage("web", "rootfs")
+			desc := b.addAttestation(web, tt.mediaType, tt.data(t, web)...)
+			b.save()
+			root, _ := loadFixtureTree(t, &standardFixture{dir: dir})
+
+			// it's shown under the image it's about
+			var label string
+			for _, node := range getAllChildren(root) {
+				if node.GetText() == `🏷  image "web"` {
+					label = node.GetChildren()[0].GetText()
+				}
+			}
+			if !strings.HasPrefix(label, "📜 attestation ") || !strings.HasSuffix(label, tt.label) {
+				t.Errorf("label = %q, want one ending in %q", label, tt.label)
+			}
+
+			info := ImageInfoMap[digestHash(desc.Digest)]
+			got := getImageInfoString(info.ref, info, 0)
+			for _, want := range tt.info {
+				if !strings.Contains(got, tview.Escape(want)) && !strings.Contains(got, want) {
+					t.Errorf("info doesn't have %q:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestInTotoSearch(t *testing.T) {
+	resetGlobals(t)
+	dir := t.TempDir()
+	b := newLayoutBuilder(t, dir)
+	web := b.addImage("web", "rootfs")
+	desc := b.addAttestation(web, MediaTypeInTotoStatement, inTotoLayerData(t, web, PredicateSLSAProvenanceV02, testProvenanceV02, false))
+	b.save()
+	loadFixtureTree(t, &standardFixture{dir: dir})
+
+	haystack := strings.Join(ImageInfoMap[digestHash(desc.Digest)].ref.searchString(), " ")
+	for _, want := range []string{"SLSA provenance v0.2", "https://github.com/actions/runner"} {
+		if !strings.Contains(haystack, want) {
+			t.Errorf("search string doesn't have %q: %s", want, haystack)
+		}
+	}
+}
+
+func TestRemoteInTotoAttestation(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	image := fr.addImageWithBlobs("app", "1.0", "base")
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: MediaTypeDSSEEnvelope,
+		Config:       fr.addBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       []ispec.Descriptor{fr.addBlob(MediaTypeDSSEEnvelope, inTotoLayerData(t, image, PredicateSLSAProvenanceV1, testProvenanceV1, true))},
+		Subject:      &image,
+	}
+	fr.addManifest("app", "", ispec.MediaTypeImageManifest, manifest)
+
+	_, node := newTestRemoteRoot(t, fr, "/app:1.0")
+	loadRemote(t, node)
+	if got := node.GetChildren()[0].GetText(); !strings.HasPrefix(got, "📜 attestation ") || !strings.HasSuffix(got, "(SLSA provenance v1)") {
+		t.Errorf("attestation node = %q", got)
+	}
+}
@@ -1,98 +1,531 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
-	"os/user"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
 )
 
-// a hash->name pair to read in from the known layers json
+// a hash->name pair to read in from the known layers json. entries fetched
+// from a registry, or imported from local layouts, also record where they
+// came from, so refreshes can merge them and skip tags that haven't changed.
 type LayerNameMapEntry struct {
 	Hash string `json:"hash"`
 	Name string `json:"name"`
+
+	Registry       string `json:"registry,omitempty"` // or oci:<dir> for imported layouts
+	Repository     string `json:"repository,omitempty"`
+	Tag            string `json:"tag,omitempty"`
+	ManifestDigest string `json:"manifestDigest,omitempty"` // what the tag pointed to, maybe an index
+	Platform       string `json:"platform,omitempty"`       // like linux/arm64/v8, when known
+
+	// where the layer is in the image, counting from 1 at the bottom, and
+	// which image manifest and config it is from
+	LayerIndex   int    `json:"layerIndex,omitempty"`
+	LayerCount   int    `json:"layerCount,omitempty"`
+	ImageDigest  string `json:"imageDigest,omitempty"`
+	ConfigDigest string `json:"configDigest,omitempty"`
+	DiffID       string `json:"diffID,omitempty"` // the uncompressed layer's hash, the same however it's compressed
+
+	Fetched     *time.Time `json:"fetched,omitempty"`     // when it was fetched or imported
+	Description string     `json:"description,omitempty"` // anything else worth saying about it
+
+	source string // the file the entry was read from
+}
+
+// a platform like linux/arm64/v8
+func platformString(p *ispec.Platform) string {
+	if p == nil || p.OS == "" {
+		return ""
+	}
+	platform := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		platform += "/" + p.Variant
+	}
+	return platform
+}
+
+// the name of a layer of repo:tag. the top layer is named for the whole
+// image; the others get their position, like c3/bird:1.0.56@layer3/5
+func layerEntryName(repo, tag string, index, count int) string {
+	name := repoTagKey(repo, tag)
+	if index == count {
+		return name
+	}
+	return fmt.Sprintf("%s@layer%d/%d", name, index, count)
+}
+
+// the image an entry is a layer of
+func (e *LayerNameMapEntry) imageName() string {
+	if e.Repository == "" {
+		name, _, _ := strings.Cut(e.Name, "@")
+		return name
+	}
+	return repoTagKey(e.Repository, e.Tag)
 }
 
 // global map of layer hashes to known names
 var LayerNameMap = map[string][]string{}
 
-// todo: be nice if this did a smart shortening, like replacing names with common prefixes and tags like
-// foo.com/{imageone,imagetwo}:commontag
+// global map of layer hashes to the known layers file entries for them
+var KnownLayerEntries = map[string][]*LayerNameMapEntry{}
 
-func getShortStringForNames(names []string) []string {
-	// map from tag-> names
-	namesWithCommonTags := map[string][]string{}
-	truncatedLayerNames := []string{}
+// global map of diffID hashes to the known layers file entries for them
+var KnownDiffIDEntries = map[string][]*LayerNameMapEntry{}
+
+// global map of config digests to the known layers file entries of the
+// images with that config
+var KnownConfigEntries = map[string][]*LayerNameMapEntry{}
+
+// add an entry unless one for the same layer and name was already added,
+// e.g. from a source with higher precedence. returns whether it was added.
+func addKnownLayerEntry(e *LayerNameMapEntry) bool {
+	for _, existing := range KnownLayerEntries[e.Hash] {
+		if existing.Name == e.Name {
+			return false
+		}
+	}
+	LayerNameMap[e.Hash] = append(LayerNameMap[e.Hash], e.Name)
+	KnownLayerEntries[e.Hash] = append(KnownLayerEntries[e.Hash], e)
+	if e.DiffID != "" {
+		KnownDiffIDEntries[e.DiffID] = append(KnownDiffIDEntries[e.DiffID], e)
+	}
+	if e.ConfigDigest != "" {
+		KnownConfigEntries[e.ConfigDigest] = append(KnownConfigEntries[e.ConfigDigest], e)
+	}
+	return true
+}
 
+// the known images with this config, which are the same image as far as
+// what's in it goes, however its layers are compressed
+func knownImagesForConfig(configDigest string) []string {
+	names := []string{}
+	for _, e := range KnownConfigEntries[configDigest] {
+		if !slices.Contains(names, e.imageName()) {
+			names = append(names, e.imageName())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the known entries for a layer: those for its blob, then those for the same
+// content compressed differently, found by its diffID if it's known
+func knownEntriesForLayer(layerDigest, diffID string) []*LayerNameMapEntry {
+	entries := append([]*LayerNameMapEntry{}, KnownLayerEntries[layerDigest]...)
+	if diffID == "" {
+		return entries
+	}
+	for _, e := range KnownDiffIDEntries[diffID] {
+		if e.Hash != layerDigest {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// the names of a layer, by its blob's hash or its diffID, or "?"
+func getNamesForLayer(layerDigest, diffID string) []string {
+	names := append([]string{}, LayerNameMap[layerDigest]...)
+	for _, e := range knownEntriesForLayer(layerDigest, diffID) {
+		if !slices.Contains(names, e.Name) {
+			names = append(names, e.Name)
+		}
+	}
+	if len(names) == 0 {
+		return []string{"?"}
+	}
+	return names
+}
+
+// the diffID of the layer at idx, or "" if it isn't known. diffIDs may be
+// shorter than the layers, or nil, if they aren't known.
+func diffIDAt(diffIDs []string, idx int) string {
+	if idx < len(diffIDs) {
+		return diffIDs[idx]
+	}
+	return ""
+}
+
+// a table of the known names of these layers and which source each came
+// from, or "" if none of them are known
+func knownNameSources(layerDigests, diffIDs []string) string {
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 1, 1, 2, ' ', 0)
+	for idx, layerDigest := range layerDigests {
+		for _, e := range knownEntriesForLayer(layerDigest, diffIDAt(diffIDs, idx)) {
+			source := e.source
+			if e.Hash != layerDigest {
+				source += " (same diffID)"
+			}
+			row := fmt.Sprintf("[blue]%s[white]\t%s\t%s", shortHash(layerDigest), tview.Escape(e.Name), tview.Escape(source))
+			if e.Description != "" {
+				row += "\t" + tview.Escape(e.Description)
+			}
+			fmt.Fprintln(tw, row)
+		}
+	}
+	tw.Flush()
+	return buf.String()
+}
+
+// find the known images an image with these layers is built on: those whose
+// layers are the same as the image's bottom layers, by blob or, if they were
+// compressed differently, by diffID. returns their names, and how many
+// layers the image adds on top of them.
+func findBaseImages(layerDigests, diffIDs []string) ([]string, int) {
+	for count := len(layerDigests); count > 0; count-- {
+		names := []string{}
+		for _, top := range knownEntriesForLayer(layerDigests[count-1], diffIDAt(diffIDs, count-1)) {
+			if top.LayerIndex != count || top.LayerCount != count {
+				continue
+			}
+			if !hasKnownLowerLayers(top, layerDigests[:count-1], diffIDs) {
+				continue
+			}
+			if !slices.Contains(names, top.imageName()) {
+				names = append(names, top.imageName())
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			return names, len(layerDigests) - count
+		}
+	}
+	return nil, 0
+}
+
+// whether the layers below the top layer of a known image are known to be
+// the image's layers, in order
+func hasKnownLowerLayers(top *LayerNameMapEntry, lower, diffIDs []string) bool {
+	for idx, layerDigest := range lower {
+		found := false
+		for _, e := range knownEntriesForLayer(layerDigest, diffIDAt(diffIDs, idx)) {
+			if e.ImageDigest == top.ImageDigest && e.LayerIndex == idx+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// which known image an image is built on, like "c3/bird:1.0.56 plus 2
+// layers", or ""
+func baseImageDescription(layerDigests, diffIDs []string) string {
+	names, extra := findBaseImages(layerDigests, diffIDs)
+	switch {
+	case len(names) == 0:
+		return ""
+	case extra == 0:
+		return fmt.Sprintf("exactly %s", strings.Join(names, ", "))
+	case extra == 1:
+		return fmt.Sprintf("%s plus one layer", strings.Join(names, ", "))
+	default:
+		return fmt.Sprintf("%s plus %d layers", strings.Join(names, ", "), extra)
+	}
+}
+
+// shorten a layer's names by factoring out what they have in common: tags of
+// the same repository are collapsed, with runs of versions as ranges, like
+// c3/bird:1.0.{56..60}, and repositories with the same tags share their
+// common path, like foo.com/{imageone,imagetwo}:commontag
+func getShortStringForNames(names []string) []string {
 	if len(names) == 1 {
 		return names
 	}
+
+	// repo and layer position -> tags
+	type repoKey struct{ repo, position string }
+	tagsByRepo := map[repoKey][]string{}
 	for _, name := range names {
-		baseName := filepath.Base(name)
-		ss := strings.Split(baseName, ":")
-		if len(ss) == 2 {
-			namesWithCommonTags[ss[1]] = append(namesWithCommonTags[ss[1]], ss[0])
-		} else {
-			namesWithCommonTags[""] = append(namesWithCommonTags[""], baseName)
+		repo, tag, position := splitLayerName(name)
+		key := repoKey{repo, position}
+		if !slices.Contains(tagsByRepo[key], tag) {
+			tagsByRepo[key] = append(tagsByRepo[key], tag)
+		}
+	}
+
+	// what follows the repo -> repos
+	reposBySuffix := map[string][]string{}
+	for key, tags := range tagsByRepo {
+		for _, tags := range collapseTags(tags) {
+			suffix := ""
+			if tags != "" {
+				suffix = ":" + tags
+			}
+			if key.position != "" {
+				suffix += "@" + key.position
+			}
+			reposBySuffix[suffix] = append(reposBySuffix[suffix], key.repo)
 		}
 	}
 
-	for tag, names := range namesWithCommonTags {
-		tagstr := fmt.Sprintf("{%s}%s", strings.Join(names, ","), tag)
-		truncatedLayerNames = append(truncatedLayerNames, tagstr)
+	shortNames := []string{}
+	for suffix, repos := range reposBySuffix {
+		shortNames = append(shortNames, factorRepos(repos)+suffix)
 	}
+	sort.Strings(shortNames)
+	return shortNames
+}
 
-	return truncatedLayerNames
+// split a name like c3/bird:1.0.56@layer3/5 into its repo, tag and layer
+// position. the tag is "" if there isn't one; a registry's port isn't one.
+func splitLayerName(name string) (repo, tag, position string) {
+	name, position, _ = strings.Cut(name, "@")
+	idx := strings.LastIndex(name, ":")
+	if idx < 0 || strings.Contains(name[idx+1:], "/") {
+		return name, "", position
+	}
+	return name[:idx], name[idx+1:], position
 }
 
-func getNamesForHash(digest string) []string {
-	layerNames, ok := LayerNameMap[digest]
-	if !ok {
-		layerNames = []string{"?"}
+// collapse tags that differ only in a trailing number, like 1.0.56, 1.0.57
+// and 1.0.58, into 1.0.{56..58}. other tags are left as they are.
+func collapseTags(tags []string) []string {
+	numbersByPrefix := map[string][]int{}
+	collapsed := []string{}
+	for _, tag := range tags {
+		prefix, number, ok := splitTrailingNumber(tag)
+		if !ok {
+			collapsed = append(collapsed, tag)
+			continue
+		}
+		numbersByPrefix[prefix] = append(numbersByPrefix[prefix], number)
 	}
-	return layerNames
+
+	for prefix, numbers := range numbersByPrefix {
+		if len(numbers) == 1 {
+			collapsed = append(collapsed, prefix+strconv.Itoa(numbers[0]))
+			continue
+		}
+		slices.Sort(numbers)
+		collapsed = append(collapsed, prefix+"{"+strings.Join(numberRanges(numbers), ",")+"}")
+	}
+	sort.Strings(collapsed)
+	return collapsed
 }
 
-func getUserOrSudoUserHomedir() string {
-	username := os.Getenv("SUDO_USER")
-	if username == "" {
-		username = os.Getenv("USER")
+// split a tag like 1.0.56 into 1.0. and 56. numbers with leading zeros
+// aren't split, since they wouldn't be written back the same.
+func splitTrailingNumber(tag string) (string, int, bool) {
+	idx := len(tag)
+	for idx > 0 && tag[idx-1] >= '0' && tag[idx-1] <= '9' {
+		idx--
 	}
-	u, err := user.Lookup(username)
-	if err != nil {
-		panic(err)
+	number, err := strconv.Atoi(tag[idx:])
+	if err != nil || strconv.Itoa(number) != tag[idx:] {
+		return "", 0, false
+	}
+	return tag[:idx], number, true
+}
+
+// sorted numbers as runs like 56..60, or single numbers. runs of two are
+// just listed.
+func numberRanges(numbers []int) []string {
+	ranges := []string{}
+	for start := 0; start < len(numbers); {
+		end := start
+		for end+1 < len(numbers) && numbers[end+1] <= numbers[end]+1 {
+			end++
+		}
+		switch {
+		case numbers[end]-numbers[start] >= 2:
+			ranges = append(ranges, fmt.Sprintf("%d..%d", numbers[start], numbers[end]))
+		case numbers[end] != numbers[start]:
+			ranges = append(ranges, strconv.Itoa(numbers[start]), strconv.Itoa(numbers[end]))
+		default:
+			ranges = append(ranges, strconv.Itoa(numbers[start]))
+		}
+		start = end + 1
+	}
+	return ranges
+}
+
+// repos with the path they have in common factored out, like
+// foo.com/{imageone,imagetwo}
+func factorRepos(repos []string) string {
+	if len(repos) == 1 {
+		return repos[0]
+	}
+	sort.Strings(repos)
+	prefix := repos[0]
+	for _, repo := range repos[1:] {
+		for !strings.HasPrefix(repo, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	// only whole path components
+	prefix = prefix[:strings.LastIndex(prefix, "/")+1]
+
+	rests := []string{}
+	for _, repo := range repos {
+		rests = append(rests, strings.TrimPrefix(repo, prefix))
+	}
+	return prefix + "{" + strings.Join(rests, ",") + "}"
+}
+
+// join shortened names, leaving out the ones that don't fit in width, like
+// "c3/bird:1.0.{56..60},c3/fish:2.1 +3 more". width 0 is unlimited.
+func fitNames(names []string, width int) string {
+	all := strings.Join(names, ",")
+	if width <= 0 || utf8.RuneCountInString(all) <= width {
+		return all
+	}
+	for shown := len(names) - 1; shown > 1; shown-- {
+		fitted := fmt.Sprintf("%s +%d more", strings.Join(names[:shown], ","), len(names)-shown)
+		if utf8.RuneCountInString(fitted) <= width {
+			return fitted
+		}
 	}
-	return u.HomeDir
+	if len(names) == 1 {
+		return all
+	}
+	return fmt.Sprintf("%s +%d more", names[0], len(names)-1)
+}
+
+// a table with a column of layers' names. names that don't fit in what the
+// other columns leave of the pane are cut short, with a count of the ones
+// left out; the layer's info pane lists them all.
+type namesTable struct {
+	rows     [][]string
+	names    [][]string // each row's shortened names, nil to keep its cell
+	namesCol int
 }
 
-func getKnowLayersFilename() string {
-	userHome := getUserOrSudoUserHomedir()
-	return filepath.Join(userHome, ".cache/ociv/known-layers.json")
+func (nt *namesTable) add(row []string, names []string) {
+	nt.rows = append(nt.rows, row)
+	nt.names = append(nt.names, names)
 }
 
-func makeCacheDir() {
-	userHome := getUserOrSudoUserHomedir()
-	cacheDir := filepath.Join(userHome, ".cache/ociv")
-	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(cacheDir, 0755); err != nil {
-			panic(err)
+// the rows, with names fitted to what's left of width after the widest cell
+// of each other column, and padding after each. the last column is free
+// text, like a command, that's left to run over. width 0 is unlimited.
+func (nt *namesTable) fit(width, padding int) [][]string {
+	namesWidth := 0
+	if width > 0 {
+		used := 0
+		for col := 0; col < len(nt.rows[0])-1; col++ {
+			if col == nt.namesCol {
+				continue
+			}
+			widest := 0
+			for _, row := range nt.rows {
+				widest = max(widest, utf8.RuneCountInString(row[col]))
+			}
+			used += widest + padding
+		}
+		namesWidth = max(width-used-padding, 1)
+	}
+	rows := [][]string{}
+	for idx, row := range nt.rows {
+		if nt.names[idx] != nil {
+			row = slices.Clone(row)
+			row[nt.namesCol] = fitNames(nt.names[idx], namesWidth)
 		}
+		rows = append(rows, row)
 	}
+	return rows
 }
 
-func setupWellKnownLayerNames() {
-	fname := getKnowLayersFilename()
-	entries, err := Load(fname)
+// write the table for a tabwriter with padding between columns
+func (nt *namesTable) write(w io.Writer, width, padding int) {
+	for _, row := range nt.fit(width, padding) {
+		fmt.Fprintln(w, strings.Join(row, "\t")+"\t")
+	}
+}
 
+// the known layers file fetching writes to, in the cache dir
+func getKnowLayersFilename() (string, error) {
+	cacheDir, err := getCacheDir()
 	if err != nil {
-		log.Printf("WARN: can't read %s: %s", fname, err.Error())
+		return "", err
+	}
+	return filepath.Join(cacheDir, "known-layers.json"), nil
+}
 
-		return
+// the known layers file, with the cache dir made for writing it
+func makeKnownLayersFile() (string, error) {
+	if err := makeCacheDir(); err != nil {
+		return "", err
 	}
+	return getKnowLayersFilename()
+}
 
-	for _, e := range entries {
-		LayerNameMap[e.Hash] = append(LayerNameMap[e.Hash], e.Name)
+// where to read known layer names from, highest precedence first: the
+// --known-layers flags, then the paths in $OCIV_KNOWN_LAYERS, then the file
+// fetch writes to
+func knownLayersSources(flags []string) []string {
+	sources := append([]string{}, flags...)
+	sources = append(sources, filepath.SplitList(os.Getenv("OCIV_KNOWN_LAYERS"))...)
+	fname, err := getKnowLayersFilename()
+	if err != nil {
+		slog.Warn("not reading the fetched known layers", "err", err)
+		return sources
+	}
+	return append(sources, fname)
+}
+
+// the known layers files of a source: the file itself, or the *.json files
+// in a directory, in name order
+func knownLayersFiles(source string) ([]string, error) {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{source}, nil
+	}
+	return filepath.Glob(filepath.Join(source, "*.json"))
+}
+
+// read the known layer names from sources, in order of precedence. a name
+// for a layer that an earlier source already gave is skipped.
+func setupWellKnownLayerNames(sources []string) {
+	read := map[string]bool{}
+	for _, source := range sources {
+		files, err := knownLayersFiles(source)
+		if err != nil {
+			slog.Warn("can't read known layers source", "source", source, "err", err)
+			continue
+		}
+		for _, fname := range files {
+			if abs, err := filepath.Abs(fname); err == nil {
+				if read[abs] {
+					continue
+				}
+				read[abs] = true
+			}
+
+			entries, err := Load(fname)
+			if err != nil {
+				slog.Warn("can't read known layers file", "file", fname, "err", err)
+				continue
+			}
+			added := 0
+			for _, e := range entries {
+				e.source = fname
+				if addKnownLayerEntry(e) {
+					added++
+				}
+			}
+			slog.Info("read known layers file", "file", fname, "entries", len(entries), "added", added)
+		}
 	}
 }
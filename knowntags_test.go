@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+)
+
+// add known entries for every layer of an image, whose diffIDs are the
+// layers' names with "diff-" in front
+func addKnownImage(repo, tag, imageDigest string, layers ...string) {
+	for idx, layer := range layers {
+		addKnownLayerEntry(&LayerNameMapEntry{
+			Hash:        layer,
+			DiffID:      "diff-" + layer,
+			Name:        layerEntryName(repo, tag, idx+1, len(layers)),
+			Repository:  repo,
+			Tag:         tag,
+			LayerIndex:  idx + 1,
+			LayerCount:  len(layers),
+			ImageDigest: imageDigest,
+		})
+	}
+}
+
+func TestFindBaseImages(t *testing.T) {
+	resetGlobals(t)
+	addKnownImage("c3/base", "1.0", "sha256:base", "a", "b")
+	addKnownImage("c3/bird", "1.0.56", "sha256:bird", "a", "b", "c")
+	addKnownImage("c3/bird", "latest", "sha256:bird", "a", "b", "c")
+	// the same top layer on a different stack isn't a match
+	addKnownImage("c3/other", "1.0", "sha256:other", "x", "c")
+
+	tests := []struct {
+		layers  []string
+		diffIDs []string
+		want    string
+	}{
+		{[]string{"a", "b", "c"}, nil, "exactly c3/bird:1.0.56, c3/bird:latest"},
+		{[]string{"a", "b", "c", "d", "e"}, nil, "c3/bird:1.0.56, c3/bird:latest plus 2 layers"},
+		{[]string{"a", "b", "d"}, nil, "c3/base:1.0 plus one layer"},
+		{[]string{"x", "b", "c"}, nil, ""},
+		{[]string{"b"}, nil, ""},
+		{nil, nil, ""},
+		// recompressed, say from gzip to zstd, so only the diffIDs match
+		{[]string{"za", "zb", "zc"}, []string{"diff-a", "diff-b", "diff-c"}, "exactly c3/bird:1.0.56, c3/bird:latest"},
+		{[]string{"za", "zb", "zd"}, []string{"diff-a", "diff-b", "diff-d"}, "c3/base:1.0 plus one layer"},
+		{[]string{"a", "zb", "zc"}, []string{"diff-a", "diff-b", "diff-c"}, "exactly c3/bird:1.0.56, c3/bird:latest"},
+		{[]string{"za", "zb", "zc"}, nil, ""},
+	}
+	for _, tt := range tests {
+		if got := baseImageDescription(tt.layers, tt.diffIDs); got != tt.want {
+			t.Errorf("baseImageDescription(%v, %v) = %q, want %q", tt.layers, tt.diffIDs, got, tt.want)
+		}
+	}
+}
+
+func TestGetShortStringForNames(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"c3/bird:1.0.56"}, "c3/bird:1.0.56"},
+		{[]string{"c3/bird:1.0.56", "c3/fish:1.0.56"}, "c3/{bird,fish}:1.0.56"},
+		{[]string{"c3/bird:1.0.56@layer1/3", "c3/fish:1.0.56@layer1/3"}, "c3/{bird,fish}:1.0.56@layer1/3"},
+		{[]string{"c3/bird:1.0.56@layer1/3", "c3/bird:1.0.57@layer1/4"}, "c3/bird:1.0.56@layer1/3,c3/bird:1.0.57@layer1/4"},
+		{[]string{"foo.com/imageone:commontag", "foo.com/imagetwo:commontag"}, "foo.com/{imageone,imagetwo}:commontag"},
+		{[]string{"c3/bird:1.0.58", "c3/bird:1.0.56", "c3/bird:1.0.60", "c3/bird:1.0.57", "c3/bird:1.0.59"}, "c3/bird:1.0.{56..60}"},
+		{[]string{"c3/bird:1.0.56", "c3/bird:1.0.57", "c3/bird:1.0.59"}, "c3/bird:1.0.{56,57,59}"},
+		{[]string{"c3/bird:1.0.56", "c3/bird:1.0.57", "c3/bird:1.0.58", "c3/bird:latest"}, "c3/bird:1.0.{56..58},c3/bird:latest"},
+		{[]string{"c3/bird:1.0.56", "c3/bird:1.0.57", "c3/bird:1.0.58", "c3/fish:1.0.56", "c3/fish:1.0.57", "c3/fish:1.0.58"}, "c3/{bird,fish}:1.0.{56..58}"},
+		{[]string{"c3/bird:1.01", "c3/bird:1.02"}, "c3/bird:1.01,c3/bird:1.02"},
+		{[]string{"a/bird:1", "b/bird:1"}, "{a/bird,b/bird}:1"},
+		{[]string{"localhost:5000/bird:1", "localhost:5000/fish:1"}, "localhost:5000/{bird,fish}:1"},
+		{[]string{"base", "c3/rootfs:1.0"}, "base,c3/rootfs:1.0"},
+		{[]string{"c3/bird:1.0", "c3/bird:1.0"}, "c3/bird:1.0"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(getShortStringForNames(tt.names), ","); got != tt.want {
+			t.Errorf("getShortStringForNames(%v) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestFitNames(t *testing.T) {
+	names := []string{"c3/bird:1.0.{56..60}", "c3/fish:2.1", "c3/rootfs:1.0", "c3/base:1.0"}
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{0, "c3/bird:1.0.{56..60},c3/fish:2.1,c3/rootfs:1.0,c3/base:1.0"},
+		{100, "c3/bird:1.0.{56..60},c3/fish:2.1,c3/rootfs:1.0,c3/base:1.0"},
+		{55, "c3/bird:1.0.{56..60},c3/fish:2.1,c3/rootfs:1.0 +1 more"},
+		{40, "c3/bird:1.0.{56..60},c3/fish:2.1 +2 more"},
+		{10, "c3/bird:1.0.{56..60} +3 more"},
+	}
+	for _, tt := range tests {
+		if got := fitNames(names, tt.width); got != tt.want {
+			t.Errorf("fitNames(%d) = %q, want %q", tt.width, got, tt.want)
+		}
+	}
+	if got := fitNames([]string{"a-very-long-name:1.0"}, 5); got != "a-very-long-name:1.0" {
+		t.Errorf("a single name was cut: %q", got)
+	}
+}
+
+func TestNamesTable(t *testing.T) {
+	names := []string{"c3/bird:1.0.{56..60}", "c3/fish:2.1", "c3/rootfs:1.0", "c3/base:1.0"}
+	table := namesTable{
+		rows:     [][]string{{"[blue]sha[white]", "names", "size", "command"}},
+		names:    [][]string{nil},
+		namesCol: 1,
+	}
+	table.add([]string{"[blue]abc1234[white]", "", "12", "RUN make install"}, names)
+	table.add([]string{"[grey]empty[white]", "-", "-", "ENV A=b"}, nil)
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{0, "c3/bird:1.0.{56..60},c3/fish:2.1,c3/rootfs:1.0,c3/base:1.0"},
+		// the sha and size columns, and the padding, take 31
+		{87, "c3/bird:1.0.{56..60},c3/fish:2.1,c3/rootfs:1.0 +1 more"},
+		{72, "c3/bird:1.0.{56..60},c3/fish:2.1 +2 more"},
+		{30, "c3/bird:1.0.{56..60} +3 more"},
+	}
+	for _, tt := range tests {
+		rows := table.fit(tt.width, 2)
+		if got := rows[1][1]; got != tt.want {
+			t.Errorf("names fitted to %d = %q, want %q", tt.width, got, tt.want)
+		}
+		if rows[0][1] != "names" || rows[2][1] != "-" {
+			t.Errorf("rows without names changed: %q", rows)
+		}
+	}
+	if table.rows[1][1] != "" {
+		t.Errorf("fitting changed the table's rows: %q", table.rows)
+	}
+}
+
+func TestFitLayerNodes(t *testing.T) {
+	names := []string{"c3/bird:1.0.{56..60}", "c3/fish:2.1", "c3/rootfs:1.0", "c3/base:1.0"}
+	root := tview.NewTreeNode("root")
+	layers := tview.NewTreeNode("layers")
+	root.AddChild(tview.NewTreeNode("layout").AddChild(tview.NewTreeNode("image").AddChild(layers)))
+	layer := tview.NewTreeNode("").SetReference(layerRef{shortNames: names})
+	unknown := tview.NewTreeNode("sha256hash").SetReference(layerRef{})
+	layers.AddChild(layer).AddChild(unknown)
+
+	// the layer nodes start at column 9
+	fitLayerNodes(root, 64, 0)
+	if got := layer.GetText(); got != "c3/bird:1.0.{56..60},c3/fish:2.1,c3/rootfs:1.0 +1 more" {
+		t.Errorf("layer node fitted to 64 = %q", got)
+	}
+	fitLayerNodes(root, 49, 0)
+	if got := layer.GetText(); got != "c3/bird:1.0.{56..60},c3/fish:2.1 +2 more" {
+		t.Errorf("layer node fitted to 49 = %q", got)
+	}
+	if got := unknown.GetText(); got != "sha256hash" {
+		t.Errorf("a layer without names was renamed %q", got)
+	}
+}
+
+func TestSetupWellKnownLayerNames(t *testing.T) {
+	resetGlobals(t)
+	dir := t.TempDir()
+	save := func(name string, entries ...*LayerNameMapEntry) string {
+		t.Helper()
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := LayerNameHashEntries(entries).Save(fname); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	flagFile := save("team.json", &LayerNameMapEntry{Hash: "a", Name: "team/base:1.0"})
+	save("shared/1.json", &LayerNameMapEntry{Hash: "a", Name: "team/base:1.0"}, &LayerNameMapEntry{Hash: "b", Name: "shared/b:1"})
+	save("shared/2.json", &LayerNameMapEntry{Hash: "a", Name: "shared/a:2"})
+	if err := os.WriteFile(filepath.Join(dir, "shared", "notes.txt"), []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	envFile := save("env.json", &LayerNameMapEntry{Hash: "c", Name: "env/c:1"})
+
+	t.Setenv("SUDO_USER", "")
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	t.Setenv("OCIV_KNOWN_LAYERS", filepath.Join(dir, "missing.json")+string(os.PathListSeparator)+envFile)
+	sources := knownLayersSources([]string{flagFile, filepath.Join(dir, "shared"), flagFile})
+	if sources[len(sources)-1] != filepath.Join(dir, "cache", "ociv", "known-layers.json") {
+		t.Errorf("the fetched file should come last: %q", sources)
+	}
+	setupWellKnownLayerNames(sources[:len(sources)-1])
+
+	if got := strings.Join(LayerNameMap["a"], ","); got != "team/base:1.0,shared/a:2" {
+		t.Errorf("names for a = %q", got)
+	}
+	if got := KnownLayerEntries["a"][0].source; got != flagFile {
+		t.Errorf("team/base:1.0 should come from the flag's file, got %q", got)
+	}
+	if got := strings.Join(LayerNameMap["b"], ","); got != "shared/b:1" {
+		t.Errorf("names for b = %q", got)
+	}
+	if got := KnownLayerEntries["c"]; len(got) != 1 || got[0].source != envFile {
+		t.Errorf("entries for c = %+v", got)
+	}
+	if got := knownNameSources([]string{"b"}, nil); !strings.Contains(got, "shared/b:1") || !strings.Contains(got, filepath.Join(dir, "shared", "1.json")) {
+		t.Errorf("knownNameSources = %q", got)
+	}
+}
+
+func TestGetNamesForLayerByDiffID(t *testing.T) {
+	f := newStandardFixture(t)
+	// the fixture's rootfs layer, as published compressed some other way
+	_, rootfsDiffID := tarGzLayer(t, "rootfs", "contents of rootfs")
+	addKnownLayerEntry(&LayerNameMapEntry{Hash: "zstdblob", Name: "c3/rootfs:1.0", DiffID: digestHash(rootfsDiffID), source: "team.json"})
+	loadFixtureTree(t, f)
+
+	info := ImageInfoMap[digestHash(f.web.Digest)]
+	if got := strings.Join(getNamesForLayer(info.layerDigests[0], info.diffIDHash(0)), ","); got != "base,c3/rootfs:1.0" {
+		t.Errorf("names of web's rootfs layer = %q", got)
+	}
+	if got := strings.Join(getNamesForLayer(info.layerDigests[0], ""), ","); got != "base" {
+		t.Errorf("names without the diffID = %q", got)
+	}
+	if got := strings.Join(getNamesForLayer("zstdblob", ""), ","); got != "c3/rootfs:1.0" {
+		t.Errorf("names of the known blob = %q", got)
+	}
+	// the tree lists all of a layer's names in the layer's ref
+	node := tview.NewTreeNode("")
+	addLayerNodes(node, info, func(ispec.Descriptor) layerRef { return layerRef{} })
+	layers := node.GetChildren()[0].GetChildren()
+	if got := layers[0].GetText(); got != "base,c3/rootfs:1.0" {
+		t.Errorf("rootfs layer node = %q", got)
+	}
+	if got := layers[0].GetReference().(layerRef).names; len(got) != 2 {
+		t.Errorf("rootfs layer ref names = %q", got)
+	}
+	if got := layers[1].GetReference().(layerRef).names; got != nil {
+		t.Errorf("unknown layer ref names = %q", got)
+	}
+	if got := getNamesForLayer(info.layerDigests[1], info.diffIDHash(1)); len(got) != 1 || got[0] != "?" {
+		t.Errorf("names of an unknown layer = %q", got)
+	}
+
+	sources := knownNameSources(info.layerDigests, info.diffIDHashes())
+	if !strings.Contains(sources, "c3/rootfs:1.0  team.json (same diffID)") {
+		t.Errorf("sources don't say the name is from the diffID:\n%s", sources)
+	}
+	if got := getImageInfoString(info.ref, info, 0); !strings.Contains(got, "c3/rootfs:1.0") {
+		t.Errorf("image info doesn't name the layer:\n%s", got)
+	}
+
+	// the web image, published with its layers compressed some other way
+	for idx := range info.layerDigests {
+		addKnownLayerEntry(&LayerNameMapEntry{
+			Hash:         fmt.Sprintf("zstd%d", idx),
+			Name:         layerEntryName("c3/web", "2.0", idx+1, len(info.layerDigests)),
+			Repository:   "c3/web",
+			Tag:          "2.0",
+			ConfigDigest: info.manifest.Config.Digest.String(),
+		})
+	}
+	if got := strings.Join(knownImagesForConfig(info.manifest.Config.Digest.String()), ","); got != "c3/web:2.0" {
+		t.Errorf("images with web's config = %q", got)
+	}
+	if got := getImageInfoString(info.ref, info, 0); !strings.Contains(got, "Known as: [blue]c3/web:2.0[white] (same config)") {
+		t.Errorf("image info doesn't say what the image is known as:\n%s", got)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// how many log lines the TUI's log pane keeps
+const recentLogsSize = 1000
+
+// logRing keeps the most recent log lines in memory for the log pane
+type logRing struct {
+	mu      sync.Mutex
+	lines   []string
+	size    int
+	onWrite func() // called after each write, if set
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{size: size}
+}
+
+func (lr *logRing) Write(p []byte) (int, error) {
+	lr.mu.Lock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		lr.lines = append(lr.lines, line)
+	}
+	if len(lr.lines) > lr.size {
+		lr.lines = lr.lines[len(lr.lines)-lr.size:]
+	}
+	onWrite := lr.onWrite
+	lr.mu.Unlock()
+	if onWrite != nil {
+		onWrite()
+	}
+	return len(p), nil
+}
+
+func (lr *logRing) setOnWrite(f func()) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.onWrite = f
+}
+
+func (lr *logRing) String() string {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return strings.Join(lr.lines, "\n")
+}
+
+var recentLogs = newLogRing(recentLogsSize)
+
+// the log file, if we opened one
+var logFile *os.File
+
+// a logger writing to w and the recent logs ring
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.MultiWriter(w, recentLogs), &slog.HandlerOptions{Level: level}))
+}
+
+// $XDG_STATE_HOME/ociv, or ~/.local/state/ociv
+func getStateDir() (string, error) {
+	return getXDGDir("XDG_STATE_HOME", ".local/state", "ociv")
+}
+
+func defaultLogFilename() (string, error) {
+	stateDir, err := getStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "ociv.log"), nil
+}
+
+func openLogFile(fname string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// set up the default slog logger from the --log-file and --log-level flags.
+// a log file of "-" logs to stderr, which the TUI would draw over, so only
+// subcommands can use it. a log file that was asked for has to open; if the
+// default one can't, logs only go to the TUI's log pane.
+func setupLogging(c *cli.Context) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.String("log-level"))); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", c.String("log-level"), err)
+	}
+
+	fname := c.String("log-file")
+	if fname == "-" {
+		if c.App.Command(c.Args().First()) == nil {
+			return fmt.Errorf("--log-file - only works with subcommands, the TUI draws over stderr")
+		}
+		slog.SetDefault(newLogger(os.Stderr, level))
+		return nil
+	}
+
+	explicit := fname != ""
+	if !explicit {
+		var err error
+		fname, err = defaultLogFilename()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARN: not logging to a file: %v\n", err)
+			slog.SetDefault(newLogger(io.Discard, level))
+			return nil
+		}
+	}
+
+	f, err := openLogFile(fname)
+	if err != nil {
+		if explicit {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "WARN: not logging to a file: %v\n", err)
+		slog.SetDefault(newLogger(io.Discard, level))
+		return nil
+	}
+	logFile = f
+	slog.SetDefault(newLogger(f, level))
+	return nil
+}
+
+func closeLogging() {
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+}
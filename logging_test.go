@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestLogRing(t *testing.T) {
+	lr := newLogRing(3)
+	for _, line := range []string{"one\n", "two\nthree\n", "four\n"} {
+		if _, err := lr.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := lr.String(); got != "two\nthree\nfour" {
+		t.Errorf("expected the last 3 lines, got %q", got)
+	}
+}
+
+// a cli context with the logging flags set
+func loggingContext(t *testing.T, args ...string) *cli.Context {
+	t.Helper()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("log-file", "", "")
+	set.String("log-level", "info", "")
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	app := cli.NewApp()
+	app.Commands = []*cli.Command{{Name: "config"}}
+	return cli.NewContext(app, set, nil)
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer closeLogging()
+
+	stateDir := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", stateDir)
+
+	if err := setupLogging(loggingContext(t, "--log-level", "warn")); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("not logged at warn level")
+	slog.Warn("logged at warn level", "key", "value")
+	closeLogging()
+
+	logBytes, err := os.ReadFile(filepath.Join(stateDir, "ociv", "ociv.log"))
+	if err != nil {
+		t.Fatalf("default log file wasn't written: %v", err)
+	}
+	logged := string(logBytes)
+	if strings.Contains(logged, "not logged") {
+		t.Errorf("info message logged at warn level:\n%s", logged)
+	}
+	if !strings.Contains(logged, `level=WARN msg="logged at warn level" key=value`) {
+		t.Errorf("warn message missing or not structured:\n%s", logged)
+	}
+
+	explicit := filepath.Join(t.TempDir(), "sub", "explicit.log")
+	if err := setupLogging(loggingContext(t, "--log-file", explicit, "--log-level", "debug")); err != nil {
+		t.Fatal(err)
+	}
+	slog.Debug("debug message")
+	closeLogging()
+	if logBytes, err := os.ReadFile(explicit); err != nil || !strings.Contains(string(logBytes), "debug message") {
+		t.Errorf("expected debug message in %s, got %q (%v)", explicit, logBytes, err)
+	}
+
+	if err := setupLogging(loggingContext(t, "--log-level", "loud")); err == nil {
+		t.Error("expected an error for an invalid log level")
+	}
+}
+
+func TestSetupLoggingExplicitFile(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer closeLogging()
+
+	notADir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notADir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupLogging(loggingContext(t, "--log-file", filepath.Join(notADir, "ociv.log"))); err == nil {
+		t.Error("expected an error for a log file that can't be opened")
+	}
+
+	// the TUI would draw over stderr
+	for _, args := range [][]string{{"--log-file", "-"}, {"--log-file", "-", "some/dir"}} {
+		if err := setupLogging(loggingContext(t, args...)); err == nil {
+			t.Errorf("%q: expected an error logging to stderr from the TUI", args)
+		}
+	}
+	if err := setupLogging(loggingContext(t, "--log-file", "-", "config")); err != nil {
+		t.Errorf("logging to stderr from a subcommand: %v", err)
+	}
+}
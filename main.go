@@ -2,24 +2,85 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 
 	"github.com/urfave/cli/v2"
 )
 
 func main() {
+	err := newApp().Run(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		slog.Error("exiting", "err", err)
+	}
+	closeLogging()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// the config file's settings are applied before anything else, so they can
+// set logging flags too
+func setupApp(c *cli.Context) error {
+	if err := applyConfig(c); err != nil {
+		return err
+	}
+	return setupLogging(c)
+}
 
-	app := &cli.App{
+func newApp() *cli.App {
+	return &cli.App{
 		Name:      "ociv",
 		Usage:     "interactively inspect oci layouts",
 		Action:    doTViewStuff,
 		ArgsUsage: "root dirs to inspect",
+		Before:    setupApp,
+		Commands: []*cli.Command{
+			{
+				Name:   "config",
+				Usage:  "show the config file's settings, and where ociv keeps its files",
+				Action: doShowConfig,
+			},
+			{
+				Name:  "known-layers",
+				Usage: "manage the known layers file",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "migrate",
+						Usage:     "rewrite known layers files in the current schema, keeping the old ones",
+						ArgsUsage: "files to migrate (default $XDG_CACHE_HOME/ociv/known-layers.json)",
+						Action:    doMigrateKnownLayers,
+					},
+					{
+						Name:      "import",
+						Usage:     "record the layers of the tagged images in local OCI layouts",
+						ArgsUsage: "dirs with OCI layouts under them",
+						Action:    doImportKnownLayers,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "known layers file to update (default $XDG_CACHE_HOME/ociv/known-layers.json)",
+							},
+							&cli.BoolFlag{
+								Name:  "prune",
+								Usage: "forget known layers of tags that are no longer in the layouts",
+							},
+						},
+					},
+				},
+			},
+		},
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "TOML file of defaults for these flags (default $XDG_CONFIG_HOME/ociv/config.toml)",
+				EnvVars: []string{"OCIV_CONFIG"},
+			},
 			&cli.StringFlag{
 				Name:    "registry",
 				Aliases: []string{"r"},
-				Usage:   "registry to fetch the tags",
+				Usage:   "registry to fetch the tags, as host[:port], optionally with http:// or https://",
 			},
 			&cli.StringFlag{
 				Name:    "prefixes",
@@ -27,18 +88,103 @@ func main() {
 				Usage:   "comma separated repository prefixes to filter the tags",
 				Value:   "", // Default is all prefixes
 			},
+			&cli.StringFlag{
+				Name:    "username",
+				Aliases: []string{"u"},
+				Usage:   "registry username, instead of one from a docker or containers auth file",
+				EnvVars: []string{"OCIV_REGISTRY_USERNAME"},
+			},
+			&cli.StringFlag{
+				Name:    "password",
+				Usage:   "registry password or token",
+				EnvVars: []string{"OCIV_REGISTRY_PASSWORD"},
+			},
+			&cli.BoolFlag{
+				Name:  "prune",
+				Usage: "when fetching from a registry, forget known layers of tags that no longer exist",
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "how many requests to make to the registry at once",
+				Value: defaultFetchOptions().concurrency,
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "how long to wait for each registry response to start, not to finish (0 for none)",
+				Value: defaultFetchOptions().timeout,
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "how many times to retry registry requests that fail with 429, 5xx or a network error",
+				Value: defaultFetchOptions().retries,
+			},
+			&cli.StringSliceFlag{
+				Name:  "ca-file",
+				Usage: "PEM bundle of CAs to trust for the registry, as well as the system's, may be repeated",
+			},
+			&cli.StringFlag{
+				Name:  "cert",
+				Usage: "PEM client certificate for the registry",
+			},
+			&cli.StringFlag{
+				Name:  "key",
+				Usage: "PEM key for the client certificate",
+			},
+			&cli.BoolFlag{
+				Name:  "insecure-skip-verify",
+				Usage: "don't verify the registry's TLS certificate",
+			},
+			&cli.StringSliceFlag{
+				Name:  "remote",
+				Usage: "registry, repository or image to browse, as docker://host[:port][/repo[:tag|@digest]], may be repeated",
+			},
+			&cli.StringFlag{
+				Name:  "artifact-type",
+				Usage: "only show referrers of remote images with this artifact type",
+			},
+			&cli.StringFlag{
+				Name:  "trust-dir",
+				Usage: "notation config directory with the trust store and trust policy to verify notary signatures with (default $XDG_CONFIG_HOME/notation)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cosign-key",
+				Usage: "PEM public key, or certificate, to verify cosign signatures and attestations with, may be repeated",
+			},
+			&cli.StringFlag{
+				Name:  "cosign-identity",
+				Usage: "email, URI or subject a --cosign-key CA's signing certificates must be issued to",
+			},
+			&cli.StringFlag{
+				Name:  "cosign-oidc-issuer",
+				Usage: "OIDC issuer that must have vouched for the --cosign-identity of Fulcio's signing certificates",
+			},
+			&cli.StringSliceFlag{
+				Name:  "known-layers",
+				Usage: "known layers JSON file, or directory of them, to read before $OCIV_KNOWN_LAYERS and the fetched file, may be repeated",
+			},
+			&cli.IntFlag{
+				Name:  "max-depth",
+				Usage: "how many directories deep to look for layouts under each root (0 is unlimited)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "exclude",
+				Aliases: []string{"x"},
+				Usage:   "glob pattern of directories to skip, may be repeated",
+			},
+			&cli.BoolFlag{
+				Name:  "follow-symlinks",
+				Usage: "descend into symlinked directories",
+			},
+			&cli.StringFlag{
+				Name:  "log-file",
+				Usage: "file to log to, or - for stderr (default $XDG_STATE_HOME/ociv/ociv.log)",
+			},
+			&cli.StringFlag{
+				Name:    "log-level",
+				Usage:   "one of debug, info, warn or error",
+				Value:   "info",
+				EnvVars: []string{"OCIV_LOG"},
+			},
 		},
 	}
-
-	file, err := os.OpenFile("log.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.SetOutput(file)
-
-	if err := app.Run(os.Args); err != nil {
-		fmt.Println(err)
-		log.Fatal(err)
-	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+func doMigrateKnownLayers(ctxt *cli.Context) error {
+	files := ctxt.Args().Slice()
+	if len(files) == 0 {
+		fname, err := getKnowLayersFilename()
+		if err != nil {
+			return err
+		}
+		files = []string{fname}
+	}
+	for _, file := range files {
+		if err := migrateKnownLayers(file, os.Stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite a known layers file in the current schema, keeping the old one
+// next to it as file.v<version>. entries from before repositories and tags
+// were recorded get them from their names.
+func migrateKnownLayers(file string, w io.Writer) error {
+	entries, version, err := loadVersioned(file)
+	if err != nil {
+		return err
+	}
+	if version == knownLayersSchemaVersion {
+		fmt.Fprintf(w, "%s is already schema version %d\n", file, version)
+		return nil
+	}
+
+	for _, e := range entries {
+		fillFromName(e)
+	}
+
+	old, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.v%d", file, version)
+	if err := os.WriteFile(backup, old, 0644); err != nil {
+		return err
+	}
+	if err := entries.Save(file); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: migrated %d entries from schema version %d to %d, the old file is %s\n",
+		file, len(entries), version, knownLayersSchemaVersion, backup)
+	return nil
+}
+
+// fill in an entry's repository, tag and layer position from its name, like
+// c3/bird:1.0.56 or c3/bird:1.0.56@layer3/5, if they aren't recorded
+func fillFromName(e *LayerNameMapEntry) {
+	if e.Repository != "" {
+		return
+	}
+	name, position, _ := strings.Cut(e.Name, "@")
+	idx := strings.LastIndex(name, ":")
+	if idx <= 0 || idx == len(name)-1 || strings.Contains(name[idx+1:], "/") {
+		// no tag, or just a registry port
+		return
+	}
+	e.Repository, e.Tag = name[:idx], name[idx+1:]
+
+	var index, count int
+	if _, err := fmt.Sscanf(position, "layer%d/%d", &index, &count); err == nil {
+		e.LayerIndex, e.LayerCount = index, count
+	}
+}
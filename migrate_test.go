@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a known layers file as the README used to document it
+const knownLayersV1 = `[{"Name": "c3/bird:1.0.56-squashfs", "Hash": "e6539655"},
+ {"Name": "my.registry.tld:5000/c3/bird:1.0.56@layer1/2", "Hash": "8b54d9ce"},
+ {"Name": "bird", "Hash": "02547463"}
+]`
+
+func TestLoadKnownLayersVersions(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		contents string
+		version  int
+		entries  int
+		err      string
+	}{
+		{knownLayersV1, 1, 3, ""},
+		{`{"schemaVersion": 2, "entries": [{"hash": "a", "name": "c3/bird:1.0"}]}`, 2, 1, ""},
+		{`{"schemaVersion": 2}`, 2, 0, ""},
+		{`{"schemaVersion": 3, "entries": []}`, 0, 0, "newer than this ociv supports"},
+		{`{"entries": []}`, 0, 0, "no schemaVersion"},
+		{`{"schemaVersion": 2, "entries": [`, 0, 0, "unexpected end"},
+	}
+	for idx, tt := range tests {
+		file := filepath.Join(dir, "known-layers.json")
+		if err := os.WriteFile(file, []byte(tt.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries, version, err := loadVersioned(file)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%d: expected an error with %q, got %v", idx, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %v", idx, err)
+			continue
+		}
+		if version != tt.version || len(entries) != tt.entries {
+			t.Errorf("%d: got version %d with %d entries, want version %d with %d", idx, version, len(entries), tt.version, tt.entries)
+		}
+	}
+}
+
+func TestMigrateKnownLayers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known-layers.json")
+	if err := os.WriteFile(file, []byte(knownLayersV1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(bytes.Buffer)
+	if err := migrateKnownLayers(file, w); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); !strings.Contains(got, "migrated 3 entries from schema version 1 to 2") {
+		t.Errorf("output = %q", got)
+	}
+	if old, err := os.ReadFile(file + ".v1"); err != nil || string(old) != knownLayersV1 {
+		t.Errorf("old file wasn't kept: %q, %v", old, err)
+	}
+
+	entries, version, err := loadVersioned(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != knownLayersSchemaVersion || len(entries) != 3 {
+		t.Fatalf("got version %d with %d entries", version, len(entries))
+	}
+	if e := entries[0]; e.Repository != "c3/bird" || e.Tag != "1.0.56-squashfs" || e.Hash != "e6539655" {
+		t.Errorf("entry 0 = %+v", e)
+	}
+	if e := entries[1]; e.Repository != "my.registry.tld:5000/c3/bird" || e.Tag != "1.0.56" || e.LayerIndex != 1 || e.LayerCount != 2 {
+		t.Errorf("entry 1 = %+v", e)
+	}
+	if e := entries[2]; e.Repository != "" || e.Tag != "" {
+		t.Errorf("entry 2 = %+v", e)
+	}
+
+	w.Reset()
+	if err := migrateKnownLayers(file, w); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); !strings.Contains(got, "already schema version 2") {
+		t.Errorf("output = %q", got)
+	}
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+)
+
+// notary v2 signatures, as made by notation: a referrer whose only layer is
+// a JWS or COSE envelope signing a descriptor of its subject, with the
+// signer's certificate chain. they're verified like `notation verify` does,
+// against notation's trust store and trust policy.
+
+const (
+	ArtifactTypeNotarySignature = "application/vnd.cncf.notary.signature"
+	MediaTypeJWSEnvelope        = "application/jose+json"
+	MediaTypeCOSEEnvelope       = "application/cose"
+	notaryPayloadType           = "application/vnd.cncf.notary.payload.v1+json"
+)
+
+// where notation's truststore/ and trustpolicy.json are, from --trust-dir.
+// signatures aren't checked against a trust policy if it's "".
+var NotaryTrustDir = ""
+
+// whether we believe a notary or cosign signature
+type signatureStatus string
+
+const (
+	signatureVerified  signatureStatus = "verified"
+	signatureInvalid   signatureStatus = "invalid"    // the signature is bad, or isn't of its subject
+	signatureUntrusted signatureStatus = "untrusted"  // a good signature, by a signer we don't trust
+	signatureUnchecked signatureStatus = "unverified" // there's nothing to check it with
+)
+
+// the status, for the tree
+func (s signatureStatus) label() string {
+	switch s {
+	case signatureVerified:
+		return "✅ verified"
+	case signatureInvalid:
+		return "❌ invalid"
+	case signatureUnchecked:
+		return "❔ unverified"
+	default:
+		return "⚠️  untrusted"
+	}
+}
+
+// the status, colored for the info pane
+func (s signatureStatus) colored() string {
+	color := map[signatureStatus]string{signatureVerified: "green", signatureInvalid: "red", signatureUntrusted: "orange"}[s]
+	if color == "" {
+		color = "white"
+	}
+	return fmt.Sprintf("[%s]%s[white]", color, s)
+}
+
+// what a signature envelope says, and whether we believe it
+type notarySignature struct {
+	envelope      string // JWS or COSE
+	algorithm     string
+	signingScheme string
+	signingTime   time.Time
+	expiry        *time.Time
+	signingAgent  string
+	target        ispec.Descriptor
+	certs         []*x509.Certificate
+	policy        string // the trust policy that applied
+
+	status signatureStatus
+	reason string
+}
+
+// is this image a notary signature, by its artifact type or, as older
+// signatures have it, its config's media type
+func isNotarySignature(info imageInfo) bool {
+	return info.manifest.ArtifactType == ArtifactTypeNotarySignature ||
+		info.manifest.Config.MediaType == ArtifactTypeNotarySignature
+}
+
+// the notary trust dir notation uses: $XDG_CONFIG_HOME/notation, or
+// ~/.config/notation
+func defaultNotaryTrustDir() (string, error) {
+	return getXDGDir("XDG_CONFIG_HOME", ".config", "notation")
+}
+
+// read and verify the signature envelope of a notary signature. a
+// signature that can't be read is invalid, with the reason why.
+func verifyNotarySignature(fetch blobFetcher, info imageInfo) *notarySignature {
+	invalid := func(format string, args ...interface{}) *notarySignature {
+		return &notarySignature{status: signatureInvalid, reason: fmt.Sprintf(format, args...)}
+	}
+
+	var envelopeDesc *ispec.Descriptor
+	for idx, layer := range info.manifest.Layers {
+		if layer.MediaType == MediaTypeJWSEnvelope || layer.MediaType == MediaTypeCOSEEnvelope {
+			envelopeDesc = &info.manifest.Layers[idx]
+			break
+		}
+	}
+	if envelopeDesc == nil {
+		return invalid("no JWS or COSE signature envelope in the manifest")
+	}
+	data, err := readArtifactBlob(fetch, *envelopeDesc)
+	if err != nil {
+		return invalid("reading the signature envelope: %v", err)
+	}
+
+	var sig *notarySignature
+	var payload, signed, signature []byte
+	if envelopeDesc.MediaType == MediaTypeJWSEnvelope {
+		sig, payload, signed, signature, err = parseJWSEnvelope(data)
+	} else {
+		sig, payload, signed, signature, err = parseCOSEEnvelope(data)
+	}
+	if err != nil {
+		return invalid("parsing the %s envelope: %v", envelopeDesc.MediaType, err)
+	}
+
+	sig.checkSignature(payload, signed, signature, info.manifest.Subject)
+	if sig.status == "" {
+		sig.checkTrust(NotaryTrustDir, registryScope(info.ref.layoutpath))
+	}
+	return sig
+}
+
+// the part of a JWS envelope notation writes, in the flattened JSON
+// serialization
+type jwsEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		X5C          []string `json:"x5c"`
+		SigningAgent string   `json:"io.cncf.notary.signingAgent"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+type jwsProtectedHeader struct {
+	Algorithm     string     `json:"alg"`
+	ContentType   string     `json:"cty"`
+	SigningScheme string     `json:"io.cncf.notary.signingScheme"`
+	SigningTime   time.Time  `json:"io.cncf.notary.signingTime"`
+	Expiry        *time.Time `json:"io.cncf.notary.expiry"`
+}
+
+// parse a JWS envelope, returning the signature's details, its payload, the
+// bytes signed and the signature over them
+func parseJWSEnvelope(data []byte) (sig *notarySignature, payload, signed, signature []byte, err error) {
+	var envelope jwsEnvelope
+	if err = json.Unmarshal(data, &envelope); err != nil {
+		return
+	}
+	protectedBytes, err := base64.RawURLEncoding.DecodeString(envelope.Protected)
+	if err != nil {
+		err = fmt.Errorf("protected header: %w", err)
+		return
+	}
+	var protected jwsProtectedHeader
+	if err = json.Unmarshal(protectedBytes, &protected); err != nil {
+		err = fmt.Errorf("protected header: %w", err)
+		return
+	}
+	if protected.ContentType != notaryPayloadType {
+		err = fmt.Errorf("payload content type is %q, not %q", protected.ContentType, notaryPayloadType)
+		return
+	}
+	if payload, err = base64.RawURLEncoding.DecodeString(envelope.Payload); err != nil {
+		err = fmt.Errorf("payload: %w", err)
+		return
+	}
+	if signature, err = base64.RawURLEncoding.DecodeString(envelope.Signature); err != nil {
+		err = fmt.Errorf("signature: %w", err)
+		return
+	}
+
+	sig = &notarySignature{
+		envelope:      "JWS",
+		algorithm:     protected.Algorithm,
+		signingScheme: protected.SigningScheme,
+		signingTime:   protected.SigningTime,
+		expiry:        protected.Expiry,
+		signingAgent:  envelope.Header.SigningAgent,
+	}
+	for _, encoded := range envelope.Header.X5C {
+		der, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			err = fmt.Errorf("certificate chain: %w", decodeErr)
+			return
+		}
+		cert, parseErr := x509.ParseCertificate(der)
+		if parseErr != nil {
+			err = fmt.Errorf("certificate chain: %w", parseErr)
+			return
+		}
+		sig.certs = append(sig.certs, cert)
+	}
+	signed = []byte(envelope.Protected + "." + envelope.Payload)
+	return sig, payload, signed, signature, nil
+}
+
+// COSE header labels and algorithms notation uses
+const (
+	coseSign1Tag        = 18
+	coseHeaderAlgorithm = 1
+	coseHeaderType      = 3
+	coseHeaderX5Chain   = 33
+	cborTagEpochTime    = 1
+)
+
+var coseAlgorithms = map[int64]string{
+	-7:  "ES256",
+	-35: "ES384",
+	-36: "ES512",
+	-37: "PS256",
+	-38: "PS384",
+	-39: "PS512",
+}
+
+// parse a COSE_Sign1 envelope, like parseJWSEnvelope
+func parseCOSEEnvelope(data []byte) (sig *notarySignature, payload, signed, signature []byte, err error) {
+	value, rest, err := decodeCBOR(data)
+	if err != nil {
+		return
+	}
+	if len(rest) > 0 {
+		err = fmt.Errorf("%d bytes after the envelope", len(rest))
+		return
+	}
+	if tag, ok := value.(cborTag); ok {
+		if tag.number != coseSign1Tag {
+			err = fmt.Errorf("tagged %d, not as a COSE_Sign1", tag.number)
+			return
+		}
+		value = tag.content
+	}
+	items, ok := value.([]interface{})
+	if !ok || len(items) != 4 {
+		err = fmt.Errorf("not a COSE_Sign1")
+		return
+	}
+	protectedBytes, ok1 := items[0].([]byte)
+	unprotected, ok2 := items[1].(map[interface{}]interface{})
+	payload, ok3 := items[2].([]byte)
+	signature, ok4 := items[3].([]byte)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		err = fmt.Errorf("not a COSE_Sign1")
+		return
+	}
+	protectedValue, _, err := decodeCBOR(protectedBytes)
+	if err != nil {
+		err = fmt.Errorf("protected header: %w", err)
+		return
+	}
+	protected, ok := protectedValue.(map[interface{}]interface{})
+	if !ok {
+		err = fmt.Errorf("protected header isn't a map")
+		return
+	}
+	if cty, _ := protected[int64(coseHeaderType)].(string); cty != notaryPayloadType {
+		err = fmt.Errorf("payload content type is %q, not %q", cty, notaryPayloadType)
+		return
+	}
+
+	sig = &notarySignature{envelope: "COSE"}
+	if alg, ok := protected[int64(coseHeaderAlgorithm)].(int64); ok {
+		sig.algorithm = coseAlgorithms[alg]
+		if sig.algorithm == "" {
+			sig.algorithm = fmt.Sprintf("COSE algorithm %d", alg)
+		}
+	}
+	sig.signingScheme, _ = protected["io.cncf.notary.signingScheme"].(string)
+	if signingTime, ok := coseTime(protected["io.cncf.notary.signingTime"]); ok {
+		sig.signingTime = signingTime
+	}
+	if expiry, ok := coseTime(protected["io.cncf.notary.expiry"]); ok {
+		sig.expiry = &expiry
+	}
+	sig.signingAgent, _ = unprotected["io.cncf.notary.signingAgent"].(string)
+
+	// one certificate, or an array of them
+	chain := unprotected[int64(coseHeaderX5Chain)]
+	if der, ok := chain.([]byte); ok {
+		chain = []interface{}{der}
+	}
+	ders, _ := chain.([]interface{})
+	for _, item := range ders {
+		der, ok := item.([]byte)
+		if !ok {
+			err = fmt.Errorf("certificate chain isn't byte strings")
+			return
+		}
+		cert, parseErr := x509.ParseCertificate(der)
+		if parseErr != nil {
+			err = fmt.Errorf("certificate chain: %w", parseErr)
+			return
+		}
+		sig.certs = append(sig.certs, cert)
+	}
+
+	signed, err = encodeCBOR([]interface{}{"Signature1", protectedBytes, []byte{}, payload})
+	return sig, payload, signed, signature, err
+}
+
+// a time in a COSE header, as epoch seconds, tagged or not
+func coseTime(value interface{}) (time.Time, bool) {
+	if tag, ok := value.(cborTag); ok && tag.number == cborTagEpochTime {
+		value = tag.content
+	}
+	secs, ok := value.(int64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0).UTC(), true
+}
+
+// check the signature over signed, by the chain's first certificate, and
+// that the payload signs subject. sets the status to invalid if not.
+func (sig *notarySignature) checkSignature(payload, signed, signature []byte, subject *ispec.Descriptor) {
+	invalid := func(format string, args ...interface{}) {
+		sig.status = signatureInvalid
+		sig.reason = fmt.Sprintf(format, args...)
+	}
+
+	if len(sig.certs) == 0 {
+		invalid("no certificate chain")
+		return
+	}
+	if err := verifyNotarySignatureBytes(sig.algorithm, sig.certs[0].PublicKey, signed, signature); err != nil {
+		invalid("%v", err)
+		return
+	}
+
+	var notaryPayload struct {
+		TargetArtifact ispec.Descriptor `json:"targetArtifact"`
+	}
+	if err := json.Unmarshal(payload, &notaryPayload); err != nil {
+		invalid("parsing the payload: %v", err)
+		return
+	}
+	sig.target = notaryPayload.TargetArtifact
+	switch {
+	case subject == nil:
+		invalid("the signature has no subject to check it signs")
+	case sig.target.Digest != subject.Digest:
+		invalid("it signs %s, not its subject %s", sig.target.Digest, subject.Digest)
+	case sig.target.Size != subject.Size:
+		invalid("it signs %d bytes of its subject, not %d", sig.target.Size, subject.Size)
+	case sig.expiry != nil && time.Now().After(*sig.expiry):
+		invalid("it expired at %s", sig.expiry.Format(time.RFC3339))
+	}
+}
+
+// verify a signature with one of the algorithms notation signs with
+func verifyNotarySignatureBytes(algorithm string, publicKey crypto.PublicKey, signed, signature []byte) error {
+	hash, ok := map[string]crypto.Hash{
+		"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}[algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %q", algorithm)
+	}
+	h := hash.New()
+	h.Write(signed)
+	hashed := h.Sum(nil)
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "PS") {
+			return fmt.Errorf("%s signature by an RSA key", algorithm)
+		}
+		if err := rsa.VerifyPSS(key, hash, hashed, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+			return fmt.Errorf("the signature doesn't verify: %w", err)
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "ES") {
+			return fmt.Errorf("%s signature by an ECDSA key", algorithm)
+		}
+		// r and s, each as long as the curve's order
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("the signature doesn't verify: %d bytes, not %d", len(signature), 2*size)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, hashed, r, s) {
+			return fmt.Errorf("the signature doesn't verify")
+		}
+	default:
+		return fmt.Errorf("unsupported public key %T", publicKey)
+	}
+	return nil
+}
+
+// notation's trustpolicy.json
+type notaryTrustPolicyDocument struct {
+	Version       string              `json:"version"`
+	TrustPolicies []notaryTrustPolicy `json:"trustPolicies"`
+}
+
+type notaryTrustPolicy struct {
+	Name                  string   `json:"name"`
+	RegistryScopes        []string `json:"registryScopes"`
+	SignatureVerification struct {
+		Level string `json:"level"`
+	} `json:"signatureVerification"`
+	TrustStores       []string `json:"trustStores"`
+	TrustedIdentities []string `json:"trustedIdentities"`
+}
+
+// the registry scope of an image, like registry.example.com/app, for
+// images in a registry. local layouts have none, so only "*" policies
+// apply to them.
+func registryScope(layoutpath string) string {
+	scope, ok := strings.CutPrefix(layoutpath, remoteRootPrefix)
+	if !ok {
+		return ""
+	}
+	return scope
+}
+
+// the policy for a registry scope: one naming it, or else the "*" one
+func (doc *notaryTrustPolicyDocument) policyFor(scope string) *notaryTrustPolicy {
+	var wildcard *notaryTrustPolicy
+	for idx := range doc.TrustPolicies {
+		policy := &doc.TrustPolicies[idx]
+		for _, policyScope := range policy.RegistryScopes {
+			if policyScope == "*" {
+				wildcard = policy
+			} else if scope != "" && policyScope == scope {
+				return policy
+			}
+		}
+	}
+	return wildcard
+}
+
+// check a signature that verified was made by a certificate the trust
+// policy for scope trusts. sets the status to verified or untrusted.
+func (sig *notarySignature) checkTrust(trustDir, scope string) {
+	untrusted := func(format string, args ...interface{}) {
+		sig.status = signatureUntrusted
+		sig.reason = fmt.Sprintf(format, args...)
+	}
+
+	if trustDir == "" {
+		untrusted("no trust policy to check it against")
+		return
+	}
+	policyFile := filepath.Join(trustDir, "trustpolicy.json")
+	data, err := os.ReadFile(policyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		untrusted("there's no trust policy, %s", policyFile)
+		return
+	} else if err != nil {
+		untrusted("reading the trust policy: %v", err)
+		return
+	}
+	var doc notaryTrustPolicyDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		untrusted("parsing %s: %v", policyFile, err)
+		return
+	}
+
+	policy := doc.policyFor(scope)
+	if policy == nil {
+		untrusted("no trust policy applies to %q", scope)
+		return
+	}
+	sig.policy = policy.Name
+	if policy.SignatureVerification.Level == "skip" {
+		untrusted("trust policy %q skips verification", policy.Name)
+		return
+	}
+
+	roots := x509.NewCertPool()
+	numRoots := 0
+	for _, store := range policy.TrustStores {
+		certs, err := loadNotaryTrustStore(trustDir, store)
+		if err != nil {
+			untrusted("reading trust store %q: %v", store, err)
+			return
+		}
+		for _, cert := range certs {
+			roots.AddCert(cert)
+			numRoots++
+		}
+	}
+	if numRoots == 0 {
+		untrusted("trust policy %q's trust stores have no certificates", policy.Name)
+		return
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range sig.certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	// the signing time is only the signer's say-so; notation trusts it only
+	// with a TSA's countersignature, which we don't check, so the chain has
+	// to be valid now
+	if _, err := sig.certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		untrusted("the certificate chain isn't trusted by policy %q: %v", policy.Name, err)
+		return
+	}
+
+	if !trustedIdentity(policy.TrustedIdentities, sig.certs[0].Subject) {
+		untrusted("%s isn't a trusted identity of policy %q", sig.certs[0].Subject, policy.Name)
+		return
+	}
+
+	sig.status = signatureVerified
+	sig.reason = fmt.Sprintf("trusted by policy %q", policy.Name)
+}
+
+// the certificates in a trust store named like ca:acme-rockets, in
+// truststore/x509/<type>/<name>/ under the trust dir. files may be PEM or
+// DER.
+func loadNotaryTrustStore(trustDir, store string) ([]*x509.Certificate, error) {
+	storeType, name, ok := strings.Cut(store, ":")
+	if !ok || storeType == "" || name == "" || strings.ContainsAny(store, `/\`) {
+		return nil, fmt.Errorf("trust store names look like ca:name")
+	}
+	dir := filepath.Join(trustDir, "truststore", "x509", storeType, name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*x509.Certificate{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		fileCerts, err := parseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		certs = append(certs, fileCerts...)
+	}
+	return certs, nil
+}
+
+// the certificates in PEM data, or a DER certificate
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+	return certs, nil
+}
+
+// does a trust policy's trustedIdentities include subject: "*", or
+// "x509.subject: " and attributes like "C=US, O=Acme" that subject has
+func trustedIdentity(identities []string, subject pkix.Name) bool {
+	attributes := map[string][]string{
+		"C":  subject.Country,
+		"ST": subject.Province,
+		"L":  subject.Locality,
+		"O":  subject.Organization,
+		"OU": subject.OrganizationalUnit,
+		"CN": {subject.CommonName},
+	}
+	for _, identity := range identities {
+		if identity == "*" {
+			return true
+		}
+		wanted, ok := strings.CutPrefix(identity, "x509.subject:")
+		if !ok {
+			continue
+		}
+		matches := true
+		for _, attribute := range strings.Split(wanted, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(attribute), "=")
+			if !slices.Contains(attributes[strings.ToUpper(key)], value) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// the signature's details, for the info pane
+func (sig *notarySignature) infoString() string {
+	out := fmt.Sprintf("[yellow]# Notary Signature: %s\n%s\n", sig.status.colored(), tview.Escape(sig.reason))
+	if sig.envelope == "" {
+		return out + "\n"
+	}
+
+	out += fmt.Sprintf("[green]envelope: [white]%s, %s, signing scheme %s\n", sig.envelope, sig.algorithm, sig.signingScheme)
+	if !sig.signingTime.IsZero() {
+		out += fmt.Sprintf("[green]signed: [white]%s\n", sig.signingTime.Format(time.RFC3339))
+	}
+	if sig.expiry != nil {
+		out += fmt.Sprintf("[green]expires: [white]%s\n", sig.expiry.Format(time.RFC3339))
+	}
+	if sig.signingAgent != "" {
+		out += fmt.Sprintf("[green]signing agent: [white]%s\n", tview.Escape(sig.signingAgent))
+	}
+	if sig.target.Digest != "" {
+		out += fmt.Sprintf("[green]signs: [blue]%s[white] (%s, %d bytes)\n", sig.target.Digest, sig.target.MediaType, sig.target.Size)
+	}
+	if sig.policy != "" {
+		out += fmt.Sprintf("[green]trust policy: [white]%s\n", tview.Escape(sig.policy))
+	}
+	out += "[green]certificate chain:[white]\n"
+	for idx, cert := range sig.certs {
+		fingerprint := sha256.Sum256(cert.Raw)
+		out += fmt.Sprintf("  %d. %s\n     issued by %s\n     valid %s to %s\n     sha256 %s\n", idx,
+			tview.Escape(cert.Subject.String()), tview.Escape(cert.Issuer.String()),
+			cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339),
+			hex.EncodeToString(fingerprint[:]))
+	}
+	return out + "\n"
+}
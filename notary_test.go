@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// a CA and a code signing certificate it issued
+type testSigner struct {
+	caCert   *x509.Certificate
+	caKey    crypto.Signer
+	leafCert *x509.Certificate
+	leafKey  crypto.Signer
+	signedAt time.Time // the signing time its envelopes claim
+}
+
+func newTestCertificate(t *testing.T, template, parent *x509.Certificate, pub crypto.PublicKey, parentKey crypto.Signer) *x509.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// a signer whose key is RSA if rsaKey, ECDSA P-256 otherwise, with
+// certificates valid now
+func newTestSigner(t *testing.T, caName string, rsaKey bool) *testSigner {
+	t.Helper()
+	return newTestSignerAt(t, caName, rsaKey, time.Now().UTC().Truncate(time.Second))
+}
+
+// a signer that signs at signedAt, with certificates valid for an hour either
+// side of it
+func newTestSignerAt(t *testing.T, caName string, rsaKey bool, signedAt time.Time) *testSigner {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: caName, Organization: []string{"Acme"}},
+		NotBefore:             signedAt.Add(-time.Hour),
+		NotAfter:              signedAt.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caCert := newTestCertificate(t, caTemplate, caTemplate, caKey.Public(), caKey)
+
+	var leafKey crypto.Signer
+	if rsaKey {
+		leafKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		leafKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "signer", Organization: []string{"Acme"}, Country: []string{"US"}},
+		NotBefore:    signedAt.Add(-time.Hour),
+		NotAfter:     signedAt.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	leafCert := newTestCertificate(t, leafTemplate, caCert, leafKey.Public(), caKey)
+	return &testSigner{caCert: caCert, caKey: caKey, leafCert: leafCert, leafKey: leafKey, signedAt: signedAt}
+}
+
+// sign data with the algorithm notation uses for the key
+func (s *testSigner) sign(t *testing.T, data []byte) []byte {
+	t.Helper()
+	hashed := crypto.SHA256.New()
+	hashed.Write(data)
+	switch key := s.leafKey.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, hashed.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	case *ecdsa.PrivateKey:
+		r, sVal, err := ecdsa.Sign(rand.Reader, key, hashed.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), sVal.FillBytes(make([]byte, 32))...)
+	}
+	t.Fatalf("unsupported key %T", s.leafKey)
+	return nil
+}
+
+func (s *testSigner) algorithm() string {
+	if _, ok := s.leafKey.(*rsa.PrivateKey); ok {
+		return "PS256"
+	}
+	return "ES256"
+}
+
+func notaryPayload(t *testing.T, target ispec.Descriptor) []byte {
+	t.Helper()
+	payload, err := json.Marshal(map[string]interface{}{"targetArtifact": target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// a JWS envelope signing target, as notation makes them
+func (s *testSigner) jwsEnvelope(t *testing.T, target ispec.Descriptor, expiry *time.Time) []byte {
+	t.Helper()
+	protected := map[string]interface{}{
+		"alg":                          s.algorithm(),
+		"cty":                          notaryPayloadType,
+		"crit":                         []string{"io.cncf.notary.signingScheme"},
+		"io.cncf.notary.signingScheme": "notary.x509",
+		"io.cncf.notary.signingTime":   s.signedAt.Format(time.RFC3339),
+	}
+	if expiry != nil {
+		protected["io.cncf.notary.expiry"] = expiry.Format(time.RFC3339)
+	}
+	protectedJSON, _ := json.Marshal(protected)
+	protectedB64 := base64.RawURLEncoding.EncodeToString(protectedJSON)
+	payloadB64 := base64.RawURLEncoding.EncodeToString(notaryPayload(t, target))
+	envelope := map[string]interface{}{
+		"payload":   payloadB64,
+		"protected": protectedB64,
+		"header": map[string]interface{}{
+			"x5c": []string{
+				base64.StdEncoding.EncodeToString(s.leafCert.Raw),
+				base64.StdEncoding.EncodeToString(s.caCert.Raw),
+			},
+			"io.cncf.notary.signingAgent": "notation/1.0.0",
+		},
+		"signature": base64.RawURLEncoding.EncodeToString(s.sign(t, []byte(protectedB64+"."+payloadB64))),
+	}
+	data, _ := json.Marshal(envelope)
+	return data
+}
+
+// a COSE_Sign1 envelope signing target
+func (s *testSigner) coseEnvelope(t *testing.T, target ispec.Descriptor) []byte {
+	t.Helper()
+	alg := int64(-7)
+	if s.algorithm() == "PS256" {
+		alg = -37
+	}
+	protected, err := encodeCBOR(map[interface{}]interface{}{
+		int64(coseHeaderAlgorithm):     alg,
+		int64(coseHeaderType):          notaryPayloadType,
+		"io.cncf.notary.signingScheme": "notary.x509",
+		"io.cncf.notary.signingTime":   cborTag{number: cborTagEpochTime, content: s.signedAt.Unix()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := notaryPayload(t, target)
+	toSign, err := encodeCBOR([]interface{}{"Signature1", protected, []byte{}, payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := encodeCBOR(cborTag{number: coseSign1Tag, content: []interface{}{
+		protected,
+		map[interface{}]interface{}{
+			int64(coseHeaderX5Chain):      []interface{}{s.leafCert.Raw, s.caCert.Raw},
+			"io.cncf.notary.signingAgent": "notation/1.0.0",
+		},
+		payload,
+		s.sign(t, toSign),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+// add a notary signature of subject with the given envelope
+func (b *layoutBuilder) addNotaryEnvelope(subject ispec.Descriptor, mediaType string, envelope []byte) ispec.Descriptor {
+	b.t.Helper()
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: ArtifactTypeNotarySignature,
+		Config:       b.writeBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       []ispec.Descriptor{b.writeBlob(mediaType, envelope)},
+		Subject:      &subject,
+	}
+	desc := b.writeJSONBlob(ispec.MediaTypeImageManifest, manifest)
+	b.addToIndex(desc, "")
+	return desc
+}
+
+// a notation trust dir trusting the CAs of signers, with a policy for
+// scope
+func writeTrustDir(t *testing.T, scope string, identities []string, signers ...*testSigner) string {
+	t.Helper()
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "truststore", "x509", "ca", "acme")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for idx, s := range signers {
+		pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})
+		if err := os.WriteFile(filepath.Join(storeDir, string(rune('a'+idx))+".pem"), pemData, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := notaryTrustPolicyDocument{Version: "1.0", TrustPolicies: []notaryTrustPolicy{{
+		Name:              "acme-images",
+		RegistryScopes:    []string{scope},
+		TrustStores:       []string{"ca:acme"},
+		TrustedIdentities: identities,
+	}}}
+	policy.TrustPolicies[0].SignatureVerification.Level = "strict"
+	data, _ := json.Marshal(policy)
+	if err := os.WriteFile(filepath.Join(dir, "trustpolicy.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestVerifyNotarySignature(t *testing.T) {
+	signer := newTestSigner(t, "acme root", false)
+	rsaSigner := newTestSigner(t, "acme rsa root", true)
+	stranger := newTestSigner(t, "someone else", false)
+	// its certificate expired yesterday, but its envelopes claim to be
+	// signed while it was valid
+	expired := newTestSignerAt(t, "acme root", false, time.Now().UTC().Add(-48*time.Hour).Truncate(time.Second))
+	past := fixtureTime.Add(-time.Minute)
+
+	tests := []struct {
+		name       string
+		mediaType  string
+		envelope   func(subject ispec.Descriptor) []byte
+		trustDir   func() string
+		status     signatureStatus
+		reason     string
+		envelopeIs string
+	}{
+		{
+			name:      "jws",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return signer.jwsEnvelope(t, subject, nil) },
+			trustDir:  func() string { return writeTrustDir(t, "*", []string{"*"}, signer) },
+			status:    signatureVerified,
+			reason:    `trusted by policy "acme-images"`,
+		},
+		{
+			name:      "cose rsa",
+			mediaType: MediaTypeCOSEEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return rsaSigner.coseEnvelope(t, subject) },
+			trustDir:  func() string { return writeTrustDir(t, "*", []string{"*"}, rsaSigner) },
+			status:    signatureVerified,
+		},
+		{
+			name:      "cose ecdsa, a trusted identity",
+			mediaType: MediaTypeCOSEEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return signer.coseEnvelope(t, subject) },
+			trustDir: func() string {
+				return writeTrustDir(t, "*", []string{"x509.subject: O=Other", "x509.subject: CN=signer, O=Acme, C=US"}, signer)
+			},
+			status: signatureVerified,
+		},
+		{
+			name:      "untrusted identity",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return signer.jwsEnvelope(t, subject, nil) },
+			trustDir:  func() string { return writeTrustDir(t, "*", []string{"x509.subject: CN=signer, O=Other"}, signer) },
+			status:    signatureUntrusted,
+			reason:    "isn't a trusted identity",
+		},
+		{
+			name:      "untrusted CA",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return signer.jwsEnvelope(t, subject, nil) },
+			trustDir:  func() string { return writeTrustDir(t, "*", []string{"*"}, stranger) },
+			status:    signatureUntrusted,
+			reason:    "certificate chain isn't trusted",
+		},
+		{
+			name:      "no policy for local layouts",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return signer.jwsEnvelope(t, subject, nil) },
+			trustDir:  func() string { return writeTrustDir(t, "registry.example.com/web", []string{"*"}, signer) },
+			status:    signatureUntrusted,
+			reason:    `no trust policy applies to ""`,
+		},
+		{
+			name:      "no trust dir",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return signer.jwsEnvelope(t, subject, nil) },
+			trustDir:  func() string { return "" },
+			status:    signatureUntrusted,
+			reason:    "no trust policy",
+		},
+		{
+			name:      "tampered",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope: func(subject ispec.Descriptor) []byte {
+				return []byte(strings.Replace(string(signer.jwsEnvelope(t, subject, nil)), `"signature":"`, `"signature":"AAAA`, 1))
+			},
+			trustDir: func() string { return writeTrustDir(t, "*", []string{"*"}, signer) },
+			status:   signatureInvalid,
+			reason:   "doesn't verify",
+		},
+		{
+			name:      "another subject",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope: func(subject ispec.Descriptor) []byte {
+				subject.Digest = digest.FromString("something else")
+				return signer.jwsEnvelope(t, subject, nil)
+			},
+			trustDir: func() string { return writeTrustDir(t, "*", []string{"*"}, signer) },
+			status:   signatureInvalid,
+			reason:   "not its subject",
+		},
+		{
+			name:      "expired",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return signer.jwsEnvelope(t, subject, &past) },
+			trustDir:  func() string { return writeTrustDir(t, "*", []string{"*"}, signer) },
+			status:    signatureInvalid,
+			reason:    "expired",
+		},
+		{
+			name:      "expired certificate, backdated",
+			mediaType: MediaTypeJWSEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return expired.jwsEnvelope(t, subject, nil) },
+			trustDir:  func() string { return writeTrustDir(t, "*", []string{"*"}, expired) },
+			status:    signatureUntrusted,
+			reason:    "expired",
+		},
+		{
+			name:      "not cbor",
+			mediaType: MediaTypeCOSEEnvelope,
+			envelope:  func(subject ispec.Descriptor) []byte { return []byte{0x84, 0x40} },
+			trustDir:  func() string { return "" },
+			status:    signatureInvalid,
+			reason:    "truncated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetGlobals(t)
+			dir := t.TempDir()
+			b := newLayoutBuilder(t, dir)
+			image := b.addImage("web", "rootfs")
+			b.addNotaryEnvelope(image, tt.mediaType, tt.envelope(image))
+			b.save()
+			NotaryTrustDir = tt.trustDir()
+			loadFixtureTree(t, &standardFixture{dir: dir})
+
+			var sig *notarySignature
+			for _, info := range ImageInfoMap {
+				if info.notary != nil {
+					sig = info.notary
+				}
+			}
+			if sig == nil {
+				t.Fatal("the signature wasn't verified")
+			}
+			if sig.status != tt.status || !strings.Contains(sig.reason, tt.reason) {
+				t.Errorf("status %s (%s), want %s (%s)", sig.status, sig.reason, tt.status, tt.reason)
+			}
+			if tt.status == signatureVerified {
+				if len(sig.certs) != 2 || sig.signingAgent != "notation/1.0.0" || !sig.signingTime.Equal(signer.signedAt) || sig.target.Digest != image.Digest {
+					t.Errorf("signature details = %+v", sig)
+				}
+				if info := sig.infoString(); !strings.Contains(info, "[green]verified") || !strings.Contains(info, "CN=signer,O=Acme,C=US") {
+					t.Errorf("info:\n%s", info)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteNotarySignature(t *testing.T) {
+	resetGlobals(t)
+	signer := newTestSigner(t, "acme root", false)
+	fr := newFakeRegistry(t)
+	image := fr.addImageWithBlobs("app", "1.0", "base")
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: ArtifactTypeNotarySignature,
+		Config:       fr.addBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       []ispec.Descriptor{fr.addBlob(MediaTypeJWSEnvelope, signer.jwsEnvelope(t, image, nil))},
+		Subject:      &image,
+	}
+	fr.addManifest("app", "", ispec.MediaTypeImageManifest, manifest)
+	NotaryTrustDir = writeTrustDir(t, fr.host()+"/app", []string{"*"}, signer)
+
+	_, node := newTestRemoteRoot(t, fr, "/app:1.0")
+	loadRemote(t, node)
+	if got := node.GetChildren()[0].GetText(); !strings.HasPrefix(got, "🔒 Notary Signature ") || !strings.HasSuffix(got, "✅ verified") {
+		t.Errorf("signature node = %q", got)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	value := map[interface{}]interface{}{
+		int64(1):  int64(-37),
+		int64(33): []interface{}{[]byte("der"), []byte{}},
+		"time":    cborTag{number: 1, content: int64(1700000000)},
+		"flags":   []interface{}{true, false, nil, int64(1 << 40)},
+	}
+	data, err := encodeCBOR(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, rest, err := decodeCBOR(data)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("decode: %v, %d bytes left", err, len(rest))
+	}
+	again, _ := encodeCBOR(got)
+	if string(again) != string(data) {
+		t.Errorf("round trip changed the encoding: %x, want %x", again, data)
+	}
+
+	for _, bad := range [][]byte{
+		{},
+		{0x5a, 0xff, 0xff, 0xff, 0xff}, // a byte string longer than the data
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // an enormous array
+		{0x5f},             // indefinite length
+		{0xa1, 0x40, 0x00}, // a byte string map key
+		[]byte(strings.Repeat("\x81", maxCBORDepth+2) + "\x00"),
+	} {
+		if _, _, err := decodeCBOR(bad); err == nil {
+			t.Errorf("decodeCBOR(%x): expected an error", bad)
+		}
+	}
+}
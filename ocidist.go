@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	_ "crypto/sha512" // so go-digest can verify sha512 blobs
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 
 	"path/filepath"
 	"strings"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/umoci/oci/casext"
 
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -32,6 +37,59 @@ func getBlob(layer *ispec.Descriptor, layoutpath string) ([]byte, error) {
 	return blobBytes, nil
 }
 
+// like oci.FromDescriptor, but also reads blobs with digest algorithms other
+// than sha256, which umoci refuses to open.
+func fromDescriptor(oci casext.Engine, layoutpath string, descriptor ispec.Descriptor) (*casext.Blob, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %w", descriptor.Digest, err)
+	}
+	if descriptor.Digest.Algorithm() == digest.SHA256 {
+		return oci.FromDescriptor(context.Background(), descriptor)
+	}
+
+	blobBytes, err := getBlob(&descriptor, layoutpath)
+	if err != nil {
+		return nil, err
+	}
+	return parseBlob(descriptor, blobBytes)
+}
+
+// the media type of docker image configs, which are close enough to OCI ones
+const MediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+
+// verify a blob against its descriptor and parse it like umoci does:
+// manifests, indexes and configs are unmarshalled, other blobs are left as a
+// reader. docker manifests and configs are parsed as their OCI equivalents.
+func parseBlob(descriptor ispec.Descriptor, blobBytes []byte) (*casext.Blob, error) {
+	verifier := descriptor.Digest.Verifier()
+	if _, err := verifier.Write(blobBytes); err != nil || !verifier.Verified() {
+		return nil, fmt.Errorf("blob %s failed verification", descriptor.Digest)
+	}
+
+	var err error
+	blob := &casext.Blob{Descriptor: descriptor}
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest, MediaTypeDockerManifest:
+		var manifest ispec.Manifest
+		err = json.Unmarshal(blobBytes, &manifest)
+		blob.Data = manifest
+	case ispec.MediaTypeImageIndex, MediaTypeDockerManifestList:
+		var index ispec.Index
+		err = json.Unmarshal(blobBytes, &index)
+		blob.Data = index
+	case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
+		var config ispec.Image
+		err = json.Unmarshal(blobBytes, &config)
+		blob.Data = config
+	default:
+		blob.Data = io.NopCloser(bytes.NewReader(blobBytes))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", descriptor.MediaType, err)
+	}
+	return blob, nil
+}
+
 func getReferrersForImage(oci casext.Engine, layoutpath string, image *ispec.Descriptor) (*ispec.Index, error) {
 	ociIndex, err := oci.GetIndex(context.Background())
 	if err != nil {
@@ -46,14 +104,17 @@ func getReferrersForImage(oci casext.Engine, layoutpath string, image *ispec.Des
 
 			// get the blob @ manifest.Digest
 			// we can't use oci since it doesn't yet support "subject" descriptors
+			// skip unreadable manifests, they are shown as errors where they are listed
 			blob, err := getBlob(&indexManifest, layoutpath)
 			if err != nil {
-				return nil, fmt.Errorf("Failed to read index manifest blob: %s", err)
+				slog.Warn("failed to read index manifest blob", "digest", indexManifest.Digest, "err", err)
+				continue
 			}
 
 			var refManifest ispec.Manifest
 			if err := json.Unmarshal(blob, &refManifest); err != nil {
-				return nil, fmt.Errorf("Failed to unmarshal index manifest blob into manifest: %s", err)
+				slog.Warn("failed to unmarshal index manifest blob into manifest", "digest", indexManifest.Digest, "err", err)
+				continue
 			}
 
 			if refManifest.Subject == nil {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/umoci"
+)
+
+func TestGetReferrersForImage(t *testing.T) {
+	f := newStandardFixture(t)
+	oci, err := umoci.OpenLayout(f.apps.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oci.Close()
+
+	out := ""
+	for _, tag := range []string{"web", "db", "readme"} {
+		desc := taggedDescriptor(t, f.apps, tag)
+		refs, err := getReferrersForImage(oci, f.apps.path, &desc)
+		if err != nil {
+			t.Fatalf("getting referrers for %s: %v", tag, err)
+		}
+		out += fmt.Sprintf("%s: %d referrers\n", tag, len(refs.Manifests))
+		for _, ref := range refs.Manifests {
+			out += fmt.Sprintf("  %s %s %s\n", ref.ArtifactType, ref.MediaType, ref.Digest)
+		}
+	}
+	checkGolden(t, "referrers", out)
+}
+
+func TestFromDescriptorSha512(t *testing.T) {
+	resetGlobals(t)
+	b := newLayoutBuilder(t, filepath.Join(t.TempDir(), "layout"))
+	desc := b.addSha512Image("sha512-image", "rootfs")
+	b.save()
+
+	oci, err := umoci.OpenLayout(b.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oci.Close()
+
+	info := loadImageManifest(oci, imageref{layoutpath: b.path, tag: "sha512-image", hash: digestHash(desc.Digest)}, desc)
+	if info.err != nil {
+		t.Fatalf("loading sha512 image: %v", info.err)
+	}
+	if len(info.layerDigests) != 1 {
+		t.Errorf("expected 1 layer, got %d", len(info.layerDigests))
+	}
+}
@@ -2,19 +2,20 @@ package main
 
 import (
 	"bytes"
-	"context"
-	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/umoci/oci/casext"
 
 	"github.com/rivo/tview"
@@ -23,6 +24,32 @@ import (
 const OCIImageTitleAnnotation = "org.opencontainers.image.title"
 const UmociUncompressedSizeAnnotation = "ci.umo.uncompressed_blob_size"
 
+// the hash part of a digest, without the "sha256:" (or other algorithm)
+// prefix. malformed digests are returned whole.
+func digestHash(d digest.Digest) string {
+	if _, hash, ok := strings.Cut(d.String(), ":"); ok {
+		return hash
+	}
+	return d.String()
+}
+
+// the abbreviated hash we display in tables
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
+
+// the path of the blob for a digest in a layout, for any digest algorithm
+func blobPath(layoutpath string, d digest.Digest) string {
+	algo, hash, ok := strings.Cut(d.String(), ":")
+	if !ok {
+		algo, hash = "sha256", d.String()
+	}
+	return filepath.Join(layoutpath, "blobs", algo, hash)
+}
+
 type imageref struct {
 	layoutpath string
 	tag        string
@@ -33,21 +60,20 @@ type imageref struct {
 	targetHash string
 }
 
-func (ir *imageref) summary() string {
+func (ir *imageref) summary(width int) string {
 	info, ok := ImageInfoMap[ir.hash]
 	if !ok {
 		errmsg := fmt.Sprintf("no info for %+v", ir)
-		log.Printf("%s\n", errmsg)
+		slog.Error("no image info", "ref", fmt.Sprintf("%+v", ir))
 		return errmsg
 	}
-	return getImageInfoString(*ir, info)
+	return getImageInfoString(*ir, info, width)
 }
 
 func (ir imageref) searchString() []string {
 	info, ok := ImageInfoMap[ir.hash]
 	if !ok {
-		errmsg := fmt.Sprintf("no info for %+v", ir)
-		log.Printf("%s\n", errmsg)
+		slog.Error("no image info", "ref", fmt.Sprintf("%+v", ir))
 		return []string{}
 	}
 	subjectHash, subjectName := info.getSubjectInfo()
@@ -62,15 +88,20 @@ func (ir imageref) searchString() []string {
 		annotationStr += fmt.Sprintf("%s %s", k, v)
 	}
 
-	if info.configBlob.Descriptor.MediaType == "application/vnd.oci.image.config.v1+json" {
-		config := info.configBlob.Data.(ispec.Image)
-		configStr += fmt.Sprintf("%s %s", config.Config.Entrypoint, config.Config.Cmd)
+	if info.configBlob != nil && info.configBlob.Descriptor.MediaType == ispec.MediaTypeImageConfig {
+		configStr += fmt.Sprintf("%s %s", info.config.Config.Entrypoint, info.config.Config.Cmd)
 	}
 	searchComponents := []string{info.manifestDescriptor.Digest.String(),
 		ir.layoutpath, ir.tag, ir.hash,
 		info.manifest.ArtifactType,
 		subjectHash, subjectName, configStr, annotationStr}
 	searchComponents = append(searchComponents, info.layerDigests...)
+	searchComponents = append(searchComponents, inTotoSearchStrings(info.attestations)...)
+	for _, doc := range info.sboms {
+		searchComponents = append(searchComponents, doc.searchStrings()...)
+	}
+	// packages in SBOMs attached to this image
+	searchComponents = append(searchComponents, SBOMPackageMap[ir.hash]...)
 	return searchComponents
 }
 
@@ -83,17 +114,39 @@ type imageInfo struct {
 	configBlob         *casext.Blob
 	config             ispec.Image
 	layerDigests       []string
-	filename           string // used for artifacts, when config is empty and there is one layer with a title annotation
+	filename           string               // used for artifacts, when config is empty and there is one layer with a title annotation
+	notary             *notarySignature     // for notary signatures
+	cosign             *cosignArtifact      // for cosign signatures and attestations
+	attestations       []*inTotoAttestation // for other in-toto attestations
+	sboms              []*sbomDocument      // for SBOM artifacts
+	previewFetch       blobFetcher          // for other artifacts, to preview their layers when shown
 	err                error
 }
 
+// the hashes of the image's diffIDs, from its config
+func (ii *imageInfo) diffIDHashes() []string {
+	hashes := []string{}
+	for _, diffID := range ii.config.RootFS.DiffIDs {
+		hashes = append(hashes, digestHash(diffID))
+	}
+	return hashes
+}
+
+// the hash of a layer's diffID, or "" if the config doesn't have it
+func (ii *imageInfo) diffIDHash(idx int) string {
+	if idx >= len(ii.config.RootFS.DiffIDs) {
+		return ""
+	}
+	return digestHash(ii.config.RootFS.DiffIDs[idx])
+}
+
 // return hash and name if available
 func (ii *imageInfo) getSubjectInfo() (string, string) {
 	if ii.manifest.Subject == nil {
 		return "", ""
 	}
 	subjectName := "-"
-	subjectHash := ii.manifest.Subject.Digest.String()[7:]
+	subjectHash := digestHash(ii.manifest.Subject.Digest)
 	subjInfo, ok := ImageInfoMap[subjectHash]
 	if ok {
 		subjectName = subjInfo.displayLabel
@@ -127,10 +180,25 @@ type layerRef struct {
 	hash          string
 	displayString string
 	mediaType     string
+	names         []string // every known name, displayString may be shortened
+	shortNames    []string // names shortened, fitted to the tree's width when it's drawn
+
+	remote *remoteBlob // for layers in a registry
 }
 
 var LayerSummaryCache = map[string]string{}
 
+// where the layer's file listing is kept once it's made
+func (lr layerRef) fileListFilename() string {
+	return fmt.Sprintf("/tmp/%s-filelist", lr.hash)
+}
+
+// whether the layer's files have been listed already
+func (lr layerRef) listed() bool {
+	_, err := os.Stat(lr.fileListFilename())
+	return err == nil
+}
+
 func (lr layerRef) summary(filter string) string {
 	layerfilterkey := lr.blobfilepath + "\\" + filter
 	cachedSummary, ok := LayerSummaryCache[layerfilterkey]
@@ -138,8 +206,13 @@ func (lr layerRef) summary(filter string) string {
 		return cachedSummary
 	}
 
-	fileListFilename := fmt.Sprintf("/tmp/%s-filelist", lr.hash)
-	if _, err := os.Stat(fileListFilename); os.IsNotExist(err) {
+	fileListFilename := lr.fileListFilename()
+	if _, err := os.Stat(fileListFilename); os.IsNotExist(err) && lr.remote != nil {
+		if err := lr.remote.writeFileList(lr.mediaType, fileListFilename); err != nil {
+			slog.Error("listing remote layer blob", "blob", lr.blobfilepath, "err", err)
+			return fmt.Sprintf(" error: %v", err)
+		}
+	} else if os.IsNotExist(err) {
 		cmdstr := "tar tzvf " + lr.blobfilepath
 		if strings.Contains(lr.mediaType, "squashfs") {
 			cmdstr = "unsquashfs -llc " + lr.blobfilepath
@@ -147,7 +220,7 @@ func (lr layerRef) summary(filter string) string {
 		cmd := exec.Command("sh", "-c", cmdstr+" > "+fileListFilename)
 		err := cmd.Run()
 		if err != nil {
-			log.Printf("error: %v", err)
+			slog.Error("listing layer blob", "blob", lr.blobfilepath, "err", err)
 			return fmt.Sprintf(" error: %v", err)
 		}
 	}
@@ -164,10 +237,14 @@ func (lr layerRef) summary(filter string) string {
 	cmd.Stderr = &stderr
 	err := cmd.Run()
 	if err != nil {
-		log.Printf("error: %v", err)
+		slog.Error("filtering layer file list", "blob", lr.blobfilepath, "filter", filter, "err", err)
 	}
 
-	summaryString := fmt.Sprintf("file listing of blob %q (%s)\n\n%s\n%s", lr.displayString, lr.mediaType, out.String(), stderr.String())
+	namesString := ""
+	if len(lr.names) > 1 {
+		namesString = "known as:\n  " + strings.Join(lr.names, "\n  ") + "\n\n"
+	}
+	summaryString := fmt.Sprintf("file listing of blob %q (%s)\n\n%s%s\n%s", lr.displayString, lr.mediaType, namesString, out.String(), stderr.String())
 	LayerSummaryCache[layerfilterkey] = summaryString
 	return summaryString
 }
@@ -190,30 +267,50 @@ func displayStringForMediaType(mediatype string) string {
 	}
 }
 
-func getImageInfoString(ref imageref, info imageInfo) string {
+// history timestamps are optional
+func formatCreated(created *time.Time) string {
+	if created == nil {
+		return "-"
+	}
+	return created.Format(time.RFC822)
+}
+
+// the info pane's text for an image. names in its tables are fitted to width
+// columns, or not at all if it's 0.
+func getImageInfoString(ref imageref, info imageInfo, width int) string {
 
-	log.Printf("getImageInfoString(ref %v)", ref)
+	slog.Debug("getImageInfoString", "ref", fmt.Sprintf("%v", ref))
 
-	digest := info.manifestDescriptor.Digest.String()
-	if len(digest) >= 7 {
-		digest = digest[7:]
-	} else {
-		//log.Printf("HEY digest wasn't big enough for ref %+v? '%v'\n", ref, digest)
-		digest = "error getting manifest descriptor!"
+	manifestLabel := "manifest blob path"
+	manifestPath := "error getting manifest descriptor!"
+	if info.manifestDescriptor.Digest != "" {
+		manifestPath = blobPath(ref.layoutpath, info.manifestDescriptor.Digest)
+		if isRemoteRoot(ref.layoutpath) {
+			manifestLabel = "manifest"
+			manifestPath = ref.layoutpath + "@" + info.manifestDescriptor.Digest.String()
+		}
 	}
 
-	hdr := fmt.Sprintf("[yellow]# %s:%s\n[green]manifest blob path: [blue]%s[white]\n\n", filepath.Base(ref.layoutpath), info.displayName,
-		filepath.Join(ref.layoutpath, "blobs", "sha256", digest))
+	hdr := fmt.Sprintf("[yellow]# %s:%s\n[green]%s: [blue]%s[white]\n\n", filepath.Base(ref.layoutpath), info.displayName,
+		manifestLabel, manifestPath)
 	artifactType := "unset"
 	if info.manifest.ArtifactType != "" {
 		artifactType = info.manifest.ArtifactType
 	}
 	hdr += fmt.Sprintf("[yellow]# ArtifactType: [blue]%s[white]\n\n", artifactType)
 
+	if baseImage := baseImageDescription(info.layerDigests, info.diffIDHashes()); baseImage != "" {
+		hdr += fmt.Sprintf("[yellow]# Base image: [blue]%s[white]\n\n", baseImage)
+	}
+	if info.manifest.Config.Digest != "" {
+		if names := knownImagesForConfig(info.manifest.Config.Digest.String()); len(names) > 0 {
+			hdr += fmt.Sprintf("[yellow]# Known as: [blue]%s[white] (same config)\n\n", tview.Escape(strings.Join(names, ", ")))
+		}
+	}
+
 	if info.err != nil {
-		errmsg := fmt.Sprintf("\nERROR reading image: %v\n", info.err)
 		hdr += fmt.Sprintf("\n[red:yellow]ERROR reading image: %v[white:-]\n", info.err)
-		log.Println(errmsg)
+		slog.Error("reading image", "hash", ref.hash, "err", info.err)
 	}
 
 	subjectHash, subjectName := info.getSubjectInfo()
@@ -221,94 +318,139 @@ func getImageInfoString(ref imageref, info imageInfo) string {
 		hdr += fmt.Sprintf("\n[yellow]# Referrer Info:\n[green]subject hash: [blue]%s\n[green]subject name: %s\n\n",
 			subjectHash, subjectName)
 	}
+	if info.notary != nil {
+		hdr += info.notary.infoString()
+	}
+	if info.cosign != nil {
+		hdr += info.cosign.infoString()
+	}
+	if info.attestations != nil {
+		hdr += inTotoInfoString(info.attestations)
+	}
+	if info.sboms != nil {
+		hdr += fmt.Sprintf("[yellow]# SBOMs: %d[white]\n", len(info.sboms))
+		for _, doc := range info.sboms {
+			hdr += doc.infoString()
+		}
+		hdr += "\n"
+	}
+	if info.previewFetch != nil {
+		hdr += previewsInfoString(artifactPreviews(info))
+	}
 
 	manifestBuf := new(bytes.Buffer)
 	manifestTW := tabwriter.NewWriter(manifestBuf, 1, 1, 2, ' ', tabwriter.AlignRight)
-	fmt.Fprintln(manifestTW, strings.Join([]string{"[blue]blob sha[white]", "tar sha", "names", "type", "created", "sz (kb)", "tar sz (kb)", "author"}, "\t")+"\t")
+	manifestTable := namesTable{
+		rows:     [][]string{{"[blue]blob sha[white]", "tar sha", "names", "type", "created", "sz (kb)", "tar sz (kb)", "author"}},
+		names:    [][]string{nil},
+		namesCol: 2,
+	}
 	manifestTableHeader := fmt.Sprintf("[yellow]# %d layers in manifest[white]\n(note tar* fields refer to the uncompressed blob)\n", len(info.manifest.Layers))
 
 	for idx, layer := range info.manifest.Layers {
-		digest := layer.Digest.String()[7:]
+		digest := digestHash(layer.Digest)
 
 		uncompressedSizeAnnotation := "missing"
 		if val, ok := layer.Annotations[UmociUncompressedSizeAnnotation]; ok {
 			uncompressedSizeAnnotation = val
 		}
 
-		var layerNames = getShortStringForNames(getNamesForHash(digest))
-
 		diffIDHash := "-"
 		if len(info.config.RootFS.DiffIDs) > idx {
-			diffIDHash = info.config.RootFS.DiffIDs[idx].String()[7:14]
+			diffIDHash = shortHash(digestHash(info.config.RootFS.DiffIDs[idx]))
 		}
 
-		fmt.Fprintln(manifestTW, strings.Join([]string{
-			fmt.Sprintf("[blue]%s[white]", digest[:7]),
+		manifestTable.add([]string{
+			fmt.Sprintf("[blue]%s[white]", shortHash(digest)),
 			diffIDHash,
-			strings.Join(layerNames, ","),
+			"",
 			displayStringForMediaType(layer.MediaType),
 			"-",
 			fmt.Sprintf("%d", layer.Size/1024.0),
 			uncompressedSizeAnnotation,
-			"-"}, "\t")+"\t")
+			"-"}, getShortStringForNames(getNamesForLayer(digest, info.diffIDHash(idx))))
 
 	}
+	manifestTable.write(manifestTW, width, 2)
 	manifestTW.Flush()
 
+	if sources := knownNameSources(info.layerDigests, info.diffIDHashes()); sources != "" {
+		manifestBuf.WriteString("\n[yellow]# Known layer names, and where they're from[white]\n" + sources)
+	}
+
 	// TODO make config history collapsible
 	cfgHistBuf := new(bytes.Buffer)
 	cfgHistHeader := ""
 	if len(info.config.History) > 0 {
 		cfgHistHeader = fmt.Sprintf("\n\n[yellow]# %d entries in Runtime Config History:[white]\n(note, some entries here do not correspond to blob layers)\n", len(info.config.History))
 		cfgHistTW := tabwriter.NewWriter(cfgHistBuf, 1, 1, 2, ' ', tabwriter.AlignRight)
-		fmt.Fprintln(cfgHistTW, strings.Join([]string{"[blue]blob digest[white]", "names", "type", "created", "blob size (kb)", "author"}, "\t")+"\t")
+		cfgHistTable := namesTable{
+			rows:     [][]string{{"[blue]blob digest[white]", "names", "type", "created", "blob size (kb)", "author"}},
+			names:    [][]string{nil},
+			namesCol: 1,
+		}
 
 		layerIdx := 0
 		for _, histEntry := range info.config.History {
 			if histEntry.EmptyLayer {
 				// only show fields from history entry, there is no matching layer from the manifest:
-				fmt.Fprintln(cfgHistTW, strings.Join([]string{
+				cfgHistTable.add([]string{
 					"[grey]empty[white]",
 					"-",            // name
 					"(cfg update)", // mediatype
-					histEntry.Created.Format(time.RFC822),
+					formatCreated(histEntry.Created),
 					"-",
-					histEntry.CreatedBy}, "\t")+"\t")
+					histEntry.CreatedBy}, nil)
 				continue
 			}
 
-			layer := info.manifest.Layers[layerIdx]
-			digest := layer.Digest.String()[7:]
+			if layerIdx >= len(info.manifest.Layers) {
+				// history claims more layers than the manifest has
+				cfgHistTable.add([]string{
+					"[red]missing[white]",
+					"-",
+					"-",
+					formatCreated(histEntry.Created),
+					"-",
+					histEntry.CreatedBy}, nil)
+				layerIdx++
+				continue
+			}
 
-			var layerNames = getNamesForHash(digest)
+			layer := info.manifest.Layers[layerIdx]
+			digest := digestHash(layer.Digest)
 
-			fmt.Fprintln(cfgHistTW, strings.Join([]string{
-				fmt.Sprintf("[blue]%s[white]", digest[:7]),
-				strings.Join(layerNames, ","),
+			cfgHistTable.add([]string{
+				fmt.Sprintf("[blue]%s[white]", shortHash(digest)),
+				"",
 				displayStringForMediaType(layer.MediaType),
-				histEntry.Created.Format(time.RFC822),
+				formatCreated(histEntry.Created),
 				fmt.Sprintf("%d", layer.Size/1024.0),
-				histEntry.CreatedBy}, "\t")+"\t")
+				histEntry.CreatedBy}, getShortStringForNames(getNamesForLayer(digest, info.diffIDHash(layerIdx))))
 			layerIdx++
 		}
+		cfgHistTable.write(cfgHistTW, width, 2)
 		cfgHistTW.Flush()
+
+		if layerIdx != len(info.manifest.Layers) {
+			cfgHistHeader += fmt.Sprintf("[red]WARNING: history has %d non-empty entries but the manifest has %d layers[white]\n",
+				layerIdx, len(info.manifest.Layers))
+		}
 	}
 
 	configInfo := "no config"
 	if info.configBlob != nil {
-		log.Printf("config blob desc mediatype is %s\n", info.configBlob.Descriptor.MediaType)
+		slog.Debug("config blob", "mediatype", info.configBlob.Descriptor.MediaType)
 
 		switch info.configBlob.Descriptor.MediaType {
 		case "application/vnd.oci.image.manifest.v1+json":
 			configInfo = "got a manifest configblob mediatype, expected?"
 
-		case "application/vnd.dev.cosign.artifact.sig.v1+json":
-			configInfo = "TODO: cosign artifact"
-		case "application/vnd.oci.image.config.v1+json":
-			config := info.configBlob.Data.(ispec.Image)
-
+		case ArtifactTypeCosignSignature:
+			configInfo = "Cosign signatures have an empty Config"
+		case "application/vnd.oci.image.config.v1+json", MediaTypeDockerConfig:
 			configInfo = tview.Escape(fmt.Sprintf("Entrypoint: %s\nCmd: %s",
-				config.Config.Entrypoint, config.Config.Cmd))
+				info.config.Config.Entrypoint, info.config.Config.Cmd))
 		case "application/vnd.cncf.notary.signature":
 			configInfo = "Notary Signatures have empty Config"
 		case "application/vnd.oci.empty.v1+json":
@@ -320,9 +462,14 @@ func getImageInfoString(ref imageref, info imageInfo) string {
 			)
 		}
 	}
+	annotationKeys := []string{}
+	for k := range info.manifest.Annotations {
+		annotationKeys = append(annotationKeys, k)
+	}
+	sort.Strings(annotationKeys)
 	annotationstr := ""
-	for k, v := range info.manifest.Annotations {
-		annotationstr += fmt.Sprintf("[green]%s[white]:\n%s\n\n", k, tview.Escape(v))
+	for _, k := range annotationKeys {
+		annotationstr += fmt.Sprintf("[green]%s[white]:\n%s\n\n", k, tview.Escape(info.manifest.Annotations[k]))
 	}
 
 	// TODO make config history collapsible
@@ -330,28 +477,35 @@ func getImageInfoString(ref imageref, info imageInfo) string {
 	return hdr + manifestTableHeader + manifestBuf.String() + cfgHistHeader + cfgHistBuf.String() + "\n\n[yellow]# Config[white]\n" + configInfo + "\n\n[yellow]# Annotations[white]\n" + annotationstr
 }
 
+// a directory we can't look in isn't a layout, so the walk reports why
 func isOCILayout(path string) bool {
-	if _, err := os.Stat(filepath.Join(path, "index.json")); errors.Is(err, os.ErrNotExist) {
-		return false
-	}
-	return true
+	_, err := os.Stat(filepath.Join(path, "index.json"))
+	return err == nil
 }
 
 func loadSubIndexManifest(oci casext.Engine, ref subIndexRef, manifestDescriptor ispec.Descriptor) subIndexInfo {
+	return loadSubIndexManifestFrom(layoutBlobFetcher(oci, ref.layoutpath), ref, manifestDescriptor)
+}
+
+func loadSubIndexManifestFrom(fetch blobFetcher, ref subIndexRef, manifestDescriptor ispec.Descriptor) subIndexInfo {
 	info := subIndexInfo{
 		ref: ref,
 	}
 
-	manifestBlob, err := oci.FromDescriptor(context.Background(), manifestDescriptor)
+	manifestBlob, err := fetch(manifestDescriptor)
 	if err != nil {
-		log.Printf("error getting manifest blob for tag %q: '%v'", ref.tag, err)
+		slog.Error("getting subindex blob", "tag", ref.tag, "err", err)
 		info.err = err
+		info.displayLabel = fmt.Sprintf("❌ error reading subindex %s: %v", ref.hash, err)
+		info.displayName = ref.hash
 		return info
 	}
 	index, ok := manifestBlob.Data.(ispec.Index)
 	if !ok {
-		log.Printf("error casting manifest blob data as an index for tag %s", ref.tag)
+		slog.Error("manifest blob data is not an index", "tag", ref.tag)
 		info.err = fmt.Errorf("couldn't read manifest blob")
+		info.displayLabel = fmt.Sprintf("❌ error reading subindex %s: %v", ref.hash, info.err)
+		info.displayName = ref.hash
 		return info
 	}
 
@@ -363,69 +517,175 @@ func loadSubIndexManifest(oci casext.Engine, ref subIndexRef, manifestDescriptor
 	return info
 }
 
+// fetches and parses a blob, from a local layout or a registry
+type blobFetcher func(descriptor ispec.Descriptor) (*casext.Blob, error)
+
+func layoutBlobFetcher(oci casext.Engine, layoutpath string) blobFetcher {
+	return func(descriptor ispec.Descriptor) (*casext.Blob, error) {
+		return fromDescriptor(oci, layoutpath, descriptor)
+	}
+}
+
+// a fetcher that reads blob files itself, for after the layout's engine is
+// closed
+func layoutFileBlobFetcher(layoutpath string) blobFetcher {
+	return func(descriptor ispec.Descriptor) (*casext.Blob, error) {
+		data, err := getBlob(&descriptor, layoutpath)
+		if err != nil {
+			return nil, err
+		}
+		return parseBlob(descriptor, data)
+	}
+}
+
+// is this a signature, attestation or SBOM, whose layers are read when it's
+// loaded
+func isDecodedArtifact(info imageInfo) bool {
+	return isNotarySignature(info) || isCosignImage(info) || isInTotoImage(info) || isSBOMImage(info)
+}
+
+// artifact blobs bigger than this aren't read to show what's in them
+const maxArtifactBlobSize = 4 << 20
+
+// the contents of a small blob of an artifact, like a signature envelope
+func readArtifactBlob(fetch blobFetcher, descriptor ispec.Descriptor) ([]byte, error) {
+	return readArtifactBlobUpTo(fetch, descriptor, maxArtifactBlobSize)
+}
+
+// the contents of a blob of an artifact, if it's no bigger than limit
+func readArtifactBlobUpTo(fetch blobFetcher, descriptor ispec.Descriptor, limit int64) ([]byte, error) {
+	if descriptor.Size > limit {
+		return nil, fmt.Errorf("blob %s is %d bytes, more than the %d we read", descriptor.Digest, descriptor.Size, limit)
+	}
+	blob, err := fetch(descriptor)
+	if err != nil {
+		return nil, err
+	}
+	reader, ok := blob.Data.(io.ReadCloser)
+	if !ok {
+		return nil, fmt.Errorf("blob %s is a %s, not a file", descriptor.Digest, descriptor.MediaType)
+	}
+	defer reader.Close()
+	return io.ReadAll(io.LimitReader(reader, limit))
+}
+
 func loadImageManifest(oci casext.Engine, ref imageref, manifestDescriptor ispec.Descriptor) imageInfo {
-	info := imageInfo{
+	info := loadImageManifestFrom(layoutBlobFetcher(oci, ref.layoutpath), ref, manifestDescriptor)
+	if isPreviewableArtifact(info) {
+		info.previewFetch = layoutFileBlobFetcher(ref.layoutpath)
+	}
+	return info
+}
+
+func loadImageManifestFrom(fetch blobFetcher, ref imageref, manifestDescriptor ispec.Descriptor) (info imageInfo) {
+	info = imageInfo{
 		ref:                ref,
 		manifestDescriptor: manifestDescriptor,
 	}
-	log.Printf("\n\nloadImageManifest loading %+v, descriptor %+v", ref, manifestDescriptor)
 
-	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
-		log.Printf("\nerror - was expecting an image manifest, got: %+v", manifestDescriptor)
+	// give images we couldn't read a label, so they show up as an error node
+	defer func() {
+		if info.err != nil && info.displayLabel == "" {
+			info.displayLabel = fmt.Sprintf("❌ error reading %s: %v", ref.hash, info.err)
+			info.displayName = ref.hash
+		}
+	}()
+
+	slog.Debug("loadImageManifest", "ref", fmt.Sprintf("%+v", ref), "descriptor", fmt.Sprintf("%+v", manifestDescriptor))
+
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest && manifestDescriptor.MediaType != MediaTypeDockerManifest {
+		slog.Error("expected an image manifest", "descriptor", fmt.Sprintf("%+v", manifestDescriptor))
 		info.err = fmt.Errorf("expecting image manifest, got %+v", manifestDescriptor)
 		return info
 	}
 
-	manifestBlob, err := oci.FromDescriptor(context.Background(), manifestDescriptor)
+	manifestBlob, err := fetch(manifestDescriptor)
 	if err != nil {
-		log.Printf("error getting manifest blob for tag %q: '%v'", ref.tag, err)
+		slog.Error("getting manifest blob", "tag", ref.tag, "err", err)
 		info.err = err
 		return info
 	}
 	manifest, ok := manifestBlob.Data.(ispec.Manifest)
 	if !ok {
-		log.Printf("error casting manifest blob data as a manifest for tag %s", ref.tag)
+		slog.Error("manifest blob data is not a manifest", "tag", ref.tag)
 		info.err = fmt.Errorf("couldn't read manifest blob")
 		return info
 	}
 	info.manifest = manifest
 
-	configBlob, err := oci.FromDescriptor(context.Background(), manifest.Config)
+	configBlob, err := fetch(manifest.Config)
 	if err != nil {
-		log.Printf("error getting config blob for tag %s: %v", ref.tag, err)
+		slog.Error("getting config blob", "tag", ref.tag, "err", err)
 		info.err = err
 		return info
 	}
-	log.Printf("configblob for tag %s is %+v", ref.tag, configBlob)
+	slog.Debug("config blob", "tag", ref.tag, "descriptor", fmt.Sprintf("%+v", configBlob.Descriptor))
 	info.configBlob = configBlob
 
 	config, ok := configBlob.Data.(ispec.Image)
 	if !ok {
-		log.Printf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+		slog.Debug("config blob is not an image config", "mediatype", configBlob.Descriptor.MediaType)
 	} else {
 		info.config = config
 	}
 
-	// add this image's tag as a known name for the top layer's digest
-	topLayer := info.manifest.Layers[len(info.manifest.Layers)-1]
-	dgst := topLayer.Digest.String()[7:]
-	LayerNameMap[dgst] = append(LayerNameMap[dgst], ref.tag)
+	// add this image's tag as a known name for the top layer's digest.
+	// artifacts may have no layers at all, and then there's nothing to name.
+	if len(info.manifest.Layers) > 0 {
+		topLayer := info.manifest.Layers[len(info.manifest.Layers)-1]
+		dgst := digestHash(topLayer.Digest)
+		if ref.tag != "" {
+			LayerNameMap[dgst] = append(LayerNameMap[dgst], ref.tag)
+		}
+	}
 
 	for _, layer := range info.manifest.Layers {
-		dgst := layer.Digest.String()[7:]
+		dgst := digestHash(layer.Digest)
 		info.layerDigests = append(info.layerDigests, dgst)
 	}
 
+	if isNotarySignature(info) {
+		info.notary = verifyNotarySignature(fetch, info)
+	} else if isCosignImage(info) {
+		info.cosign = verifyCosignImage(fetch, info)
+	} else if isInTotoImage(info) {
+		info.attestations = readInTotoAttestations(fetch, info)
+	} else if isSBOMImage(info) {
+		info.sboms = readSBOMs(fetch, info)
+	}
+	indexSBOMPackages(info)
+
 	// set the displayName based on the kind of thing this is
 	// if it's a tagged image, just use that:
-	if ref.tag != "" {
+	if info.cosign != nil {
+		info.displayLabel = info.cosign.label(ref)
+		info.displayName = ref.hash
+		if ref.tag != "" {
+			info.displayName = ref.tag
+		}
+	} else if info.attestations != nil {
+		info.displayLabel = inTotoLabel(ref, info.attestations)
+		info.displayName = ref.hash
+		if ref.tag != "" {
+			info.displayName = ref.tag
+		}
+	} else if info.sboms != nil {
+		info.displayLabel = sbomLabel(info)
+		info.displayName = ref.hash
+		if ref.tag != "" {
+			info.displayName = ref.tag
+		}
+	} else if ref.tag != "" {
 		info.displayLabel = fmt.Sprintf("🏷  image %q", ref.tag)
 		info.displayName = ref.tag
+	} else if info.notary != nil {
+		info.displayLabel = fmt.Sprintf("🔒 Notary Signature %s %s", ref.hash, info.notary.status.label())
+		info.displayName = fmt.Sprintf("Notary Signature %s", ref.hash)
 	} else {
 		switch configBlob.Descriptor.MediaType {
-		case ispec.MediaTypeImageConfig:
+		case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
 			info.displayLabel = fmt.Sprintf("💾 image %q", ref.hash)
-			info.displayName = dgst
+			info.displayName = ref.hash
 		case "application/vnd.oci.empty.v1+json":
 			filename := ""
 			if len(info.manifest.Layers) == 1 {
@@ -433,10 +693,7 @@ func loadImageManifest(oci casext.Engine, ref imageref, manifestDescriptor ispec
 			}
 			info.filename = filename
 			info.displayLabel = fmt.Sprintf("🗄  %q (%s)", info.filename, info.manifest.ArtifactType)
-			info.displayName = dgst
-		case "application/vnd.cncf.notary.signature":
-			info.displayLabel = fmt.Sprintf("🔒 Notary Signature %s", ref.hash)
-			info.displayName = fmt.Sprintf("Notary Signature %s", ref.hash)
+			info.displayName = ref.hash
 		case "application/vnd.oci.image.index.v1+json":
 			info.displayLabel = "🗂  Notary Signature Index"
 			info.displayName = "Notary Signature Index"
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// find a descriptor in the layout's index by its tag
+func taggedDescriptor(t *testing.T, b *layoutBuilder, tag string) ispec.Descriptor {
+	t.Helper()
+	for _, desc := range b.index.Manifests {
+		if desc.Annotations[ispec.AnnotationRefName] == tag {
+			return desc
+		}
+	}
+	t.Fatalf("no descriptor tagged %q", tag)
+	return ispec.Descriptor{}
+}
+
+func TestGetImageInfoString(t *testing.T) {
+	f := newStandardFixture(t)
+	loadFixtureTree(t, f)
+
+	tests := []struct {
+		name string
+		desc ispec.Descriptor
+	}{
+		{"image", f.web},
+		{"image_sharing_base", f.db},
+		{"sbom_referrer", f.sbom},
+		{"notary_signature", f.signature},
+		{"artifact", taggedDescriptor(t, f.apps, "readme")},
+		{"missing_blob", taggedDescriptor(t, f.apps, "missing")},
+		{"corrupt_blob", taggedDescriptor(t, f.apps, "corrupt")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, ok := ImageInfoMap[digestHash(tt.desc.Digest)]
+			if !ok {
+				t.Fatalf("no image info loaded for %s", tt.desc.Digest)
+			}
+			checkGolden(t, "imageinfo_"+tt.name, scrubPath(getImageInfoString(info.ref, info, 0), f.dir))
+		})
+	}
+}
+
+func TestDigestHelpers(t *testing.T) {
+	tests := []struct {
+		digest digest.Digest
+		hash   string
+		short  string
+		path   string
+	}{
+		{"sha256:0123456789abcdef", "0123456789abcdef", "0123456", "l/blobs/sha256/0123456789abcdef"},
+		{"sha512:fedcba9876543210", "fedcba9876543210", "fedcba9", "l/blobs/sha512/fedcba9876543210"},
+		{"abc", "abc", "abc", "l/blobs/sha256/abc"},
+	}
+	for _, tt := range tests {
+		if got := digestHash(tt.digest); got != tt.hash {
+			t.Errorf("digestHash(%q) = %q, want %q", tt.digest, got, tt.hash)
+		}
+		if got := shortHash(digestHash(tt.digest)); got != tt.short {
+			t.Errorf("shortHash(%q) = %q, want %q", tt.digest, got, tt.short)
+		}
+		if got := blobPath("l", tt.digest); got != tt.path {
+			t.Errorf("blobPath(%q) = %q, want %q", tt.digest, got, tt.path)
+		}
+	}
+}
+
+func TestMalformedImages(t *testing.T) {
+	resetGlobals(t)
+	dir := t.TempDir()
+	b := newLayoutBuilder(t, dir)
+	noLayers := b.addImage("scratch")
+	emptyArtifact := b.addEmptyArtifact("", "application/vnd.example.empty")
+	// a layer the history doesn't mention, and one it does that isn't there
+	extraHistory := b.addImageWithConfig("extra-history", nil, func(config *ispec.Image) {
+		config.History = append(config.History, ispec.History{CreatedBy: "add ghost"})
+	}, "rootfs")
+	shortHistory := b.addImageWithConfig("short-history", nil, func(config *ispec.Image) {
+		config.History = config.History[:1]
+	}, "rootfs", "app")
+	untagged := b.addImage("", "rootfs", "untagged")
+	missing := b.addMissingBlob("missing")
+	b.save()
+	loadFixtureTree(t, &standardFixture{dir: dir})
+
+	tests := []struct {
+		name  string
+		desc  ispec.Descriptor
+		label string
+		info  []string
+	}{
+		{"no layers", noLayers, `🏷  image "scratch"`, []string{"# 0 layers in manifest"}},
+		{"an artifact with no layers", emptyArtifact, `🗄  "" (application/vnd.example.empty)`, []string{"# 0 layers in manifest"}},
+		{"more history than layers", extraHistory, `🏷  image "extra-history"`, []string{
+			"[red]WARNING: history has 2 non-empty entries but the manifest has 1 layers[white]",
+			"[red]missing[white]",
+		}},
+		{"less history than layers", shortHistory, `🏷  image "short-history"`, []string{
+			"[red]WARNING: history has 1 non-empty entries but the manifest has 2 layers[white]",
+		}},
+		{"untagged", untagged, `💾 image "` + digestHash(untagged.Digest) + `"`, []string{"# 2 layers in manifest"}},
+		{"missing manifest", missing, "❌ error reading " + digestHash(missing.Digest) + ": ", []string{"ERROR reading image"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, ok := ImageInfoMap[digestHash(tt.desc.Digest)]
+			if !ok {
+				t.Fatalf("no image info loaded for %s", tt.desc.Digest)
+			}
+			if !strings.HasPrefix(info.displayLabel, tt.label) {
+				t.Errorf("label = %q, want %q", info.displayLabel, tt.label)
+			}
+			got := getImageInfoString(info.ref, info, 0)
+			for _, want := range tt.info {
+				if !strings.Contains(got, want) {
+					t.Errorf("info doesn't have %q:\n%s", want, got)
+				}
+			}
+		})
+	}
+
+	// untagged, so they don't give their top layers an empty name
+	for layerDigest, names := range LayerNameMap {
+		if slices.Contains(names, "") {
+			t.Errorf("layer %s has an empty name: %q", layerDigest, names)
+		}
+	}
+	for _, desc := range []ispec.Descriptor{untagged, emptyArtifact} {
+		if name := ImageInfoMap[digestHash(desc.Digest)].displayName; name != digestHash(desc.Digest) {
+			t.Errorf("untagged %s is named %q, want its manifest digest", desc.Digest, name)
+		}
+	}
+}
+
+func TestGetImageInfoStringKnownBase(t *testing.T) {
+	f := newStandardFixture(t)
+	loadFixtureTree(t, f)
+
+	info := ImageInfoMap[digestHash(f.web.Digest)]
+	// the web image's bottom two layers, as published in a registry
+	entries := LayerNameHashEntries{}
+	for idx, layerDigest := range info.layerDigests[:2] {
+		entries = append(entries, &LayerNameMapEntry{
+			Hash:        layerDigest,
+			Name:        layerEntryName("c3/nginx", "1.25", idx+1, 2),
+			Repository:  "c3/nginx",
+			Tag:         "1.25",
+			LayerIndex:  idx + 1,
+			LayerCount:  2,
+			ImageDigest: "sha256:nginx",
+		})
+	}
+	knownLayersFile := filepath.Join(f.dir, "known-layers.json")
+	if err := entries.Save(knownLayersFile); err != nil {
+		t.Fatal(err)
+	}
+	setupWellKnownLayerNames([]string{knownLayersFile})
+
+	checkGolden(t, "imageinfo_known_base", scrubPath(getImageInfoString(info.ref, info, 0), f.dir))
+}
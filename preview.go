@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+)
+
+// previews of artifacts' layers for the info pane, by what their media type
+// says they are or what they look like: JSON indented, YAML and text as they
+// are, archives listed, and a look inside Helm charts and WASM modules.
+// blobs bigger than maxArtifactBlobSize aren't read. layers are only fetched
+// when the artifact's info is shown, not while the tree is loaded.
+
+const (
+	// previews are cut to this many lines
+	maxPreviewLines = 200
+	// compressed blobs that unpack to more than this aren't previewed
+	maxPreviewUnpacked = 16 << 20
+	// binary blobs are shown as a hex dump of this many bytes
+	maxPreviewHexBytes = 256
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	wasmMagic = []byte("\x00asm")
+)
+
+type artifactPreview struct {
+	title     string // the layer's title, or its short hash
+	mediaType string
+	size      int64
+	kind      string // what it looks like, like JSON or a Helm chart
+	content   string // ready for the info pane
+	err       error
+}
+
+// previews by the artifact's manifest hash, made when its info is first shown
+var PreviewCache = map[string][]*artifactPreview{}
+
+// is this an artifact whose layers we preview: anything but an image, or a
+// signature, attestation or SBOM, which are decoded when it's loaded
+func isPreviewableArtifact(info imageInfo) bool {
+	if isDecodedArtifact(info) {
+		return false
+	}
+	switch info.manifest.Config.MediaType {
+	case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
+		return false
+	}
+	return len(info.manifest.Layers) > 0
+}
+
+// the previews of an artifact's layers, fetching them the first time
+func artifactPreviews(info imageInfo) []*artifactPreview {
+	if previews, ok := PreviewCache[info.ref.hash]; ok {
+		return previews
+	}
+	previews := fetchArtifactPreviews(info)
+	PreviewCache[info.ref.hash] = previews
+	return previews
+}
+
+// preview an artifact's layers, without the cache, so it's safe off the UI
+// goroutine
+func fetchArtifactPreviews(info imageInfo) []*artifactPreview {
+	previews := []*artifactPreview{}
+	for _, layer := range info.manifest.Layers {
+		previews = append(previews, previewLayer(info.previewFetch, layer))
+	}
+	return previews
+}
+
+func previewLayer(fetch blobFetcher, layer ispec.Descriptor) *artifactPreview {
+	p := &artifactPreview{title: layer.Annotations[OCIImageTitleAnnotation], mediaType: layer.MediaType, size: layer.Size}
+	if p.title == "" {
+		p.title = shortHash(digestHash(layer.Digest))
+	}
+	// filesystems are listed under the layers node
+	if isImageLayerMediaType(layer.MediaType) {
+		p.kind = "image layer"
+		return p
+	}
+	data, err := readArtifactBlob(fetch, layer)
+	if err != nil {
+		p.err = err
+		return p
+	}
+	p.kind, p.content, p.err = previewData(layer.MediaType, data)
+	return p
+}
+
+// what data is, and how to show it
+func previewData(mediaType string, data []byte) (string, string, error) {
+	return previewUnpacked(mediaType, data, true)
+}
+
+// only one level of gzip is unpacked, so a blob that unpacks to itself, or
+// to more gzip, is shown as binary
+func previewUnpacked(mediaType string, data []byte, unpack bool) (string, string, error) {
+	switch {
+	case len(data) == 0:
+		return "empty", "", nil
+	case bytes.HasPrefix(data, wasmMagic):
+		return previewWASM(data)
+	case unpack && bytes.HasPrefix(data, gzipMagic):
+		unpacked, err := gunzipPreview(data)
+		if err != nil {
+			return "gzip", "", err
+		}
+		kind, content, err := previewUnpacked(strings.TrimSuffix(mediaType, "+gzip"), unpacked, false)
+		if kind != "Helm chart" {
+			kind = "gzipped " + kind
+		}
+		return kind, content, err
+	case len(data) >= 512 && string(data[257:262]) == "ustar":
+		return previewTar(data)
+	case isJSONMediaType(mediaType) && json.Valid(data), looksLikeJSON(data):
+		return "JSON", indentJSON(data, maxPreviewLines), nil
+	case strings.Contains(mediaType, "yaml") && utf8.Valid(data):
+		return "YAML", highlightYAML(cutLines(string(data), maxPreviewLines)), nil
+	case utf8.Valid(data) && !bytes.ContainsRune(data, 0):
+		return "text", tview.Escape(cutLines(string(data), maxPreviewLines)) + "\n", nil
+	}
+
+	dump := hex.Dump(data[:min(len(data), maxPreviewHexBytes)])
+	if len(data) > maxPreviewHexBytes {
+		dump += fmt.Sprintf("... %d more bytes\n", len(data)-maxPreviewHexBytes)
+	}
+	return "binary", tview.Escape(dump), nil
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// an object or array that parses, whatever the media type says
+func looksLikeJSON(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed)
+}
+
+func gunzipPreview(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	unpacked, err := io.ReadAll(io.LimitReader(reader, maxPreviewUnpacked+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(unpacked) > maxPreviewUnpacked {
+		return nil, fmt.Errorf("it unpacks to more than the %d bytes we preview", maxPreviewUnpacked)
+	}
+	return unpacked, nil
+}
+
+// list a tar archive, like tar tv. a Helm chart, a directory with a
+// Chart.yaml, also shows what the Chart.yaml says.
+func previewTar(data []byte) (string, string, error) {
+	reader := tar.NewReader(bytes.NewReader(data))
+	listing := []string{}
+	var chartYAML []byte
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "tar archive", tview.Escape(cutLines(strings.Join(listing, "\n"), maxPreviewLines)) + "\n", err
+		}
+		listing = append(listing, fmt.Sprintf("%s %9d %s", hdr.FileInfo().Mode(), hdr.Size, hdr.Name))
+		name := strings.Trim(hdr.Name, "/")
+		if chartYAML == nil && path.Base(name) == "Chart.yaml" && strings.Count(name, "/") == 1 {
+			if chartYAML, err = io.ReadAll(io.LimitReader(reader, maxArtifactBlobSize)); err != nil {
+				return "tar archive", "", err
+			}
+		}
+	}
+
+	files := fmt.Sprintf("%d entries:\n", len(listing)) + tview.Escape(cutLines(strings.Join(listing, "\n"), maxPreviewLines)) + "\n"
+	if chartYAML == nil {
+		return "tar archive", files, nil
+	}
+	return "Helm chart", "[green]Chart.yaml:[white]\n" + highlightYAML(cutLines(string(chartYAML), maxPreviewLines)) +
+		"\n[green]files: [white]" + files, nil
+}
+
+// a YAML key, maybe a list item's, and what follows it
+var yamlKeyRE = regexp.MustCompile(`^(\s*(?:-\s+)?)([^\s#'"\-][^:#]*):(\s.*)?$`)
+
+// YAML with its keys colored
+func highlightYAML(text string) string {
+	lines := strings.Split(text, "\n")
+	for idx, line := range lines {
+		if m := yamlKeyRE.FindStringSubmatch(line); m != nil {
+			lines[idx] = tview.Escape(m[1]) + "[green]" + tview.Escape(m[2]) + "[white]:" + tview.Escape(m[3])
+		} else {
+			lines[idx] = tview.Escape(line)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+var wasmSectionNames = []string{"custom", "type", "import", "function", "table", "memory", "global",
+	"export", "start", "element", "code", "data", "data count"}
+
+var wasmExportKinds = []string{"func", "table", "memory", "global"}
+
+// a WASM module's version, sections and exports
+func previewWASM(data []byte) (string, string, error) {
+	const kind = "WebAssembly module"
+	if len(data) < 8 {
+		return kind, "", fmt.Errorf("its header is truncated")
+	}
+	version := binary.LittleEndian.Uint32(data[4:8])
+	sections := []string{}
+	exports := []string{}
+	for rest := data[8:]; len(rest) > 0; {
+		id := rest[0]
+		size, n := readULEB128(rest[1:])
+		if n == 0 || uint64(len(rest)-1-n) < size {
+			return kind, "", fmt.Errorf("section %d is truncated", len(sections))
+		}
+		body := rest[1+n : 1+n+int(size)]
+		rest = rest[1+n+int(size):]
+
+		name := fmt.Sprintf("unknown %d", id)
+		if int(id) < len(wasmSectionNames) {
+			name = wasmSectionNames[id]
+		}
+		switch id {
+		case 0:
+			if customName, _, ok := readWASMName(body); ok {
+				name = "custom " + strconv.Quote(customName)
+			}
+		case 7:
+			exports = wasmExports(body)
+		}
+		sections = append(sections, fmt.Sprintf("%s (%d bytes)", name, size))
+	}
+
+	out := fmt.Sprintf("[green]version: [white]%d\n[green]sections: [white]%s\n", version, tview.Escape(strings.Join(sections, ", ")))
+	if len(exports) > 0 {
+		out += "[green]exports:[white]\n" + tview.Escape(cutLines("  "+strings.Join(exports, "\n  "), maxPreviewLines)) + "\n"
+	}
+	return kind, out, nil
+}
+
+// an unsigned LEB128 number and how many bytes it took, or 0 if it's bad
+func readULEB128(data []byte) (uint64, int) {
+	var value uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		value |= uint64(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// a length-prefixed WASM name, and what follows it
+func readWASMName(data []byte) (string, []byte, bool) {
+	length, n := readULEB128(data)
+	if n == 0 || uint64(len(data)-n) < length {
+		return "", nil, false
+	}
+	return string(data[n : n+int(length)]), data[n+int(length):], true
+}
+
+// the names and kinds of an export section's exports
+func wasmExports(body []byte) []string {
+	count, n := readULEB128(body)
+	if n == 0 {
+		return nil
+	}
+	body = body[n:]
+	exports := []string{}
+	for i := uint64(0); i < count; i++ {
+		name, rest, ok := readWASMName(body)
+		if !ok || len(rest) < 1 {
+			break
+		}
+		kind := "unknown"
+		if int(rest[0]) < len(wasmExportKinds) {
+			kind = wasmExportKinds[rest[0]]
+		}
+		_, m := readULEB128(rest[1:])
+		if m == 0 {
+			break
+		}
+		body = rest[1+m:]
+		exports = append(exports, fmt.Sprintf("%s (%s)", name, kind))
+	}
+	return exports
+}
+
+// the artifact's layers, previewed, for the info pane
+func previewsInfoString(previews []*artifactPreview) string {
+	out := "[yellow]# Contents[white]\n"
+	for _, p := range previews {
+		out += fmt.Sprintf("\n[yellow]## %s[white] (%s, %d bytes)", tview.Escape(p.title), tview.Escape(p.mediaType), p.size)
+		if p.kind != "" {
+			out += ": " + p.kind
+		}
+		out += "\n"
+		if p.err != nil {
+			out += fmt.Sprintf("[red]can't preview it: %s[white]\n", tview.Escape(p.err.Error()))
+		}
+		out += p.content
+	}
+	return out + "\n"
+}
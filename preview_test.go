@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// a tar archive of files, name then contents, gzipped if compress
+func testTar(t *testing.T, compress bool, files ...string) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for i := 0; i < len(files); i += 2 {
+		hdr := &tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1])), ModTime: fixtureTime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !compress {
+		return buf.Bytes()
+	}
+	return testGzip(t, buf.Bytes())
+}
+
+func testGzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// a WASM module with a function, exported along with its memory
+var testWASM = []byte{
+	0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x04, 0x01, 0x60, 0x00, 0x00, // type: func () -> ()
+	0x03, 0x02, 0x01, 0x00, // function: of type 0
+	0x05, 0x03, 0x01, 0x00, 0x01, // memory: one page
+	0x07, 0x13, 0x02, // export: 2 of them
+	0x06, '_', 's', 't', 'a', 'r', 't', 0x00, 0x00,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x0a, 0x04, 0x01, 0x02, 0x00, 0x0b, // code: an empty body
+	0x00, 0x0b, 0x09, 'p', 'r', 'o', 'd', 'u', 'c', 'e', 'r', 's', 0x00, // custom
+}
+
+func TestPreviewData(t *testing.T) {
+	chartYAML := "apiVersion: v2\nname: web\n# the chart's version\nversion: 1.2.3\nkeywords:\n  - nginx\n"
+	tests := []struct {
+		name      string
+		mediaType string
+		data      []byte
+		kind      string
+		content   []string
+		err       string
+	}{
+		{name: "JSON", mediaType: "application/vnd.acme.config+json", data: []byte(`{"a":[1,2]}`), kind: "JSON",
+			content: []string{"  {\n    \"a\": [\n      1,"}},
+		{name: "sniffed JSON", mediaType: "application/octet-stream", data: []byte(` [{"b": true}]`), kind: "JSON",
+			content: []string{`"b": true`}},
+		{name: "not JSON after all", mediaType: "application/json", data: []byte(`{"a": `), kind: "text",
+			content: []string{`{"a": `}},
+		{name: "YAML", mediaType: "application/yaml", data: []byte(chartYAML), kind: "YAML",
+			content: []string{"[green]name[white]: web\n", "# the chart's version\n", "  - nginx"}},
+		{name: "text", mediaType: "text/plain", data: []byte("hello [world]\n"), kind: "text",
+			content: []string{"hello [world[]\n"}},
+		{name: "long text", mediaType: "text/plain", data: []byte(strings.Repeat("line\n", maxPreviewLines+5)), kind: "text",
+			content: []string{"line\n... 5 more lines\n"}},
+		{name: "binary", mediaType: "application/octet-stream", data: append([]byte{0xff, 0x00, 0x01}, make([]byte, 300)...), kind: "binary",
+			content: []string{"00000000  ff 00 01 00", "... 47 more bytes"}},
+		{name: "empty", data: []byte{}, kind: "empty"},
+		{name: "tar", mediaType: "application/x-tar", data: testTar(t, false, "etc/motd", "hi\n"), kind: "tar archive",
+			content: []string{"1 entries:\n-rw-r--r--         3 etc/motd"}},
+		{name: "gzipped text", mediaType: "text/plain+gzip", data: testGzip(t, []byte("zipped")), kind: "gzipped text",
+			content: []string{"zipped"}},
+		{name: "Helm chart", mediaType: "application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+			data: testTar(t, true, "web/Chart.yaml", chartYAML, "web/templates/deployment.yaml", "kind: Deployment\n"), kind: "Helm chart",
+			content: []string{"Chart.yaml:[white]\n[green]apiVersion[white]: v2", "[green]version[white]: 1.2.3", "2 entries:", "web/templates/deployment.yaml"}},
+		{name: "chart in a subdirectory isn't a chart", data: testTar(t, true, "a/b/Chart.yaml", chartYAML), kind: "gzipped tar archive"},
+		{name: "WASM", mediaType: "application/vnd.wasm.content.layer.v1+wasm", data: testWASM, kind: "WebAssembly module",
+			content: []string{"version: [white]1\n", "type (4 bytes), function (2 bytes), memory (3 bytes), export (19 bytes), code (4 bytes), custom \"producers\" (11 bytes)",
+				"  _start (func)\n  memory (memory)\n"}},
+		{name: "truncated WASM", data: testWASM[:20], kind: "WebAssembly module", err: "section 2 is truncated"},
+		{name: "gzip in gzip", data: testGzip(t, testGzip(t, []byte("zipped"))), kind: "gzipped binary",
+			content: []string{"00000000  1f 8b"}},
+		{name: "gzip bomb", data: testGzip(t, make([]byte, maxPreviewUnpacked+1)), kind: "gzip", err: "unpacks to more than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, content, err := previewData(tt.mediaType, tt.data)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if kind != tt.kind {
+				t.Errorf("kind = %q, want %q", kind, tt.kind)
+			}
+			for _, want := range tt.content {
+				if !strings.Contains(content, want) {
+					t.Errorf("preview doesn't have %q:\n%s", want, content)
+				}
+			}
+		})
+	}
+}
+
+func TestPreviewLayerTooBig(t *testing.T) {
+	fetch := func(ispec.Descriptor) (*casext.Blob, error) {
+		t.Fatal("a blob too big to preview was fetched")
+		return nil, nil
+	}
+	layer := ispec.Descriptor{MediaType: "application/octet-stream", Digest: digest.Digest("sha256:" + strings.Repeat("ab", 32)), Size: maxArtifactBlobSize + 1}
+	p := previewLayer(fetch, layer)
+	if p.err == nil || !strings.Contains(p.err.Error(), "more than the") {
+		t.Errorf("err = %v", p.err)
+	}
+	if got := previewsInfoString([]*artifactPreview{p}); !strings.Contains(got, "## abababa[white] (application/octet-stream, 4194305 bytes)\n[red]can't preview it: ") {
+		t.Errorf("info:\n%s", got)
+	}
+}
+
+func TestArtifactPreviewsLazy(t *testing.T) {
+	resetGlobals(t)
+	dir := t.TempDir()
+	b := newLayoutBuilder(t, filepath.Join(dir, "apps"))
+	artifact := b.addArtifact("notes", "application/vnd.acme.notes", "notes.txt", "take notes\n", nil)
+	b.save()
+	loadFixtureTree(t, &standardFixture{dir: dir})
+
+	info := ImageInfoMap[digestHash(artifact.Digest)]
+	if info.previewFetch == nil {
+		t.Fatal("the artifact can't be previewed")
+	}
+	if len(PreviewCache) != 0 {
+		t.Errorf("artifacts were previewed while the tree loaded: %v", PreviewCache)
+	}
+	if got := getImageInfoString(info.ref, info, 0); !strings.Contains(got, "## notes.txt[white] (application/octet-stream, 11 bytes): text\ntake notes") {
+		t.Errorf("info:\n%s", got)
+	}
+	if len(PreviewCache[info.ref.hash]) != 1 {
+		t.Errorf("the preview wasn't kept: %v", PreviewCache)
+	}
+}
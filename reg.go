@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/semaphore"
 )
@@ -23,6 +30,15 @@ func (i ImageNameSet) HasName(name string) bool {
 
 type LayerNameHashEntries []*LayerNameMapEntry
 
+// the version of the known layers file format we write. version 1 was a
+// bare list of entries; version 2 wraps them in an object with the version.
+const knownLayersSchemaVersion = 2
+
+type knownLayersFile struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	Entries       LayerNameHashEntries `json:"entries"`
+}
+
 func (l LayerNameHashEntries) Save(file string) error {
 	if len(l) == 0 {
 		return fmt.Errorf("no entries to save")
@@ -32,27 +48,119 @@ func (l LayerNameHashEntries) Save(file string) error {
 		return fmt.Errorf("filename is empty")
 	}
 
-	jsonBytes, err := json.Marshal(l)
+	jsonBytes, err := json.Marshal(knownLayersFile{SchemaVersion: knownLayersSchemaVersion, Entries: l})
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(file, jsonBytes, 0644)
+	// write and rename, so an interrupted save doesn't lose the old entries
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, jsonBytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
 }
 
 func Load(file string) (LayerNameHashEntries, error) {
+	l, _, err := loadVersioned(file)
+	return l, err
+}
+
+// load a known layers file of any version we know, returning its version
+func loadVersioned(file string) (LayerNameHashEntries, int, error) {
 	if file == "" {
-		return nil, fmt.Errorf("filename is empty")
+		return nil, 0, fmt.Errorf("filename is empty")
 	}
 
 	d, e := os.ReadFile(file)
 	if e != nil {
-		return nil, e
+		return nil, 0, e
 	}
 
 	l := LayerNameHashEntries{}
-	e = json.Unmarshal(d, &l)
-	return l, e
+	if trimmed := bytes.TrimSpace(d); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(d, &l); err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", file, err)
+		}
+		return l, 1, nil
+	}
+
+	f := knownLayersFile{}
+	if err := json.Unmarshal(d, &f); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", file, err)
+	}
+	switch {
+	case f.SchemaVersion == 0:
+		return nil, 0, fmt.Errorf("%s: no schemaVersion", file)
+	case f.SchemaVersion > knownLayersSchemaVersion:
+		return nil, 0, fmt.Errorf("%s: schema version %d is newer than this ociv supports (%d)", file, f.SchemaVersion, knownLayersSchemaVersion)
+	}
+	if f.Entries != nil {
+		l = f.Entries
+	}
+	return l, f.SchemaVersion, nil
+}
+
+// the key of an entry's tag within its registry
+func repoTagKey(repo, tag string) string {
+	return repo + ":" + tag
+}
+
+// the manifest digest each of a registry's tags had when it was last fetched
+func (l LayerNameHashEntries) TagDigests(registry string) map[string]string {
+	digests := map[string]string{}
+	for _, entry := range l {
+		if entry.Registry == registry && entry.ManifestDigest != "" {
+			digests[repoTagKey(entry.Repository, entry.Tag)] = entry.ManifestDigest
+		}
+	}
+	return digests
+}
+
+// the result of refreshing a registry's tags
+type registryRefresh struct {
+	registry  string
+	inScope   func(repo string) bool // whether a repo matches the prefixes we fetched
+	fetched   LayerNameHashEntries   // entries for tags we fetched again
+	unchanged map[string]bool        // repo:tag keys whose manifest digest didn't change
+	seen      map[string]bool        // repo:tag keys of every tag in the registry now
+	failed    map[string]bool        // repo:tag keys, or repo names, we couldn't fetch
+}
+
+// merge a refresh of one registry into the existing entries. entries from
+// other registries, or for tags we failed to fetch, are kept as they are.
+// tags that are gone from the registry are kept unless prune is set.
+func (l LayerNameHashEntries) Merge(refresh registryRefresh, prune bool) (LayerNameHashEntries, int) {
+	fetchedNames := ImageNameSet{}
+	for _, entry := range refresh.fetched {
+		fetchedNames[entry.Hash+" "+entry.Name] = nil
+	}
+
+	merged := LayerNameHashEntries{}
+	pruned := 0
+	for _, entry := range l {
+		if entry.Registry != refresh.registry {
+			// drop old-format entries this refresh is replacing
+			if entry.Registry == "" && fetchedNames.HasName(entry.Hash+" "+entry.Name) {
+				continue
+			}
+			merged = append(merged, entry)
+			continue
+		}
+		key := repoTagKey(entry.Repository, entry.Tag)
+		switch {
+		case refresh.unchanged[key], refresh.failed[key], refresh.failed[entry.Repository]:
+			merged = append(merged, entry)
+		case refresh.seen[key]:
+			// replaced by the fetched entries
+		case prune && refresh.inScope(entry.Repository):
+			pruned++
+		default:
+			merged = append(merged, entry)
+		}
+	}
+
+	return append(merged, refresh.fetched...), pruned
 }
 
 func (l LayerNameHashEntries) ImageNames() ImageNameSet {
@@ -64,8 +172,10 @@ func (l LayerNameHashEntries) ImageNames() ImageNameSet {
 }
 
 type Reg struct {
-	URL      string
-	Prefixes []string
+	URL         string
+	Prefixes    []string
+	Client      *http.Client
+	Concurrency int
 }
 
 type RepoList struct {
@@ -77,85 +187,428 @@ type Repo struct {
 	Tags []string `json:"tags"`
 }
 
-func NewReg(url string, prefixes string) *Reg {
+// a client for the registry, given as host[:port], optionally with a scheme
+// and /v2
+func NewReg(registry string, prefixes string, creds credentials, opts fetchOptions) (*Reg, error) {
+	ref, err := parseRegistryRef(registry)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newRegistryTransport(ref, creds, opts)
+	if err != nil {
+		return nil, err
+	}
 	return &Reg{
-		URL:      url,
-		Prefixes: strings.Split(prefixes, ","),
+		URL:         ref.URL(),
+		Prefixes:    strings.Split(prefixes, ","),
+		Client:      &http.Client{Transport: transport},
+		Concurrency: opts.concurrency,
+	}, nil
+}
+
+// the host[:port] of a registry URL, for looking up credentials
+func registryHost(registryURL string) string {
+	u, err := url.Parse(registryURL)
+	if err != nil || u.Host == "" {
+		host, _, _ := strings.Cut(registryURL, "/")
+		return host
 	}
+	return u.Host
 }
 
-func (r *Reg) GetRepoList(ctx context.Context) (*RepoList, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/v2/_catalog", r.URL))
+// whether a repo matches one of the prefixes we fetch
+func (r *Reg) InScope(repo string) bool {
+	for _, prefix := range r.Prefixes {
+		if strings.HasPrefix(repo, prefix) {
+			return true
+		}
+	}
+	return len(r.Prefixes) == 0
+}
+
+func (r *Reg) get(ctx context.Context, url string, accept ...string) (*http.Response, error) {
+	return r.do(ctx, http.MethodGet, url, accept...)
+}
+
+func (r *Reg) do(ctx context.Context, method string, url string, accept ...string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	return r.Client.Do(req)
+}
 
-	defer resp.Body.Close()
+// a registry response with a status we didn't expect
+type statusError struct {
+	code int
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad status code: %d", e.code)
+}
+
+func isNotFound(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.code == http.StatusNotFound
+}
+
+// how many pages getPages follows, in case a registry keeps linking to new
+// ones. a var so tests can lower it.
+var maxPages = 10000
+
+// get every page of a paginated list, following the RFC5988 Link headers
+// registries send for _catalog, tags/list and referrers. a registry whose
+// links go round in circles, or on and on, gets the pages fetched so far.
+func (r *Reg) getPages(ctx context.Context, pageURL string, accept ...string) ([][]byte, error) {
+	pages := [][]byte{}
+	seen := map[string]bool{}
+	for pageURL != "" {
+		if len(pages) == maxPages {
+			slog.Warn("stopped paginating after too many pages", "url", pageURL, "pages", len(pages))
+			break
+		}
+		seen[pageURL] = true
+		resp, err := r.get(ctx, pageURL, accept...)
+		if err != nil {
+			return nil, err
+		}
+
+		d, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, &statusError{code: resp.StatusCode}
+		}
+		pages = append(pages, d)
+
+		next := nextLink(resp.Header.Values("Link"))
+		if next == "" {
+			break
+		}
+		// links are usually relative to the registry
+		nextURL, err := resp.Request.URL.Parse(next)
+		if err != nil {
+			return nil, fmt.Errorf("bad Link header %q: %w", next, err)
+		}
+		if seen[nextURL.String()] {
+			slog.Warn("stopped paginating, the Link header points back to an earlier page", "url", nextURL, "pages", len(pages))
+			break
+		}
+		pageURL = nextURL.String()
 	}
+	return pages, nil
+}
 
-	d, err := io.ReadAll(resp.Body)
+// the target of the rel="next" link in RFC5988 Link headers, like
+// </v2/_catalog?last=c3%2Fbird&n=100>; rel="next"
+func nextLink(headers []string) string {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			target, params, _ := strings.Cut(link, ";")
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "rel") && slices.Contains(strings.Fields(strings.Trim(value, `"`)), "next") {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (r *Reg) GetRepoList(ctx context.Context) (*RepoList, error) {
+	pages, err := r.getPages(ctx, fmt.Sprintf("%s/v2/_catalog", r.URL))
 	if err != nil {
 		return nil, err
 	}
 
 	allRepos := &RepoList{}
-	err = json.Unmarshal(d, allRepos)
+	for _, d := range pages {
+		page := &RepoList{}
+		if err := json.Unmarshal(d, page); err != nil {
+			return nil, err
+		}
+		allRepos.Repositories = append(allRepos.Repositories, page.Repositories...)
+	}
 
 	if len(r.Prefixes) == 0 {
-		return allRepos, err
+		return allRepos, nil
 	}
 
 	// Filter for repos starting with prefixes
 	rl := &RepoList{Repositories: []string{}}
 	for _, repo := range allRepos.Repositories {
-		for _, prefix := range r.Prefixes {
-			if strings.HasPrefix(repo, prefix) {
-				rl.Repositories = append(rl.Repositories, repo)
-			}
+		if r.InScope(repo) {
+			rl.Repositories = append(rl.Repositories, repo)
 		}
 	}
 
-	return rl, err
+	return rl, nil
 }
 
 func (r *Reg) GetRepoInfo(ctx context.Context, repo string) (*Repo, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/v2/%s/tags/list", r.URL, repo))
+	pages, err := r.getPages(ctx, fmt.Sprintf("%s/v2/%s/tags/list", r.URL, repo))
 	if err != nil {
 		return nil, err
 	}
+
+	repoInfo := &Repo{}
+	for _, d := range pages {
+		page := &Repo{}
+		if err := json.Unmarshal(d, page); err != nil {
+			return nil, err
+		}
+		repoInfo.Name = page.Name
+		repoInfo.Tags = append(repoInfo.Tags, page.Tags...)
+	}
+	return repoInfo, nil
+}
+
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// the manifest types we can read, for the Accept header. without it many
+// registries fall back to the old docker schema1 format.
+var manifestAcceptTypes = []string{
+	ispec.MediaTypeImageManifest,
+	ispec.MediaTypeImageIndex,
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList
+}
+
+// fetch a manifest or index by tag or digest, returning its media type
+func (r *Reg) GetManifest(ctx context.Context, repo, reference string) (string, []byte, error) {
+	resp, err := r.get(ctx, fmt.Sprintf("%s/v2/%s/manifests/%s", r.URL, repo, reference), manifestAcceptTypes...)
+	if err != nil {
+		return "", nil, err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+		return "", nil, &statusError{code: resp.StatusCode}
 	}
 
 	d, err := io.ReadAll(resp.Body)
 	if err != nil {
+		return "", nil, err
+	}
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if !slices.Contains(manifestAcceptTypes, mediaType) {
+		// some registries send a generic content type, so look inside
+		mediaType = sniffManifestMediaType(d)
+	}
+	return mediaType, d, nil
+}
+
+// the manifests that refer to subject, from the referrers API, or for
+// registries without it, the index tagged with the digest like sha256-<hex>.
+// if artifactType isn't empty, only referrers of that type are returned.
+func (r *Reg) GetReferrers(ctx context.Context, repo string, subject digest.Digest, artifactType string) (*ispec.Index, error) {
+	referrersURL := fmt.Sprintf("%s/v2/%s/referrers/%s", r.URL, repo, subject)
+	if artifactType != "" {
+		referrersURL += "?artifactType=" + url.QueryEscape(artifactType)
+	}
+
+	index := &ispec.Index{MediaType: ispec.MediaTypeImageIndex}
+	pages, err := r.getPages(ctx, referrersURL, ispec.MediaTypeImageIndex)
+	switch {
+	case isNotFound(err):
+		if index, err = r.getReferrersTag(ctx, repo, subject); err != nil {
+			return nil, err
+		}
+	case err != nil:
 		return nil, err
 	}
+	for _, d := range pages {
+		page := ispec.Index{}
+		if err := json.Unmarshal(d, &page); err != nil {
+			return nil, fmt.Errorf("parse referrers: %w", err)
+		}
+		index.Manifests = append(index.Manifests, page.Manifests...)
+	}
 
-	repoInfo := &Repo{}
-	err = json.Unmarshal(d, repoInfo)
-	return repoInfo, err
+	// registries that ignore the filter don't say they applied it
+	if artifactType != "" {
+		index.Manifests = slices.DeleteFunc(index.Manifests, func(desc ispec.Descriptor) bool {
+			return desc.ArtifactType != artifactType
+		})
+	}
+	return index, nil
 }
 
-func (r *Reg) GetLayerNameEntry(ctx context.Context, repo, tag string) (*LayerNameMapEntry, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/v2/%s/manifests/%s", r.URL, repo, tag))
+// the fallback referrers index, which is empty if it isn't tagged
+func (r *Reg) getReferrersTag(ctx context.Context, repo string, subject digest.Digest) (*ispec.Index, error) {
+	index := &ispec.Index{MediaType: ispec.MediaTypeImageIndex}
+	tag := subject.Algorithm().String() + "-" + subject.Encoded()
+	mediaType, d, err := r.GetManifest(ctx, repo, tag)
+	if isNotFound(err) {
+		return index, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	if mediaType != ispec.MediaTypeImageIndex {
+		return nil, fmt.Errorf("referrers tag %s is a %s, not an index", tag, mediaType)
+	}
+	if err := json.Unmarshal(d, index); err != nil {
+		return nil, fmt.Errorf("parse referrers tag %s: %w", tag, err)
+	}
+	return index, nil
+}
+
+// blobs we read into memory, like configs, are limited to this size
+const maxInMemoryBlobSize = 16 << 20
+
+// open a blob for streaming, like a layer
+func (r *Reg) OpenBlob(ctx context.Context, repo string, d digest.Digest) (io.ReadCloser, error) {
+	resp, err := r.get(ctx, fmt.Sprintf("%s/v2/%s/blobs/%s", r.URL, repo, d))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &statusError{code: resp.StatusCode}
+	}
+	return resp.Body, nil
+}
+
+// read a small blob, like a config
+func (r *Reg) GetBlob(ctx context.Context, repo string, d digest.Digest) ([]byte, error) {
+	return r.getBlobUpTo(ctx, repo, d, maxInMemoryBlobSize)
+}
+
+// read a blob, if it's no bigger than limit
+func (r *Reg) getBlobUpTo(ctx context.Context, repo string, d digest.Digest, limit int64) ([]byte, error) {
+	body, err := r.OpenBlob(ctx, repo, d)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("blob %s is bigger than %d bytes", d, limit)
+	}
+	return data, nil
+}
+
+func sniffManifestMediaType(d []byte) string {
+	m := struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}{}
+	if err := json.Unmarshal(d, &m); err != nil {
+		return ""
+	}
+	if m.MediaType != "" {
+		return m.MediaType
+	}
+	if m.Manifests != nil {
+		return ispec.MediaTypeImageIndex
+	}
+	return ispec.MediaTypeImageManifest
+}
+
+// the digest a tag points to, from a HEAD request, so we can tell if it
+// changed without fetching the manifest. returns "" if the registry doesn't
+// say.
+func (r *Reg) GetManifestDigest(ctx context.Context, repo, tag string) (string, error) {
+	resp, err := r.do(ctx, http.MethodHead, fmt.Sprintf("%s/v2/%s/manifests/%s", r.URL, repo, tag), manifestAcceptTypes...)
+	if err != nil {
+		return "", err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+		return "", &statusError{code: resp.StatusCode}
 	}
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
 
-	d, e := io.ReadAll(resp.Body)
-	if e != nil {
-		return nil, e
+// the known layer entries for a tag: every layer of its image, or of each
+// platform's image if the tag is an index
+func (r *Reg) GetLayerNameEntries(ctx context.Context, repo, tag string) ([]*LayerNameMapEntry, error) {
+	mediaType, d, err := r.GetManifest(ctx, repo, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := r.layerNameEntriesFor(ctx, repo, tag, mediaType, d, 0)
+	if err != nil {
+		return nil, err
+	}
+	manifestDigest := digest.FromBytes(d).String()
+	fetched := time.Now().UTC().Truncate(time.Second)
+	for _, entry := range entries {
+		entry.Registry = registryHost(r.URL)
+		entry.Repository = repo
+		entry.Tag = tag
+		entry.ManifestDigest = manifestDigest
+		entry.Fetched = &fetched
+	}
+	return entries, nil
+}
+
+// indexes can nest, but not usefully deeply
+const maxIndexDepth = 4
+
+func (r *Reg) layerNameEntriesFor(ctx context.Context, repo, tag, mediaType string, d []byte, depth int) ([]*LayerNameMapEntry, error) {
+	if isIndexMediaType(mediaType) {
+		if depth >= maxIndexDepth {
+			return nil, fmt.Errorf("%s:%s: indexes nested too deeply", repo, tag)
+		}
+		index := &ispec.Index{}
+		if err := json.Unmarshal(d, index); err != nil {
+			return nil, err
+		}
+		entries := []*LayerNameMapEntry{}
+		for _, desc := range index.Manifests {
+			if desc.Platform != nil && desc.Platform.OS == "unknown" {
+				// buildx attestations, not images
+				continue
+			}
+			if desc.MediaType != "" && !slices.Contains(manifestAcceptTypes, desc.MediaType) {
+				continue
+			}
+			platformMediaType, platformData, err := r.GetManifest(ctx, repo, desc.Digest.String())
+			if err != nil {
+				return nil, fmt.Errorf("%s:%s@%s: %w", repo, tag, desc.Digest, err)
+			}
+			platformEntries, err := r.layerNameEntriesFor(ctx, repo, tag, platformMediaType, platformData, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%s@%s: %w", repo, tag, desc.Digest, err)
+			}
+			for _, entry := range platformEntries {
+				if entry.Platform == "" {
+					entry.Platform = platformString(desc.Platform)
+				}
+			}
+			entries = append(entries, platformEntries...)
+		}
+		return entries, nil
+	}
+
+	if mediaType != ispec.MediaTypeImageManifest && mediaType != MediaTypeDockerManifest {
+		return nil, fmt.Errorf("%s:%s: unsupported manifest type %q", repo, tag, mediaType)
 	}
 
 	m := &ispec.Manifest{}
@@ -163,42 +616,88 @@ func (r *Reg) GetLayerNameEntry(ctx context.Context, repo, tag string) (*LayerNa
 		return nil, err
 	}
 
-	layer := m.Layers[len(m.Layers)-1]
-
-	entry := &LayerNameMapEntry{
-		Hash: string(layer.Digest)[7:], // trim off the "sha256:" prefix
-		Name: fmt.Sprintf("%s:%s", repo, tag),
+	// artifacts may have no layers to name
+	entries := []*LayerNameMapEntry{}
+	if len(m.Layers) == 0 {
+		return entries, nil
+	}
+	diffIDs := r.getDiffIDs(ctx, repo, m)
+	imageDigest := digest.FromBytes(d).String()
+	for idx, layer := range m.Layers {
+		entry := &LayerNameMapEntry{
+			Hash:         digestHash(layer.Digest),
+			Name:         layerEntryName(repo, tag, idx+1, len(m.Layers)),
+			LayerIndex:   idx + 1,
+			LayerCount:   len(m.Layers),
+			ImageDigest:  imageDigest,
+			ConfigDigest: m.Config.Digest.String(),
+		}
+		if len(diffIDs) == len(m.Layers) {
+			entry.DiffID = digestHash(diffIDs[idx])
+		}
+		entries = append(entries, entry)
 	}
+	return entries, nil
+}
 
-	return entry, nil
+// the diffIDs of an image's layers, from its config. without them layers
+// can still be named, just not when they're compressed differently, so
+// failures are only logged.
+func (r *Reg) getDiffIDs(ctx context.Context, repo string, m *ispec.Manifest) []digest.Digest {
+	if m.Config.MediaType != ispec.MediaTypeImageConfig && m.Config.MediaType != MediaTypeDockerConfig {
+		return nil
+	}
+	d, err := r.GetBlob(ctx, repo, m.Config.Digest)
+	if err != nil {
+		slog.Warn("can't fetch config for diffIDs", "repo", repo, "config", m.Config.Digest, "err", err)
+		return nil
+	}
+	config := ispec.Image{}
+	if err := json.Unmarshal(d, &config); err != nil {
+		slog.Warn("can't parse config for diffIDs", "repo", repo, "config", m.Config.Digest, "err", err)
+		return nil
+	}
+	return config.RootFS.DiffIDs
 }
 
 type RepoError struct {
+	Name string
 	Repo *Repo
 	Err  error
 }
 
 type LayerEntryError struct {
-	Entry *LayerNameMapEntry
-	Err   error
+	Repo      string
+	Tag       string
+	Entries   []*LayerNameMapEntry
+	Unchanged bool // the tag's manifest digest matched the known one, so it wasn't fetched
+	Err       error
 }
 
-func (r *Reg) FetchRepoInfos(l *RepoList, repos chan RepoError) {
+// how many requests FetchRepoInfos and FetchLayerEntries make at once
+func (r *Reg) concurrency() int64 {
+	if r.Concurrency <= 0 {
+		return int64(defaultFetchOptions().concurrency)
+	}
+	return int64(r.Concurrency)
+}
+
+// fetch the tags of every repo in l. stops starting new requests once ctx is
+// done, so not every repo may be sent.
+func (r *Reg) FetchRepoInfos(ctx context.Context, l *RepoList, repos chan RepoError) {
 	wg := sync.WaitGroup{}
-	wg.Add(len(l.Repositories))
-	sem := semaphore.NewWeighted(16)
-	ctx := context.Background()
+	sem := semaphore.NewWeighted(r.concurrency())
 	for _, repo := range l.Repositories {
-		// Create only 16 concurrent requests
 		if err := sem.Acquire(ctx, 1); err != nil {
-			panic(err)
+			break
 		}
 
-		go func(repo string) {
+		wg.Add(1)
+		go func(name string) {
 			defer wg.Done()
 			defer sem.Release(1)
-			r, e := r.GetRepoInfo(context.Background(), repo)
-			repos <- RepoError{Repo: r, Err: e}
+			info, e := r.GetRepoInfo(ctx, name)
+			repos <- RepoError{Name: name, Repo: info, Err: e}
 		}(repo)
 	}
 
@@ -206,21 +705,31 @@ func (r *Reg) FetchRepoInfos(l *RepoList, repos chan RepoError) {
 	close(repos)
 }
 
-func (r *Reg) FetchLayerEntries(repos []*Repo, entries chan LayerEntryError) {
+// fetch the layer entries for every tag of repos, skipping tags whose
+// manifest digest is the same as in knownDigests (keyed by repo:tag). stops
+// starting new requests once ctx is done.
+func (r *Reg) FetchLayerEntries(ctx context.Context, repos []*Repo, knownDigests map[string]string, entries chan LayerEntryError) {
 	wg := sync.WaitGroup{}
-	sem := semaphore.NewWeighted(16)
-	ctx := context.Background()
+	sem := semaphore.NewWeighted(r.concurrency())
+tags:
 	for _, repo := range repos {
 		for _, tag := range repo.Tags {
-			wg.Add(1)
 			if err := sem.Acquire(ctx, 1); err != nil {
-				panic(err)
+				break tags
 			}
+			wg.Add(1)
 			go func(name, tag string) {
 				defer wg.Done()
 				defer sem.Release(1)
-				entry, err := r.GetLayerNameEntry(context.Background(), name, tag)
-				entries <- LayerEntryError{Entry: entry, Err: err}
+				if known, ok := knownDigests[repoTagKey(name, tag)]; ok {
+					current, err := r.GetManifestDigest(ctx, name, tag)
+					if err == nil && current == known {
+						entries <- LayerEntryError{Repo: name, Tag: tag, Unchanged: true}
+						return
+					}
+				}
+				tagEntries, err := r.GetLayerNameEntries(ctx, name, tag)
+				entries <- LayerEntryError{Repo: name, Tag: tag, Entries: tagEntries, Err: err}
 			}(repo.Name, tag)
 		}
 	}
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+// fakeRegistry is a stand-in for a distribution registry, serving the
+// catalog, tag lists, manifests and blobs, optionally behind basic or bearer
+// auth.
+type fakeRegistry struct {
+	t      *testing.T
+	server *httptest.Server
+
+	username string
+	password string
+	authMode string // "", "basic" or "bearer"
+	pageSize int    // paginate lists with Link headers if > 0
+
+	noReferrersAPI bool // 404 for referrers, like older registries
+
+	mu        sync.Mutex
+	repos     map[string]map[string]fakeManifest // repo -> tag or digest -> manifest
+	blobs     map[digest.Digest][]byte           // served from any repo
+	redirects map[digest.Digest]string           // blob -> URL it's redirected to
+	held      map[digest.Digest]chan struct{}    // blob -> closed once it can be served
+	failures  map[string][]int                   // path -> status codes to fail with first
+	requests  []string
+	tokenHits int
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	t.Helper()
+	fr := newUnstartedFakeRegistry(t)
+	fr.server.Start()
+	t.Cleanup(fr.server.Close)
+	return fr
+}
+
+// a fake registry serving https, with config's settings if it isn't nil
+func newFakeTLSRegistry(t *testing.T, config *tls.Config) *fakeRegistry {
+	t.Helper()
+	fr := newUnstartedFakeRegistry(t)
+	fr.server.TLS = config
+	fr.server.StartTLS()
+	t.Cleanup(fr.server.Close)
+	return fr
+}
+
+func newUnstartedFakeRegistry(t *testing.T) *fakeRegistry {
+	fr := &fakeRegistry{
+		t:         t,
+		repos:     map[string]map[string]fakeManifest{},
+		blobs:     map[digest.Digest][]byte{},
+		redirects: map[digest.Digest]string{},
+		held:      map[digest.Digest]chan struct{}{},
+		failures:  map[string][]int{},
+	}
+	fr.server = httptest.NewUnstartedServer(http.HandlerFunc(fr.serve))
+	return fr
+}
+
+func (fr *fakeRegistry) URL() string {
+	return fr.server.URL
+}
+
+// host:port, without a scheme
+func (fr *fakeRegistry) host() string {
+	return fr.server.Listener.Addr().String()
+}
+
+func (fr *fakeRegistry) newReg(prefixes string, creds credentials) *Reg {
+	fr.t.Helper()
+	reg, err := NewReg(fr.URL(), prefixes, creds, testFetchOptions())
+	if err != nil {
+		fr.t.Fatal(err)
+	}
+	return reg
+}
+
+// add a manifest under a tag, and by its digest
+func (fr *fakeRegistry) addManifest(repo, tag, mediaType string, v interface{}) ispec.Descriptor {
+	fr.t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		fr.t.Fatal(err)
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.repos[repo] == nil {
+		fr.repos[repo] = map[string]fakeManifest{}
+	}
+	dgst := digest.FromBytes(data)
+	m := fakeManifest{mediaType: mediaType, data: data}
+	if tag != "" {
+		fr.repos[repo][tag] = m
+	}
+	fr.repos[repo][dgst.String()] = m
+	return ispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+// add an image manifest whose layers have the given digests, with a config
+// giving each a made up diffID
+func (fr *fakeRegistry) addImage(repo, tag string, layerDigests ...digest.Digest) ispec.Descriptor {
+	fr.t.Helper()
+	config := ispec.Image{RootFS: ispec.RootFS{Type: "layers"}}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+	}
+	for _, dgst := range layerDigests {
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    dgst,
+		})
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, fakeDiffID(dgst))
+	}
+	configData, err := json.Marshal(config)
+	if err != nil {
+		fr.t.Fatal(err)
+	}
+	manifest.Config = fr.addBlob(ispec.MediaTypeImageConfig, configData)
+	return fr.addManifest(repo, tag, ispec.MediaTypeImageManifest, manifest)
+}
+
+// the diffID addImage gives a layer
+func fakeDiffID(layerDigest digest.Digest) digest.Digest {
+	return digest.FromString("uncompressed " + layerDigest.String())
+}
+
+// forget a blob, so fetching it fails
+func (fr *fakeRegistry) removeBlob(d digest.Digest) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	delete(fr.blobs, d)
+}
+
+func (fr *fakeRegistry) addBlob(mediaType string, data []byte) ispec.Descriptor {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	dgst := digest.FromBytes(data)
+	fr.blobs[dgst] = data
+	return ispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+// add an image with its config and layer blobs, one layer per entry in
+// layers, each holding a file of that name, like layoutBuilder.addImage
+func (fr *fakeRegistry) addImageWithBlobs(repo, tag string, layers ...string) ispec.Descriptor {
+	fr.t.Helper()
+	config := ispec.Image{
+		Created:  &fixtureTime,
+		Platform: ispec.Platform{OS: "linux", Architecture: "amd64"},
+		Config:   ispec.ImageConfig{Entrypoint: []string{"/bin/" + tag}},
+		RootFS:   ispec.RootFS{Type: "layers"},
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+	}
+	for _, layer := range layers {
+		data, diffID := tarGzLayer(fr.t, layer, "contents of "+layer)
+		manifest.Layers = append(manifest.Layers, fr.addBlob(ispec.MediaTypeImageLayerGzip, data))
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	}
+	configData, err := json.Marshal(config)
+	if err != nil {
+		fr.t.Fatal(err)
+	}
+	manifest.Config = fr.addBlob(ispec.MediaTypeImageConfig, configData)
+	return fr.addManifest(repo, tag, ispec.MediaTypeImageManifest, manifest)
+}
+
+// add an artifact manifest referring to subject, with an empty config
+func (fr *fakeRegistry) addReferrer(repo string, subject ispec.Descriptor, artifactType string) ispec.Descriptor {
+	fr.t.Helper()
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       fr.addBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       []ispec.Descriptor{fr.addBlob("application/octet-stream", []byte("signature of "+subject.Digest.String()))},
+		Subject:      &ispec.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size},
+	}
+	return fr.addManifest(repo, "", ispec.MediaTypeImageManifest, manifest)
+}
+
+// the referrers of subject in repo, as the referrers API lists them
+func (fr *fakeRegistry) referrers(repo string, subject digest.Digest, artifactType string) []ispec.Descriptor {
+	referrers := []ispec.Descriptor{}
+	for ref, m := range fr.repos[repo] {
+		manifest := ispec.Manifest{}
+		if !strings.Contains(ref, ":") || json.Unmarshal(m.data, &manifest) != nil {
+			continue
+		}
+		if manifest.Subject == nil || manifest.Subject.Digest != subject {
+			continue
+		}
+		if artifactType != "" && manifest.ArtifactType != artifactType {
+			continue
+		}
+		referrers = append(referrers, ispec.Descriptor{
+			MediaType:    m.mediaType,
+			ArtifactType: manifest.ArtifactType,
+			Digest:       digest.Digest(ref),
+			Size:         int64(len(m.data)),
+		})
+	}
+	sort.Slice(referrers, func(i, j int) bool { return referrers[i].Digest < referrers[j].Digest })
+	return referrers
+}
+
+// add an index of the given manifests, which should already be added
+func (fr *fakeRegistry) addIndex(repo, tag, mediaType string, manifests ...ispec.Descriptor) ispec.Descriptor {
+	fr.t.Helper()
+	index := ispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: mediaType,
+		Manifests: manifests,
+	}
+	return fr.addManifest(repo, tag, mediaType, index)
+}
+
+// fail the next requests for path with the given status codes, with a
+// Retry-After of 0 for 429s
+func (fr *fakeRegistry) failWith(path string, statusCodes ...int) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.failures[path] = append(fr.failures[path], statusCodes...)
+}
+
+// hold back a blob until the returned channel is closed
+func (fr *fakeRegistry) holdBlob(d digest.Digest) chan struct{} {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	held := make(chan struct{})
+	fr.held[d] = held
+	return held
+}
+
+// remove a tag, leaving the manifest reachable by digest
+
+func (fr *fakeRegistry) removeTag(repo, tag string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	delete(fr.repos[repo], tag)
+}
+
+func (fr *fakeRegistry) clearRequestLog() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.requests = nil
+}
+
+func (fr *fakeRegistry) requestLog() []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return append([]string{}, fr.requests...)
+}
+
+func (fr *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	fr.mu.Lock()
+	fr.requests = append(fr.requests, req.Method+" "+req.URL.RequestURI())
+	if statusCodes := fr.failures[req.URL.Path]; len(statusCodes) > 0 {
+		fr.failures[req.URL.Path] = statusCodes[1:]
+		fr.mu.Unlock()
+		if statusCodes[0] == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(statusCodes[0])
+		return
+	}
+	fr.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		fr.serveToken(w, req)
+		return
+	}
+	if !fr.authorized(w, req) {
+		return
+	}
+
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v2/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	if rest == "_catalog" {
+		names := []string{}
+		for name := range fr.repos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		json.NewEncoder(w).Encode(RepoList{Repositories: fr.paginate(w, req, names)})
+		return
+	}
+	if repo, ok := strings.CutSuffix(rest, "/tags/list"); ok {
+		tags := []string{}
+		for ref := range fr.repos[repo] {
+			if !strings.Contains(ref, ":") {
+				tags = append(tags, ref)
+			}
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(Repo{Name: repo, Tags: fr.paginate(w, req, tags)})
+		return
+	}
+	if repo, ref, ok := strings.Cut(rest, "/manifests/"); ok {
+		m, ok := fr.repos[repo][ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		// like real registries, don't serve a type the client didn't accept
+		if !strings.Contains(req.Header.Get("Accept"), m.mediaType) {
+			http.Error(w, "manifest type not accepted", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.data).String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(m.data)))
+		if req.Method != http.MethodHead {
+			w.Write(m.data)
+		}
+		return
+	}
+	if repo, ref, ok := strings.Cut(rest, "/referrers/"); ok {
+		if fr.noReferrersAPI {
+			http.NotFound(w, req)
+			return
+		}
+		artifactType := req.URL.Query().Get("artifactType")
+		if artifactType != "" {
+			w.Header().Set("OCI-Filters-Applied", "artifactType")
+		}
+		w.Header().Set("Content-Type", ispec.MediaTypeImageIndex)
+		json.NewEncoder(w).Encode(ispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ispec.MediaTypeImageIndex,
+			Manifests: fr.referrers(repo, digest.Digest(ref), artifactType),
+		})
+		return
+	}
+	if _, ref, ok := strings.Cut(rest, "/blobs/"); ok {
+		if location, ok := fr.redirects[digest.Digest(ref)]; ok {
+			http.Redirect(w, req, location, http.StatusFound)
+			return
+		}
+		data, ok := fr.blobs[digest.Digest(ref)]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if held := fr.held[digest.Digest(ref)]; held != nil {
+			fr.mu.Unlock()
+			<-held
+			fr.mu.Lock()
+		}
+		w.Header().Set("Docker-Content-Digest", ref)
+		w.Write(data)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// return the page of sorted items after the "last" query parameter, and
+// add a Link header for the next page like the distribution spec does
+func (fr *fakeRegistry) paginate(w http.ResponseWriter, req *http.Request, items []string) []string {
+	n := fr.pageSize
+	if nParam := req.URL.Query().Get("n"); nParam != "" {
+		n, _ = strconv.Atoi(nParam)
+	}
+	if last := req.URL.Query().Get("last"); last != "" {
+		items = items[sort.SearchStrings(items, last+"\x00"):]
+	}
+	if n <= 0 || len(items) <= n {
+		return items
+	}
+	items = items[:n]
+	next := url.Values{"n": {strconv.Itoa(n)}, "last": {items[n-1]}}
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, req.URL.Path, next.Encode()))
+	return items
+}
+
+func (fr *fakeRegistry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	switch fr.authMode {
+	case "basic":
+		if user, pass, ok := req.BasicAuth(); ok && user == fr.username && pass == fr.password {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+	case "bearer":
+		scope := scopeForPath(req.URL.Path)
+		if req.Header.Get("Authorization") == "Bearer token-for-"+scope {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="%s"`, fr.URL(), scope))
+	default:
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+// hand out a token for the requested scope, to anyone if there's no
+// username, otherwise only with the right basic auth
+func (fr *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	fr.mu.Lock()
+	fr.tokenHits++
+	fr.mu.Unlock()
+	if fr.username != "" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != fr.username || pass != fr.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if req.URL.Query().Get("service") != "fake" {
+		http.Error(w, "wrong service", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": "token-for-" + req.URL.Query().Get("scope")})
+}
+
+func TestRegFetch(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.addImage("c3/bird", "1.0.56", digest.FromString("base"), digest.FromString("bird"))
+	fr.addImage("c3/bird", "1.0.57", digest.FromString("base"), digest.FromString("bird2"))
+	fr.addImage("other/thing", "latest", digest.FromString("thing"))
+
+	reg := fr.newReg("c3", credentials{})
+	ctx := context.Background()
+
+	repos, err := reg.GetRepoList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos.Repositories) != 1 || repos.Repositories[0] != "c3/bird" {
+		t.Fatalf("expected only c3/bird with prefix c3, got %v", repos.Repositories)
+	}
+
+	repo, err := reg.GetRepoInfo(ctx, "c3/bird")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(repo.Tags, ",") != "1.0.56,1.0.57" {
+		t.Errorf("unexpected tags %v", repo.Tags)
+	}
+
+	entries, err := reg.GetLayerNameEntries(ctx, "c3/bird", "1.0.56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected an entry for each layer, got %d", len(entries))
+	}
+	for idx, want := range []struct{ name, layer string }{
+		{"c3/bird:1.0.56@layer1/2", "base"},
+		{"c3/bird:1.0.56", "bird"},
+	} {
+		entry := entries[idx]
+		if entry.Name != want.name || entry.Hash != digest.FromString(want.layer).Encoded() {
+			t.Errorf("entry %d: got %s %s, want %s for layer %s", idx, entry.Name, entry.Hash, want.name, want.layer)
+		}
+		if entry.LayerIndex != idx+1 || entry.LayerCount != 2 || entry.ImageDigest != entry.ManifestDigest || entry.ConfigDigest == "" {
+			t.Errorf("entry %d: unexpected position or digests %+v", idx, entry)
+		}
+		if entry.DiffID != fakeDiffID(digest.FromString(want.layer)).Encoded() {
+			t.Errorf("entry %d: diffID %q isn't from the config", idx, entry.DiffID)
+		}
+	}
+}
+
+func TestRegPagination(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.pageSize = 2
+	for _, repo := range []string{"a/one", "a/two", "a/three", "b/four", "b/five"} {
+		for _, tag := range []string{"1", "2", "3", "4", "5"} {
+			fr.addImage(repo, tag, digest.FromString(repo+tag))
+		}
+	}
+
+	ctx := context.Background()
+	repos, err := fr.newReg("", credentials{}).GetRepoList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(repos.Repositories, ","); got != "a/one,a/three,a/two,b/five,b/four" {
+		t.Errorf("expected all repos across pages, got %s", got)
+	}
+
+	repo, err := fr.newReg("", credentials{}).GetRepoInfo(ctx, "b/five")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(repo.Tags, ","); got != "1,2,3,4,5" {
+		t.Errorf("expected all tags across pages, got %s", got)
+	}
+
+	catalogRequests := 0
+	for _, r := range fr.requestLog() {
+		if strings.HasPrefix(r, "GET /v2/_catalog") {
+			catalogRequests++
+		}
+	}
+	if catalogRequests != 3 {
+		t.Errorf("expected 3 catalog pages, got %d", catalogRequests)
+	}
+}
+
+func TestRegPaginationLoop(t *testing.T) {
+	// each page links to the next, and the last back to one before it. the
+	// first page is the one without a page parameter.
+	for _, links := range []map[string]string{
+		{"": "a", "a": "a"},
+		{"": "a", "a": "b", "b": "a"},
+		{"": "a", "a": "b", "b": "c", "c": "b"},
+	} {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests++
+			page := req.URL.Query().Get("page")
+			w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?page=%s>; rel="next"`, links[page]))
+			fmt.Fprintf(w, `{"repositories": [%q]}`, page)
+		}))
+		reg, err := NewReg(server.URL, "", credentials{}, testFetchOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos, err := reg.GetRepoList(context.Background())
+		server.Close()
+		if err != nil {
+			t.Errorf("%v: %v", links, err)
+			continue
+		}
+		// every page is kept, each once
+		if len(repos.Repositories) != len(links) {
+			t.Errorf("%v: got repos %q", links, repos.Repositories)
+		}
+		if requests != len(links) {
+			t.Errorf("%v: %d requests, want %d", links, requests, len(links))
+		}
+	}
+}
+
+func TestRegPaginationLimit(t *testing.T) {
+	defer func(max int) { maxPages = max }(maxPages)
+	maxPages = 5
+
+	// every page links to a new one
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?last=repo%d>; rel="next"`, requests))
+		fmt.Fprintf(w, `{"repositories": ["repo%d"]}`, requests)
+	}))
+	defer server.Close()
+	reg, err := NewReg(server.URL, "", credentials{}, testFetchOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, err := reg.GetRepoList(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 5 || len(repos.Repositories) != 5 {
+		t.Errorf("%d requests for repos %q, want 5", requests, repos.Repositories)
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	tests := []struct {
+		headers []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{`</v2/_catalog?last=b&n=2>; rel="next"`}, "/v2/_catalog?last=b&n=2"},
+		{[]string{`<https://other.example.com/v2/x/tags/list?last=1>; rel=next`}, "https://other.example.com/v2/x/tags/list?last=1"},
+		{[]string{`</prev>; rel="prev", </next>; rel="next"`}, "/next"},
+		{[]string{`</first>; rel="first"`, `</next>; title="x"; rel="next last"`}, "/next"},
+		{[]string{`</v2/_catalog?last=b>; rel="prev"`}, ""},
+	}
+	for _, tt := range tests {
+		if got := nextLink(tt.headers); got != tt.want {
+			t.Errorf("nextLink(%q) = %q, want %q", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestGetLayerNameEntriesManifestTypes(t *testing.T) {
+	fr := newFakeRegistry(t)
+
+	// an OCI index with two platforms and a buildx attestation
+	amd64 := fr.addImage("c3/bird", "", digest.FromString("base"), digest.FromString("bird-amd64"))
+	amd64.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := fr.addImage("c3/bird", "", digest.FromString("base"), digest.FromString("bird-arm64"))
+	arm64.Platform = &ispec.Platform{OS: "linux", Architecture: "arm64"}
+	attestation := fr.addImage("c3/bird", "", digest.FromString("attestation"))
+	attestation.Platform = &ispec.Platform{OS: "unknown", Architecture: "unknown"}
+	fr.addIndex("c3/bird", "multi", ispec.MediaTypeImageIndex, amd64, arm64, attestation)
+
+	// a docker manifest list of docker manifests
+	dockerImage := fr.addManifest("c3/bird", "", MediaTypeDockerManifest, ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: MediaTypeDockerManifest,
+		Layers:    []ispec.Descriptor{{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", Digest: digest.FromString("docker-layer")}},
+	})
+	fr.addIndex("c3/bird", "dockerlist", MediaTypeDockerManifestList, dockerImage)
+
+	// an artifact with no layers
+	fr.addManifest("c3/bird", "empty", ispec.MediaTypeImageManifest, ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+	})
+
+	tests := []struct {
+		tag       string
+		hashes    []string // of the top layers
+		platforms string   // of the top layers
+	}{
+		{"multi", []string{digest.FromString("bird-amd64").Encoded(), digest.FromString("bird-arm64").Encoded()}, "linux/amd64,linux/arm64"},
+		{"dockerlist", []string{digest.FromString("docker-layer").Encoded()}, ""},
+		{"empty", []string{}, ""},
+	}
+
+	reg := fr.newReg("", credentials{})
+	for _, tt := range tests {
+		entries, err := reg.GetLayerNameEntries(context.Background(), "c3/bird", tt.tag)
+		if err != nil {
+			t.Errorf("%s: %v", tt.tag, err)
+			continue
+		}
+		hashes := []string{}
+		platforms := []string{}
+		for _, entry := range entries {
+			if entry.imageName() != "c3/bird:"+tt.tag {
+				t.Errorf("%s: unexpected name %q", tt.tag, entry.Name)
+			}
+			if entry.Fetched == nil || time.Since(*entry.Fetched) > time.Minute {
+				t.Errorf("%s: bad fetch time %v", tt.tag, entry.Fetched)
+			}
+			if entry.LayerIndex == entry.LayerCount {
+				hashes = append(hashes, entry.Hash)
+				if entry.Platform != "" {
+					platforms = append(platforms, entry.Platform)
+				}
+			}
+		}
+		if strings.Join(hashes, ",") != strings.Join(tt.hashes, ",") {
+			t.Errorf("%s: got hashes %v, want %v", tt.tag, hashes, tt.hashes)
+		}
+		if got := strings.Join(platforms, ","); got != tt.platforms {
+			t.Errorf("%s: got platforms %q, want %q", tt.tag, got, tt.platforms)
+		}
+	}
+}
+
+func TestSniffManifestMediaType(t *testing.T) {
+	for data, want := range map[string]string{
+		`{"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "layers": []}`: MediaTypeDockerManifest,
+		`{"schemaVersion": 2, "manifests": []}`:                                               ispec.MediaTypeImageIndex,
+		`{"schemaVersion": 2, "layers": []}`:                                                  ispec.MediaTypeImageManifest,
+		`not json`:                                                                            "",
+	} {
+		if got := sniffManifestMediaType([]byte(data)); got != want {
+			t.Errorf("sniffManifestMediaType(%s) = %q, want %q", data, got, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// the parts of containers-registries.conf(5) we use: where a registry is,
+// whether it's insecure or blocked, and its mirrors
+type registriesConf struct {
+	Registries []registryConf `toml:"registry"`
+	path       string
+}
+
+type registryConf struct {
+	Prefix   string       `toml:"prefix"`
+	Location string       `toml:"location"`
+	Insecure bool         `toml:"insecure"`
+	Blocked  bool         `toml:"blocked"`
+	Mirrors  []mirrorConf `toml:"mirror"`
+}
+
+type mirrorConf struct {
+	Location string `toml:"location"`
+	Insecure bool   `toml:"insecure"`
+}
+
+// the registries.conf files we look for, in order of precedence. like
+// podman, the first one that exists is used.
+func registriesConfPaths() []string {
+	paths := []string{}
+	if confFile := os.Getenv("CONTAINERS_REGISTRIES_CONF"); confFile != "" {
+		paths = append(paths, confFile)
+	}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		paths = append(paths, filepath.Join(configHome, "containers", "registries.conf"))
+	}
+	return append(paths, "/etc/containers/registries.conf")
+}
+
+// load the first registries.conf there is. returns an empty config if there
+// isn't one, or if one we found ourselves, like the system one, is broken;
+// only a broken $CONTAINERS_REGISTRIES_CONF is an error.
+func loadRegistriesConf() (*registriesConf, error) {
+	explicit := os.Getenv("CONTAINERS_REGISTRIES_CONF")
+	for _, path := range registriesConfPaths() {
+		conf, err := readRegistriesConf(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil && path != explicit {
+			slog.Warn("ignoring registries.conf", "err", err)
+			return &registriesConf{}, nil
+		}
+		return conf, err
+	}
+	return &registriesConf{}, nil
+}
+
+func readRegistriesConf(path string) (*registriesConf, error) {
+	conf := &registriesConf{path: path}
+	if _, err := toml.DecodeFile(path, conf); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for idx := range conf.Registries {
+		reg := &conf.Registries[idx]
+		if reg.Prefix == "" {
+			reg.Prefix = reg.Location
+		}
+		if reg.Location == "" && !strings.HasPrefix(reg.Prefix, "*.") {
+			reg.Location = reg.Prefix
+		}
+	}
+	return conf, nil
+}
+
+// the config for a registry host. we fetch whole registries, so only
+// entries for a host, or a *.domain wildcard, apply. the most specific wins.
+func (c *registriesConf) lookup(host string) *registryConf {
+	if c == nil {
+		return nil
+	}
+	var found *registryConf
+	for idx := range c.Registries {
+		reg := &c.Registries[idx]
+		prefix := strings.TrimSuffix(reg.Prefix, "/")
+		matches := prefix == host
+		if wildcard, ok := strings.CutPrefix(prefix, "*"); ok {
+			hostname, _, _ := strings.Cut(host, ":")
+			matches = strings.HasSuffix(hostname, wildcard)
+		}
+		if matches && (found == nil || len(prefix) > len(found.Prefix)) {
+			found = reg
+		}
+	}
+	return found
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a registry as given to --registry: host[:port], optionally with a scheme
+// and the /v2 API path, which we add ourselves
+type registryRef struct {
+	scheme string // "http" or "https", or "" to detect
+	host   string // host[:port]
+}
+
+func parseRegistryRef(s string) (registryRef, error) {
+	ref := registryRef{}
+	rest := strings.TrimSpace(s)
+	if scheme, afterScheme, ok := strings.Cut(rest, "://"); ok {
+		switch scheme {
+		case "http", "https":
+			ref.scheme = scheme
+		case "docker":
+		default:
+			return ref, fmt.Errorf("registry %q: unsupported scheme %q", s, scheme)
+		}
+		rest = afterScheme
+	}
+	rest = strings.TrimSuffix(strings.TrimSuffix(rest, "/"), "/v2")
+	if rest == "" {
+		return ref, fmt.Errorf("registry %q has no host", s)
+	}
+	if strings.Contains(rest, "/") {
+		return ref, fmt.Errorf("registry %q has a path, expected host[:port]", s)
+	}
+
+	u, err := url.Parse("//" + rest)
+	if err != nil || u.Host != rest || u.User != nil {
+		return ref, fmt.Errorf("registry %q: bad host %q", s, rest)
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return ref, fmt.Errorf("registry %q: bad port %q", s, port)
+		}
+	} else if strings.HasSuffix(rest, ":") {
+		return ref, fmt.Errorf("registry %q: empty port", s)
+	}
+	ref.host = rest
+	return ref, nil
+}
+
+// the registry's base URL, without /v2
+func (ref registryRef) URL() string {
+	scheme := ref.scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme + "://" + ref.host
+}
+
+func (ref registryRef) String() string {
+	if ref.scheme == "" {
+		return ref.host
+	}
+	return ref.URL()
+}
+
+// a registries.conf mirror location: a registry, optionally followed by the
+// namespace its copies of repos are under, like mirror.example.com/dockerhub
+func parseMirrorLocation(s string) (registryRef, string, error) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if ok {
+		scheme += "://"
+	} else {
+		scheme, rest = "", s
+	}
+	host, namespace, _ := strings.Cut(strings.Trim(rest, "/"), "/")
+	ref, err := parseRegistryRef(scheme + host)
+	return ref, namespace, err
+}
+
+// like docker, registries on localhost may use plain http
+func isLocalhost(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(hostname, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// somewhere to fetch a registry's content from: the registry itself, or one
+// of its mirrors. if the scheme isn't known, https is tried first, then
+// plain http if the endpoint allows it.
+type endpoint struct {
+	host      string
+	namespace string // a mirror's prefix for repo names, or ""
+	allowHTTP bool
+	rt        http.RoundTripper
+	plain     http.RoundTripper // rt without the credentials, for other hosts
+
+	mu     sync.Mutex
+	scheme string // "" until we know
+}
+
+func (e *endpoint) getScheme() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.scheme
+}
+
+func (e *endpoint) setScheme(scheme string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.scheme = scheme
+}
+
+// req, for the repo under the endpoint's namespace
+func (e *endpoint) inNamespace(req *http.Request) *http.Request {
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v2/")
+	if e.namespace == "" || !ok || rest == "" {
+		return req
+	}
+	req = req.Clone(req.Context())
+	req.URL.Path = "/v2/" + e.namespace + "/" + rest
+	req.URL.RawPath = ""
+	return req
+}
+
+func (e *endpoint) send(req *http.Request, scheme string) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = scheme
+	req.URL.Host = e.host
+	req.Host = e.host
+	return e.rt.RoundTrip(req)
+}
+
+func (e *endpoint) RoundTrip(req *http.Request) (*http.Response, error) {
+	if scheme := e.getScheme(); scheme != "" {
+		return e.send(req, scheme)
+	}
+
+	resp, err := e.send(req, "https")
+	if err == nil {
+		e.setScheme("https")
+		return resp, nil
+	}
+	if !e.allowHTTP || req.Context().Err() != nil {
+		return nil, err
+	}
+	resp, httpErr := e.send(req, "http")
+	if httpErr != nil {
+		return nil, fmt.Errorf("%w (over plain http: %v)", err, httpErr)
+	}
+	slog.Info("registry doesn't use https, using plain http", "host", e.host)
+	e.setScheme("http")
+	return resp, nil
+}
+
+// mirrorTransport sends pulls from a registry to each of its mirrors in
+// turn, then to the registry itself, moving on when one fails. lists, like
+// the catalog and tags, always come from the registry: a mirror only lists
+// what it has cached, and pruning by that would drop the rest.
+type mirrorTransport struct {
+	host      string      // the registry's host, as requests are addressed
+	endpoints []*endpoint // mirrors first, the registry last
+}
+
+func (mt *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != mt.host {
+		// e.g. a redirect, or the next page link of a list, relative to
+		// the endpoint it came from
+		for _, e := range mt.endpoints {
+			if e.host == req.URL.Host {
+				return e.RoundTrip(req)
+			}
+		}
+		// e.g. a blob redirected to a CDN, which mustn't see our credentials
+		return mt.endpoints[len(mt.endpoints)-1].plain.RoundTrip(req)
+	}
+	if !isPullPath(req.URL.Path) {
+		return mt.endpoints[len(mt.endpoints)-1].RoundTrip(req)
+	}
+
+	for idx, e := range mt.endpoints {
+		resp, err := e.RoundTrip(e.inNamespace(req))
+		if idx == len(mt.endpoints)-1 {
+			return resp, err
+		}
+		if err == nil && resp.StatusCode < 400 {
+			return resp, nil
+		}
+		if err != nil {
+			slog.Debug("mirror failed, trying the next", "mirror", e.host, "url", req.URL.String(), "err", err)
+		} else {
+			slog.Debug("mirror failed, trying the next", "mirror", e.host, "url", req.URL.String(), "status", resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	return nil, fmt.Errorf("no endpoints for %s", mt.host)
+}
+
+// whether a request pulls a manifest or blob, which a mirror can serve
+func isPullPath(path string) bool {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	return ok && (strings.Contains(rest, "/manifests/") || strings.Contains(rest, "/blobs/"))
+}
+
+// the transport for a registry: its mirrors from registries.conf, then the
+// registry itself, each with its own TLS settings, retries and credentials
+func newRegistryTransport(ref registryRef, creds credentials, opts fetchOptions) (http.RoundTripper, error) {
+	location := ref
+	insecure := false
+	mirrors := []mirrorConf{}
+	if regConf := opts.registries.lookup(ref.host); regConf != nil {
+		if regConf.Blocked {
+			return nil, fmt.Errorf("registry %s is blocked in %s", ref.host, opts.registries.path)
+		}
+		if regConf.Location != "" && regConf.Location != ref.host {
+			var err error
+			if location, err = parseRegistryRef(regConf.Location); err != nil {
+				return nil, fmt.Errorf("%s: %w", opts.registries.path, err)
+			}
+			location.scheme = ref.scheme
+		}
+		insecure = regConf.Insecure
+		mirrors = regConf.Mirrors
+	}
+
+	mt := &mirrorTransport{host: ref.host}
+	for _, mirror := range mirrors {
+		mirrorRef, namespace, err := parseMirrorLocation(mirror.Location)
+		if err != nil {
+			return nil, fmt.Errorf("%s: mirror: %w", opts.registries.path, err)
+		}
+		mirrorCreds, err := loadCredentials(mirrorRef.host)
+		if err != nil {
+			slog.Warn("can't load mirror credentials", "mirror", mirrorRef.host, "err", err)
+		}
+		e, err := newEndpoint(mirrorRef, mirror.Insecure, mirrorCreds, opts)
+		if err != nil {
+			return nil, err
+		}
+		e.namespace = namespace
+		mt.endpoints = append(mt.endpoints, e)
+	}
+
+	e, err := newEndpoint(location, insecure, creds, opts)
+	if err != nil {
+		return nil, err
+	}
+	mt.endpoints = append(mt.endpoints, e)
+	return mt, nil
+}
+
+func newEndpoint(ref registryRef, insecure bool, creds credentials, opts fetchOptions) (*endpoint, error) {
+	tlsConfig, err := opts.tls.config(insecure)
+	if err != nil {
+		return nil, err
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = tlsConfig
+	plain := newRetryTransport(base, opts)
+	return &endpoint{
+		host:      ref.host,
+		allowHTTP: insecure || isLocalhost(ref.host),
+		rt:        newAuthTransport(plain, creds),
+		plain:     plain,
+		scheme:    ref.scheme,
+	}, nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseRegistryRef(t *testing.T) {
+	tests := []struct {
+		in     string
+		scheme string
+		host   string
+		err    bool
+	}{
+		{"my.registry.tld", "", "my.registry.tld", false},
+		{"my.registry.tld:5000", "", "my.registry.tld:5000", false},
+		{"http://my.registry.tld/v2", "http", "my.registry.tld", false},
+		{"https://my.registry.tld/v2/", "https", "my.registry.tld", false},
+		{"https://my.registry.tld/", "https", "my.registry.tld", false},
+		{"docker://my.registry.tld", "", "my.registry.tld", false},
+		{"[::1]:5000", "", "[::1]:5000", false},
+		{"ftp://my.registry.tld", "", "", true},
+		{"my.registry.tld/some/repo", "", "", true},
+		{"my.registry.tld:port", "", "", true},
+		{"my.registry.tld:", "", "", true},
+		{"user@my.registry.tld", "", "", true},
+		{"http://", "", "", true},
+	}
+	for _, tt := range tests {
+		ref, err := parseRegistryRef(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseRegistryRef(%q): expected an error, got %+v", tt.in, ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRegistryRef(%q): %v", tt.in, err)
+			continue
+		}
+		if ref.scheme != tt.scheme || ref.host != tt.host {
+			t.Errorf("parseRegistryRef(%q) = %q %q, want %q %q", tt.in, ref.scheme, ref.host, tt.scheme, tt.host)
+		}
+	}
+}
+
+func TestParseMirrorLocation(t *testing.T) {
+	tests := []struct {
+		in        string
+		host      string
+		namespace string
+	}{
+		{"mirror.example.com:5000", "mirror.example.com:5000", ""},
+		{"mirror.example.com/dockerhub", "mirror.example.com", "dockerhub"},
+		{"http://mirror.example.com/mirrors/dockerhub/", "mirror.example.com", "mirrors/dockerhub"},
+	}
+	for _, tt := range tests {
+		ref, namespace, err := parseMirrorLocation(tt.in)
+		if err != nil || ref.host != tt.host || namespace != tt.namespace {
+			t.Errorf("parseMirrorLocation(%q) = %q %q %v, want %q %q", tt.in, ref.host, namespace, err, tt.host, tt.namespace)
+		}
+	}
+	if _, _, err := parseMirrorLocation("user@mirror.example.com/dockerhub"); err == nil {
+		t.Error("expected an error for a bad mirror host")
+	}
+}
+
+func TestIsLocalhost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"localhost":       true,
+		"localhost:5000":  true,
+		"127.0.0.1:5000":  true,
+		"[::1]:5000":      true,
+		"my.registry.tld": false,
+		"10.0.0.1:5000":   false,
+	} {
+		if got := isLocalhost(host); got != want {
+			t.Errorf("isLocalhost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+// write the fake registry's certificate as a CA bundle
+func writeServerCA(t *testing.T, fr *fakeRegistry) string {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fr.server.Certificate().Raw})
+	if err := os.WriteFile(caFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+// fetch the one tag from a registry with the given options
+func fetchTestTag(registry string, opts fetchOptions) error {
+	reg, err := NewReg(registry, "", credentials{}, opts)
+	if err != nil {
+		return err
+	}
+	_, err = reg.GetLayerNameEntries(context.Background(), "c3/bird", "1.0")
+	return err
+}
+
+func TestRegTLS(t *testing.T) {
+	fr := newFakeTLSRegistry(t, nil)
+	fr.addImage("c3/bird", "1.0", digest.FromString("bird"))
+	caFile := writeServerCA(t, fr)
+
+	confFile := filepath.Join(t.TempDir(), "registries.conf")
+	conf := "[[registry]]\nlocation = \"" + fr.host() + "\"\ninsecure = true\n"
+	if err := os.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	insecureConf, err := readRegistriesConf(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		registry string
+		opts     func(*fetchOptions)
+		ok       bool
+	}{
+		{"untrusted", fr.URL(), func(o *fetchOptions) {}, false},
+		{"ca file", fr.URL(), func(o *fetchOptions) { o.tls.caFiles = []string{caFile} }, true},
+		{"ca file, detecting https", fr.host(), func(o *fetchOptions) { o.tls.caFiles = []string{caFile} }, true},
+		{"skip verify", fr.URL(), func(o *fetchOptions) { o.tls.insecureSkipVerify = true }, true},
+		{"insecure in registries.conf", fr.URL(), func(o *fetchOptions) { o.registries = insecureConf }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testFetchOptions()
+			tt.opts(&opts)
+			start := time.Now()
+			err := fetchTestTag(tt.registry, opts)
+			if tt.ok && err != nil {
+				t.Errorf("expected to fetch, got %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("expected a certificate error")
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("took %s, certificate errors shouldn't be retried", time.Since(start))
+			}
+		})
+	}
+}
+
+// write a certificate and key to dir, signed by parent, or self-signed if
+// parent is nil
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+func TestRegClientCert(t *testing.T) {
+	dir := t.TempDir()
+	clientCA, clientCAKey, _, _ := writeTestCert(t, dir, "client-ca", nil, nil)
+	_, _, certFile, keyFile := writeTestCert(t, dir, "client", clientCA, clientCAKey)
+	_, _, otherCertFile, otherKeyFile := writeTestCert(t, dir, "other", nil, nil)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA)
+	fr := newFakeTLSRegistry(t, &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs})
+	fr.addImage("c3/bird", "1.0", digest.FromString("bird"))
+	caFile := writeServerCA(t, fr)
+
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		errMatch string
+	}{
+		{"signed client cert", certFile, keyFile, ""},
+		{"no client cert", "", "", "certificate"},
+		{"untrusted client cert", otherCertFile, otherKeyFile, "certificate"},
+		{"cert without key", certFile, "", "needs both"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testFetchOptions()
+			opts.tls = tlsOptions{caFiles: []string{caFile}, certFile: tt.cert, keyFile: tt.key}
+			err := fetchTestTag(fr.URL(), opts)
+			if tt.errMatch == "" {
+				if err != nil {
+					t.Errorf("expected to fetch, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMatch) {
+				t.Errorf("expected an error mentioning %q, got %v", tt.errMatch, err)
+			}
+		})
+	}
+}
+
+func TestRegPlainHTTPDetection(t *testing.T) {
+	fr := newFakeRegistry(t)
+	fr.addImage("c3/bird", "1.0", digest.FromString("bird"))
+
+	// plain http is fine for localhost, without saying so
+	if err := fetchTestTag(fr.host(), testFetchOptions()); err != nil {
+		t.Errorf("expected to fall back to http for localhost, got %v", err)
+	}
+	// but not when https is asked for
+	if err := fetchTestTag("https://"+fr.host(), testFetchOptions()); err == nil {
+		t.Errorf("expected an error talking https to a plain http registry")
+	}
+}
+
+func writeRegistriesConf(t *testing.T, conf string) *registriesConf {
+	t.Helper()
+	confFile := filepath.Join(t.TempDir(), "registries.conf")
+	if err := os.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := readRegistriesConf(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+func TestRegMirrors(t *testing.T) {
+	primary := newFakeRegistry(t)
+	primary.addImage("c3/bird", "1.0", digest.FromString("bird"))
+	emptyMirror := newFakeRegistry(t)
+	fullMirror := newFakeRegistry(t)
+	fullMirror.addImage("c3/bird", "1.0", digest.FromString("bird"))
+
+	opts := testFetchOptions()
+	opts.registries = writeRegistriesConf(t, `
+[[registry]]
+prefix = "registry.example.com"
+location = "`+primary.host()+`"
+
+[[registry.mirror]]
+location = "`+emptyMirror.host()+`"
+insecure = true
+
+[[registry.mirror]]
+location = "`+fullMirror.host()+`"
+insecure = true
+`)
+	reg, err := NewReg("http://registry.example.com", "", credentials{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := reg.GetLayerNameEntries(context.Background(), "c3/bird", "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Registry != "registry.example.com" {
+		t.Errorf("expected an entry for registry.example.com, got %+v", entries)
+	}
+	if len(emptyMirror.requestLog()) == 0 {
+		t.Errorf("first mirror wasn't tried")
+	}
+	if len(fullMirror.requestLog()) == 0 {
+		t.Errorf("second mirror wasn't used")
+	}
+	if len(primary.requestLog()) != 0 {
+		t.Errorf("primary was used though a mirror had the tag: %v", primary.requestLog())
+	}
+
+	// the registry itself is the last resort
+	primary.addImage("c3/bird", "2.0", digest.FromString("bird2"))
+	if _, err := reg.GetLayerNameEntries(context.Background(), "c3/bird", "2.0"); err != nil {
+		t.Errorf("expected to fall back to the registry, got %v", err)
+	}
+
+	// a mirror only lists what it's cached, so lists come from the registry
+	emptyMirror.clearRequestLog()
+	fullMirror.clearRequestLog()
+	if repos, err := reg.GetRepoList(context.Background()); err != nil || !reflect.DeepEqual(repos.Repositories, []string{"c3/bird"}) {
+		t.Errorf("catalog = %+v, %v", repos, err)
+	}
+	if repo, err := reg.GetRepoInfo(context.Background(), "c3/bird"); err != nil || !reflect.DeepEqual(repo.Tags, []string{"1.0", "2.0"}) {
+		t.Errorf("tags = %+v, %v", repo, err)
+	}
+	if mirrored := append(emptyMirror.requestLog(), fullMirror.requestLog()...); len(mirrored) != 0 {
+		t.Errorf("lists were sent to mirrors: %v", mirrored)
+	}
+}
+
+func TestRegNamespacedMirror(t *testing.T) {
+	primary := newFakeRegistry(t)
+	mirror := newFakeRegistry(t)
+	mirror.addImage("dockerhub/c3/bird", "1.0", digest.FromString("bird"))
+
+	opts := testFetchOptions()
+	opts.registries = writeRegistriesConf(t, `
+[[registry]]
+location = "`+primary.host()+`"
+
+[[registry.mirror]]
+location = "`+mirror.host()+`/dockerhub"
+insecure = true
+`)
+	reg, err := NewReg(primary.host(), "", credentials{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reg.GetLayerNameEntries(context.Background(), "c3/bird", "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Repository != "c3/bird" {
+		t.Errorf("expected an entry for c3/bird, got %+v", entries)
+	}
+	if len(primary.requestLog()) != 0 {
+		t.Errorf("primary was used though the mirror had the tag: %v", primary.requestLog())
+	}
+}
+
+func TestRegistriesConf(t *testing.T) {
+	rc := writeRegistriesConf(t, `
+unqualified-search-registries = ["docker.io"]
+
+[[registry]]
+prefix = "*.example.com"
+insecure = true
+
+[[registry]]
+prefix = "blocked.example.com"
+blocked = true
+
+[[registry]]
+location = "quay.io"
+
+[[registry.mirror]]
+location = "quay-mirror.example.com:5000"
+`)
+
+	if reg := rc.lookup("quay.io"); reg == nil || reg.Location != "quay.io" || len(reg.Mirrors) != 1 {
+		t.Errorf("unexpected quay.io config %+v", reg)
+	}
+	if reg := rc.lookup("other.example.com:5000"); reg == nil || !reg.Insecure {
+		t.Errorf("expected the wildcard to match, got %+v", reg)
+	}
+	if reg := rc.lookup("blocked.example.com"); reg == nil || !reg.Blocked {
+		t.Errorf("expected the more specific entry, got %+v", reg)
+	}
+	if reg := rc.lookup("example.org"); reg != nil {
+		t.Errorf("expected no config, got %+v", reg)
+	}
+
+	opts := testFetchOptions()
+	opts.registries = rc
+	if _, err := NewReg("blocked.example.com", "", credentials{}, opts); err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Errorf("expected blocked registry error, got %v", err)
+	}
+}
+
+func TestLoadRegistriesConf(t *testing.T) {
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	t.Setenv("CONTAINERS_REGISTRIES_CONF", "")
+	broken := filepath.Join(configHome, "containers", "registries.conf")
+	if err := os.MkdirAll(filepath.Dir(broken), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(broken, []byte("[[registry]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// one we found ourselves is skipped
+	rc, err := loadRegistriesConf()
+	if err != nil || len(rc.Registries) != 0 {
+		t.Errorf("a broken registries.conf we found: %+v, %v", rc, err)
+	}
+
+	// one we were pointed at has to work
+	t.Setenv("CONTAINERS_REGISTRIES_CONF", broken)
+	if _, err := loadRegistriesConf(); err == nil {
+		t.Error("expected an error for a broken $CONTAINERS_REGISTRIES_CONF")
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/rivo/tview"
+)
+
+// remote roots look like docker://registry[:port]/repo[:tag], and are
+// browsed over the distribution API instead of read from disk
+const remoteRootPrefix = "docker://"
+
+func isRemoteRoot(root string) bool {
+	return strings.HasPrefix(root, remoteRootPrefix)
+}
+
+// split a remote root into the registry and what to browse in it. the
+// repository and the tag or digest are optional. a scheme can be given
+// after docker://, for registries that need one.
+func parseRemoteRoot(root string) (registry, repo, reference string, err error) {
+	rest := strings.TrimPrefix(root, remoteRootPrefix)
+	scheme := ""
+	if s, afterScheme, ok := strings.Cut(rest, "://"); ok {
+		if s != "http" && s != "https" {
+			return "", "", "", fmt.Errorf("remote %q: unsupported scheme %q", root, s)
+		}
+		scheme, rest = s+"://", afterScheme
+	}
+
+	host, path, _ := strings.Cut(rest, "/")
+	if host == "" {
+		return "", "", "", fmt.Errorf("remote %q has no registry", root)
+	}
+	registry = scheme + host
+	if path == "" {
+		return registry, "", "", nil
+	}
+
+	repo = path
+	if name, dgst, ok := strings.Cut(path, "@"); ok {
+		if _, err := digest.Parse(dgst); err != nil {
+			return "", "", "", fmt.Errorf("remote %q: %w", root, err)
+		}
+		repo, reference = name, dgst
+	} else if idx := strings.LastIndex(path, ":"); idx >= 0 {
+		repo, reference = path[:idx], path[idx+1:]
+		if reference == "" {
+			return "", "", "", fmt.Errorf("remote %q has an empty tag", root)
+		}
+	}
+	if repo == "" || strings.HasSuffix(repo, "/") {
+		return "", "", "", fmt.Errorf("remote %q has a bad repository %q", root, repo)
+	}
+	return registry, repo, reference, nil
+}
+
+type remoteKind int
+
+const (
+	remoteRegistry remoteKind = iota // lists repositories
+	remoteRepo                       // lists tags
+	remoteManifest                   // an image or index, by tag or digest
+)
+
+// the reference for a tree node of something in a registry. it's loaded in
+// the background the first time it's selected. once a manifest is loaded,
+// its node gets an imageref or subIndexRef like a local one.
+type remoteNode struct {
+	reg       *Reg
+	kind      remoteKind
+	repo      string
+	reference string // tag or digest, for manifests
+	label     string // the node's text before it's loaded
+
+	artifactType string // only show referrers of this type, if set
+
+	// only used on the UI goroutine
+	loading  bool
+	loaded   bool
+	err      error
+	children int
+}
+
+func newRemoteRoot(root string, creds credentials, opts fetchOptions) (*remoteNode, error) {
+	registry, repo, reference, err := parseRemoteRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	if creds.empty() {
+		if creds, err = loadCredentials(registryHost(registry)); err != nil {
+			return nil, err
+		}
+	}
+	reg, err := NewReg(registry, "", creds, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rn := &remoteNode{reg: reg, repo: repo, reference: reference}
+	switch {
+	case reference != "":
+		rn.kind = remoteManifest
+	case repo != "":
+		rn.kind = remoteRepo
+	default:
+		rn.kind = remoteRegistry
+	}
+	rn.label = rn.location()
+	return rn, nil
+}
+
+// where a repository is, like docker://registry/repo, used in place of a
+// layout path for remote images
+func remoteRepoLocation(reg *Reg, repo string) string {
+	return remoteRootPrefix + registryHost(reg.URL) + "/" + repo
+}
+
+func (rn *remoteNode) location() string {
+	location := remoteRootPrefix + registryHost(rn.reg.URL)
+	if rn.repo != "" {
+		location = remoteRepoLocation(rn.reg, rn.repo)
+	}
+	if strings.Contains(rn.reference, ":") {
+		location += "@" + rn.reference
+	} else if rn.reference != "" {
+		location += ":" + rn.reference
+	}
+	return location
+}
+
+func (rn *remoteNode) summary() string {
+	switch {
+	case rn.err != nil:
+		return fmt.Sprintf("%s\n\nerror: %v", rn.location(), rn.err)
+	case rn.loading:
+		return fmt.Sprintf("%s\n\nloading...", rn.location())
+	case !rn.loaded:
+		return fmt.Sprintf("%s\n\nselect to load", rn.location())
+	case rn.kind == remoteRegistry:
+		return fmt.Sprintf("%s: registry with %d repositories", rn.location(), rn.children)
+	default:
+		return fmt.Sprintf("%s: repository with %d tags", rn.location(), rn.children)
+	}
+}
+
+// a node for something under this one, with the same settings
+func (rn *remoteNode) child(kind remoteKind, repo, reference, label string) *remoteNode {
+	return &remoteNode{reg: rn.reg, kind: kind, repo: repo, reference: reference, label: label, artifactType: rn.artifactType}
+}
+
+func (rn *remoteNode) searchString() []string {
+	return []string{rn.repo, rn.reference, rn.label}
+}
+
+// fetch what the node needs, off the UI goroutine, and return a function to
+// update the node with it, to run on the UI goroutine
+func (rn *remoteNode) load(ctx context.Context) func(node *tview.TreeNode) {
+	var apply func(node *tview.TreeNode)
+	var err error
+	switch rn.kind {
+	case remoteRegistry:
+		apply, err = rn.loadRepos(ctx)
+	case remoteRepo:
+		apply, err = rn.loadTags(ctx)
+	default:
+		apply, err = rn.loadManifest(ctx)
+	}
+
+	return func(node *tview.TreeNode) {
+		rn.loading = false
+		if err != nil {
+			rn.err = err
+			node.SetText(fmt.Sprintf("%s (error: %v)", rn.label, err))
+			return
+		}
+		rn.loaded = true
+		apply(node)
+	}
+}
+
+func (rn *remoteNode) loadRepos(ctx context.Context) (func(node *tview.TreeNode), error) {
+	repos, err := rn.reg.GetRepoList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(node *tview.TreeNode) {
+		rn.children = len(repos.Repositories)
+		node.SetText(fmt.Sprintf("%s (%d repositories)", rn.label, rn.children))
+		for _, repo := range repos.Repositories {
+			child := rn.child(remoteRepo, repo, "", repo)
+			node.AddChild(tview.NewTreeNode(child.label).SetReference(child).SetSelectable(true))
+		}
+	}, nil
+}
+
+func (rn *remoteNode) loadTags(ctx context.Context) (func(node *tview.TreeNode), error) {
+	repo, err := rn.reg.GetRepoInfo(ctx, rn.repo)
+	if err != nil {
+		return nil, err
+	}
+	tags := append([]string{}, repo.Tags...)
+	sort.Strings(tags)
+	return func(node *tview.TreeNode) {
+		rn.children = len(tags)
+		node.SetText(fmt.Sprintf("%s (%d tags)", rn.label, rn.children))
+		for _, tag := range tags {
+			child := rn.child(remoteManifest, rn.repo, tag, fmt.Sprintf("🏷  %q", tag))
+			node.AddChild(tview.NewTreeNode(child.label).SetReference(child).SetSelectable(true))
+		}
+	}, nil
+}
+
+// fetch the manifest, and the config and referrers if it's an image. the
+// image info is made on the UI goroutine, since it updates the global maps.
+func (rn *remoteNode) loadManifest(ctx context.Context) (func(node *tview.TreeNode), error) {
+	mediaType, data, err := rn.reg.GetManifest(ctx, rn.repo, rn.reference)
+	if err != nil {
+		return nil, err
+	}
+	desc := ispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	blobs := map[digest.Digest][]byte{desc.Digest: data}
+
+	tag := rn.reference
+	if strings.Contains(tag, ":") {
+		tag = ""
+	}
+	location := remoteRepoLocation(rn.reg, rn.repo)
+
+	if isIndexMediaType(mediaType) {
+		return func(node *tview.TreeNode) {
+			subref := subIndexRef{hash: digestHash(desc.Digest), tag: tag, layoutpath: location}
+			subInfo := loadSubIndexManifestFrom(cachedBlobFetcher(blobs), subref, desc)
+			SubIndexInfoMap[subref.hash] = subInfo
+			node.SetReference(subref).SetText(subInfo.displayLabel)
+			for _, manifestDesc := range subInfo.manifestDescriptors {
+				child := rn.child(remoteManifest, rn.repo, manifestDesc.Digest.String(), remoteManifestLabel(manifestDesc))
+				node.AddChild(tview.NewTreeNode(child.label).SetReference(child).SetSelectable(true))
+			}
+		}, nil
+	}
+
+	fetchImage, err := rn.fetchConfig(ctx, blobs, data)
+	if err != nil {
+		return nil, err
+	}
+	referrers := rn.fetchReferrers(ctx, desc.Digest)
+
+	return func(node *tview.TreeNode) {
+		ref := imageref{layoutpath: location, tag: tag, hash: digestHash(desc.Digest)}
+		info := rn.loadImageManifest(fetchImage, ref, desc)
+		ImageInfoMap[ref.hash] = info
+		node.SetReference(info.ref).SetText(info.displayLabel)
+
+		for _, referrer := range referrers {
+			referrerRef := imageref{layoutpath: location, hash: digestHash(referrer.desc.Digest)}
+			referrerInfo := rn.loadImageManifest(referrer.fetch, referrerRef, referrer.desc)
+			ImageInfoMap[referrerRef.hash] = referrerInfo
+			referrerRef.targetTag = ref.tag
+			referrerRef.targetHash = ref.hash
+			node.AddChild(tview.NewTreeNode(referrerInfo.displayLabel).
+				SetReference(referrerRef).
+				SetSelectable(true))
+		}
+
+		addLayerNodes(node, info, func(layer ispec.Descriptor) layerRef {
+			return layerRef{
+				blobfilepath: location + "@" + layer.Digest.String(),
+				remote:       &remoteBlob{reg: rn.reg, repo: rn.repo, digest: layer.Digest},
+			}
+		})
+	}, nil
+}
+
+// load an image from blobs fetched already. artifacts' layers are fetched
+// for previews when the info pane shows them.
+func (rn *remoteNode) loadImageManifest(fetch blobFetcher, ref imageref, desc ispec.Descriptor) imageInfo {
+	info := loadImageManifestFrom(fetch, ref, desc)
+	if isPreviewableArtifact(info) {
+		info.previewFetch = func(d ispec.Descriptor) (*casext.Blob, error) {
+			data, err := rn.reg.GetBlob(context.Background(), rn.repo, d.Digest)
+			if err != nil {
+				return nil, err
+			}
+			return parseBlob(d, data)
+		}
+	}
+	return info
+}
+
+// fetch the config of the image manifest in data into blobs, returning a
+// fetcher for the image. the small layers of signatures, attestations and
+// SBOMs are fetched too, since they're read when the image is loaded. if a
+// blob can't be fetched, the fetcher returns the error for it, so the image
+// info shows it.
+func (rn *remoteNode) fetchConfig(ctx context.Context, blobs map[digest.Digest][]byte, data []byte) (blobFetcher, error) {
+	manifest := ispec.Manifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	errs := map[digest.Digest]error{}
+	fetchBlob := func(d digest.Digest, limit int64) {
+		blobData, err := rn.reg.getBlobUpTo(ctx, rn.repo, d, limit)
+		blobs[d] = blobData
+		if err != nil {
+			errs[d] = err
+		}
+	}
+	fetchBlob(manifest.Config.Digest, maxInMemoryBlobSize)
+	info := imageInfo{manifest: manifest}
+	if isDecodedArtifact(info) {
+		limit := int64(maxArtifactBlobSize)
+		if isSBOMImage(info) {
+			limit = maxSBOMSize
+		}
+		for _, layer := range manifest.Layers {
+			if !isImageLayerMediaType(layer.MediaType) && layer.Size <= limit {
+				fetchBlob(layer.Digest, limit)
+			}
+		}
+	}
+	fetch := cachedBlobFetcher(blobs)
+	return func(d ispec.Descriptor) (*casext.Blob, error) {
+		if err, ok := errs[d.Digest]; ok {
+			return nil, err
+		}
+		return fetch(d)
+	}, nil
+}
+
+// is a layer a filesystem, as a tarball, squashfs or the like
+func isImageLayerMediaType(mediaType string) bool {
+	return strings.Contains(mediaType, ".image.layer.") || strings.Contains(mediaType, ".image.rootfs.")
+}
+
+// a referrer of a remote image, with its manifest and config fetched
+type remoteReferrer struct {
+	desc  ispec.Descriptor
+	fetch blobFetcher
+}
+
+// fetch the referrers of an image. like local referrers, ones that can't be
+// read are logged and left out.
+func (rn *remoteNode) fetchReferrers(ctx context.Context, subject digest.Digest) []remoteReferrer {
+	index, err := rn.reg.GetReferrers(ctx, rn.repo, subject, rn.artifactType)
+	if err != nil {
+		slog.Error("getting referrers", "location", rn.location(), "err", err)
+		return nil
+	}
+
+	referrers := []remoteReferrer{}
+	for _, desc := range index.Manifests {
+		if desc.MediaType != ispec.MediaTypeImageManifest {
+			slog.Debug("skipping referrer that isn't an image manifest", "digest", desc.Digest, "mediaType", desc.MediaType)
+			continue
+		}
+		_, data, err := rn.reg.GetManifest(ctx, rn.repo, desc.Digest.String())
+		if err != nil {
+			slog.Error("getting referrer", "location", rn.location(), "digest", desc.Digest, "err", err)
+			continue
+		}
+		blobs := map[digest.Digest][]byte{desc.Digest: data}
+		fetch, err := rn.fetchConfig(ctx, blobs, data)
+		if err != nil {
+			slog.Error("getting referrer", "location", rn.location(), "digest", desc.Digest, "err", err)
+			continue
+		}
+		referrers = append(referrers, remoteReferrer{
+			desc:  ispec.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: int64(len(data)), ArtifactType: desc.ArtifactType},
+			fetch: fetch,
+		})
+	}
+	return referrers
+}
+
+// what to call an image in an index before it's loaded
+func remoteManifestLabel(desc ispec.Descriptor) string {
+	if desc.Platform == nil {
+		return shortHash(digestHash(desc.Digest))
+	}
+	return fmt.Sprintf("%s %s", platformString(desc.Platform), shortHash(digestHash(desc.Digest)))
+}
+
+// a blob fetcher for blobs that have already been fetched
+func cachedBlobFetcher(blobs map[digest.Digest][]byte) blobFetcher {
+	return func(descriptor ispec.Descriptor) (*casext.Blob, error) {
+		data, ok := blobs[descriptor.Digest]
+		if !ok {
+			return nil, fmt.Errorf("blob %s wasn't fetched", descriptor.Digest)
+		}
+		return parseBlob(descriptor, data)
+	}
+}
+
+// a layer in a registry, streamed when its files are listed
+type remoteBlob struct {
+	reg    *Reg
+	repo   string
+	digest digest.Digest
+
+	err error // why it couldn't be listed, set on the UI goroutine
+}
+
+// write the file listing of a remote layer to fileListFilename. tarballs are
+// listed as they stream in; squashfs needs the whole blob on disk first. the
+// listing is only put in place once it's complete.
+func (rb *remoteBlob) writeFileList(mediaType, fileListFilename string) error {
+	body, err := rb.reg.OpenBlob(context.Background(), rb.repo, rb.digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(fileListFilename), filepath.Base(fileListFilename)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	var cmd *exec.Cmd
+	if strings.Contains(mediaType, "squashfs") {
+		tmp, err := os.CreateTemp("", "ociv-layer-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, body)
+		tmp.Close()
+		if err != nil {
+			return err
+		}
+		cmd = exec.Command("unsquashfs", "-llc", tmp.Name())
+	} else {
+		cmd = exec.Command("tar", "tzvf", "-")
+		cmd.Stdin = body
+	}
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), fileListFilename)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+)
+
+func TestParseRemoteRoot(t *testing.T) {
+	dgst := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		in        string
+		registry  string
+		repo      string
+		reference string
+		err       bool
+	}{
+		{"docker://my.registry.tld", "my.registry.tld", "", "", false},
+		{"docker://my.registry.tld/", "my.registry.tld", "", "", false},
+		{"docker://my.registry.tld:5000/some/repo", "my.registry.tld:5000", "some/repo", "", false},
+		{"docker://my.registry.tld/some/repo:1.0", "my.registry.tld", "some/repo", "1.0", false},
+		{"docker://my.registry.tld:5000/repo:1.0", "my.registry.tld:5000", "repo", "1.0", false},
+		{"docker://my.registry.tld/repo@" + dgst, "my.registry.tld", "repo", dgst, false},
+		{"docker://http://localhost:5000/repo", "http://localhost:5000", "repo", "", false},
+		{"docker://", "", "", "", true},
+		{"docker:///repo", "", "", "", true},
+		{"docker://my.registry.tld/repo:", "", "", "", true},
+		{"docker://my.registry.tld/repo@sha256:nope", "", "", "", true},
+		{"docker://my.registry.tld/:1.0", "", "", "", true},
+		{"docker://ftp://my.registry.tld", "", "", "", true},
+	}
+	for _, tt := range tests {
+		registry, repo, reference, err := parseRemoteRoot(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseRemoteRoot(%q): expected an error, got %q %q %q", tt.in, registry, repo, reference)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRemoteRoot(%q): %v", tt.in, err)
+			continue
+		}
+		if registry != tt.registry || repo != tt.repo || reference != tt.reference {
+			t.Errorf("parseRemoteRoot(%q) = %q %q %q, want %q %q %q", tt.in,
+				registry, repo, reference, tt.registry, tt.repo, tt.reference)
+		}
+	}
+}
+
+func newTestRemoteRoot(t *testing.T, fr *fakeRegistry, path string) (*remoteNode, *tview.TreeNode) {
+	t.Helper()
+	rn, err := newRemoteRoot(remoteRootPrefix+fr.URL()+path, credentials{username: "x"}, testFetchOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rn, tview.NewTreeNode(rn.label).SetReference(rn)
+}
+
+// load a node's remote reference, as the viewer does when it's selected
+func loadRemote(t *testing.T, node *tview.TreeNode) {
+	t.Helper()
+	rn, ok := node.GetReference().(*remoteNode)
+	if !ok {
+		t.Fatalf("node %q is a %T, not a remote node", node.GetText(), node.GetReference())
+	}
+	rn.load(context.Background())(node)
+	if rn.err != nil {
+		t.Fatalf("loading %s: %v", rn.location(), rn.err)
+	}
+}
+
+func childTexts(node *tview.TreeNode) []string {
+	texts := []string{}
+	for _, child := range node.GetChildren() {
+		texts = append(texts, child.GetText())
+	}
+	return texts
+}
+
+func TestRemoteBrowse(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	fr.addImageWithBlobs("tools/busybox", "1.36", "base", "busybox")
+	fr.addImageWithBlobs("tools/busybox", "1.35", "base")
+	fr.addImageWithBlobs("alpine", "3.18", "base")
+
+	_, root := newTestRemoteRoot(t, fr, "")
+	loadRemote(t, root)
+	if got := strings.Join(childTexts(root), ","); got != "alpine,tools/busybox" {
+		t.Fatalf("repos = %q", got)
+	}
+	if !strings.HasSuffix(root.GetText(), "(2 repositories)") {
+		t.Errorf("registry node text = %q", root.GetText())
+	}
+
+	repo := root.GetChildren()[1]
+	loadRemote(t, repo)
+	if got := strings.Join(childTexts(repo), ","); got != `🏷  "1.35",🏷  "1.36"` {
+		t.Fatalf("tags = %q", got)
+	}
+
+	image := repo.GetChildren()[1]
+	loadRemote(t, image)
+	ref, ok := image.GetReference().(imageref)
+	if !ok {
+		t.Fatalf("loaded image node is a %T, not an imageref", image.GetReference())
+	}
+	if ref.tag != "1.36" || ref.layoutpath != remoteRootPrefix+fr.host()+"/tools/busybox" {
+		t.Errorf("image ref = %+v", ref)
+	}
+	info := ImageInfoMap[ref.hash]
+	if len(info.config.RootFS.DiffIDs) != 2 {
+		t.Errorf("config wasn't loaded: %+v", info.config)
+	}
+	if got := getImageInfoString(ref, info, 0); !strings.Contains(got, "manifest: [blue]"+ref.layoutpath+"@sha256:") {
+		t.Errorf("image info doesn't show the remote manifest:\n%s", got)
+	}
+
+	layers := image.GetChildren()[0].GetChildren()
+	if len(layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(layers))
+	}
+	layer := layers[1].GetReference().(layerRef)
+	if layer.remote == nil || !strings.HasPrefix(layer.blobfilepath, ref.layoutpath+"@sha256:") {
+		t.Errorf("layer ref = %+v", layer)
+	}
+	if got := layer.summary(""); !strings.Contains(got, "busybox") {
+		t.Errorf("remote layer listing = %q", got)
+	}
+}
+
+func TestRemoteIndex(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	amd64 := fr.addImageWithBlobs("multi", "", "amd64")
+	amd64.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := fr.addImageWithBlobs("multi", "", "arm64")
+	arm64.Platform = &ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	fr.addIndex("multi", "latest", ispec.MediaTypeImageIndex, amd64, arm64)
+
+	rn, root := newTestRemoteRoot(t, fr, "/multi:latest")
+	if rn.kind != remoteManifest {
+		t.Fatalf("kind = %v, want a manifest", rn.kind)
+	}
+	loadRemote(t, root)
+	if _, ok := root.GetReference().(subIndexRef); !ok {
+		t.Fatalf("loaded index node is a %T, not a subIndexRef", root.GetReference())
+	}
+	children := childTexts(root)
+	if len(children) != 2 || !strings.HasPrefix(children[0], "linux/amd64 ") || !strings.HasPrefix(children[1], "linux/arm64/v8 ") {
+		t.Fatalf("index children = %q", children)
+	}
+
+	image := root.GetChildren()[1]
+	loadRemote(t, image)
+	ref := image.GetReference().(imageref)
+	if ref.tag != "" || ImageInfoMap[ref.hash].manifestDescriptor.Digest != arm64.Digest {
+		t.Errorf("image by digest = %+v", ref)
+	}
+}
+
+func TestRemoteErrors(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	fr.failWith("/v2/_catalog", http.StatusForbidden)
+
+	rn, root := newTestRemoteRoot(t, fr, "")
+	rn.load(context.Background())(root)
+	if rn.err == nil || rn.loaded {
+		t.Fatalf("expected an error, got loaded=%v err=%v", rn.loaded, rn.err)
+	}
+	if !strings.Contains(root.GetText(), "(error: ") || !strings.Contains(rn.summary(), "error: ") {
+		t.Errorf("error isn't shown: text %q, summary %q", root.GetText(), rn.summary())
+	}
+
+	// an image whose config is missing still loads, showing the error
+	desc := fr.addImage("broken", "1.0")
+	_, data, err := fr.newReg("", credentials{}).GetManifest(context.Background(), "broken", "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	fr.removeBlob(manifest.Config.Digest)
+	rn, node := newTestRemoteRoot(t, fr, "/broken:1.0")
+	loadRemote(t, node)
+	info := ImageInfoMap[digestHash(desc.Digest)]
+	if info.err == nil {
+		t.Errorf("expected the missing config to be reported, got %+v", info)
+	}
+	if !rn.loaded {
+		t.Errorf("node wasn't marked loaded")
+	}
+}
+
+func TestRemoteReferrers(t *testing.T) {
+	const sigType = "application/vnd.cncf.notary.signature"
+	const sbomType = "application/spdx+json"
+	for _, fallback := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fallback=%v", fallback), func(t *testing.T) {
+			resetGlobals(t)
+			fr := newFakeRegistry(t)
+			fr.noReferrersAPI = fallback
+			image := fr.addImageWithBlobs("app", "1.0", "base", "app")
+			sig := fr.addReferrer("app", image, sigType)
+			sbom := fr.addReferrer("app", image, sbomType)
+			if fallback {
+				sig.ArtifactType, sbom.ArtifactType = sigType, sbomType
+				tag := "sha256-" + image.Digest.Encoded()
+				fr.addIndex("app", tag, ispec.MediaTypeImageIndex, sig, sbom)
+			}
+
+			rn, node := newTestRemoteRoot(t, fr, "/app:1.0")
+			loadRemote(t, node)
+			ref := node.GetReference().(imageref)
+			children := node.GetChildren()
+			if len(children) != 3 {
+				t.Fatalf("expected 2 referrers and layers, got %q", childTexts(node))
+			}
+			seen := map[string]bool{}
+			for _, child := range children[:2] {
+				referrer, ok := child.GetReference().(imageref)
+				if !ok {
+					t.Fatalf("referrer node is a %T", child.GetReference())
+				}
+				if referrer.targetHash != ref.hash || referrer.targetTag != "1.0" {
+					t.Errorf("referrer doesn't point at its subject: %+v", referrer)
+				}
+				info := ImageInfoMap[referrer.hash]
+				if subjectHash, subjectName := info.getSubjectInfo(); subjectHash != ref.hash || subjectName == "-" {
+					t.Errorf("referrer subject = %q %q", subjectHash, subjectName)
+				}
+				seen[info.manifest.ArtifactType] = true
+			}
+			if !seen[sigType] || !seen[sbomType] {
+				t.Errorf("referrer types = %v", seen)
+			}
+			if children[2].GetText() != "layers" {
+				t.Errorf("last child = %q, want the layers", children[2].GetText())
+			}
+
+			// only the signature, with the filter
+			rn, node = newTestRemoteRoot(t, fr, "/app:1.0")
+			rn.artifactType = sigType
+			loadRemote(t, node)
+			children = node.GetChildren()
+			if len(children) != 2 || ImageInfoMap[children[0].GetReference().(imageref).hash].manifest.ArtifactType != sigType {
+				t.Errorf("filtered children = %q", childTexts(node))
+			}
+		})
+	}
+}
+
+func TestGetReferrersNone(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	fr.noReferrersAPI = true
+	image := fr.addImageWithBlobs("app", "1.0", "base")
+	index, err := fr.newReg("", credentials{}).GetReferrers(context.Background(), "app", image.Digest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 0 {
+		t.Errorf("expected no referrers, got %+v", index.Manifests)
+	}
+	// the referrers API, then the fallback tag
+	want := []string{
+		"GET /v2/app/referrers/" + image.Digest.String(),
+		"GET /v2/app/manifests/sha256-" + image.Digest.Encoded(),
+	}
+	if got := fr.requestLog(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
+
+func TestRemoteArtifactPreviewsLazy(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	image := fr.addImageWithBlobs("app", "1.0", "app")
+	notes := fr.addReferrer("app", image, "application/vnd.acme.notes")
+	layer := digest.FromString("signature of " + image.Digest.String())
+
+	_, node := newTestRemoteRoot(t, fr, "/app:1.0")
+	fr.clearRequestLog()
+	loadRemote(t, node)
+	fetchedLayer := func() bool {
+		for _, r := range fr.requestLog() {
+			if r == "GET /v2/app/blobs/"+layer.String() {
+				return true
+			}
+		}
+		return false
+	}
+	if fetchedLayer() {
+		t.Errorf("the artifact's layer was fetched while loading: %v", fr.requestLog())
+	}
+
+	info := ImageInfoMap[digestHash(notes.Digest)]
+	if got := getImageInfoString(info.ref, info, 0); !strings.Contains(got, "signature of "+image.Digest.String()) {
+		t.Errorf("info:\n%s", got)
+	}
+	if !fetchedLayer() {
+		t.Errorf("the artifact's layer wasn't fetched for its preview: %v", fr.requestLog())
+	}
+}
+
+func TestRemoteBigSBOM(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	image := fr.addImageWithBlobs("app", "1.0", "app")
+	sbom := fr.addManifest("app", "", ispec.MediaTypeImageManifest, ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: MediaTypeSPDXJSON,
+		Config:       fr.addBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       []ispec.Descriptor{fr.addBlob(MediaTypeSPDXJSON, []byte(bigTestSPDX()))},
+		Subject:      &ispec.Descriptor{MediaType: image.MediaType, Digest: image.Digest, Size: image.Size},
+	})
+
+	_, node := newTestRemoteRoot(t, fr, "/app:1.0")
+	loadRemote(t, node)
+	info := ImageInfoMap[digestHash(sbom.Digest)]
+	if len(info.sboms) != 1 || info.sboms[0].err != nil || len(info.sboms[0].packages) != 2 {
+		t.Errorf("the SBOM wasn't read: %q", info.displayLabel)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// how to fetch from a registry, and how hard to try
+type fetchOptions struct {
+	concurrency int           // requests in flight at once
+	timeout     time.Duration // for each response's headers, 0 for none
+	retries     int           // extra attempts after a 429, 5xx or network error
+	backoff     time.Duration // delay before the first retry, doubling after that
+
+	tls        tlsOptions
+	registries *registriesConf // mirrors and insecure registries
+}
+
+func defaultFetchOptions() fetchOptions {
+	return fetchOptions{
+		concurrency: 16,
+		timeout:     30 * time.Second,
+		retries:     3,
+		backoff:     500 * time.Millisecond,
+	}
+}
+
+func newFetchOptions(ctxt *cli.Context) (fetchOptions, error) {
+	opts := defaultFetchOptions()
+	if ctxt.Int("concurrency") > 0 {
+		opts.concurrency = ctxt.Int("concurrency")
+	}
+	opts.timeout = ctxt.Duration("timeout")
+	opts.retries = max(ctxt.Int("retries"), 0)
+	opts.tls = tlsOptions{
+		caFiles:            ctxt.StringSlice("ca-file"),
+		certFile:           ctxt.String("cert"),
+		keyFile:            ctxt.String("key"),
+		insecureSkipVerify: ctxt.Bool("insecure-skip-verify"),
+	}
+
+	var err error
+	opts.registries, err = loadRegistriesConf()
+	return opts, err
+}
+
+// don't wait longer than this for a retry, whatever Retry-After says
+const maxRetryDelay = time.Minute
+
+// retryTransport times out each attempt at a request, and retries requests
+// that hit a network error, a 429 or a 5xx, waiting as long as the
+// Retry-After header says or backing off exponentially.
+type retryTransport struct {
+	base http.RoundTripper
+	opts fetchOptions
+}
+
+func newRetryTransport(base http.RoundTripper, opts fetchOptions) *retryTransport {
+	return &retryTransport{base: base, opts: opts}
+}
+
+func shouldRetry(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// errors that retrying won't fix, like bad certificates or talking TLS to a
+// plain http server
+func isPermanentError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	return errors.As(err, &certErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr)
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := rt.opts.backoff
+	for attempt := 0; ; attempt++ {
+		resp, cancel, err := rt.attempt(req)
+		lastAttempt := attempt >= rt.opts.retries || req.Body != nil
+		if err == nil && (!shouldRetry(resp.StatusCode) || lastAttempt) {
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+		cancel()
+		if err != nil && (lastAttempt || isPermanentError(err) || req.Context().Err() != nil) {
+			return nil, err
+		}
+
+		wait := delay
+		if err == nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			slog.Debug("retrying request", "url", req.URL.String(), "status", resp.StatusCode, "wait", wait)
+		} else {
+			slog.Debug("retrying request", "url", req.URL.String(), "err", err, "wait", wait)
+		}
+		wait = min(wait, maxRetryDelay)
+		delay *= 2
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// one attempt at a request. the timeout is for the response headers; a big
+// body, like a layer, takes as long as it takes. the returned cancel
+// function must be called once the response body is done with.
+func (rt *retryTransport) attempt(req *http.Request) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	if rt.opts.timeout <= 0 {
+		resp, err := rt.base.RoundTrip(req.Clone(ctx))
+		return resp, cancel, err
+	}
+	timer := time.AfterFunc(rt.opts.timeout, cancel)
+	resp, err := rt.base.RoundTrip(req.Clone(ctx))
+	if !timer.Stop() {
+		// the timeout went off, so even if a response came, its body is gone
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, cancel, fmt.Errorf("no response from %s within %s: %w", req.URL.Host, rt.opts.timeout, context.DeadlineExceeded)
+	}
+	return resp, cancel, err
+}
+
+// releases a request's context once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return max(time.Until(when), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testFetchOptions() fetchOptions {
+	opts := defaultFetchOptions()
+	opts.backoff = time.Millisecond
+	return opts
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int // returned by the first attempts, then 200
+		retries  int
+		want     int
+		attempts int32
+	}{
+		{"success", nil, 3, http.StatusOK, 1},
+		{"server errors", []int{http.StatusServiceUnavailable, http.StatusBadGateway}, 3, http.StatusOK, 3},
+		{"rate limited", []int{http.StatusTooManyRequests}, 3, http.StatusOK, 2},
+		{"out of retries", []int{500, 500, 500}, 2, 500, 3},
+		{"not retried", []int{http.StatusNotFound}, 3, http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := int32(0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				if int(n) <= len(tt.statuses) {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(tt.statuses[n-1])
+					return
+				}
+				io.WriteString(w, "ok")
+			}))
+			defer server.Close()
+
+			opts := testFetchOptions()
+			opts.retries = tt.retries
+			client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, opts)}
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("got %d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryTransportTimeout(t *testing.T) {
+	attempts := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	opts := testFetchOptions()
+	opts.timeout = 50 * time.Millisecond
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, opts)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "ok" {
+		t.Errorf("expected the retry to succeed, got %q, %v", body, err)
+	}
+}
+
+func TestRetryTransportTimeoutIsForHeaders(t *testing.T) {
+	// the body takes longer than the timeout, a bit at a time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "slow")
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	opts := testFetchOptions()
+	opts.timeout = 50 * time.Millisecond
+	opts.retries = 0
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, opts)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 20 {
+		t.Errorf("expected the whole body, got %q, %v", body, err)
+	}
+}
+
+func TestRetryTransportCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, testFetchOptions())}
+
+	start := time.Now()
+	if _, err := client.Do(req); err == nil {
+		t.Errorf("expected an error when cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancel didn't interrupt the Retry-After wait, took %s", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d, ok := parseRetryAfter("120"); !ok || d != 2*time.Minute {
+		t.Errorf("seconds: got %s, %v", d, ok)
+	}
+	if d, ok := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); !ok || d < 59*time.Minute {
+		t.Errorf("date: got %s, %v", d, ok)
+	}
+	if d, ok := parseRetryAfter("Wed, 21 Oct 2015 07:28:00 GMT"); !ok || d != 0 {
+		t.Errorf("past date: got %s, %v", d, ok)
+	}
+	for _, value := range []string{"", "soon", "-1"} {
+		if _, ok := parseRetryAfter(value); ok {
+			t.Errorf("%q: expected not ok", value)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rivo/tview"
+)
+
+// SBOMs in SPDX or CycloneDX JSON, attached to images as artifacts or as
+// the predicates of in-toto attestations. their packages are shown in a
+// table, and can be searched for from the image they describe.
+
+const (
+	MediaTypeSPDXJSON      = "application/spdx+json"
+	MediaTypeCycloneDXJSON = "application/vnd.cyclonedx+json"
+
+	PredicateSPDX      = "https://spdx.dev/Document"
+	PredicateCycloneDX = "https://cyclonedx.org/bom"
+)
+
+// SBOMPackageMap - global map of image hashes to the search strings of the
+// packages in SBOMs attached to them
+var SBOMPackageMap = map[string][]string{}
+
+type sbomDocument struct {
+	filename string // from the layer's title, for artifacts
+	format   string // like SPDX-2.3 or CycloneDX 1.5
+	name     string
+	packages []sbomPackage
+	err      error
+}
+
+type sbomPackage struct {
+	name    string
+	version string
+	license string
+	purl    string
+}
+
+func isSBOMMediaType(mediaType string) bool {
+	return mediaType == MediaTypeSPDXJSON || mediaType == MediaTypeCycloneDXJSON
+}
+
+// is this image an SBOM artifact: its type says so, or its layers are SBOMs
+func isSBOMImage(info imageInfo) bool {
+	if isSBOMMediaType(info.manifest.ArtifactType) {
+		return true
+	}
+	for _, layer := range info.manifest.Layers {
+		if isSBOMMediaType(layer.MediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// SBOMs of ordinary images are often bigger than the other artifact blobs
+// we read, so they have a limit of their own
+const maxSBOMSize = 64 << 20
+
+// read an SBOM artifact's documents: its SBOM layers, or its only layer if
+// its artifact type says what that is
+func readSBOMs(fetch blobFetcher, info imageInfo) []*sbomDocument {
+	docs := []*sbomDocument{}
+	for _, layer := range info.manifest.Layers {
+		if !isSBOMMediaType(layer.MediaType) && len(info.manifest.Layers) > 1 {
+			continue
+		}
+		doc := &sbomDocument{}
+		if title := layer.Annotations[OCIImageTitleAnnotation]; title != "" {
+			doc.filename = filepath.Base(title)
+		}
+		docs = append(docs, doc)
+		data, err := readArtifactBlobUpTo(fetch, layer, maxSBOMSize)
+		if err != nil {
+			doc.err = err
+			continue
+		}
+		doc.err = doc.parse(data)
+	}
+	return docs
+}
+
+// the SBOM a statement's predicate is, or nil if it isn't one
+func statementSBOM(statement *inTotoStatement) *sbomDocument {
+	if statement == nil {
+		return nil
+	}
+	switch statement.PredicateType {
+	case PredicateSPDX, PredicateCycloneDX:
+		doc := &sbomDocument{}
+		doc.err = doc.parse(statement.Predicate)
+		return doc
+	}
+	return nil
+}
+
+// parse an SPDX or CycloneDX JSON document, telling which by its contents
+func (doc *sbomDocument) parse(data []byte) error {
+	var header struct {
+		SPDXVersion string `json:"spdxVersion"`
+		BOMFormat   string `json:"bomFormat"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("parsing the SBOM: %w", err)
+	}
+	switch {
+	case header.SPDXVersion != "":
+		doc.format = header.SPDXVersion
+		return doc.parseSPDX(data)
+	case header.BOMFormat == "CycloneDX":
+		return doc.parseCycloneDX(data)
+	}
+	return fmt.Errorf("it isn't an SPDX or CycloneDX JSON document")
+}
+
+func (doc *sbomDocument) parseSPDX(data []byte) error {
+	var spdx struct {
+		Name     string `json:"name"`
+		Packages []struct {
+			Name             string `json:"name"`
+			VersionInfo      string `json:"versionInfo"`
+			LicenseConcluded string `json:"licenseConcluded"`
+			LicenseDeclared  string `json:"licenseDeclared"`
+			ExternalRefs     []struct {
+				ReferenceType    string `json:"referenceType"`
+				ReferenceLocator string `json:"referenceLocator"`
+			} `json:"externalRefs"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal(data, &spdx); err != nil {
+		return fmt.Errorf("parsing the SPDX document: %w", err)
+	}
+	doc.name = spdx.Name
+	for _, p := range spdx.Packages {
+		pkg := sbomPackage{name: p.Name, version: p.VersionInfo}
+		// NOASSERTION and NONE say nothing about the license
+		for _, license := range []string{p.LicenseConcluded, p.LicenseDeclared} {
+			if license != "" && license != "NOASSERTION" && license != "NONE" {
+				pkg.license = license
+				break
+			}
+		}
+		for _, ref := range p.ExternalRefs {
+			if ref.ReferenceType == "purl" {
+				pkg.purl = ref.ReferenceLocator
+				break
+			}
+		}
+		doc.packages = append(doc.packages, pkg)
+	}
+	return nil
+}
+
+type cycloneDXComponent struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	PURL     string `json:"purl"`
+	Licenses []struct {
+		License struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"license"`
+		Expression string `json:"expression"`
+	} `json:"licenses"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+func (doc *sbomDocument) parseCycloneDX(data []byte) error {
+	var bom struct {
+		SpecVersion string `json:"specVersion"`
+		Metadata    struct {
+			Component cycloneDXComponent `json:"component"`
+		} `json:"metadata"`
+		Components []cycloneDXComponent `json:"components"`
+	}
+	if err := json.Unmarshal(data, &bom); err != nil {
+		return fmt.Errorf("parsing the CycloneDX document: %w", err)
+	}
+	doc.format = "CycloneDX " + bom.SpecVersion
+	doc.name = strings.TrimSpace(bom.Metadata.Component.Name + " " + bom.Metadata.Component.Version)
+
+	// components can have components of their own
+	var add func(components []cycloneDXComponent)
+	add = func(components []cycloneDXComponent) {
+		for _, c := range components {
+			licenses := []string{}
+			for _, l := range c.Licenses {
+				for _, license := range []string{l.Expression, l.License.ID, l.License.Name} {
+					if license != "" {
+						licenses = append(licenses, license)
+						break
+					}
+				}
+			}
+			doc.packages = append(doc.packages, sbomPackage{name: c.Name, version: c.Version, license: strings.Join(licenses, ", "), purl: c.PURL})
+			add(c.Components)
+		}
+	}
+	add(bom.Components)
+	return nil
+}
+
+// a short description, for labels
+func (doc *sbomDocument) summary() string {
+	if doc.err != nil {
+		return "unreadable"
+	}
+	return fmt.Sprintf("%s, %d packages", doc.format, len(doc.packages))
+}
+
+// the tree label of an SBOM artifact
+func sbomLabel(info imageInfo) string {
+	names := []string{}
+	failed := false
+	for _, doc := range info.sboms {
+		failed = failed || doc.err != nil
+		names = append(names, doc.summary())
+	}
+	name := info.ref.hash
+	if info.ref.tag != "" {
+		name = info.ref.tag
+	} else if len(info.sboms) == 1 && info.sboms[0].filename != "" {
+		name = info.sboms[0].filename
+	}
+	label := fmt.Sprintf("🧾 SBOM %q (%s)", name, strings.Join(names, "; "))
+	if failed {
+		label += " ⚠️"
+	}
+	return label
+}
+
+// the document and a table of its packages, for the info pane
+func (doc *sbomDocument) infoString() string {
+	out := "\n[yellow]### SBOM"
+	if doc.filename != "" {
+		out += " " + tview.Escape(doc.filename)
+	}
+	out += "[white]\n"
+	if doc.err != nil {
+		return out + fmt.Sprintf("[red]couldn't read it: %s[white]\n", tview.Escape(doc.err.Error()))
+	}
+	out += fmt.Sprintf("[green]format: [white]%s\n", tview.Escape(doc.format))
+	if doc.name != "" {
+		out += fmt.Sprintf("[green]name: [white]%s\n", tview.Escape(doc.name))
+	}
+	out += fmt.Sprintf("[green]packages: [white]%d\n", len(doc.packages))
+	if len(doc.packages) == 0 {
+		return out
+	}
+
+	packages := append([]sbomPackage{}, doc.packages...)
+	sort.SliceStable(packages, func(i, j int) bool {
+		if packages[i].name != packages[j].name {
+			return packages[i].name < packages[j].name
+		}
+		return packages[i].version < packages[j].version
+	})
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 1, 1, 2, ' ', 0)
+	fmt.Fprintln(tw, "[blue]name[white]\tversion\tlicense\tpurl\t")
+	for _, pkg := range packages {
+		fmt.Fprintf(tw, "[blue]%s[white]\t%s\t%s\t%s\t\n", tview.Escape(pkg.name), orDash(tview.Escape(pkg.version)),
+			orDash(tview.Escape(pkg.license)), orDash(tview.Escape(pkg.purl)))
+	}
+	tw.Flush()
+	return out + "\n" + buf.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// what to search the packages by
+func (doc *sbomDocument) searchStrings() []string {
+	components := []string{}
+	for _, pkg := range doc.packages {
+		components = append(components, strings.TrimSpace(pkg.name+" "+pkg.version), pkg.license, pkg.purl)
+	}
+	return components
+}
+
+// index the packages of an image's SBOMs, or the ones it attests to, under
+// the image they describe, so searching finds it
+func indexSBOMPackages(info imageInfo) {
+	docs := append([]*sbomDocument{}, info.sboms...)
+	for _, att := range info.attestations {
+		if doc := statementSBOM(att.statement); doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	if info.cosign != nil {
+		for _, sig := range info.cosign.signatures {
+			if doc := statementSBOM(sig.statement); doc != nil {
+				docs = append(docs, doc)
+			}
+		}
+	}
+
+	subject := ""
+	if info.manifest.Subject != nil {
+		subject = digestHash(info.manifest.Subject.Digest)
+	} else if info.cosign != nil && info.cosign.subject != "" {
+		subject = digestHash(info.cosign.subject)
+	}
+	if subject == "" {
+		return
+	}
+	for _, doc := range docs {
+		SBOMPackageMap[subject] = append(SBOMPackageMap[subject], doc.searchStrings()...)
+	}
+}
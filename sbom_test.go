@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSPDX = `{
+	"spdxVersion": "SPDX-2.3",
+	"name": "web",
+	"packages": [
+		{"name": "openssl", "versionInfo": "3.0.8", "licenseConcluded": "NOASSERTION", "licenseDeclared": "Apache-2.0",
+		 "externalRefs": [{"referenceCategory": "SECURITY", "referenceType": "cpe23Type", "referenceLocator": "cpe:2.3:a:openssl"},
+		                  {"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": "pkg:apk/alpine/openssl@3.0.8"}]},
+		{"name": "busybox", "versionInfo": "1.36.0", "licenseConcluded": "GPL-2.0-only"}
+	]
+}`
+
+const testCycloneDX = `{
+	"bomFormat": "CycloneDX",
+	"specVersion": "1.5",
+	"metadata": {"component": {"name": "db", "version": "15"}},
+	"components": [
+		{"name": "postgres", "version": "15.2", "purl": "pkg:deb/debian/postgres@15.2",
+		 "licenses": [{"license": {"id": "PostgreSQL"}}],
+		 "components": [{"name": "zlib", "version": "1.2.13", "licenses": [{"expression": "Zlib OR MIT"}]}]}
+	]
+}`
+
+func TestParseSBOM(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		format   string
+		docName  string
+		packages []sbomPackage
+		err      string
+	}{
+		{
+			name:    "SPDX",
+			data:    testSPDX,
+			format:  "SPDX-2.3",
+			docName: "web",
+			packages: []sbomPackage{
+				{name: "openssl", version: "3.0.8", license: "Apache-2.0", purl: "pkg:apk/alpine/openssl@3.0.8"},
+				{name: "busybox", version: "1.36.0", license: "GPL-2.0-only"},
+			},
+		},
+		{
+			name:    "CycloneDX",
+			data:    testCycloneDX,
+			format:  "CycloneDX 1.5",
+			docName: "db 15",
+			packages: []sbomPackage{
+				{name: "postgres", version: "15.2", license: "PostgreSQL", purl: "pkg:deb/debian/postgres@15.2"},
+				{name: "zlib", version: "1.2.13", license: "Zlib OR MIT"},
+			},
+		},
+		{name: "other JSON", data: `{"hello": "world"}`, err: "isn't an SPDX or CycloneDX"},
+		{name: "not JSON", data: `<bom/>`, err: "parsing the SBOM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &sbomDocument{}
+			err := doc.parse([]byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc.format != tt.format || doc.name != tt.docName || !reflect.DeepEqual(doc.packages, tt.packages) {
+				t.Errorf("got %s %q %+v", doc.format, doc.name, doc.packages)
+			}
+		})
+	}
+}
+
+func TestSBOMArtifact(t *testing.T) {
+	resetGlobals(t)
+	dir := t.TempDir()
+	b := newLayoutBuilder(t, dir)
+	web := b.addImage("web", "rootfs", "nginx")
+	db := b.addImage("db", "rootfs", "postgres")
+	sbom := b.addArtifact("", MediaTypeSPDXJSON, "web.spdx.json", testSPDX, &web)
+	// attested to, rather than attached
+	b.addAttestation(db, MediaTypeInTotoStatement, inTotoLayerData(t, db, PredicateCycloneDX, testCycloneDX, false))
+	b.save()
+	root, _ := loadFixtureTree(t, &standardFixture{dir: dir})
+
+	info := ImageInfoMap[digestHash(sbom.Digest)]
+	if info.displayLabel != `🧾 SBOM "web.spdx.json" (SPDX-2.3, 2 packages)` {
+		t.Errorf("label = %q", info.displayLabel)
+	}
+	got := getImageInfoString(info.ref, info, 0)
+	busybox := strings.Index(got, "[blue]busybox[white]")
+	openssl := strings.Index(got, "[blue]openssl[white]")
+	if busybox < 0 || openssl < busybox || !strings.Contains(got, "pkg:apk/alpine/openssl@3.0.8") {
+		t.Errorf("the package table isn't sorted by name:\n%s", got)
+	}
+
+	// packages find the image the SBOM describes, and the SBOM
+	for needle, want := range map[string][]string{
+		"openssl":      {`🏷  image "web"`, `🧾 SBOM "web.spdx.json" (SPDX-2.3, 2 packages)`},
+		"Zlib OR MIT":  {`🏷  image "db"`},
+		"pkg:deb":      {`🏷  image "db"`},
+		"GPL-2.0-only": {`🏷  image "web"`},
+	} {
+		texts := []string{}
+		for _, node := range getMatchingTreeNodes(root, needle) {
+			texts = append(texts, node.GetText())
+		}
+		for _, w := range want {
+			found := false
+			for _, text := range texts {
+				found = found || text == w
+			}
+			if !found {
+				t.Errorf("searching for %q didn't find %q: %q", needle, w, texts)
+			}
+		}
+	}
+}
+
+// an SPDX document just over the size of other artifact blobs we read
+func bigTestSPDX() string {
+	padding := strings.Repeat("x", maxArtifactBlobSize)
+	return strings.Replace(testSPDX, `"name": "web",`, `"name": "web", "comment": "`+padding+`",`, 1)
+}
+
+func TestBigSBOM(t *testing.T) {
+	resetGlobals(t)
+	dir := t.TempDir()
+	b := newLayoutBuilder(t, dir)
+	web := b.addImage("web", "rootfs", "nginx")
+	sbom := b.addArtifact("", MediaTypeSPDXJSON, "web.spdx.json", bigTestSPDX(), &web)
+	b.save()
+	root, _ := loadFixtureTree(t, &standardFixture{dir: dir})
+
+	info := ImageInfoMap[digestHash(sbom.Digest)]
+	if info.displayLabel != `🧾 SBOM "web.spdx.json" (SPDX-2.3, 2 packages)` {
+		t.Errorf("label = %q", info.displayLabel)
+	}
+	found := false
+	for _, node := range getMatchingTreeNodes(root, "openssl") {
+		found = found || node.GetText() == `🏷  image "web"`
+	}
+	if !found {
+		t.Errorf("searching for a package in the SBOM didn't find its image")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLS settings for talking to registries, from the command line
+type tlsOptions struct {
+	caFiles            []string // PEM bundles to trust as well as the system's CAs
+	certFile           string   // client certificate and key, in PEM
+	keyFile            string
+	insecureSkipVerify bool
+}
+
+// the TLS config for a registry. insecure is set for registries marked
+// insecure in registries.conf.
+func (o tlsOptions) config(insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.insecureSkipVerify || insecure,
+	}
+
+	if len(o.caFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range o.caFiles {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading CA bundle: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if o.certFile != "" || o.keyFile != "" {
+		if o.certFile == "" || o.keyFile == "" {
+			return nil, fmt.Errorf("a client certificate needs both --cert and --key")
+		}
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io/fs"
 	"os"
 
 	"fmt"
-	"log"
+	"log/slog"
 
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/olekukonko/tablewriter"
@@ -39,21 +42,21 @@ func addContentsOfLayout(target *tview.TreeNode, path string) ([]imageInfo, []su
 	oci, err := umoci.OpenLayout(path)
 
 	if err != nil {
-		log.Printf("error opening layout at path '%s': %s", path, err.Error())
+		slog.Error("opening layout", "path", path, "err", err)
 		return imageInfos, subIndexInfos
 	}
 	defer oci.Close()
 
 	index, err := oci.GetIndex(context.Background())
 	if err != nil {
-		log.Printf("error getting index in path %s: %v", path, err)
+		slog.Error("getting index", "path", path, "err", err)
 		return imageInfos, subIndexInfos
 	}
 
 	// get info for every image/artifact/subindex in the layout, regardless of whether or
 	// not they are tagged:
 	for _, descriptor := range index.Manifests {
-		dgst := descriptor.Digest.String()[7:]
+		dgst := digestHash(descriptor.Digest)
 		newref := imageref{
 			layoutpath: path,
 			hash:       dgst,
@@ -68,7 +71,6 @@ func addContentsOfLayout(target *tview.TreeNode, path string) ([]imageInfo, []su
 		case ispec.MediaTypeImageManifest:
 			imageInfo := loadImageManifest(oci, newref, descriptor)
 			ImageInfoMap[newref.hash] = imageInfo
-			log.Printf("appending imageinfo for newref=%+v", newref)
 			imageInfos = append(imageInfos, imageInfo)
 		case ispec.MediaTypeImageIndex:
 			subref := subIndexRef{
@@ -80,26 +82,27 @@ func addContentsOfLayout(target *tview.TreeNode, path string) ([]imageInfo, []su
 			SubIndexInfoMap[subref.hash] = subInfo
 			subIndexInfos = append(subIndexInfos, subInfo)
 		default:
-			log.Printf("Don't know what to do with a top level descriptor like this: %+v", descriptor)
+			slog.Warn("unknown top level descriptor", "descriptor", fmt.Sprintf("%+v", descriptor))
 		}
 
 	}
 
 	for _, imageInfo := range imageInfos {
 
-		log.Printf("image %q digest is %v\n", imageInfo.displayName, imageInfo.manifestDescriptor.Digest)
+		slog.Debug("adding image", "name", imageInfo.displayName, "digest", imageInfo.manifestDescriptor.Digest)
 		node := tview.NewTreeNode(imageInfo.displayLabel).
 			SetReference(imageInfo.ref).
 			SetSelectable(true)
 		referrers, err := getReferrersForImage(oci, path, &imageInfo.manifestDescriptor)
 		if err != nil {
-			log.Printf("error getting referrers: %s\n", err.Error())
+			slog.Error("getting referrers", "path", path, "err", err)
+			referrers = &ispec.Index{}
 		}
 
 		for _, referrerDescriptor := range referrers.Manifests {
-			log.Printf("referrer: %+v\n", referrerDescriptor)
+			slog.Debug("referrer", "digest", referrerDescriptor.Digest, "artifactType", referrerDescriptor.ArtifactType)
 
-			dgst := referrerDescriptor.Digest.String()[7:]
+			dgst := digestHash(referrerDescriptor.Digest)
 			referrerImageInfo := ImageInfoMap[dgst]
 			referrerImageInfo.ref.targetTag = imageInfo.ref.tag
 			referrerImageInfo.ref.targetHash = imageInfo.ref.hash
@@ -111,28 +114,12 @@ func addContentsOfLayout(target *tview.TreeNode, path string) ([]imageInfo, []su
 			node.AddChild(refNode)
 		}
 
-		layerTreeNode := tview.NewTreeNode("layers").
-			SetReference(imageInfo.ref).
-			SetSelectable(true)
-		node.AddChild(layerTreeNode)
-
-		for idx, layerDigest := range imageInfo.layerDigests {
-			displayString := layerDigest
-			if len(LayerNameMap[layerDigest]) > 0 {
-				displayString = strings.Join(LayerNameMap[layerDigest], ",")
-			}
-			blobfilepath := filepath.Join(path, "blobs", "sha256", layerDigest)
-			mt := imageInfo.manifest.Layers[idx].MediaType
-			newLayerRef := layerRef{hash: layerDigest, mediaType: mt,
-				blobfilepath: blobfilepath, displayString: displayString}
-			layerNode := tview.NewTreeNode(displayString).
-				SetReference(newLayerRef).
-				SetSelectable(true)
-			layerTreeNode.AddChild(layerNode)
-		}
+		addLayerNodes(node, imageInfo, func(layer ispec.Descriptor) layerRef {
+			return layerRef{blobfilepath: blobPath(path, layer.Digest)}
+		})
 
 		target.AddChild(node)
-		log.Printf("    done loading image %q", imageInfo.displayName)
+		slog.Debug("done loading image", "name", imageInfo.displayName)
 	}
 
 	for _, subIndexInfo := range subIndexInfos {
@@ -141,12 +128,23 @@ func addContentsOfLayout(target *tview.TreeNode, path string) ([]imageInfo, []su
 			SetSelectable(true)
 
 		for _, desc := range subIndexInfo.manifestDescriptors {
-			dgst := desc.Digest.String()[7:]
-			subIndexedImageInfo := ImageInfoMap[dgst]
+			dgst := digestHash(desc.Digest)
+			subIndexedImageInfo, ok := ImageInfoMap[dgst]
+			if !ok {
+				// the index's images aren't in index.json themselves
+				subref := imageref{layoutpath: path, hash: dgst}
+				subIndexedImageInfo = loadImageManifest(oci, subref, desc)
+				ImageInfoMap[dgst] = subIndexedImageInfo
+			}
 
 			subIndexedNode := tview.NewTreeNode(subIndexedImageInfo.displayLabel).
 				SetReference(subIndexedImageInfo.ref).
 				SetSelectable(true)
+			if len(subIndexedImageInfo.layerDigests) > 0 {
+				addLayerNodes(subIndexedNode, subIndexedImageInfo, func(layer ispec.Descriptor) layerRef {
+					return layerRef{blobfilepath: blobPath(path, layer.Digest)}
+				})
+			}
 			node.AddChild(subIndexedNode)
 		}
 		target.AddChild(node)
@@ -155,16 +153,73 @@ func addContentsOfLayout(target *tview.TreeNode, path string) ([]imageInfo, []su
 	return imageInfos, subIndexInfos
 }
 
+// add a "layers" node listing an image's layers to node. newLayerRef says
+// where each layer's blob is.
+func addLayerNodes(node *tview.TreeNode, imageInfo imageInfo, newLayerRef func(layer ispec.Descriptor) layerRef) {
+	layerTreeNode := tview.NewTreeNode("layers").
+		SetReference(imageInfo.ref).
+		SetSelectable(true)
+	node.AddChild(layerTreeNode)
+
+	for idx, layerDigest := range imageInfo.layerDigests {
+		displayString := layerDigest
+		names := getNamesForLayer(layerDigest, imageInfo.diffIDHash(idx))
+		var shortNames []string
+		if names[0] != "?" {
+			shortNames = getShortStringForNames(names)
+			displayString = fitNames(shortNames, 0)
+		} else {
+			names = nil
+		}
+		layer := imageInfo.manifest.Layers[idx]
+		ref := newLayerRef(layer)
+		ref.hash = layerDigest
+		ref.mediaType = layer.MediaType
+		ref.displayString = displayString
+		ref.names = names
+		ref.shortNames = shortNames
+		layerNode := tview.NewTreeNode(displayString).
+			SetReference(ref).
+			SetSelectable(true)
+		layerTreeNode.AddChild(layerNode)
+	}
+}
+
+// nodes are indented this much a level, with tview's default indent and
+// graphics
+const treeIndent = 3
+
+// fit the names of the layer nodes under node to the tree's width as it's
+// drawn. its children start at column x.
+func fitLayerNodes(node *tview.TreeNode, width, x int) {
+	if !node.IsExpanded() {
+		return
+	}
+	for _, child := range node.GetChildren() {
+		if ref, ok := child.GetReference().(layerRef); ok && ref.shortNames != nil {
+			child.SetText(fitNames(ref.shortNames, max(width-x, 1)))
+		}
+		fitLayerNodes(child, width, x+treeIndent)
+	}
+}
+
 type treeInfo struct {
 	path          string
 	numLayouts    int
 	imageInfos    []imageInfo
 	subIndexInfos []subIndexInfo
+	err           error   // error reading this directory
+	errs          []error // errors reading this directory or any below it
 }
 
 func (ti *treeInfo) update(other treeInfo) {
 	ti.numLayouts += other.numLayouts
 	ti.imageInfos = append(ti.imageInfos, other.imageInfos...)
+	ti.subIndexInfos = append(ti.subIndexInfos, other.subIndexInfos...)
+	if other.err != nil {
+		ti.errs = append(ti.errs, other.err)
+	}
+	ti.errs = append(ti.errs, other.errs...)
 	// TODO: should we ignore path, should this be a tree structure
 }
 
@@ -185,10 +240,12 @@ func (a byCount) Less(i, j int) bool {
 	return a[i].count < a[j].count
 }
 
-func getNamesOfSelfOrUniqueDescendantLayer(digest string, allLayers map[string][]string) []string {
-	return getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(digest, allLayers, 0)
+// diffIDs maps layer digests to their diffIDs, to find the names of layers
+// that were recompressed
+func getNamesOfSelfOrUniqueDescendantLayer(digest string, allLayers map[string][]string, diffIDs map[string]string) []string {
+	return getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(digest, allLayers, diffIDs, 0)
 }
-func getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(digest string, allLayers map[string][]string, logindent int) []string {
+func getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(digest string, allLayers map[string][]string, diffIDs map[string]string, logindent int) []string {
 
 	ilog := func(fmtstr string, indent int, args ...interface{}) {}
 	/*
@@ -198,12 +255,12 @@ func getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(digest string, allLayers
 					indentstr += "  "
 				}
 				fmtstr = fmt.Sprintf("%s%s", indentstr, fmtstr)
-				log.Printf(fmtstr, args...)
+				slog.Debug(fmt.Sprintf(fmtstr, args...))
 			}
 	*/
 	ilog("getNamesOfSelf for %q", logindent, digest)
 
-	names := getNamesForHash(digest)
+	names := getNamesForLayer(digest, diffIDs[digest])
 	// if there are names for digest, return them
 	ilog("names is %v", logindent, names)
 
@@ -220,7 +277,7 @@ func getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(digest string, allLayers
 	ilog("children is %v", logindent, children)
 	// if there is only one child, recurse on it, get the first name we can
 	if len(children) == 1 {
-		return getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(children[0], allLayers, logindent+1)
+		return getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(children[0], allLayers, diffIDs, logindent+1)
 	}
 
 	// if there are 0 or multiple children, just return digest, there is no unique descendant:
@@ -230,12 +287,18 @@ func getNamesOfSelfOrUniqueDescendantLayerWithLogIndent(digest string, allLayers
 
 }
 
-func (ti *treeInfo) summary() string {
+// a directory's summary, with names in its table fitted to width columns, or
+// not at all if it's 0
+func (ti *treeInfo) summary(width int) string {
+	if ti.err != nil {
+		return fmt.Sprintf("%s: error reading directory: %v\n", ti.path, ti.err)
+	}
 	s := fmt.Sprintf("%s: %d layouts, %d images\n\nbase image info:\n (base images marked with a * are not the first layer, just the first named layer)\n", ti.path, ti.numLayouts, len(ti.imageInfos))
 
 	allInternalKnownLayersStr := "\n\nAll known tags used internally in these images:\n"
 	allInternalKnownLayersSet := make(map[string][]string)
 	allLayers := make(map[string][]string)
+	diffIDs := map[string]string{}
 
 	baseLayerMap := map[string][]string{}
 
@@ -244,11 +307,23 @@ func (ti *treeInfo) summary() string {
 	// allLayers, an adjacency list of hashes representing the tree of all layers
 	// baseLayerMap, a map of image tags to the initial base layer in the image stack
 	for _, info := range ti.imageInfos {
-		pathAndTag := fmt.Sprintf("%s/%s", filepath.Base(info.ref.layoutpath), info.ref.tag)
+		// untagged referrers and artifacts go by their hash
+		name := info.ref.tag
+		if name == "" {
+			name = shortHash(info.ref.hash)
+		}
+		pathAndTag := fmt.Sprintf("%s/%s", filepath.Base(info.ref.layoutpath), name)
 
+		if len(info.layerDigests) == 0 {
+			// artifacts and unreadable images have no base layer
+			continue
+		}
 		baseLayer := info.layerDigests[0]
 		baseLayerMap[baseLayer] = append(baseLayerMap[baseLayer], pathAndTag)
 		for idx, digest := range info.layerDigests {
+			if diffID := info.diffIDHash(idx); diffID != "" {
+				diffIDs[digest] = diffID
+			}
 			if idx == len(info.layerDigests)-1 {
 				// ignore last layer for the internalknownlayersset, it is not "internal"
 				continue
@@ -266,7 +341,7 @@ func (ti *treeInfo) summary() string {
 					allLayers[digest] = append(allLayers[digest], nextLayer)
 				}
 			}
-			for _, name := range getNamesForHash(digest) {
+			for _, name := range getNamesForLayer(digest, diffIDs[digest]) {
 				if name == "?" {
 					continue
 				}
@@ -297,12 +372,13 @@ func (ti *treeInfo) summary() string {
 	tw.SetBorder(false)
 	tw.SetColumnSeparator(" ")
 	summaryItems := []summaryItem{}
+	table := namesTable{
+		rows:     [][]string{{"digest7", "base layer names", "number of uses", "images using that base"}},
+		names:    [][]string{nil},
+		namesCol: 1,
+	}
 	for baseHash, users := range baseLayerMap {
-		digest := baseHash
-		if len(baseHash) > 7 {
-			digest = baseHash[:7]
-
-		}
+		digest := shortHash(baseHash)
 
 		usersString := ""
 		for idx, user := range users {
@@ -312,7 +388,7 @@ func (ti *treeInfo) summary() string {
 			}
 		}
 
-		names := getNamesOfSelfOrUniqueDescendantLayer(baseHash, allLayers)
+		names := getNamesOfSelfOrUniqueDescendantLayer(baseHash, allLayers, diffIDs)
 
 		summaryItems = append(summaryItems,
 			summaryItem{
@@ -324,19 +400,29 @@ func (ti *treeInfo) summary() string {
 	}
 	sort.Sort(sort.Reverse(byCount(summaryItems)))
 	for _, item := range summaryItems {
-		tw.Append([]string{
+		table.add([]string{
 			item.digest7,
-			strings.Join(item.names, ","),
+			"",
 			fmt.Sprintf("%d", item.count),
-			item.users})
+			item.users}, item.names)
 
 	}
+	// cells have a space either side, and a space between them
+	tw.AppendBulk(table.fit(width, 3)[1:])
 	tw.Render()
 
-	return s + buf.String() + allInternalKnownLayersStr
+	errStr := ""
+	if len(ti.errs) > 0 {
+		errStr = fmt.Sprintf("\n\n%d directories could not be read:\n", len(ti.errs))
+		for _, err := range ti.errs {
+			errStr += err.Error() + "\n"
+		}
+	}
+
+	return s + buf.String() + allInternalKnownLayersStr + errStr
 }
 
-func addOCILayoutNodes(target *tview.TreeNode, root string, needle string) treeInfo {
+func addOCILayoutNodes(target *tview.TreeNode, root string, opts *walkOptions, depth int) treeInfo {
 	node := tview.NewTreeNode("placeholder").
 		SetSelectable(true)
 
@@ -354,24 +440,52 @@ func addOCILayoutNodes(target *tview.TreeNode, root string, needle string) treeI
 		return ti
 	}
 
-	paths, err := os.ReadDir(root)
+	thisTreeInfo := treeInfo{
+		path: root,
+	}
+
+	if opts.maxDepth > 0 && depth >= opts.maxDepth {
+		return thisTreeInfo
+	}
+
+	realPath, err := filepath.EvalSymlinks(root)
 	if err != nil {
-		panic(err)
+		realPath = root
+	}
+	if opts.ancestors[realPath] {
+		slog.Warn("not following symlink loop", "path", root, "target", realPath)
+		return thisTreeInfo
 	}
+	opts.ancestors[realPath] = true
+	defer delete(opts.ancestors, realPath)
 
-	thisTreeInfo := treeInfo{
-		path: root,
+	paths, err := os.ReadDir(root)
+	if err != nil {
+		// annotate the tree instead of giving up on the whole walk
+		slog.Error("reading directory", "path", root, "err", err)
+		thisTreeInfo.err = err
+		reason := err
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			reason = pathErr.Err
+		}
+		node.SetText(fmt.Sprintf("%s (error: %v)", filepath.Base(root), reason))
+		node.SetReference(thisTreeInfo)
+		target.AddChild(node)
+		return thisTreeInfo
 	}
 
+	opts = opts.withIgnoreFile(root)
+
 	for _, path := range paths {
-		if !path.IsDir() {
+		fullPath := filepath.Join(root, path.Name())
+		if !opts.shouldDescend(fullPath, path) || opts.isExcluded(fullPath) {
 			continue
 		}
-		fullPath := filepath.Join(root, path.Name())
-		pathTreeInfo := addOCILayoutNodes(node, fullPath, needle)
+		pathTreeInfo := addOCILayoutNodes(node, fullPath, opts, depth+1)
 		thisTreeInfo.update(pathTreeInfo)
 	}
-	if thisTreeInfo.numLayouts > 0 {
+	if thisTreeInfo.numLayouts > 0 || len(thisTreeInfo.errs) > 0 {
 		node.SetText(fmt.Sprintf("%s (%d layouts)", filepath.Base(root), thisTreeInfo.numLayouts))
 		target.AddChild(node)
 	}
@@ -404,17 +518,20 @@ func getMatchingTreeNodes(node *tview.TreeNode, needle string) []*tview.TreeNode
 			haystacks = reference.(imageref).searchString()
 
 		case layerRef:
-			haystacks = []string{ref.hash, ref.displayString}
+			haystacks = append([]string{ref.hash, ref.displayString}, ref.names...)
 
 		case subIndexRef:
-			haystacks = []string{}
 			info := SubIndexInfoMap[ref.hash]
+			haystacks = []string{ref.hash, ref.tag, info.displayName}
 			for _, manifestDesc := range info.manifestDescriptors {
-				haystacks = append(haystacks, manifestDesc.Digest.String()[7:])
+				haystacks = append(haystacks, digestHash(manifestDesc.Digest))
 			}
 
+		case *remoteNode:
+			haystacks = ref.searchString()
+
 		default:
-			log.Printf("unknown type for reference %v: %T", reference, reference)
+			slog.Error("unknown type for reference", "type", fmt.Sprintf("%T", reference))
 		}
 
 		for _, haystack := range haystacks {
@@ -454,17 +571,30 @@ func clearTreeFormatting(node *tview.TreeNode, selectable bool) {
 		reference := node.GetReference()
 		if reference != nil {
 
-			switch reference.(type) {
+			switch ref := reference.(type) {
 			case treeInfo:
-				node.SetColor(tcell.ColorBlue)
+				if ref.err != nil {
+					node.SetColor(tcell.ColorRed)
+				} else {
+					node.SetColor(tcell.ColorBlue)
+				}
 			case imageref:
 				node.SetColor(tcell.ColorRed)
 			case layerRef:
 				node.SetColor(tcell.ColorGreen)
 			case subIndexRef:
 				node.SetColor(tcell.ColorBlue)
+			case *remoteNode:
+				switch {
+				case ref.err != nil:
+					node.SetColor(tcell.ColorRed)
+				case ref.kind == remoteManifest:
+					node.SetColor(tcell.ColorRed)
+				default:
+					node.SetColor(tcell.ColorBlue)
+				}
 			default:
-				log.Printf("unknown type for reference %v: %T", reference, reference)
+				slog.Error("unknown type for reference", "type", fmt.Sprintf("%T", reference))
 			}
 		}
 
@@ -494,9 +624,17 @@ func doTViewStuff(ctxt *cli.Context) error {
 		return err
 	}
 
-	rootDirs := ctxt.Args().Slice()
-	log.Print(rootDirs)
-	if len(rootDirs) == 0 {
+	rootDirs := []string{}
+	remoteRoots := ctxt.StringSlice("remote")
+	for _, root := range ctxt.Args().Slice() {
+		if isRemoteRoot(root) {
+			remoteRoots = append(remoteRoots, root)
+		} else {
+			rootDirs = append(rootDirs, root)
+		}
+	}
+	slog.Info("starting", "roots", rootDirs, "remotes", remoteRoots)
+	if len(rootDirs) == 0 && len(remoteRoots) == 0 {
 		rootDirs = []string{"."}
 	}
 
@@ -506,154 +644,164 @@ func doTViewStuff(ctxt *cli.Context) error {
 		}
 	}
 
-	setupWellKnownLayerNames()
-	app := tview.NewApplication()
-
-	root := tview.NewTreeNode("Your forest of OCI layouts").
-		SetColor(tcell.ColorRed)
-
-	tree := tview.NewTreeView().
-		SetRoot(root).
-		SetCurrentNode(root).SetAlign(false).SetTopLevel(1).SetGraphics(true)
-	tree.Box.SetBorder(true)
-
-	searchInputField := tview.NewInputField().
-		SetLabel("Search: ").
-		SetChangedFunc(func(needle string) {
-
-			if needle == "" {
-				tree.SetCurrentNode(nil)
-				clearTreeFormatting(root, true)
-				return
+	remotes := []*remoteNode{}
+	if len(remoteRoots) > 0 {
+		opts, err := newFetchOptions(ctxt)
+		if err != nil {
+			return err
+		}
+		creds := credentials{
+			username: ctxt.String("username"),
+			password: ctxt.String("password"),
+		}
+		for _, root := range remoteRoots {
+			remote, err := newRemoteRoot(root, creds, opts)
+			if err != nil {
+				return err
 			}
+			remote.artifactType = ctxt.String("artifact-type")
+			remotes = append(remotes, remote)
+		}
+	}
 
-			// look through all tree children and highlight ones that match, and
-			// autoselect the first match that is an oci layout
+	setupWellKnownLayerNames(knownLayersSources(ctxt.StringSlice("known-layers")))
+	cosignKeys, err := loadCosignKeys(ctxt.StringSlice("cosign-key"))
+	if err != nil {
+		return fmt.Errorf("reading --cosign-key: %w", err)
+	}
+	cosignKeys.identity = ctxt.String("cosign-identity")
+	cosignKeys.oidcIssuer = ctxt.String("cosign-oidc-issuer")
+	CosignKeys = cosignKeys
+	NotaryTrustDir = ctxt.String("trust-dir")
+	if NotaryTrustDir == "" {
+		if dir, err := defaultNotaryTrustDir(); err == nil {
+			NotaryTrustDir = dir
+		}
+	}
 
-			matches := getMatchingTreeNodes(root, needle)
-			if len(matches) == 0 {
-				clearTreeFormatting(root, true)
-			} else {
-				// set everything unselectable to allow us to just set the matches selectable
-				clearTreeFormatting(root, false)
+	viewer := newOCIViewer(rootDirs, remotes, newWalkOptions(ctxt))
+	return viewer.app.EnableMouse(true).Run()
+}
 
-				firstLayoutNodeIdx := 0
+// ociViewer holds the TUI's widgets and state. newOCIViewer builds it without
+// starting the application, so tests can run it on a simulation screen.
+type ociViewer struct {
+	app                *tview.Application
+	root               *tview.TreeNode
+	tree               *tview.TreeView
+	searchInputField   *tview.InputField
+	infoPane           *tview.TextView
+	summaryFilterField *tview.InputField
+	infoPaneGrid       *tview.Grid
+	logPane            *tview.TextView
+	statusLine         *tview.TextView
+	mainGrid           *tview.Grid
+
+	rootInfos     []treeInfo
+	remotes       []*remoteNode
+	infoWidth     int // the info pane's width, which its tables are fitted to
+	currentFilter string
+	showingLogs   bool
+
+	logRefreshPending atomic.Bool     // a log pane refresh is queued
+	loading           map[string]bool // remote layers and previews being fetched, by hash
+
+	tabbableViews   []tview.Primitive
+	tabbableViewIdx int
+}
 
-				for idx, match := range matches {
-					if isNodeOCILayout(match) && firstLayoutNodeIdx == 0 {
-						firstLayoutNodeIdx = idx
-					}
-					match.SetColor(tcell.ColorYellow)
-					match.SetSelectable(true)
-				}
+func newOCIViewer(rootDirs []string, remotes []*remoteNode, walkOpts *walkOptions) *ociViewer {
+	v := &ociViewer{
+		app:     tview.NewApplication(),
+		loading: map[string]bool{},
+	}
 
-				tree.SetCurrentNode(matches[firstLayoutNodeIdx])
-				// force a process() call
-				tree.Move(1)
-				tree.Move(-1)
+	v.root = tview.NewTreeNode("Your forest of OCI layouts").
+		SetColor(tcell.ColorRed)
 
-			}
-			// update info pane with summaries
-		})
-	searchInputField.SetDoneFunc(func(key tcell.Key) {
-		app.SetFocus(tree)
+	v.tree = tview.NewTreeView().
+		SetRoot(v.root).
+		SetCurrentNode(v.root).SetAlign(false).SetTopLevel(1).SetGraphics(true)
+	v.tree.Box.SetBorder(true)
+	v.tree.SetDrawFunc(func(screen tcell.Screen, x, y, width, height int) (int, int, int, int) {
+		fitLayerNodes(v.root, width-2, 0)
+		return x + 1, y + 1, width - 2, height - 2
 	})
 
-	searchInputField.Box.SetBorder(true)
+	v.searchInputField = tview.NewInputField().
+		SetLabel("Search: ").
+		SetChangedFunc(v.search)
+	v.searchInputField.SetDoneFunc(func(key tcell.Key) {
+		v.setFocusedView(0)
+	})
+
+	v.searchInputField.Box.SetBorder(true)
 
 	treeGrid := tview.NewGrid().SetRows(0, 3).SetColumns(0).
-		AddItem(tree, 0, 0, 1, 1, 0, 0, true).
-		AddItem(searchInputField, 1, 0, 1, 1, 0, 0, false)
+		AddItem(v.tree, 0, 0, 1, 1, 0, 0, true).
+		AddItem(v.searchInputField, 1, 0, 1, 1, 0, 0, false)
 
-	summaries := []string{}
 	for _, rootDir := range rootDirs {
-		treeInfo := addOCILayoutNodes(root, rootDir, "")
-		summaries = append(summaries, tview.Escape(treeInfo.summary()))
+		v.rootInfos = append(v.rootInfos, addOCILayoutNodes(v.root, rootDir, walkOpts, 0))
+	}
+	for _, remote := range remotes {
+		v.root.AddChild(tview.NewTreeNode(remote.label).SetReference(remote).SetSelectable(true))
 	}
-	clearTreeFormatting(root, true)
-	infoPane := tview.NewTextView().
+	v.remotes = remotes
+	clearTreeFormatting(v.root, true)
+	v.infoPane = tview.NewTextView().
 		SetTextAlign(tview.AlignLeft).
-		SetText(strings.Join(summaries, "\n")).
+		SetText(v.rootSummary()).
 		SetDynamicColors(true).
 		SetRegions(true)
 
-	infoPane.Box.SetBorder(true)
-	currentFilter := ""
-	summaryFilterField := tview.NewInputField().
+	v.infoPane.Box.SetBorder(true)
+	v.infoPane.SetDrawFunc(func(screen tcell.Screen, x, y, width, height int) (int, int, int, int) {
+		// the names in tables fit the pane, so redo them when it's resized
+		if width-2 != v.infoWidth {
+			v.infoWidth = width - 2
+			v.refitInfoPane()
+		}
+		return x + 1, y + 1, width - 2, height - 2
+	})
+	v.summaryFilterField = tview.NewInputField().
 		SetLabel("Filter Output: ").
 		SetChangedFunc(func(needle string) {
 
-			currentFilter = needle
+			v.currentFilter = needle
 
-			reference := tree.GetCurrentNode().GetReference()
-			switch ref := reference.(type) {
+			node := v.tree.GetCurrentNode()
+			switch ref := node.GetReference().(type) {
 			case layerRef:
-				infoPane.SetText(ref.summary(currentFilter))
+				v.showLayerSummary(node, ref)
 			}
 
 			// update info pane with summaries
 		})
-	summaryFilterField.SetDoneFunc(func(key tcell.Key) {
-		app.SetFocus(infoPane)
+	v.summaryFilterField.SetDoneFunc(func(key tcell.Key) {
+		v.setFocusedView(2)
 	})
 
-	summaryFilterField.Box.SetBorder(true)
+	v.summaryFilterField.Box.SetBorder(true)
+
+	v.infoPaneGrid = tview.NewGrid().SetRows(0, 3).SetColumns(0).
+		AddItem(v.infoPane, 0, 0, 1, 1, 0, 0, true).
+		AddItem(v.summaryFilterField, 1, 0, 1, 1, 0, 0, false)
 
-	infoPaneGrid := tview.NewGrid().SetRows(0, 3).SetColumns(0).
-		AddItem(infoPane, 0, 0, 1, 1, 0, 0, true).
-		AddItem(summaryFilterField, 1, 0, 1, 1, 0, 0, false)
+	v.logPane = tview.NewTextView().
+		SetTextAlign(tview.AlignLeft).
+		SetDynamicColors(false)
+	v.logPane.Box.SetBorder(true).SetTitle("log")
 
-	statusLine := tview.NewTextView().
+	v.statusLine = tview.NewTextView().
 		SetTextAlign(tview.AlignCenter).
-		SetText("press 'ctrl-q' to exit, 'ctrl-s' to search")
+		SetText("press 'ctrl-q' to exit, 'ctrl-s' to search, 'ctrl-l' to show logs")
 
-	selfunc := func(node *tview.TreeNode) {
-		reference := node.GetReference()
-		if reference == nil {
-			infoPane.SetText(strings.Join(summaries, "\n"))
-			infoPane.ScrollToBeginning()
-			return
-		}
-		children := node.GetChildren()
-		if len(children) == 0 {
-			switch ref := reference.(type) {
-			case imageref:
-				infoPane.SetText(ref.summary())
-				infoPane.ScrollToBeginning()
-			case treeInfo:
-				infoPane.SetText(tview.Escape(ref.summary()))
-			case layerRef:
-				infoPane.SetText(ref.summary(currentFilter))
-			case subIndexRef:
-				infoPane.SetText(ref.summary())
-			default:
-				log.Printf("node ref is unknown type: %T\n", reference)
-			}
-		} else {
-			switch ref := reference.(type) {
-			case imageref:
-				infoPane.SetText(ref.summary())
-				infoPane.ScrollToBeginning()
-			case treeInfo:
-				infoPane.SetText(ref.summary())
-				infoPane.ScrollToBeginning()
-			case layerRef:
-				// todo mmcc didn't think through this behavior:
-				infoPane.SetText(ref.summary(currentFilter))
-				infoPane.ScrollToBeginning()
-			case subIndexRef:
-				infoPane.SetText(ref.summary())
-			default:
-				log.Printf("node ref is unknown type: %T\n", reference)
-				infoPane.SetText("error")
-			}
-		}
-	}
-	tree.SetSelectedFunc(selfunc)
-	tree.SetChangedFunc(selfunc)
+	v.tree.SetSelectedFunc(v.selectNode)
+	v.tree.SetChangedFunc(v.selectNode)
 
 	// customise the movement keys to auto select instead of waiting for space or enter
-	tree.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+	v.tree.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		switch key := event.Key(); key {
 		case tcell.KeyRune:
 			if r := event.Rune(); key == tcell.KeyRune {
@@ -661,24 +809,24 @@ func doTViewStuff(ctxt *cli.Context) error {
 				case 'k':
 					fallthrough
 				case 'p':
-					tree.Move(-1)
+					v.tree.Move(-1)
 				case 'j':
 					fallthrough
 				case 'n':
-					tree.Move(1)
+					v.tree.Move(1)
 				case 'r':
-					infoPane.Clear()
+					v.infoPane.Clear()
 				}
-				cur := tree.GetCurrentNode()
+				cur := v.tree.GetCurrentNode()
 				if cur != nil {
-					tree.SetCurrentNode(cur)
-					selfunc(cur)
+					v.tree.SetCurrentNode(cur)
+					v.selectNode(cur)
 				}
 				return nil
 			}
 		case tcell.KeyEnter:
 			// enter toggles expanded setting
-			cur := tree.GetCurrentNode()
+			cur := v.tree.GetCurrentNode()
 			if cur != nil {
 				cur.SetExpanded(!cur.IsExpanded())
 			}
@@ -687,24 +835,16 @@ func doTViewStuff(ctxt *cli.Context) error {
 		return event
 	})
 
-	mainGrid := tview.NewGrid().
+	v.mainGrid = tview.NewGrid().
 		SetRows(0, 1).
 		SetColumns(-1, -3).
 		AddItem(treeGrid, 0, 0, 1, 1, 0, 0, true).
-		AddItem(infoPaneGrid, 0, 1, 1, 1, 0, 0, false).
-		AddItem(statusLine, 1, 0, 1, 2, 0, 0, false)
-
-	tabbableViews := []tview.Primitive{tree, searchInputField, infoPane, summaryFilterField}
-	tabbableViewIdx := 0
+		AddItem(v.infoPaneGrid, 0, 1, 1, 1, 0, 0, false).
+		AddItem(v.statusLine, 1, 0, 1, 2, 0, 0, false)
 
-	setNewFocusedViewIdx := func(prevIdx int, newIdx int) {
-		//		prev := tabbableViews[prevIdx%len(tabbableViews)]
-		//		 note: remember to check if prev == new
-		new := tabbableViews[newIdx%len(tabbableViews)]
-		app.SetFocus(new)
-	}
+	v.tabbableViews = v.mainTabbableViews()
 
-	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+	v.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		switch key := event.Key(); key {
 		// case tcell.KeyRune:
 		// 	if r := event.Rune(); key == tcell.KeyRune && r == 'q' {
@@ -712,25 +852,259 @@ func doTViewStuff(ctxt *cli.Context) error {
 		// 		return nil
 		// 	}
 		case tcell.KeyCtrlQ:
-			app.Stop()
+			v.app.Stop()
 		case tcell.KeyCtrlS:
-			prev := tabbableViewIdx
-			tabbableViewIdx := 1
-			setNewFocusedViewIdx(prev, tabbableViewIdx)
+			v.setFocusedView(1)
+			return nil
+		case tcell.KeyCtrlL:
+			v.toggleLogPane()
+			return nil
 		case tcell.KeyTab:
-			prev := tabbableViewIdx
-			tabbableViewIdx += 1
-			setNewFocusedViewIdx(prev, tabbableViewIdx)
+			v.setFocusedView(v.tabbableViewIdx + 1)
+			return nil
 		case tcell.KeyBacktab:
-			prev := tabbableViewIdx
-			tabbableViewIdx -= 1
-			setNewFocusedViewIdx(prev, tabbableViewIdx)
+			v.setFocusedView(v.tabbableViewIdx - 1)
+			return nil
 		}
 		return event
 	})
 
-	if err := app.SetRoot(mainGrid, true).EnableMouse(true).Run(); err != nil {
-		panic(err)
+	v.app.SetRoot(v.mainGrid, true)
+	return v
+}
+
+func (v *ociViewer) setFocusedView(idx int) {
+	n := len(v.tabbableViews)
+	v.tabbableViewIdx = ((idx % n) + n) % n
+	v.app.SetFocus(v.tabbableViews[v.tabbableViewIdx])
+}
+
+// the views tab cycles through, which are the visible ones
+func (v *ociViewer) mainTabbableViews() []tview.Primitive {
+	if v.showingLogs {
+		return []tview.Primitive{v.tree, v.searchInputField, v.logPane}
+	}
+	return []tview.Primitive{v.tree, v.searchInputField, v.infoPane, v.summaryFilterField}
+}
+
+// swap the info pane for the log pane and back. the log pane follows new
+// records while it's shown.
+func (v *ociViewer) toggleLogPane() {
+	v.showingLogs = !v.showingLogs
+	v.tabbableViews = v.mainTabbableViews()
+	if v.showingLogs {
+		v.logPane.SetText(recentLogs.String()).ScrollToEnd()
+		v.mainGrid.RemoveItem(v.infoPaneGrid)
+		v.mainGrid.AddItem(v.logPane, 0, 1, 1, 1, 0, 0, false)
+		recentLogs.setOnWrite(v.queueLogRefresh)
+	} else {
+		recentLogs.setOnWrite(nil)
+		v.mainGrid.RemoveItem(v.logPane)
+		v.mainGrid.AddItem(v.infoPaneGrid, 0, 1, 1, 1, 0, 0, false)
+	}
+	// the info pane and log pane take each other's place, and the filter
+	// is hidden with the info pane
+	if v.tabbableViewIdx >= 2 {
+		v.setFocusedView(2)
+	}
+}
+
+// refresh the log pane after new records. they can be logged from any
+// goroutine, the UI's own included, so this mustn't wait for the update.
+func (v *ociViewer) queueLogRefresh() {
+	if !v.logRefreshPending.CompareAndSwap(false, true) {
+		return
+	}
+	go v.app.QueueUpdateDraw(func() {
+		v.logRefreshPending.Store(false)
+		if v.showingLogs {
+			// the pane keeps following the end, unless it's been scrolled up
+			v.logPane.SetText(recentLogs.String())
+		}
+	})
+}
+
+// look through all tree children and highlight ones that match, and
+// autoselect the first match that is an oci layout
+func (v *ociViewer) search(needle string) {
+	if needle == "" {
+		v.tree.SetCurrentNode(nil)
+		clearTreeFormatting(v.root, true)
+		return
+	}
+
+	matches := getMatchingTreeNodes(v.root, needle)
+	if len(matches) == 0 {
+		clearTreeFormatting(v.root, true)
+	} else {
+		// set everything unselectable to allow us to just set the matches selectable
+		clearTreeFormatting(v.root, false)
+
+		firstLayoutNodeIdx := 0
+
+		for idx, match := range matches {
+			if isNodeOCILayout(match) && firstLayoutNodeIdx == 0 {
+				firstLayoutNodeIdx = idx
+			}
+			match.SetColor(tcell.ColorYellow)
+			match.SetSelectable(true)
+		}
+
+		v.tree.SetCurrentNode(matches[firstLayoutNodeIdx])
+		// force a process() call
+		v.tree.Move(1)
+		v.tree.Move(-1)
+
 	}
-	return nil
+	// update info pane with summaries
+}
+
+// update the info pane for the selected tree node
+func (v *ociViewer) selectNode(node *tview.TreeNode) {
+	reference := node.GetReference()
+	if reference == nil {
+		v.infoPane.SetText(v.rootSummary())
+		v.infoPane.ScrollToBeginning()
+		return
+	}
+	children := node.GetChildren()
+	if len(children) == 0 {
+		switch ref := reference.(type) {
+		case imageref:
+			v.showImageInfo(node, ref)
+		case treeInfo:
+			v.infoPane.SetText(tview.Escape(ref.summary(v.infoWidth)))
+		case layerRef:
+			v.showLayerSummary(node, ref)
+		case subIndexRef:
+			v.infoPane.SetText(ref.summary())
+		case *remoteNode:
+			v.loadRemoteNode(node, ref)
+			v.infoPane.SetText(tview.Escape(ref.summary()))
+		default:
+			slog.Error("node ref is unknown type", "type", fmt.Sprintf("%T", reference))
+		}
+	} else {
+		switch ref := reference.(type) {
+		case imageref:
+			v.showImageInfo(node, ref)
+		case treeInfo:
+			v.infoPane.SetText(ref.summary(v.infoWidth))
+			v.infoPane.ScrollToBeginning()
+		case layerRef:
+			// todo mmcc didn't think through this behavior:
+			v.showLayerSummary(node, ref)
+			v.infoPane.ScrollToBeginning()
+		case subIndexRef:
+			v.infoPane.SetText(ref.summary())
+		case *remoteNode:
+			v.infoPane.SetText(tview.Escape(ref.summary()))
+		default:
+			slog.Error("node ref is unknown type", "type", fmt.Sprintf("%T", reference))
+			v.infoPane.SetText("error")
+		}
+	}
+}
+
+// the info pane's text for the root: each directory's summary, and the
+// remotes
+func (v *ociViewer) rootSummary() string {
+	summaries := []string{}
+	for _, ti := range v.rootInfos {
+		summaries = append(summaries, tview.Escape(ti.summary(v.infoWidth)))
+	}
+	for _, remote := range v.remotes {
+		summaries = append(summaries, tview.Escape(remote.location()+": remote, select it to browse\n"))
+	}
+	return strings.Join(summaries, "\n")
+}
+
+// show an image's info. a remote artifact's layers are fetched to preview
+// them the first time it's shown, in the background.
+func (v *ociViewer) showImageInfo(node *tview.TreeNode, ref imageref) {
+	info, ok := ImageInfoMap[ref.hash]
+	if _, cached := PreviewCache[ref.hash]; ok && !cached && info.previewFetch != nil && isRemoteRoot(ref.layoutpath) {
+		if !v.loading[ref.hash] {
+			v.loading[ref.hash] = true
+			go func() {
+				previews := fetchArtifactPreviews(info)
+				v.app.QueueUpdateDraw(func() {
+					delete(v.loading, ref.hash)
+					PreviewCache[ref.hash] = previews
+					v.reselect(node)
+				})
+			}()
+		}
+		v.infoPane.SetText(tview.Escape(info.displayName) + " (loading...)")
+		return
+	}
+	v.infoPane.SetText(ref.summary(v.infoWidth))
+	v.infoPane.ScrollToBeginning()
+}
+
+// show a layer's file listing. a remote layer is streamed to list it the
+// first time it's shown, in the background.
+func (v *ociViewer) showLayerSummary(node *tview.TreeNode, ref layerRef) {
+	if ref.remote == nil || ref.listed() {
+		v.infoPane.SetText(ref.summary(v.currentFilter))
+		return
+	}
+	if ref.remote.err != nil {
+		v.infoPane.SetText(fmt.Sprintf(" error: %v", ref.remote.err))
+		return
+	}
+	if !v.loading[ref.hash] {
+		v.loading[ref.hash] = true
+		go func() {
+			err := ref.remote.writeFileList(ref.mediaType, ref.fileListFilename())
+			v.app.QueueUpdateDraw(func() {
+				delete(v.loading, ref.hash)
+				if err != nil {
+					slog.Error("listing remote layer blob", "blob", ref.blobfilepath, "err", err)
+					ref.remote.err = err
+				}
+				v.reselect(node)
+			})
+		}()
+	}
+	v.infoPane.SetText(tview.Escape(ref.displayString) + " (loading...)")
+}
+
+// show node's info again after loading it in the background, if it's still
+// selected
+func (v *ociViewer) reselect(node *tview.TreeNode) {
+	if v.tree.GetCurrentNode() == node {
+		v.selectNode(node)
+	}
+}
+
+// show the selected node's info again, after the info pane is resized, if
+// it has tables of names
+func (v *ociViewer) refitInfoPane() {
+	node := v.tree.GetCurrentNode()
+	if node == nil {
+		return
+	}
+	switch node.GetReference().(type) {
+	case nil, imageref, treeInfo:
+		v.selectNode(node)
+	}
+}
+
+// start loading a remote node in the background, the first time it's
+// selected. the tree and info pane are updated when it's done.
+func (v *ociViewer) loadRemoteNode(node *tview.TreeNode, rn *remoteNode) {
+	if rn.loading || rn.loaded || rn.err != nil {
+		return
+	}
+	rn.loading = true
+	node.SetText(rn.label + " (loading...)")
+	go func() {
+		apply := rn.load(context.Background())
+		v.app.QueueUpdateDraw(func() {
+			apply(node)
+			clearTreeFormatting(node, true)
+			v.reselect(node)
+		})
+	}()
 }
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rivo/tview"
+)
+
+func loadFixtureTree(t *testing.T, f *standardFixture) (*tview.TreeNode, treeInfo) {
+	t.Helper()
+	root := tview.NewTreeNode("root")
+	ti := addOCILayoutNodes(root, f.dir, &walkOptions{ancestors: map[string]bool{}}, 0)
+	return root, ti
+}
+
+// find the node for a layout by its directory name
+func findLayoutNode(t *testing.T, root *tview.TreeNode, name string) *tview.TreeNode {
+	t.Helper()
+	for _, node := range getAllChildren(root) {
+		if ti, ok := node.GetReference().(treeInfo); ok && isOCILayout(ti.path) && strings.HasSuffix(ti.path, name) {
+			return node
+		}
+	}
+	t.Fatalf("no layout node for %s", name)
+	return nil
+}
+
+func TestTreeInfoSummary(t *testing.T) {
+	f := newStandardFixture(t)
+	root, ti := loadFixtureTree(t, f)
+
+	// name the shared base layer, as if it came from known-layers.json
+	rootfs := ImageInfoMap[digestHash(f.web.Digest)].layerDigests[0]
+	LayerNameMap[rootfs] = append(LayerNameMap[rootfs], "example.com/c3/rootfs:1.0")
+
+	if ti.numLayouts != 2 {
+		t.Errorf("expected 2 layouts, got %d", ti.numLayouts)
+	}
+	checkGolden(t, "summary_root", scrubPath(ti.summary(0), f.dir))
+
+	appsInfo := findLayoutNode(t, root, "apps").GetReference().(treeInfo)
+	checkGolden(t, "summary_apps", scrubPath(appsInfo.summary(0), f.dir))
+}
+
+func TestTreeInfoSummaryRecompressedBase(t *testing.T) {
+	resetGlobals(t)
+	dir := t.TempDir()
+	b := newLayoutBuilder(t, filepath.Join(dir, "apps"))
+	web := b.addImage("web", "rootfs", "nginx")
+	b.save()
+	_, ti := loadFixtureTree(t, &standardFixture{dir: dir})
+
+	// the base image is known with its layer compressed differently, so only
+	// the diffID matches
+	info := ImageInfoMap[digestHash(web.Digest)]
+	addKnownLayerEntry(&LayerNameMapEntry{
+		Hash:        digestHash(digest.FromString("zstd rootfs")),
+		DiffID:      info.diffIDHash(0),
+		Name:        "c3/rootfs:1.0",
+		Repository:  "c3/rootfs",
+		Tag:         "1.0",
+		LayerIndex:  1,
+		LayerCount:  1,
+		ImageDigest: "sha256:rootfs",
+	})
+
+	if got := getImageInfoString(info.ref, info, 0); !strings.Contains(got, "Base image: [blue]c3/rootfs:1.0 plus one layer") {
+		t.Errorf("info doesn't name the base image:\n%s", got)
+	}
+	summary := ti.summary(0)
+	for _, want := range []string{shortHash(info.layerDigests[0]) + "   c3/rootfs:1.0*", "c3/rootfs:1.0 in apps/web"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary doesn't have %q:\n%s", want, summary)
+		}
+	}
+}
+
+func TestGetMatchingTreeNodes(t *testing.T) {
+	f := newStandardFixture(t)
+	root, _ := loadFixtureTree(t, f)
+
+	out := ""
+	for _, needle := range []string{"web", "spdx", "add postgres", "busybox", digestHash(f.db.Digest)[:12], "no such thing"} {
+		out += fmt.Sprintf("needle %q:\n", needle)
+		for _, node := range getMatchingTreeNodes(root, needle) {
+			out += "  " + node.GetText() + "\n"
+		}
+	}
+	checkGolden(t, "matching_nodes", scrubPath(out, f.dir))
+}
+
+// tuiHarness runs an ociViewer on a simulation screen and feeds it key
+// events, waiting for each one to be handled and drawn.
+type tuiHarness struct {
+	t      *testing.T
+	viewer *ociViewer
+	screen tcell.SimulationScreen
+
+	keyPending bool // only touched from the app's event loop
+	drawn      chan struct{}
+	stopped    chan struct{}
+}
+
+const harnessWidth, harnessHeight = 160, 40
+
+func newTUIHarness(t *testing.T, rootDirs ...string) *tuiHarness {
+	t.Helper()
+	return newTUIHarnessWithRemotes(t, nil, rootDirs...)
+}
+
+func newTUIHarnessWithRemotes(t *testing.T, remotes []*remoteNode, rootDirs ...string) *tuiHarness {
+	t.Helper()
+	h := &tuiHarness{
+		t:       t,
+		viewer:  newOCIViewer(rootDirs, remotes, &walkOptions{ancestors: map[string]bool{}}),
+		screen:  tcell.NewSimulationScreen("UTF-8"),
+		drawn:   make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	app := h.viewer.app
+	app.SetScreen(h.screen)
+	h.screen.SetSize(harnessWidth, harnessHeight)
+
+	// every key event is followed by exactly one draw, so note when a key
+	// comes in and signal when the draw after it is done
+	capture := app.GetInputCapture()
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		h.keyPending = true
+		return capture(event)
+	})
+	firstDraw := true
+	app.SetAfterDrawFunc(func(screen tcell.Screen) {
+		if h.keyPending || firstDraw {
+			h.keyPending = false
+			firstDraw = false
+			h.drawn <- struct{}{}
+		}
+	})
+
+	go func() {
+		defer close(h.stopped)
+		if err := app.Run(); err != nil {
+			t.Errorf("running app: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		recentLogs.setOnWrite(nil)
+		app.Stop()
+		<-h.stopped
+	})
+
+	h.waitForDraw()
+	return h
+}
+
+func (h *tuiHarness) waitForDraw() {
+	h.t.Helper()
+	select {
+	case <-h.drawn:
+	case <-time.After(5 * time.Second):
+		h.t.Fatal("timed out waiting for the TUI to draw")
+	}
+}
+
+// wait for cond, checked on the UI goroutine between draws, to be true, e.g.
+// after a background update
+func (h *tuiHarness) waitFor(cond func() bool) bool {
+	h.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		done := false
+		h.viewer.app.QueueUpdate(func() { done = cond() })
+		if done {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// wait for want to be drawn by something other than a key press
+func (h *tuiHarness) waitForScreen(fromCol, toCol int, want string) {
+	h.t.Helper()
+	if !h.waitFor(func() bool { return strings.Contains(h.screenText(fromCol, toCol), want) }) {
+		h.t.Fatalf("timed out waiting for %q on screen:\n%s", want, h.screenText(fromCol, toCol))
+	}
+}
+
+// select node, as if it had been moved to
+func (h *tuiHarness) selectNode(node *tview.TreeNode) {
+	h.viewer.app.QueueUpdateDraw(func() {
+		h.viewer.tree.SetCurrentNode(node)
+		h.viewer.selectNode(node)
+	})
+}
+
+func (h *tuiHarness) press(key tcell.Key) {
+	h.t.Helper()
+	h.screen.InjectKey(key, 0, tcell.ModNone)
+	h.waitForDraw()
+}
+
+func (h *tuiHarness) typeRunes(s string) {
+	h.t.Helper()
+	for _, r := range s {
+		h.screen.InjectKey(tcell.KeyRune, r, tcell.ModNone)
+		h.waitForDraw()
+	}
+}
+
+// the text on screen in the given columns, one line per row with trailing
+// spaces trimmed
+func (h *tuiHarness) screenText(fromCol, toCol int) string {
+	cells, width, height := h.screen.GetContents()
+	lines := []string{}
+	for y := 0; y < height; y++ {
+		line := ""
+		for x := fromCol; x < toCol && x < width; x++ {
+			runes := cells[y*width+x].Runes
+			if len(runes) == 0 {
+				line += " "
+				continue
+			}
+			line += string(runes)
+			if runewidth.RuneWidth(runes[0]) == 2 {
+				// the next cell is covered by this rune, and may hold
+				// leftovers from earlier draws
+				x++
+			}
+		}
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// the tree pane takes the left quarter of the screen
+func (h *tuiHarness) treeText() string {
+	return h.screenText(0, harnessWidth/4)
+}
+
+func (h *tuiHarness) currentNodeText() string {
+	node := h.viewer.tree.GetCurrentNode()
+	if node == nil {
+		return ""
+	}
+	return node.GetText()
+}
+
+func (h *tuiHarness) focused() tview.Primitive {
+	return h.viewer.app.GetFocus()
+}
+
+func TestTUISelection(t *testing.T) {
+	f := newStandardFixture(t)
+	h := newTUIHarness(t, f.dir)
+	checkGolden(t, "tui_tree_initial", h.treeText())
+
+	// j/k move the selection and update the info pane
+	h.typeRunes("jj")
+	if got := h.currentNodeText(); got != "apps (8 images)" {
+		t.Errorf("after jj expected apps layout selected, got %q", got)
+	}
+	if info := h.viewer.infoPane.GetText(true); !strings.Contains(info, "1 layouts, 8 images") {
+		t.Errorf("info pane should show the apps layout summary, got:\n%s", info)
+	}
+
+	h.typeRunes("j")
+	if got := h.currentNodeText(); got != `🏷  image "base"` {
+		t.Errorf("after j expected base image selected, got %q", got)
+	}
+	if info := h.viewer.infoPane.GetText(true); !strings.Contains(info, "# apps:base") {
+		t.Errorf("info pane should show the base image, got:\n%s", info)
+	}
+
+	h.typeRunes("k")
+	if got := h.currentNodeText(); got != "apps (8 images)" {
+		t.Errorf("after k expected apps layout selected, got %q", got)
+	}
+
+	// enter collapses and expands the selected node
+	h.press(tcell.KeyEnter)
+	if strings.Contains(h.treeText(), `image "base"`) {
+		t.Errorf("collapsed layout's images are still shown:\n%s", h.treeText())
+	}
+	checkGolden(t, "tui_tree_collapsed", h.treeText())
+	h.press(tcell.KeyEnter)
+	if !strings.Contains(h.treeText(), `image "base"`) {
+		t.Errorf("expanded layout's images aren't shown:\n%s", h.treeText())
+	}
+}
+
+func TestTUIFitsLayerNames(t *testing.T) {
+	f := newStandardFixture(t)
+	data, _ := tarGzLayer(t, "rootfs", "contents of rootfs")
+	for _, name := range []string{"c3/rootfs:1.0", "c3/fish:2.1", "c3/lizard:3.0"} {
+		addKnownLayerEntry(&LayerNameMapEntry{Hash: digest.FromBytes(data).Encoded(), Name: name})
+	}
+	h := newTUIHarness(t, f.dir)
+
+	// the base layer starts 15 columns into the tree's 38
+	if tree := h.treeText(); !strings.Contains(tree, "└──base +3 more           ║") {
+		t.Errorf("the base layer's names weren't fitted to the tree:\n%s", tree)
+	}
+	// the info pane's tables fit them to what the other columns leave
+	h.typeRunes("jjj")
+	if info := h.viewer.infoPane.GetText(true); !strings.Contains(info, "  base,c3/fish:2.1 +2 more  tgz Image Layer") {
+		t.Errorf("the info pane didn't fit the base layer's names:\n%s", info)
+	}
+
+	// and fit them again when the window is resized
+	h.screen.SetSize(harnessWidth+80, harnessHeight)
+	if err := h.screen.PostEvent(tcell.NewEventResize(harnessWidth+80, harnessHeight)); err != nil {
+		t.Fatal(err)
+	}
+	h.typeRunes("x")
+	if info := h.viewer.infoPane.GetText(true); !strings.Contains(info, "  base,c3/fish:2.1,c3/lizard:3.0,c3/rootfs:1.0  tgz Image Layer") {
+		t.Errorf("the info pane didn't refit the base layer's names:\n%s", info)
+	}
+}
+
+func TestTUISearch(t *testing.T) {
+	f := newStandardFixture(t)
+	h := newTUIHarness(t, f.dir)
+
+	h.press(tcell.KeyCtrlS)
+	if h.focused() != h.viewer.searchInputField {
+		t.Fatalf("ctrl-s should focus the search field, focused %T", h.focused())
+	}
+
+	h.typeRunes("postgres")
+	if got := h.viewer.searchInputField.GetText(); got != "postgres" {
+		t.Errorf("search field text is %q", got)
+	}
+	// the first matching layout is selected, and the matches are selectable
+	if got := h.currentNodeText(); got != "apps (8 images)" {
+		t.Errorf("search should select the matching layout, got %q", got)
+	}
+	checkGolden(t, "tui_tree_search", h.treeText())
+
+	// enter returns to the tree, where j moves between matches only
+	h.press(tcell.KeyEnter)
+	if h.focused() != h.viewer.tree {
+		t.Fatalf("enter should focus the tree, focused %T", h.focused())
+	}
+	h.typeRunes("j")
+	if got := h.currentNodeText(); got != `🏷  image "db"` {
+		t.Errorf("j should move to the next match, got %q", got)
+	}
+
+	// clearing the search removes the highlighting
+	h.press(tcell.KeyCtrlS)
+	for range "postgres" {
+		h.press(tcell.KeyBackspace2)
+	}
+	for _, node := range getAllChildren(h.viewer.root) {
+		if node.GetColor() == tcell.ColorYellow {
+			t.Errorf("node %q is still highlighted after clearing the search", node.GetText())
+		}
+	}
+}
+
+func TestTUIFocusCycling(t *testing.T) {
+	f := newStandardFixture(t)
+	h := newTUIHarness(t, f.dir)
+	v := h.viewer
+
+	if h.focused() != v.tree {
+		t.Fatalf("tree should start focused, focused %T", h.focused())
+	}
+	for _, want := range []tview.Primitive{v.searchInputField, v.infoPane, v.summaryFilterField, v.tree} {
+		h.press(tcell.KeyTab)
+		if h.focused() != want {
+			t.Errorf("tab focused %T, expected %T", h.focused(), want)
+		}
+	}
+
+	h.press(tcell.KeyBacktab)
+	if h.focused() != v.summaryFilterField {
+		t.Errorf("backtab from the tree should wrap to the filter field, focused %T", h.focused())
+	}
+
+	// ctrl-s jumps to search, and tab continues from there
+	h.press(tcell.KeyCtrlS)
+	if h.focused() != v.searchInputField {
+		t.Errorf("ctrl-s should focus search, focused %T", h.focused())
+	}
+	h.press(tcell.KeyTab)
+	if h.focused() != v.infoPane {
+		t.Errorf("tab after ctrl-s should focus the info pane, focused %T", h.focused())
+	}
+}
+
+func TestTUILogPane(t *testing.T) {
+	f := newStandardFixture(t)
+	h := newTUIHarness(t, f.dir)
+
+	slog.Warn("a message for the log pane")
+	h.press(tcell.KeyCtrlL)
+	if !h.viewer.showingLogs {
+		t.Fatal("ctrl-l should show the log pane")
+	}
+	if !strings.Contains(h.screenText(harnessWidth/4, harnessWidth), "a message for the log pane") {
+		t.Errorf("log pane doesn't show the logged message:\n%s", h.screenText(harnessWidth/4, harnessWidth))
+	}
+
+	// records logged while it's shown appear without another key press
+	slog.Warn("a later message")
+	h.waitForScreen(harnessWidth/4, harnessWidth, "a later message")
+
+	h.press(tcell.KeyCtrlL)
+	if h.viewer.showingLogs {
+		t.Fatal("ctrl-l again should hide the log pane")
+	}
+	if strings.Contains(h.screenText(harnessWidth/4, harnessWidth), "a message for the log pane") {
+		t.Errorf("log pane is still shown after hiding it")
+	}
+}
+
+func TestTUILogPaneFocusCycling(t *testing.T) {
+	f := newStandardFixture(t)
+	h := newTUIHarness(t, f.dir)
+	v := h.viewer
+
+	// the info pane is focused when the logs are shown, and the log pane
+	// takes its place
+	h.press(tcell.KeyTab)
+	h.press(tcell.KeyTab)
+	h.press(tcell.KeyCtrlL)
+	if h.focused() != v.logPane {
+		t.Errorf("showing logs with the info pane focused should focus the log pane, focused %T", h.focused())
+	}
+
+	// the hidden info pane and filter are skipped
+	for _, want := range []tview.Primitive{v.tree, v.searchInputField, v.logPane, v.tree} {
+		h.press(tcell.KeyTab)
+		if h.focused() != want {
+			t.Errorf("tab focused %T, expected %T", h.focused(), want)
+		}
+	}
+	h.press(tcell.KeyBacktab)
+	if h.focused() != v.logPane {
+		t.Errorf("backtab from the tree should wrap to the log pane, focused %T", h.focused())
+	}
+
+	h.press(tcell.KeyCtrlL)
+	if h.focused() != v.infoPane {
+		t.Errorf("hiding logs with the log pane focused should focus the info pane, focused %T", h.focused())
+	}
+	h.press(tcell.KeyTab)
+	if h.focused() != v.summaryFilterField {
+		t.Errorf("tab after hiding logs should focus the filter, focused %T", h.focused())
+	}
+}
+
+func TestTUIRemoteLayerListedInBackground(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	fr.addImageWithBlobs("tools/busybox", "1.36", "base", "busybox")
+	rn, _ := newTestRemoteRoot(t, fr, "/tools/busybox:1.36")
+	h := newTUIHarnessWithRemotes(t, []*remoteNode{rn})
+	v := h.viewer
+
+	remote := v.root.GetChildren()[0]
+	h.selectNode(remote)
+	if !h.waitFor(func() bool { return rn.loaded }) {
+		t.Fatalf("the remote image didn't load: %v", rn.err)
+	}
+
+	// the layer is streamed to list it, while the TUI carries on
+	var layer *tview.TreeNode
+	var ref layerRef
+	v.app.QueueUpdate(func() {
+		layer = remote.GetChildren()[0].GetChildren()[1]
+		ref = layer.GetReference().(layerRef)
+	})
+	os.Remove(ref.fileListFilename())
+	t.Cleanup(func() { os.Remove(ref.fileListFilename()) })
+	held := fr.holdBlob(digest.Digest("sha256:" + ref.hash))
+	h.selectNode(layer)
+	h.waitForScreen(harnessWidth/4, harnessWidth, "(loading...)")
+	h.press(tcell.KeyTab)
+	if h.focused() != v.searchInputField {
+		t.Errorf("tab while listing focused %T", h.focused())
+	}
+
+	close(held)
+	h.waitForScreen(harnessWidth/4, harnessWidth, "file listing of blob")
+}
+
+func TestTUIRemotePreviewsInBackground(t *testing.T) {
+	resetGlobals(t)
+	fr := newFakeRegistry(t)
+	notes := fr.addBlob("text/plain", []byte("take notes\n"))
+	notes.Annotations = map[string]string{ispec.AnnotationTitle: "notes.txt"}
+	fr.addManifest("notes", "1.0", ispec.MediaTypeImageManifest, ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.acme.notes",
+		Config:       fr.addBlob("application/vnd.oci.empty.v1+json", []byte("{}")),
+		Layers:       []ispec.Descriptor{notes},
+	})
+	held := fr.holdBlob(notes.Digest)
+	rn, _ := newTestRemoteRoot(t, fr, "/notes:1.0")
+	h := newTUIHarnessWithRemotes(t, []*remoteNode{rn})
+
+	// the artifact loads, then its layer is fetched for its preview
+	h.selectNode(h.viewer.root.GetChildren()[0])
+	if !h.waitFor(func() bool { return rn.loaded }) {
+		t.Fatalf("the remote artifact didn't load: %v", rn.err)
+	}
+	h.waitForScreen(harnessWidth/4, harnessWidth, "(loading...)")
+
+	close(held)
+	h.waitForScreen(harnessWidth/4, harnessWidth, "take notes")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// name of a per-directory file listing glob patterns to skip while walking,
+// one per line, with '#' comments, like a .gitignore.
+const ociIgnoreFilename = ".ocivignore"
+
+// an exclude pattern, and the directory it is relative to. patterns from the
+// command line have an empty base.
+type excludePattern struct {
+	base    string
+	pattern string
+}
+
+// options controlling how addOCILayoutNodes walks the directories under a root
+type walkOptions struct {
+	maxDepth       int // 0 means no limit
+	excludes       []excludePattern
+	followSymlinks bool
+
+	// real paths of the directories currently being walked, used to detect
+	// symlink loops
+	ancestors map[string]bool
+}
+
+func newWalkOptions(ctxt *cli.Context) *walkOptions {
+	opts := &walkOptions{
+		maxDepth:       ctxt.Int("max-depth"),
+		followSymlinks: ctxt.Bool("follow-symlinks"),
+		ancestors:      map[string]bool{},
+	}
+	for _, pattern := range ctxt.StringSlice("exclude") {
+		opts.excludes = append(opts.excludes, excludePattern{pattern: pattern})
+	}
+	return opts
+}
+
+// return a copy of the options with the patterns from dir's .ocivignore
+// added, or the original options if there isn't one
+func (wo *walkOptions) withIgnoreFile(dir string) *walkOptions {
+	patterns, err := readIgnoreFile(filepath.Join(dir, ociIgnoreFilename))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("can't read ignore file", "file", filepath.Join(dir, ociIgnoreFilename), "err", err)
+		}
+		return wo
+	}
+	if len(patterns) == 0 {
+		return wo
+	}
+
+	newOpts := *wo
+	newOpts.excludes = append([]excludePattern{}, wo.excludes...)
+	for _, pattern := range patterns {
+		newOpts.excludes = append(newOpts.excludes, excludePattern{base: dir, pattern: pattern})
+	}
+	return &newOpts
+}
+
+func readIgnoreFile(fname string) ([]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.TrimSuffix(line, "/"))
+	}
+	return patterns, scanner.Err()
+}
+
+// a path is excluded if a pattern matches its base name, or its path relative
+// to the directory the pattern came from
+func (wo *walkOptions) isExcluded(path string) bool {
+	name := filepath.Base(path)
+	for _, ex := range wo.excludes {
+		if ok, _ := filepath.Match(ex.pattern, name); ok {
+			return true
+		}
+		rel := path
+		if ex.base != "" {
+			var err error
+			rel, err = filepath.Rel(ex.base, path)
+			if err != nil {
+				continue
+			}
+		}
+		if ok, _ := filepath.Match(ex.pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the walk should descend into the directory entry, following
+// symlinks to directories if asked to
+func (wo *walkOptions) shouldDescend(fullPath string, entry fs.DirEntry) bool {
+	if entry.IsDir() {
+		return true
+	}
+	if entry.Type()&fs.ModeSymlink == 0 || !wo.followSymlinks {
+		return false
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		slog.Warn("can't follow symlink", "path", fullPath, "err", err)
+		return false
+	}
+	return info.IsDir()
+}
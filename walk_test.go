@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// make a layout with an image at each of paths under dir
+func addLayouts(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		b := newLayoutBuilder(t, filepath.Join(dir, path))
+		b.addImage(filepath.Base(path), "rootfs")
+		b.save()
+	}
+}
+
+// walk dir with opts, returning the paths of the layouts found under it
+func walkLayouts(t *testing.T, dir string, opts *walkOptions) (*tview.TreeNode, treeInfo, []string) {
+	t.Helper()
+	resetGlobals(t)
+	opts.ancestors = map[string]bool{}
+	root := tview.NewTreeNode("root")
+	ti := addOCILayoutNodes(root, dir, opts, 0)
+	layouts := []string{}
+	for _, node := range getAllChildren(root) {
+		if nodeInfo, ok := node.GetReference().(treeInfo); ok && nodeInfo.numLayouts == 1 && isOCILayout(nodeInfo.path) {
+			rel, err := filepath.Rel(dir, nodeInfo.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layouts = append(layouts, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(layouts)
+	if ti.numLayouts != len(layouts) {
+		t.Errorf("the walk counted %d layouts, but has %d nodes for them: %v", ti.numLayouts, len(layouts), layouts)
+	}
+	return root, ti, layouts
+}
+
+func TestWalk(t *testing.T) {
+	tests := []struct {
+		name    string
+		layouts []string
+		files   map[string]string
+		opts    walkOptions
+		want    []string
+	}{
+		{
+			name:    "everything",
+			layouts: []string{"web", "a/b/c/deep"},
+			want:    []string{"a/b/c/deep", "web"},
+		},
+		{
+			name:    "max depth",
+			layouts: []string{"web", "a/shallow", "a/b/c/deep"},
+			opts:    walkOptions{maxDepth: 2},
+			want:    []string{"a/shallow", "web"},
+		},
+		{
+			name:    "excluded globs",
+			layouts: []string{"web", "cache-1/old", "a/cache-2", "a/db"},
+			opts:    walkOptions{excludes: []excludePattern{{pattern: "cache-*"}}},
+			want:    []string{"a/db", "web"},
+		},
+		{
+			name:    "ignore files",
+			layouts: []string{"web", "old/web", "a/tmp/web", "b/tmp/web", "b/db"},
+			files: map[string]string{
+				".ocivignore":   "# not these\nold/\n\na/tmp\n",
+				"b/.ocivignore": "db\n",
+			},
+			want: []string{"b/tmp/web", "web"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			addLayouts(t, dir, tt.layouts...)
+			for name, contents := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, _, got := walkLayouts(t, dir, &tt.opts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("found layouts %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	addLayouts(t, dir, "a/web")
+	addLayouts(t, other, "db")
+	for link, target := range map[string]string{
+		"a/loop": dir, // back to an ancestor
+		"db":     filepath.Join(other, "db"),
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, got := walkLayouts(t, dir, &walkOptions{}); !reflect.DeepEqual(got, []string{"a/web"}) {
+		t.Errorf("without following symlinks, found %v", got)
+	}
+	if _, _, got := walkLayouts(t, dir, &walkOptions{followSymlinks: true}); !reflect.DeepEqual(got, []string{"a/web", "db"}) {
+		t.Errorf("following symlinks, found %v", got)
+	}
+}
+
+func TestWalkUnreadableDirectory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any directory")
+	}
+	dir := t.TempDir()
+	addLayouts(t, dir, "web", "locked/db")
+	locked := filepath.Join(dir, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+
+	root, ti, got := walkLayouts(t, dir, &walkOptions{})
+	if !reflect.DeepEqual(got, []string{"web"}) {
+		t.Errorf("found layouts %v", got)
+	}
+	if len(ti.errs) != 1 || !strings.Contains(ti.errs[0].Error(), locked) {
+		t.Errorf("errors = %v", ti.errs)
+	}
+
+	// the rest of the walk carries on, with the directory shown in red
+	clearTreeFormatting(root, true)
+	var lockedNode *tview.TreeNode
+	for _, node := range getAllChildren(root) {
+		if node.GetText() == "locked (error: permission denied)" {
+			lockedNode = node
+		}
+	}
+	if lockedNode == nil {
+		t.Fatal("there's no node for the unreadable directory")
+	}
+	if lockedNode.GetColor() != tcell.ColorRed {
+		t.Errorf("the unreadable directory's node is %v, not red", lockedNode.GetColor())
+	}
+}